@@ -1,10 +1,12 @@
 package prekeyserver
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"io"
+	"log/slog"
 	"time"
 )
 
@@ -15,6 +17,12 @@ type Factory interface {
 	LoadStorageType(name string) (Storage, error)
 	StoreKeysInto(Keypair, io.Writer) error
 	NewServer(identity string, keys Keypair, fragLen int, st Storage, sessionTimeout, fragmentTimeout time.Duration, r Restrictor) Server
+	NewServerWithConfig(ServerConfig) (Server, error)
+
+	CreateClientProfile(keys Keypair, instanceTag uint32, expiration time.Time) ClientProfile
+	CreatePrekeyProfile(keys Keypair, instanceTag uint32, expiration time.Time) (PrekeyProfile, Keypair)
+	CreatePrekeyMessage(instanceTag uint32) (PrekeyMessage, Keypair)
+	NewInitiator(from, serverIdentity string, keys Keypair, cp ClientProfile) Initiator
 }
 
 // Keypair represents the minimum key functionality a server implementation will need
@@ -23,14 +31,70 @@ type Keypair interface {
 	realKeys() *keypair
 }
 
-// Storage has the responsibility of creating new storage implementations
+// Storage has the responsibility of creating new storage implementations.
+// Use StorageFromBackend to plug in your own storage engine.
 type Storage interface {
-	createStorage() storage
+	createStorage() (storage, error)
 }
 
 // Server is the core handling functionality of a prekey server
 type Server interface {
 	Handle(from, message string) ([]string, error)
+	HandleContext(ctx context.Context, from, message string) ([]string, error)
+	Metrics() *Metrics
+	Use(mw ...Middleware)
+	Start() error
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// Initiator contains the client side of one DAKE with a prekey server.
+// It creates the messages to send and checks the answers from the server, but
+// the encoding and the actual transport is left to the caller.
+// An Initiator can only be used for one DAKE. If the server answers with an
+// authentic failure message, ReceiveSuccess and ReceiveStorageStatus return ErrRejected.
+type Initiator interface {
+	DAKE1() []byte
+	ReceiveDAKE2(msg []byte) error
+	ServerFingerprint() []byte
+	PublicationDAKE3(cp ClientProfile, pp PrekeyProfile, pms []PrekeyMessage) ([]byte, error)
+	StorageInformationDAKE3() ([]byte, error)
+	ReceiveSuccess(msg []byte) error
+	ReceiveStorageStatus(msg []byte) (uint32, error)
+}
+
+// ClientProfile is a read-only view of a client profile
+type ClientProfile interface {
+	InstanceTag() uint32
+	Expiration() time.Time
+	Versions() []byte
+	Serialize() []byte
+	realClientProfile() *clientProfile
+}
+
+// PrekeyProfile is a read-only view of a prekey profile
+type PrekeyProfile interface {
+	InstanceTag() uint32
+	Expiration() time.Time
+	Serialize() []byte
+	realPrekeyProfile() *prekeyProfile
+}
+
+// PrekeyMessage is a read-only view of a prekey message
+type PrekeyMessage interface {
+	Identifier() uint32
+	InstanceTag() uint32
+	Serialize() []byte
+	realPrekeyMessage() *prekeyMessage
+}
+
+// PrekeyEnsemble is a read-only view of a prekey ensemble, as handed out
+// by the server when someone asks for the prekeys of an identity
+type PrekeyEnsemble interface {
+	ClientProfile() ClientProfile
+	PrekeyProfile() PrekeyProfile
+	PrekeyMessage() PrekeyMessage
+	Serialize() []byte
 }
 
 // CreateFactory will return a new factory that can be used to access
@@ -38,11 +102,19 @@ type Server interface {
 // be a reader to allow for fixed randomness. If nil is given, rand.Reader will
 // be used instead.
 func CreateFactory(rand io.Reader) Factory {
-	return &realFactory{rand}
+	return &realFactory{r: rand}
+}
+
+// CreateFactoryWithLogger works like CreateFactory, but the servers created by
+// the factory will log every message they handle to the given logger. Use
+// CreateLogger to get a logger writing in text or JSON format.
+func CreateFactoryWithLogger(rand io.Reader, log *slog.Logger) Factory {
+	return &realFactory{r: rand, log: log}
 }
 
 type realFactory struct {
-	r io.Reader
+	r   io.Reader
+	log *slog.Logger
 }
 
 func (f *realFactory) randReader() io.Reader {
@@ -53,13 +125,7 @@ func (f *realFactory) randReader() io.Reader {
 }
 
 func (*realFactory) LoadStorageType(name string) (Storage, error) {
-	if isInMemoryStorageDescriptor(name) {
-		return &inMemoryStorageFactory{}, nil
-	} else if isFileStorageDescriptor(name) {
-		return createFileStorageFactoryFrom(name)
-	}
-
-	return nil, errors.New("unknown storage type")
+	return loadStorageType(name)
 }
 
 type keypairInStorage struct {
@@ -120,23 +186,114 @@ func (f *realFactory) CreateKeypair() Keypair {
 	return generateKeypair(f)
 }
 
-func (*realFactory) NewServer(identity string, keys Keypair, fragLen int, st Storage, sessionTimeout, fragmentTimeout time.Duration, r Restrictor) Server {
-	kp := keys.realKeys()
+func (f *realFactory) CreateClientProfile(keys Keypair, instanceTag uint32, expiration time.Time) ClientProfile {
+	return generateClientProfile(instanceTag, expiration, keys.realKeys())
+}
+
+func (f *realFactory) CreatePrekeyProfile(keys Keypair, instanceTag uint32, expiration time.Time) (PrekeyProfile, Keypair) {
+	return generatePrekeyProfile(f, instanceTag, expiration, keys.realKeys())
+}
+
+func (f *realFactory) CreatePrekeyMessage(instanceTag uint32) (PrekeyMessage, Keypair) {
+	return generatePrekeyMessage(f, instanceTag)
+}
+
+func (f *realFactory) NewInitiator(from, serverIdentity string, keys Keypair, cp ClientProfile) Initiator {
+	return newInitiator(f, from, serverIdentity, keys.realKeys(), cp.realClientProfile())
+}
+
+// NewServer creates a server without checking the settings given. Use
+// NewServerWithConfig to get the settings validated, and to reach all of them.
+func (f *realFactory) NewServer(identity string, keys Keypair, fragLen int, st Storage, sessionTimeout, fragmentTimeout time.Duration, r Restrictor) Server {
+	conf := ServerConfig{
+		Identity:        identity,
+		Keys:            keys,
+		Storage:         st,
+		FragmentLength:  fragLen,
+		SessionTimeout:  sessionTimeout,
+		FragmentTimeout: fragmentTimeout,
+		Restrictor:      r,
+	}
+	stor, e := st.createStorage()
+	if e != nil {
+		// There's no way to report it from here, so every message gets it instead
+		stor = failedStorage{e}
+	}
+	return f.newServer(conf, stor)
+}
+
+// NewServerWithConfig creates a server with the given settings, or returns an
+// error of kind ErrInvalidConfig if they can't be used, and of kind ErrStorage
+// if the storage can't be opened
+func (f *realFactory) NewServerWithConfig(conf ServerConfig) (Server, error) {
+	if e := conf.validate(); e != nil {
+		return nil, e
+	}
+	st, e := conf.Storage.createStorage()
+	if e != nil {
+		return nil, wrapError(ErrStorage, "couldn't open the storage", e)
+	}
+	return f.newServer(conf, st), nil
+}
+
+func (f *realFactory) newServer(conf ServerConfig, st storage) *GenericServer {
+	kp := conf.Keys.realKeys()
+	r := conf.Restrictor
 	if r == nil {
 		r = nullRestrictor
 	}
+	log := conf.Logger
+	if log == nil {
+		log = f.log
+	}
+	random := conf.Rand
+	if random == nil {
+		random = f.r
+	}
+	clock := conf.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	if cs, ok := st.(clockStorage); ok {
+		cs.useClock(clock)
+	}
 	gs := &GenericServer{
-		identity:             identity,
+		identity:             conf.Identity,
 		fingerprint:          kp.fingerprint(),
 		key:                  kp,
-		fragLen:              fragLen,
+		fragLen:              conf.FragmentLength,
 		fragmentations:       newFragmentations(),
 		sessions:             newSessionManager(),
-		storageImpl:          st.createStorage(),
-		sessionTimeout:       sessionTimeout,
-		fragmentationTimeout: fragmentTimeout,
+		storageImpl:          st,
+		sessionTimeout:       conf.SessionTimeout,
+		fragmentationTimeout: conf.FragmentTimeout,
 		rest:                 r,
+		rand:                 random,
+		clock:                clock,
+		logger:               log,
+		metrics:              NewMetrics(),
+		limits:               conf.Limits,
+		middleware:           append([]Middleware(nil), conf.Middleware...),
+	}
+	gs.sessions.clock = clock
+	gs.sessions.limits = sessionLimits{
+		max:          conf.Limits.MaxSessions,
+		maxPerPrefix: conf.Limits.MaxSessionsPerPrefix,
+		prefix:       conf.Limits.SenderPrefix,
+	}
+	gs.sessions.evicted = gs.metrics.sessionEvicted
+	gs.fragmentations.clock = clock
+	gs.fragmentations.limits = fragmentLimits{
+		maxFragments: conf.Limits.MaxFragmentsPerMessage,
+		maxPerSender: conf.Limits.MaxIncompleteMessagesPerSender,
+		maxBuffered:  conf.Limits.MaxBufferedFragmentBytes,
+		maxLength:    conf.Limits.MaxReassembledLength,
 	}
+	gs.fragmentations.evicted = gs.metrics.fragmentEvicted
 	gs.messageHandler = &otrngMessageHandler{s: gs}
+	gs.hooks = newHookDispatcher(conf.Hooks, func(e error) {
+		gs.log().Warn("couldn't run hook", "error", e.Error())
+	})
+	gs.maintenance = gs.maintenanceFor(conf.Maintenance)
 	return gs
 }
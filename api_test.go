@@ -30,7 +30,7 @@ func (s *GenericServerSuite) Test_CreateFactory_returnsARealFactoryWithTheGivenR
 }
 
 func (s *GenericServerSuite) Test_inMemoryStorageFactory_createStorage_returnsAnInMemoryStorageFactory(c *C) {
-	res := (&inMemoryStorageFactory{}).createStorage()
+	res, _ := (&inMemoryStorageFactory{}).createStorage()
 	c.Assert(res, Not(IsNil))
 	c.Assert(res, FitsTypeOf, &inMemoryStorage{})
 }
@@ -55,10 +55,19 @@ func (s *GenericServerSuite) Test_realFactory_LoadStorageType_returnsErrorForNon
 	c.Assert(e, ErrorMatches, "directory doesn't exist")
 }
 
+func (s *GenericServerSuite) Test_realFactory_LoadStorageType_rejectsUnknownOptionsForFileStorage(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	res, e := (&realFactory{}).LoadStorageType("dir:" + testDir + "?sync=false")
+	c.Assert(res, IsNil)
+	c.Assert(e, ErrorMatches, "unknown storage option: sync")
+}
+
 func (s *GenericServerSuite) Test_realFactory_LoadStorageType_givesErrorForUnknownStorageType(c *C) {
 	res, e := (&realFactory{}).LoadStorageType("unknown-storage-please-don't-create")
 	c.Assert(res, IsNil)
-	c.Assert(e, ErrorMatches, "unknown storage type")
+	c.Assert(e, ErrorMatches, `unknown storage type "unknown-storage-please-don't-create" - available types are: dir, in-memory, kv, sql`)
 }
 
 func (s *GenericServerSuite) Test_realFactory_CreateKeypair_createsAKeypairFromTheGivenRandomness(c *C) {
@@ -0,0 +1,144 @@
+// Package client implements the initiating side of the OTRng prekey server
+// protocol. It can publish prekey material, ask for the storage status and
+// retrieve prekey ensembles, over any transport that can deliver a message to
+// a prekey server and give back the answers.
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// Client talks to one prekey server on behalf of one identity and
+// client profile. It is safe to use the same client for several
+// requests, since each request runs its own DAKE.
+type Client struct {
+	f              pks.Factory
+	from           string
+	serverIdentity string
+	keys           pks.Keypair
+	profile        pks.ClientProfile
+	t              Transport
+	fingerprint    []byte
+}
+
+// New creates a new client. The from argument is the identity the server will
+// see for this client, and the keys have to be the long term keys the client
+// profile was created with.
+func New(f pks.Factory, from, serverIdentity string, keys pks.Keypair, profile pks.ClientProfile, t Transport) *Client {
+	return &Client{
+		f:              f,
+		from:           from,
+		serverIdentity: serverIdentity,
+		keys:           keys,
+		profile:        profile,
+		t:              t,
+	}
+}
+
+// ExpectFingerprint makes the client refuse to talk to a server that
+// doesn't have a long term key with the given fingerprint
+func (c *Client) ExpectFingerprint(fp []byte) {
+	c.fingerprint = fp
+}
+
+func (c *Client) roundTrip(msg []byte) ([]byte, error) {
+	res, e := c.t.Send(base64.StdEncoding.EncodeToString(msg) + ".")
+	if e != nil {
+		return nil, e
+	}
+
+	full, e := reassemble(res)
+	if e != nil {
+		return nil, e
+	}
+
+	if len(full) == 0 || full[len(full)-1] != '.' {
+		return nil, errors.New("invalid message format - missing ending punctuation")
+	}
+
+	decoded, e := base64.StdEncoding.DecodeString(full[:len(full)-1])
+	if e != nil {
+		return nil, errors.New("invalid message format - corrupted base64 encoding")
+	}
+	return decoded, nil
+}
+
+// dake runs DAKE1 and DAKE2 against the server, and returns an initiator
+// ready to generate the DAKE3 message
+func (c *Client) dake() (pks.Initiator, error) {
+	in := c.f.NewInitiator(c.from, c.serverIdentity, c.keys, c.profile)
+
+	d2, e := c.roundTrip(in.DAKE1())
+	if e != nil {
+		return nil, e
+	}
+
+	if e := in.ReceiveDAKE2(d2); e != nil {
+		return nil, e
+	}
+
+	if c.fingerprint != nil && !bytes.Equal(c.fingerprint, in.ServerFingerprint()) {
+		return nil, errors.New("unexpected server fingerprint")
+	}
+
+	return in, nil
+}
+
+// Publish will publish the client profile of this client, together with the given
+// prekey profile and prekey messages. The prekey profile can be nil, if it has
+// been published before.
+func (c *Client) Publish(pp pks.PrekeyProfile, pms []pks.PrekeyMessage) error {
+	in, e := c.dake()
+	if e != nil {
+		return e
+	}
+
+	d3, e := in.PublicationDAKE3(c.profile, pp, pms)
+	if e != nil {
+		return e
+	}
+
+	res, e := c.roundTrip(d3)
+	if e != nil {
+		return e
+	}
+
+	return in.ReceiveSuccess(res)
+}
+
+// StorageStatus returns the number of prekey messages the server has stored
+// for the instance tag of this client
+func (c *Client) StorageStatus() (uint32, error) {
+	in, e := c.dake()
+	if e != nil {
+		return 0, e
+	}
+
+	d3, e := in.StorageInformationDAKE3()
+	if e != nil {
+		return 0, e
+	}
+
+	res, e := c.roundTrip(d3)
+	if e != nil {
+		return 0, e
+	}
+
+	return in.ReceiveStorageStatus(res)
+}
+
+// Retrieve asks the server for prekey ensembles for the given identity.
+// If the server doesn't have any, an empty result will be returned.
+func (c *Client) Retrieve(identity string, versions []byte) ([]pks.PrekeyEnsemble, error) {
+	tag := c.profile.InstanceTag()
+	res, e := c.roundTrip(pks.CreateEnsembleRetrievalQuery(tag, identity, versions))
+	if e != nil {
+		return nil, e
+	}
+
+	return pks.ParseEnsembleRetrievalResponse(tag, res)
+}
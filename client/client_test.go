@@ -0,0 +1,172 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+const serverIdentity = "prekeys.example.org"
+
+type testSetup struct {
+	f      pks.Factory
+	server pks.Server
+	keys   pks.Keypair
+}
+
+func setupServer(fragLen int) *testSetup {
+	f := pks.CreateFactory(nil)
+	keys := f.CreateKeypair()
+	st, _ := f.LoadStorageType("in-memory")
+	return &testSetup{
+		f:      f,
+		server: f.NewServer(serverIdentity, keys, fragLen, st, time.Minute, time.Minute, nil),
+		keys:   keys,
+	}
+}
+
+func (ts *testSetup) newClient(from string, tag uint32) (*Client, pks.Keypair) {
+	keys := ts.f.CreateKeypair()
+	cp := ts.f.CreateClientProfile(keys, tag, time.Now().Add(24*time.Hour))
+	return New(ts.f, from, serverIdentity, keys, cp, ServerTransport(ts.server, from)), keys
+}
+
+func (ts *testSetup) prekeys(keys pks.Keypair, tag uint32, n int) (pks.PrekeyProfile, []pks.PrekeyMessage) {
+	pp, _ := ts.f.CreatePrekeyProfile(keys, tag, time.Now().Add(24*time.Hour))
+	pms := []pks.PrekeyMessage{}
+	for i := 0; i < n; i++ {
+		pm, _ := ts.f.CreatePrekeyMessage(tag)
+		pms = append(pms, pm)
+	}
+	return pp, pms
+}
+
+func (s *ClientSuite) Test_Client_PublishAndStorageStatus(c *C) {
+	ts := setupServer(0)
+	sita, keys := ts.newClient("sita@example.org", 0x1245ABCD)
+
+	n, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, uint32(0))
+
+	pp, pms := ts.prekeys(keys, 0x1245ABCD, 3)
+	c.Assert(sita.Publish(pp, pms), IsNil)
+
+	n, e = sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, uint32(3))
+}
+
+func (s *ClientSuite) Test_Client_PublishWithoutPrekeyProfile(c *C) {
+	ts := setupServer(0)
+	sita, keys := ts.newClient("sita@example.org", 0x1245ABCD)
+
+	_, pms := ts.prekeys(keys, 0x1245ABCD, 2)
+	c.Assert(sita.Publish(nil, pms), IsNil)
+
+	n, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, uint32(2))
+}
+
+func (s *ClientSuite) Test_Client_PublishIsRejectedForPrekeysOfAnotherInstance(c *C) {
+	ts := setupServer(0)
+	sita, keys := ts.newClient("sita@example.org", 0x1245ABCD)
+
+	pp, pms := ts.prekeys(keys, 0x99887766, 2)
+	c.Assert(sita.Publish(pp, pms), Equals, pks.ErrRejected)
+}
+
+func (s *ClientSuite) Test_Client_Retrieve(c *C) {
+	ts := setupServer(0)
+	sita, keys := ts.newClient("sita@example.org", 0x1245ABCD)
+	rama, _ := ts.newClient("rama@example.org", 0x5555DDDD)
+
+	res, e := rama.Retrieve("sita@example.org", []byte{'4'})
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 0)
+
+	pp, pms := ts.prekeys(keys, 0x1245ABCD, 2)
+	c.Assert(sita.Publish(pp, pms), IsNil)
+
+	res, e = rama.Retrieve("sita@example.org", []byte{'4'})
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].ClientProfile().InstanceTag(), Equals, uint32(0x1245ABCD))
+	c.Assert(res[0].PrekeyProfile().Serialize(), DeepEquals, pp.Serialize())
+	c.Assert(res[0].PrekeyMessage().Serialize(), DeepEquals, pms[0].Serialize())
+
+	n, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, uint32(1))
+}
+
+func (s *ClientSuite) Test_Client_RetrieveOnlyGetsEnsemblesForTheAskedVersions(c *C) {
+	ts := setupServer(0)
+	sita, keys := ts.newClient("sita@example.org", 0x1245ABCD)
+	rama, _ := ts.newClient("rama@example.org", 0x5555DDDD)
+
+	pp, pms := ts.prekeys(keys, 0x1245ABCD, 1)
+	c.Assert(sita.Publish(pp, pms), IsNil)
+
+	res, e := rama.Retrieve("sita@example.org", []byte{'5'})
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 0)
+
+	n, _ := sita.StorageStatus()
+	c.Assert(n, Equals, uint32(1))
+}
+
+func (s *ClientSuite) Test_Client_worksWithFragmentedAnswers(c *C) {
+	ts := setupServer(100)
+	sita, keys := ts.newClient("sita@example.org", 0x1245ABCD)
+	rama, _ := ts.newClient("rama@example.org", 0x5555DDDD)
+
+	pp, pms := ts.prekeys(keys, 0x1245ABCD, 1)
+	c.Assert(sita.Publish(pp, pms), IsNil)
+
+	res, e := rama.Retrieve("sita@example.org", []byte{'4'})
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 1)
+}
+
+func (s *ClientSuite) Test_Client_refusesUnexpectedServerIdentity(c *C) {
+	ts := setupServer(0)
+	keys := ts.f.CreateKeypair()
+	cp := ts.f.CreateClientProfile(keys, 0x1245ABCD, time.Now().Add(24*time.Hour))
+	cl := New(ts.f, "sita@example.org", "other.example.org", keys, cp, ServerTransport(ts.server, "sita@example.org"))
+
+	_, e := cl.StorageStatus()
+	c.Assert(e, ErrorMatches, "incorrect server identity")
+}
+
+func (s *ClientSuite) Test_Client_checksTheServerFingerprint(c *C) {
+	ts := setupServer(0)
+	sita, _ := ts.newClient("sita@example.org", 0x1245ABCD)
+
+	sita.ExpectFingerprint(ts.keys.Fingerprint())
+	_, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+
+	sita.ExpectFingerprint(ts.f.CreateKeypair().Fingerprint())
+	_, e = sita.StorageStatus()
+	c.Assert(e, ErrorMatches, "unexpected server fingerprint")
+}
+
+func (s *ClientSuite) Test_Client_detectsAMismatchingSender(c *C) {
+	ts := setupServer(0)
+	keys := ts.f.CreateKeypair()
+	cp := ts.f.CreateClientProfile(keys, 0x1245ABCD, time.Now().Add(24*time.Hour))
+	cl := New(ts.f, "sita@example.org", serverIdentity, keys, cp, ServerTransport(ts.server, "rama@example.org"))
+
+	_, e := cl.StorageStatus()
+	c.Assert(e, ErrorMatches, "incorrect ring signature")
+}
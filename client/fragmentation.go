@@ -0,0 +1,73 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const fragmentationPrefix = "?OTRP|"
+
+func isFragment(msg string) bool {
+	return strings.HasPrefix(msg, fragmentationPrefix) && strings.HasSuffix(msg, ",")
+}
+
+// reassemble puts together the answer from a server. All fragments
+// of one answer are expected to arrive in the same response.
+func reassemble(msgs []string) (string, error) {
+	if len(msgs) == 0 {
+		return "", errors.New("no answer received from server")
+	}
+
+	if !isFragment(msgs[0]) {
+		if len(msgs) != 1 {
+			return "", errors.New("unexpected number of messages received from server")
+		}
+		return msgs[0], nil
+	}
+
+	var pieces []string
+	var id string
+	count := 0
+
+	for _, m := range msgs {
+		if !isFragment(m) {
+			return "", errors.New("invalid fragmentation parse")
+		}
+		frag := m[len(fragmentationPrefix) : len(m)-1]
+		fragOne := strings.SplitN(frag, "|", 3)
+		if len(fragOne) < 3 {
+			return "", errors.New("invalid fragmentation parse")
+		}
+		fragTwo := strings.SplitN(fragOne[2], ",", 4)
+		if len(fragTwo) < 4 {
+			return "", errors.New("invalid fragmentation parse")
+		}
+
+		ix, e1 := strconv.ParseUint(fragTwo[1], 10, 16)
+		tot, e2 := strconv.ParseUint(fragTwo[2], 10, 16)
+		if e1 != nil || e2 != nil || ix == 0 || tot == 0 || ix > tot {
+			return "", errors.New("invalid fragmentation parse")
+		}
+
+		if pieces == nil {
+			pieces = make([]string, tot)
+			id = fragOne[0]
+		}
+
+		if fragOne[0] != id || int(tot) != len(pieces) {
+			return "", errors.New("inconsistent fragments")
+		}
+
+		if pieces[ix-1] == "" {
+			count++
+		}
+		pieces[ix-1] = fragTwo[3]
+	}
+
+	if count != len(pieces) {
+		return "", errors.New("missing fragments")
+	}
+
+	return strings.Join(pieces, ""), nil
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *ClientSuite) Test_reassemble_returnsASingleMessage(c *C) {
+	res, e := reassemble([]string{"AAQ."})
+	c.Assert(e, IsNil)
+	c.Assert(res, Equals, "AAQ.")
+}
+
+func (s *ClientSuite) Test_reassemble_failsWithoutMessages(c *C) {
+	_, e := reassemble(nil)
+	c.Assert(e, ErrorMatches, "no answer received from server")
+}
+
+func (s *ClientSuite) Test_reassemble_failsOnSeveralUnfragmentedMessages(c *C) {
+	_, e := reassemble([]string{"AAQ.", "AAQ."})
+	c.Assert(e, ErrorMatches, "unexpected number of messages received from server")
+}
+
+func (s *ClientSuite) Test_reassemble_putsFragmentsTogetherInOrder(c *C) {
+	res, e := reassemble([]string{
+		"?OTRP|123|BEEF|CADE,2,3,def,",
+		"?OTRP|123|BEEF|CADE,1,3,abc,",
+		"?OTRP|123|BEEF|CADE,3,3,gh.,",
+	})
+	c.Assert(e, IsNil)
+	c.Assert(res, Equals, "abcdefgh.")
+}
+
+func (s *ClientSuite) Test_reassemble_failsOnMissingFragments(c *C) {
+	_, e := reassemble([]string{
+		"?OTRP|123|BEEF|CADE,1,3,abc,",
+		"?OTRP|123|BEEF|CADE,3,3,gh.,",
+	})
+	c.Assert(e, ErrorMatches, "missing fragments")
+}
+
+func (s *ClientSuite) Test_reassemble_failsOnFragmentsFromDifferentMessages(c *C) {
+	_, e := reassemble([]string{
+		"?OTRP|123|BEEF|CADE,1,2,abc,",
+		"?OTRP|124|BEEF|CADE,2,2,gh.,",
+	})
+	c.Assert(e, ErrorMatches, "inconsistent fragments")
+}
+
+func (s *ClientSuite) Test_reassemble_failsOnBadFragments(c *C) {
+	_, e := reassemble([]string{
+		"?OTRP|123|BEEF|CADE,1,2,abc,",
+		"?OTRP|123|BEEF|CADE,3,2,gh.,",
+	})
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// Transport sends one message to a prekey server and returns the messages
+// the server answered with. The transport is responsible for letting
+// the server know who the message is from.
+type Transport interface {
+	Send(message string) ([]string, error)
+}
+
+// TransportFunc allows a simple function to be used as a transport
+type TransportFunc func(message string) ([]string, error)
+
+// Send implements Transport
+func (f TransportFunc) Send(message string) ([]string, error) {
+	return f(message)
+}
+
+// ServerTransport returns a transport that hands messages directly to
+// a prekey server in the same process. This is mostly useful for tests.
+// Like a server on the other side of a network, it only returns the error of
+// the server when there are no messages to answer with.
+func ServerTransport(s pks.Server, from string) Transport {
+	return TransportFunc(func(message string) ([]string, error) {
+		res, e := s.Handle(from, message)
+		if len(res) > 0 {
+			return res, nil
+		}
+		return res, e
+	})
+}
+
+type rawTransport struct {
+	address string
+	from    string
+	timeout time.Duration
+}
+
+// RawTransport returns a transport that talks to a prekey server
+// using the protocol of the raw TCP server
+func RawTransport(address, from string, timeout time.Duration) Transport {
+	return &rawTransport{
+		address: address,
+		from:    from,
+		timeout: timeout,
+	}
+}
+
+const maxRawLength = 0xFFFF
+const rawReadLimit = 268435456
+
+func appendShort(l []byte, r uint16) []byte {
+	return append(l, byte(r>>8), byte(r))
+}
+
+func (t *rawTransport) Send(message string) ([]string, error) {
+	if len(t.from) > maxRawLength || len(message) > maxRawLength {
+		return nil, errors.New("message too long for the raw protocol")
+	}
+
+	con, e := net.DialTimeout("tcp", t.address, t.timeout)
+	if e != nil {
+		return nil, e
+	}
+	defer con.Close()
+
+	if t.timeout != 0 {
+		con.SetDeadline(time.Now().Add(t.timeout))
+	}
+
+	toSend := appendShort(nil, uint16(len(t.from)))
+	toSend = append(toSend, []byte(t.from)...)
+	toSend = appendShort(toSend, uint16(len(message)))
+	toSend = append(toSend, []byte(message)...)
+
+	if _, e := con.Write(toSend); e != nil {
+		return nil, e
+	}
+
+	if tc, ok := con.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+
+	res, e := ioutil.ReadAll(io.LimitReader(con, rawReadLimit))
+	if e != nil {
+		return nil, e
+	}
+
+	return parseRawResponse(res)
+}
+
+func parseRawResponse(data []byte) ([]string, error) {
+	result := []string{}
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("can't parse length of data element")
+		}
+		l := int(data[0])<<8 | int(data[1])
+		data = data[2:]
+		if len(data) < l {
+			return nil, errors.New("can't parse data element")
+		}
+		result = append(result, string(data[:l]))
+		data = data[l:]
+	}
+	return result, nil
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *ClientSuite) Test_RawTransport_sendsTheMessageAndParsesTheAnswer(c *C) {
+	l, e := net.Listen("tcp", "localhost:0")
+	c.Assert(e, IsNil)
+	defer l.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		con, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer con.Close()
+		data, _ := ioutil.ReadAll(con)
+		received <- data
+		con.Write([]byte{0x00, 0x02, 'h', 'i', 0x00, 0x03, 'y', 'o', '.'})
+	}()
+
+	res, e := RawTransport(l.Addr().String(), "sita", time.Minute).Send("abc.")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []string{"hi", "yo."})
+	c.Assert(<-received, DeepEquals, []byte{0x00, 0x04, 's', 'i', 't', 'a', 0x00, 0x04, 'a', 'b', 'c', '.'})
+}
+
+func (s *ClientSuite) Test_parseRawResponse_failsOnTruncatedData(c *C) {
+	_, e := parseRawResponse([]byte{0x00})
+	c.Assert(e, ErrorMatches, "can't parse length of data element")
+
+	_, e = parseRawResponse([]byte{0x00, 0x05, 'a'})
+	c.Assert(e, ErrorMatches, "can't parse data element")
+}
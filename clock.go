@@ -0,0 +1,75 @@
+package prekeyserver
+
+import "time"
+
+// Clock tells a server what time it is. Every expiry check and timeout of the
+// server goes through its clock, so a fixed clock can be used to test them
+// without waiting.
+type Clock interface {
+	Now() time.Time
+}
+
+// TimerClock is a Clock that also decides when a wait is over. The background
+// maintenance waits on it between runs, so with a clock that implements it the
+// intervals can be tested without sleeping. With any other clock, the
+// maintenance waits for the system time.
+type TimerClock interface {
+	Clock
+	// NewTimer returns a channel that gets the time once d has passed on the
+	// clock, and a function that stops the timer
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// SystemClock returns the time of the system
+type SystemClock struct{}
+
+// Now returns time.Now()
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer uses time.NewTimer
+func (SystemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// nowFrom returns the time of the clock, or the system time if there is none
+func nowFrom(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// newTimerFrom starts a timer on the clock if it can have one, and on the
+// system time otherwise
+func newTimerFrom(c Clock, d time.Duration) (<-chan time.Time, func() bool) {
+	if tc, ok := c.(TimerClock); ok {
+		return tc.NewTimer(d)
+	}
+	return SystemClock{}.NewTimer(d)
+}
+
+// clockStorage is implemented by storages that check for expired profiles on
+// their own. The server gives them its clock when it's created.
+type clockStorage interface {
+	useClock(Clock)
+}
+
+// storageClock can be embedded in a storage to implement clockStorage
+type storageClock struct {
+	clock Clock
+}
+
+func (s *storageClock) useClock(c Clock) {
+	s.clock = c
+}
+
+func (s *storageClock) now() time.Time {
+	return nowFrom(s.clock)
+}
+
+func (g *GenericServer) now() time.Time {
+	return nowFrom(g.clock)
+}
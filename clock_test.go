@@ -0,0 +1,96 @@
+package prekeyserver
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type fixedClock struct {
+	t time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fixedClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func deterministicServer(c *C, clock Clock) *GenericServer {
+	f := &realFactory{r: fixtureRand()}
+	res, e := f.NewServerWithConfig(ServerConfig{
+		Identity:        "masterOfKeys.example.org",
+		Keys:            deriveKeypair([symKeyLength]byte{0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25}),
+		Storage:         &inMemoryStorageFactory{},
+		FragmentLength:  100,
+		SessionTimeout:  time.Minute,
+		FragmentTimeout: time.Minute,
+		Clock:           clock,
+		Maintenance:     Maintenance{SessionInterval: -1, FragmentInterval: -1, StorageInterval: -1},
+	})
+	c.Assert(e, IsNil)
+	return res.(*GenericServer)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_withFixedRandomnessAndClockAnswersTheSameEveryTime(c *C) {
+	run := func() []string {
+		gs := deterministicServer(c, &fixedClock{time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)})
+		in := newInitiator(&realFactory{r: fixtureRand()}, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+		res, e := gs.Handle("sita@example.org", encodeMessage(in.DAKE1())+".")
+		c.Assert(e, IsNil)
+		return res
+	}
+
+	first := run()
+
+	c.Assert(len(first) > 1, Equals, true)
+	c.Assert(run(), DeepEquals, first)
+}
+
+func (s *GenericServerSuite) Test_realFactory_NewServerWithConfig_usesTheRandomnessOfTheFactory(c *C) {
+	f := &realFactory{r: fixtureRand()}
+	conf := validServerConfig(f)
+
+	res, _ := f.NewServerWithConfig(conf)
+
+	c.Assert(res.(*GenericServer).rand, Equals, f.r)
+	c.Assert(res.(*GenericServer).clock, Equals, SystemClock{})
+}
+
+func (s *GenericServerSuite) Test_GenericServer_usesItsClockForExpiredProfiles(c *C) {
+	clock := &fixedClock{time.Date(2028, 11, 5, 4, 0, 0, 0, time.UTC)}
+	gs := deterministicServer(c, clock)
+	storeSitaPrekeys(gs, 2)
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+
+	res, e := gs.Handle("someone@example.org", q)
+	c.Assert(e, IsNil)
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+
+	clock.advance(time.Hour)
+	noEnsembles, e := gs.Handle("someone@example.org", q)
+	c.Assert(e, IsNil)
+	c.Assert(noEnsembles, Not(DeepEquals), res)
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+}
+
+func (s *GenericServerSuite) Test_GenericServer_usesItsClockForSessionsAndFragments(c *C) {
+	clock := &fixedClock{time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)}
+	gs := deterministicServer(c, clock)
+	gs.testSession("sita@example.org").(*realSession).touch()
+	gs.fragmentations.newFragmentReceived("rama@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,AAQ1,")
+
+	clock.advance(59 * time.Second)
+	gs.cleanupSessions()
+	gs.cleanupFragments()
+	c.Assert(gs.sessions.has("sita@example.org"), Equals, true)
+	c.Assert(gs.fragmentations.count(), Equals, 1)
+
+	clock.advance(2 * time.Second)
+	gs.cleanupSessions()
+	gs.cleanupFragments()
+	c.Assert(gs.sessions.has("sita@example.org"), Equals, false)
+	c.Assert(gs.fragmentations.count(), Equals, 0)
+}
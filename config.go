@@ -0,0 +1,118 @@
+package prekeyserver
+
+import (
+	"io"
+	"log/slog"
+	"time"
+)
+
+// minFragmentLength is the smallest fragment length that leaves room for any
+// data next to the fragment envelope
+const minFragmentLength = totalEnvelopeLen + 1
+
+// ServerConfig has all settings for a server created by NewServerWithConfig.
+// Only Identity, Keys, Storage and the timeouts are required - every other
+// field can be left at its zero value to get the default.
+type ServerConfig struct {
+	// Identity is the identity of the server, for example prekey.example.org
+	Identity string
+	// Keys is the long term keypair of the server
+	Keys Keypair
+	// Storage is where the server keeps the published prekey data
+	Storage Storage
+
+	// FragmentLength is the longest message the server will send without
+	// fragmenting it. It has to be zero, to never fragment, or at least 48.
+	FragmentLength int
+	// SessionTimeout is how long an unfinished DAKE is kept around
+	SessionTimeout time.Duration
+	// FragmentTimeout is how long the fragments of an incomplete message are kept around
+	FragmentTimeout time.Duration
+
+	// Restrictor decides which senders can't start a DAKE. By default, every sender can.
+	Restrictor Restrictor
+	// Hooks are told about publications and retrievals
+	Hooks Hooks
+	// Middleware wraps the handling of every message, as if given to Use
+	Middleware []Middleware
+	// Logger gets a record for every message handled. If nil, the logger of
+	// the factory is used.
+	Logger *slog.Logger
+	// Rand is the source of randomness of the server. If nil, the randomness
+	// of the factory is used.
+	Rand io.Reader
+	// Clock tells the server what time it is. If nil, the system time is used.
+	Clock Clock
+
+	// Limits restricts how much a client can ask of the server
+	Limits Limits
+	// Maintenance decides how often the server cleans up in the background
+	Maintenance Maintenance
+}
+
+// Limits restricts how much a client can ask of the server. A limit of zero
+// means there is no limit.
+type Limits struct {
+	// MaxPrekeyMessagesPerPublication is the largest number of prekey messages
+	// accepted in one publication
+	MaxPrekeyMessagesPerPublication int
+	// MaxSessions is the largest number of unfinished DAKEs kept at the same
+	// time. When it's reached, the least recently used session that hasn't been
+	// authenticated is evicted to make room for a new one.
+	MaxSessions int
+	// MaxSessionsPerPrefix works like MaxSessions, but for the senders that
+	// share a prefix, as decided by SenderPrefix
+	MaxSessionsPerPrefix int
+	// SenderPrefix decides which prefix a sender belongs to. If nil,
+	// DomainPrefix is used.
+	SenderPrefix func(from string) string
+
+	// MaxFragmentsPerMessage is the largest number of fragments a message can
+	// be split into
+	MaxFragmentsPerMessage int
+	// MaxIncompleteMessagesPerSender is the largest number of fragmented
+	// messages one sender can have waiting for more fragments. When it's
+	// reached, the one touched least recently is thrown away.
+	MaxIncompleteMessagesPerSender int
+	// MaxBufferedFragmentBytes is the largest number of bytes kept in the
+	// fragments of all incomplete messages. When it's reached, the incomplete
+	// messages touched least recently are thrown away.
+	MaxBufferedFragmentBytes int
+	// MaxReassembledLength is the longest message that can be put together
+	// from fragments
+	MaxReassembledLength int
+}
+
+func (l *Limits) hasNegative() bool {
+	return l.MaxPrekeyMessagesPerPublication < 0 ||
+		l.MaxSessions < 0 ||
+		l.MaxSessionsPerPrefix < 0 ||
+		l.MaxFragmentsPerMessage < 0 ||
+		l.MaxIncompleteMessagesPerSender < 0 ||
+		l.MaxBufferedFragmentBytes < 0 ||
+		l.MaxReassembledLength < 0
+}
+
+// validate returns an error of kind ErrInvalidConfig for the first setting
+// that can't be used
+func (c *ServerConfig) validate() error {
+	switch {
+	case c.Identity == "":
+		return newError(ErrInvalidConfig, "missing server identity")
+	case c.Keys == nil:
+		return newError(ErrInvalidConfig, "missing server keypair")
+	case c.Storage == nil:
+		return newError(ErrInvalidConfig, "missing storage")
+	case c.FragmentLength < 0 || (c.FragmentLength > 0 && c.FragmentLength < minFragmentLength):
+		return newError(ErrInvalidConfig, "fragment length has to be 0 or at least 48")
+	case c.SessionTimeout <= 0:
+		return newError(ErrInvalidConfig, "session timeout has to be positive")
+	case c.FragmentTimeout <= 0:
+		return newError(ErrInvalidConfig, "fragment timeout has to be positive")
+	case c.Limits.hasNegative():
+		return newError(ErrInvalidConfig, "limits can't be negative")
+	case c.Maintenance.Jitter < 0 || c.Maintenance.Jitter >= 1:
+		return newError(ErrInvalidConfig, "maintenance jitter has to be at least 0 and less than 1")
+	}
+	return nil
+}
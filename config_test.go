@@ -0,0 +1,104 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func validServerConfig(f *realFactory) ServerConfig {
+	return ServerConfig{
+		Identity:        "prekeys.example.org",
+		Keys:            f.CreateKeypair(),
+		Storage:         &inMemoryStorageFactory{},
+		SessionTimeout:  time.Minute,
+		FragmentTimeout: time.Minute,
+	}
+}
+
+func (s *GenericServerSuite) Test_realFactory_NewServerWithConfig_createsAServerWithTheGivenSettings(c *C) {
+	f := &realFactory{r: fixtureRand()}
+	conf := validServerConfig(f)
+	conf.FragmentLength = 48
+	conf.Rand = fixtureRand()
+	conf.Limits.MaxPrekeyMessagesPerPublication = 3
+	conf.Middleware = []Middleware{func(next Handler) Handler { return next }}
+	log, _ := CreateLogger(&bytes.Buffer{}, "info", "text")
+	conf.Logger = log
+
+	res, e := f.NewServerWithConfig(conf)
+
+	c.Assert(e, IsNil)
+	gs := res.(*GenericServer)
+	c.Assert(gs.identity, Equals, "prekeys.example.org")
+	c.Assert(gs.key, Equals, conf.Keys)
+	c.Assert(gs.fragLen, Equals, 48)
+	c.Assert(gs.sessionTimeout, Equals, time.Minute)
+	c.Assert(gs.fragmentationTimeout, Equals, time.Minute)
+	c.Assert(gs.rand, Equals, conf.Rand)
+	c.Assert(gs.logger, Equals, log)
+	c.Assert(gs.limits.MaxPrekeyMessagesPerPublication, Equals, 3)
+	c.Assert(gs.middleware, HasLen, 1)
+	c.Assert(gs.rest("bla"), Equals, false)
+	c.Assert(gs.hooks, IsNil)
+}
+
+func (s *GenericServerSuite) Test_realFactory_NewServerWithConfig_usesTheLoggerOfTheFactoryByDefault(c *C) {
+	log, _ := CreateLogger(&bytes.Buffer{}, "info", "text")
+	f := &realFactory{r: fixtureRand(), log: log}
+
+	res, e := f.NewServerWithConfig(validServerConfig(f))
+
+	c.Assert(e, IsNil)
+	c.Assert(res.(*GenericServer).logger, Equals, log)
+}
+
+func (s *GenericServerSuite) Test_realFactory_NewServerWithConfig_rejectsInvalidSettings(c *C) {
+	f := &realFactory{r: fixtureRand()}
+	invalid := []struct {
+		change func(*ServerConfig)
+		err    string
+	}{
+		{func(c *ServerConfig) { c.Identity = "" }, "missing server identity"},
+		{func(c *ServerConfig) { c.Keys = nil }, "missing server keypair"},
+		{func(c *ServerConfig) { c.Storage = nil }, "missing storage"},
+		{func(c *ServerConfig) { c.FragmentLength = 47 }, "fragment length has to be 0 or at least 48"},
+		{func(c *ServerConfig) { c.FragmentLength = -1 }, "fragment length has to be 0 or at least 48"},
+		{func(c *ServerConfig) { c.SessionTimeout = 0 }, "session timeout has to be positive"},
+		{func(c *ServerConfig) { c.FragmentTimeout = -time.Second }, "fragment timeout has to be positive"},
+		{func(c *ServerConfig) { c.Limits.MaxPrekeyMessagesPerPublication = -1 }, "limits can't be negative"},
+		{func(c *ServerConfig) { c.Limits.MaxSessions = -1 }, "limits can't be negative"},
+		{func(c *ServerConfig) { c.Limits.MaxSessionsPerPrefix = -1 }, "limits can't be negative"},
+		{func(c *ServerConfig) { c.Limits.MaxReassembledLength = -1 }, "limits can't be negative"},
+		{func(c *ServerConfig) { c.Maintenance.Jitter = 1 }, "maintenance jitter has to be at least 0 and less than 1"},
+	}
+
+	for _, t := range invalid {
+		conf := validServerConfig(f)
+		t.change(&conf)
+		res, e := f.NewServerWithConfig(conf)
+		c.Assert(res, IsNil)
+		c.Assert(e, ErrorMatches, t.err)
+		c.Assert(errors.Is(e, ErrInvalidConfig), Equals, true)
+	}
+}
+
+func (s *GenericServerSuite) Test_publicationMessage_validate_rejectsTooManyPrekeyMessages(c *C) {
+	gs := testServerForInitiator()
+	gs.limits.MaxPrekeyMessagesPerPublication = 1
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	d3, _ := in.PublicationDAKE3(nil, nil, []PrekeyMessage{pm1, pm2})
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+
+	c.Assert(errors.Is(e, ErrInvalidMessage), Equals, true)
+	c.Assert(in.ReceiveSuccess(res), Equals, ErrRejected)
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(0))
+}
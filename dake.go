@@ -1,7 +1,7 @@
 package prekeyserver
 
 import (
-	"errors"
+	"context"
 	"fmt"
 
 	"github.com/otrv4/ed448"
@@ -53,75 +53,137 @@ func generateDake3(it uint32, sigma *ringSignature, m []byte) *dake3Message {
 	}
 }
 
-func (m *dake1Message) validate(string, *GenericServer) error {
-	if e := m.clientProfile.validate(m.instanceTag); e != nil {
-		return errors.New("invalid client profile")
+func calculatePhi(from, serverIdentity string) []byte {
+	return appendData(appendData(nil, []byte(from)), []byte(serverIdentity))
+}
+
+func calculateCompositeIdentity(serverIdentity string, pub *publicKey) []byte {
+	return append(appendData(nil, []byte(serverIdentity)), pub.serialize()...)
+}
+
+// calculateDAKE2T returns the data the server signs in DAKE2
+func calculateDAKE2T(cp *clientProfile, compositeIdentity []byte, i, s ed448.Point, phi []byte) []byte {
+	t := append([]byte{}, 0x00)
+	t = append(t, kdfx(usageInitiatorClientProfile, 64, cp.serialize())...)
+	t = append(t, kdfx(usageInitiatorPrekeyCompositeIdentity, 64, compositeIdentity)...)
+	t = append(t, serializePoint(i)...)
+	t = append(t, serializePoint(s)...)
+	t = append(t, kdfx(usageInitiatorPrekeyCompositePHI, 64, phi)...)
+	return t
+}
+
+// calculateDAKE3T returns the data the client signs in DAKE3
+func calculateDAKE3T(cp *clientProfile, compositeIdentity []byte, i, s ed448.Point, phi []byte) []byte {
+	t := append([]byte{}, 0x01)
+	t = append(t, kdfx(usageReceiverClientProfile, 64, cp.serialize())...)
+	t = append(t, kdfx(usageReceiverPrekeyCompositeIdentity, 64, compositeIdentity)...)
+	t = append(t, serializePoint(i)...)
+	t = append(t, serializePoint(s)...)
+	t = append(t, kdfx(usageReceiverPrekeyCompositePHI, 64, phi)...)
+	return t
+}
+
+// calculateMACKey derives the prekey MAC key from the DH of the two ephemeral keys
+func calculateMACKey(p ed448.Point, k ed448.Scalar) []byte {
+	return kdfx(usagePreMACKey, 64, kdfx(usageSK, skLength, serializePoint(ed448.PointScalarMul(p, k))))
+}
+
+func (m *dake1Message) validate(from string, s *GenericServer) error {
+	if st := s.sessionState(from); st != sessionAwaitingDAKE1 && st != sessionAwaitingDAKE3 {
+		return newError(ErrOutOfSequence, fmt.Sprintf("unexpected DAKE1 message, session is %s", st))
+	}
+
+	if e := m.clientProfile.validate(m.instanceTag, s.now()); e != nil {
+		return wrapError(ErrInvalidProfile, "invalid client profile", e)
 	}
 
 	if e := validatePoint(m.i); e != nil {
-		return errors.New("invalid point I")
+		return newError(ErrInvalidMessage, "invalid point I")
 	}
 
 	return nil
 }
 
 func (m *dake3Message) validate(from string, s *GenericServer) error {
-	sess := s.session(from)
+	if st := s.sessionState(from); st != sessionAwaitingDAKE3 {
+		return newError(ErrOutOfSequence, fmt.Sprintf("unexpected DAKE3 message, session is %s", st))
+	}
+
+	sess, e := s.session(from)
+	if e != nil {
+		return e
+	}
 	if sess.instanceTag() != m.instanceTag {
-		return errors.New("incorrect instance tag")
+		return newError(ErrAuthentication, "incorrect instance tag")
 	}
 
 	if len(m.message) == 0 {
-		return errors.New("incorrect message")
+		return newError(ErrInvalidMessage, "incorrect message")
 	}
 
-	phi := appendData(appendData(nil, []byte(from)), []byte(s.identity))
-
-	t := append([]byte{}, 0x01)
-	t = append(t, kdfx(usageReceiverClientProfile, 64, sess.clientProfile().serialize())...)
-	t = append(t, kdfx(usageReceiverPrekeyCompositeIdentity, 64, s.compositeIdentity())...)
-	t = append(t, serializePoint(sess.pointI())...)
-	t = append(t, serializePoint(sess.keypairS().pub.k)...)
-	t = append(t, kdfx(usageReceiverPrekeyCompositePHI, 64, phi)...)
+	phi := calculatePhi(from, s.identity)
+	t := calculateDAKE3T(sess.clientProfile(), s.compositeIdentity(), sess.pointI(), sess.keypairS().pub.k, phi)
 
 	if !m.sigma.verify(sess.clientProfile().publicKey, s.key.pub, sess.keypairS().pub, t) {
-		return errors.New("incorrect ring signature")
+		return newError(ErrAuthentication, "incorrect ring signature")
 	}
 
 	return nil
 }
 
-func (m *dake1Message) respond(from string, s *GenericServer) (serializable, error) {
+func (m *dake1Message) respond(ctx context.Context, from string, s *GenericServer) (serializable, error) {
+	sess, e := s.startSession(from)
+	if e != nil {
+		return nil, e
+	}
 	sk := generateKeypair(s)
-	s.session(from).save(sk, m.i, m.instanceTag, m.clientProfile)
+	sess.save(sk, m.i, m.instanceTag, m.clientProfile)
 
-	fmt.Printf("\n\n\nGenerating dake2\n")
-
-	phi := appendData(appendData(nil, []byte(from)), []byte(s.identity))
-
-	fmt.Printf("clientProfile = %#v\n", m.clientProfile.serialize())
-	fmt.Printf("compositeId = %#v\n", s.compositeIdentity())
-	fmt.Printf("I = %#v\n", serializePoint(m.i))
-	fmt.Printf("S = %#v\n", serializePoint(sk.pub.k))
-	fmt.Printf("phi = %#v\n", phi)
-
-	t := append([]byte{}, 0x00)
-	t = append(t, kdfx(usageInitiatorClientProfile, 64, m.clientProfile.serialize())...)
-	t = append(t, kdfx(usageInitiatorPrekeyCompositeIdentity, 64, s.compositeIdentity())...)
-	t = append(t, serializePoint(m.i)...)
-	t = append(t, serializePoint(sk.pub.k)...)
-	t = append(t, kdfx(usageInitiatorPrekeyCompositePHI, 64, phi)...)
-
-	fmt.Printf("t = %#v\n", t)
+	phi := calculatePhi(from, s.identity)
+	t := calculateDAKE2T(m.clientProfile, s.compositeIdentity(), m.i, sk.pub.k, phi)
 
 	sigma, e := generateSignature(s, s.key.priv, s.key.pub, m.clientProfile.publicKey, s.key.pub, &publicKey{k: m.i}, t)
 	if e != nil {
-		return nil, errors.New("invalid ring signature generation")
+		return nil, newError(ErrInternal, "invalid ring signature generation")
 	}
 
 	return generateDake2(m.instanceTag, []byte(s.identity), s.key.pub.k, sk.pub.k, sigma), nil
 }
 
-func (m *dake3Message) respond(from string, s *GenericServer) (serializable, error) {
-	return s.messageHandler.handleInnerMessage(from, m.message)
+func isValidInnerMessage(msg []byte) bool {
+	if len(msg) <= indexOfMessageType {
+		return false
+	}
+	mt := msg[indexOfMessageType]
+	return mt == messageTypePublication || mt == messageTypeStorageInformationRequest
+}
+
+// respond will handle the message inside of the DAKE3. Since the session is
+// authenticated at this point, any problem with the inner message will be
+// reported back to the client with a failure message, instead of dropping it.
+// The failure message is returned together with the error that caused it.
+// The session is always closed once the inner message has been handled.
+func (m *dake3Message) respond(ctx context.Context, from string, s *GenericServer) (serializable, error) {
+	sess, e := s.session(from)
+	if e != nil {
+		return nil, e
+	}
+	if e := sess.authenticate(); e != nil {
+		return nil, e
+	}
+	defer s.sessionComplete(from)
+
+	if !isValidInnerMessage(m.message) {
+		return generateFailureMessage(sess.macKey(), sess.instanceTag()),
+			newError(ErrInvalidMessage, "DAKE3 doesn't contain a publication or storage information request")
+	}
+
+	r, e := s.messageHandler.handleInnerMessage(ctx, from, m.message)
+	if e != nil {
+		return generateFailureMessage(sess.macKey(), sess.instanceTag()),
+			fmt.Errorf("message inside of DAKE3 was rejected: %w", e)
+	}
+
+	s.metrics.dakeCompleted()
+	return r, nil
 }
@@ -1,6 +1,8 @@
 package prekeyserver
 
 import (
+	"context"
+
 	"github.com/otrv4/ed448"
 	. "gopkg.in/check.v1"
 )
@@ -14,14 +16,15 @@ func (s *GenericServerSuite) Test_dake3Message_validate_acceptsAValidDake3Messag
 		fingerprint: serverKey.pub.fingerprint(),
 		sessions:    newSessionManager(),
 	}
-	gs.session("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).st = sessionAwaitingDAKE3
 
 	phi := appendData(appendData(nil, []byte("someone@example.org")), []byte(gs.identity))
 
 	spoint := generateKeypair(gs)
-	gs.session("someone@example.org").(*realSession).s = spoint
-	gs.session("someone@example.org").(*realSession).i = sita.i.pub.k
-	gs.session("someone@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("someone@example.org").(*realSession).s = spoint
+	gs.testSession("someone@example.org").(*realSession).i = sita.i.pub.k
+	gs.testSession("someone@example.org").(*realSession).cp = sita.clientProfile
 
 	t := append([]byte{}, 0x01)
 	t = append(t, kdfx(usageReceiverClientProfile, 64, sita.clientProfile.serialize())...)
@@ -45,14 +48,15 @@ func (s *GenericServerSuite) Test_dake3Message_validate_checksInstanceTag(c *C)
 		fingerprint: serverKey.pub.fingerprint(),
 		sessions:    newSessionManager(),
 	}
-	gs.session("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).st = sessionAwaitingDAKE3
 
 	phi := appendData(appendData(nil, []byte("someone@example.org")), []byte(gs.identity))
 
 	spoint := generateKeypair(gs)
-	gs.session("someone@example.org").(*realSession).s = spoint
-	gs.session("someone@example.org").(*realSession).i = sita.i.pub.k
-	gs.session("someone@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("someone@example.org").(*realSession).s = spoint
+	gs.testSession("someone@example.org").(*realSession).i = sita.i.pub.k
+	gs.testSession("someone@example.org").(*realSession).cp = sita.clientProfile
 
 	t := append([]byte{}, 0x01)
 	t = append(t, kdfx(usageReceiverClientProfile, 64, sita.clientProfile.serialize())...)
@@ -76,14 +80,15 @@ func (s *GenericServerSuite) Test_dake3Message_validate_checksRingSignature(c *C
 		fingerprint: serverKey.pub.fingerprint(),
 		sessions:    newSessionManager(),
 	}
-	gs.session("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).st = sessionAwaitingDAKE3
 
 	phi := appendData(appendData(nil, []byte("someone@example.org")), []byte(gs.identity))
 
 	spoint := generateKeypair(gs)
-	gs.session("someone@example.org").(*realSession).s = spoint
-	gs.session("someone@example.org").(*realSession).i = sita.i.pub.k
-	gs.session("someone@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("someone@example.org").(*realSession).s = spoint
+	gs.testSession("someone@example.org").(*realSession).i = sita.i.pub.k
+	gs.testSession("someone@example.org").(*realSession).cp = sita.clientProfile
 
 	t := append([]byte{}, 0x01)
 	t = append(t, kdfx(usageReceiverClientProfile, 64, sita.clientProfile.serialize())...)
@@ -108,14 +113,15 @@ func (s *GenericServerSuite) Test_dake3Message_validate_checksMessage(c *C) {
 		fingerprint: serverKey.pub.fingerprint(),
 		sessions:    newSessionManager(),
 	}
-	gs.session("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("someone@example.org").(*realSession).st = sessionAwaitingDAKE3
 
 	phi := appendData(appendData(nil, []byte("someone@example.org")), []byte(gs.identity))
 
 	spoint := generateKeypair(gs)
-	gs.session("someone@example.org").(*realSession).s = spoint
-	gs.session("someone@example.org").(*realSession).i = sita.i.pub.k
-	gs.session("someone@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("someone@example.org").(*realSession).s = spoint
+	gs.testSession("someone@example.org").(*realSession).i = sita.i.pub.k
+	gs.testSession("someone@example.org").(*realSession).cp = sita.clientProfile
 
 	t := append([]byte{}, 0x01)
 	t = append(t, kdfx(usageReceiverClientProfile, 64, sita.clientProfile.serialize())...)
@@ -143,6 +149,6 @@ func (s *GenericServerSuite) Test_dake3Message_respond_shouldFailOnInvalidRingSi
 	}
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, gs.key.pub.k)
 
-	_, e := d1.respond("someone@example.org", gs)
+	_, e := d1.respond(context.Background(), "someone@example.org", gs)
 	c.Assert(e, ErrorMatches, "invalid ring signature generation")
 }
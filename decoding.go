@@ -0,0 +1,212 @@
+package prekeyserver
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/otrv4/ed448"
+)
+
+// DecodeError describes why a message couldn't be decoded. It is returned by
+// Handle for any message that is truncated, has trailing bytes, or has a
+// field with an invalid value.
+type DecodeError struct {
+	// MessageType is the type of the message being decoded
+	MessageType uint8
+	// Field is the name of the field that failed, for example "client profile public key"
+	Field string
+	// Offset is the position in the message where the field starts
+	Offset int
+	// Reason describes what was wrong with the field
+	Reason string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("invalid message of type 0x%02X: %s at offset %d: %s", e.MessageType, e.Field, e.Offset, e.Reason)
+}
+
+// decoder reads the fields of a message one by one. As soon as one field
+// fails, all further reads are ignored, so the decode methods don't have to
+// check every step. The first failure is kept in err.
+type decoder struct {
+	buf         []byte
+	offset      int
+	messageType uint8
+	path        []string
+	err         *DecodeError
+}
+
+func newDecoder(buf []byte, messageType uint8) *decoder {
+	return &decoder{buf: buf, messageType: messageType}
+}
+
+func (d *decoder) failed() bool {
+	return d.err != nil
+}
+
+func (d *decoder) fieldName(field string) string {
+	names := d.path
+	if field != "" {
+		names = append(names[:len(names):len(names)], field)
+	}
+	if len(names) == 0 {
+		return "message"
+	}
+	return strings.Join(names, " ")
+}
+
+func (d *decoder) failAt(offset int, field, reason string) {
+	if d.err == nil {
+		d.err = &DecodeError{
+			MessageType: d.messageType,
+			Field:       d.fieldName(field),
+			Offset:      offset,
+			Reason:      reason,
+		}
+	}
+}
+
+func (d *decoder) fail(field, reason string) {
+	d.failAt(d.offset, field, reason)
+}
+
+// nested decodes a part of the message, naming its fields after it
+func (d *decoder) nested(name string, f func()) {
+	d.path = append(d.path, name)
+	f()
+	d.path = d.path[:len(d.path)-1]
+}
+
+// finish returns the error of the decoding, if any. The whole message has
+// to have been used up for it to be valid.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail("", fmt.Sprintf("%d unexpected trailing bytes", len(d.buf)))
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return nil
+}
+
+func (d *decoder) fixed(field string, n int) []byte {
+	if d.failed() {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.fail(field, fmt.Sprintf("needs %d bytes, but only %d are left", n, len(d.buf)))
+		return nil
+	}
+	res := d.buf[:n]
+	d.buf = d.buf[n:]
+	d.offset += n
+	return res
+}
+
+func (d *decoder) byte(field string) uint8 {
+	if b := d.fixed(field, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) short(field string) uint16 {
+	if b := d.fixed(field, 2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (d *decoder) word(field string) uint32 {
+	if b := d.fixed(field, 4); b != nil {
+		_, res, _ := extractWord(b)
+		return res
+	}
+	return 0
+}
+
+func (d *decoder) long(field string) uint64 {
+	if b := d.fixed(field, 8); b != nil {
+		_, res, _ := extractLong(b)
+		return res
+	}
+	return 0
+}
+
+func (d *decoder) data(field string) []byte {
+	if d.failed() {
+		return nil
+	}
+	start := d.offset
+	_, length, ok := extractWord(d.buf)
+	if !ok {
+		d.fail(field, fmt.Sprintf("needs 4 bytes for the length, but only %d are left", len(d.buf)))
+		return nil
+	}
+	if int64(length) > int64(len(d.buf)-4) {
+		d.failAt(start, field, fmt.Sprintf("length %d is longer than the %d bytes left", length, len(d.buf)-4))
+		return nil
+	}
+	d.fixed(field, 4)
+	return d.fixed(field, int(length))
+}
+
+func (d *decoder) time(field string) time.Time {
+	v := d.long(field)
+	if d.failed() {
+		return time.Time{}
+	}
+	return time.Unix(int64(v), 0).In(time.UTC)
+}
+
+func (d *decoder) mpi(field string) *big.Int {
+	if v := d.data(field); v != nil {
+		return new(big.Int).SetBytes(v)
+	}
+	return nil
+}
+
+func (d *decoder) point(field string) ed448.Point {
+	start := d.offset
+	b := d.fixed(field, 57)
+	if b == nil {
+		return nil
+	}
+	_, p, ok := deserializePoint(b)
+	if !ok {
+		d.failAt(start, field, "not a valid point")
+		return nil
+	}
+	return p
+}
+
+func (d *decoder) scalar(field string) ed448.Scalar {
+	b := d.fixed(field, 56)
+	if b == nil {
+		return nil
+	}
+	_, s, _ := deserializeScalar(b)
+	return s
+}
+
+// header checks the protocol version and message type at the start of a message
+func (d *decoder) header(messageType uint8) {
+	if v := d.short("protocol version"); !d.failed() && v != version {
+		d.failAt(d.offset-2, "protocol version", fmt.Sprintf("unsupported version %d", v))
+	}
+	if mt := d.byte("message type"); !d.failed() && mt != messageType {
+		d.failAt(d.offset-1, "message type", fmt.Sprintf("expected 0x%02X but got 0x%02X", messageType, mt))
+	}
+}
+
+// deserializeWith runs a decode method over buf, in the form the deserialize methods use
+func deserializeWith(buf []byte, decode func(*decoder)) ([]byte, bool) {
+	d := newDecoder(buf, 0)
+	decode(d)
+	if d.failed() {
+		return nil, false
+	}
+	return d.buf, true
+}
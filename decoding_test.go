@@ -0,0 +1,119 @@
+package prekeyserver
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func decodeErrorFrom(c *C, e error) *DecodeError {
+	de, ok := e.(*DecodeError)
+	c.Assert(ok, Equals, true, Commentf("expected a decode error, got %v", e))
+	return de
+}
+
+func (s *GenericServerSuite) Test_parseMessage_rejectsTrailingBytes(c *C) {
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k).serialize()
+	msg := append(append([]byte{}, d1...), 0x01, 0x02)
+
+	_, _, e := parseMessage(msg)
+
+	de := decodeErrorFrom(c, e)
+	c.Assert(de.MessageType, Equals, messageTypeDAKE1)
+	c.Assert(de.Field, Equals, "message")
+	c.Assert(de.Offset, Equals, len(d1))
+	c.Assert(de.Reason, Equals, "2 unexpected trailing bytes")
+}
+
+func (s *GenericServerSuite) Test_parseMessage_reportsTheFieldOfATruncatedMessage(c *C) {
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k).serialize()
+
+	_, _, e := parseMessage(d1[:len(d1)-10])
+
+	de := decodeErrorFrom(c, e)
+	c.Assert(de.Field, Equals, "point I")
+	c.Assert(de.Offset, Equals, len(d1)-57)
+	c.Assert(e, ErrorMatches, "invalid message of type 0x35: point I at offset [0-9]+: needs 57 bytes, but only 47 are left")
+}
+
+func (s *GenericServerSuite) Test_parseMessage_reportsAMissingClientProfileField(c *C) {
+	msg := []byte{0x00, 0x04, messageTypeDAKE1, 0x12, 0x45, 0xab, 0xcd,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x01, 0x12, 0x45, 0xab, 0xcd,
+	}
+
+	_, _, e := parseMessage(msg)
+
+	de := decodeErrorFrom(c, e)
+	c.Assert(de.Field, Equals, "client profile")
+	c.Assert(de.Offset, Equals, 7)
+	c.Assert(de.Reason, Equals, "missing public key field")
+}
+
+func (s *GenericServerSuite) Test_parseMessage_reportsAnUnknownClientProfileField(c *C) {
+	msg := []byte{0x00, 0x04, messageTypeDAKE1, 0x12, 0x45, 0xab, 0xcd,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x01, 0x12, 0x45, 0xab, 0xcd,
+		0x00, 0x10, 0x00,
+	}
+
+	_, _, e := parseMessage(msg)
+
+	de := decodeErrorFrom(c, e)
+	c.Assert(de.Field, Equals, "client profile field type")
+	c.Assert(de.Offset, Equals, 17)
+	c.Assert(de.Reason, Equals, "unknown field type 0x0010")
+}
+
+func (s *GenericServerSuite) Test_parseMessage_reportsADuplicateClientProfileField(c *C) {
+	msg := []byte{0x00, 0x04, messageTypeDAKE1, 0x12, 0x45, 0xab, 0xcd,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x01, 0x12, 0x45, 0xab, 0xcd,
+		0x00, 0x01, 0x12, 0x45, 0xab, 0xcd,
+	}
+
+	_, _, e := parseMessage(msg)
+
+	c.Assert(e, ErrorMatches, "invalid message of type 0x35: client profile field type at offset 17: duplicate instance tag field")
+}
+
+func (s *GenericServerSuite) Test_parseMessage_namesTheNestedFieldThatFailed(c *C) {
+	pm, _ := generatePrekeyMessage(testServerForInitiator(), sita.instanceTag)
+	pub := generatePublicationMessage(nil, nil, []*prekeyMessage{pm, pm}, make([]byte, 64)).serialize()
+	pmLen := len(pm.serialize())
+
+	_, _, e := parseMessage(pub[:4+pmLen+20])
+
+	de := decodeErrorFrom(c, e)
+	c.Assert(de.MessageType, Equals, messageTypePublication)
+	c.Assert(de.Field, Equals, "prekey message 2 point Y")
+	c.Assert(de.Offset, Equals, 4+pmLen+11)
+}
+
+func (s *GenericServerSuite) Test_parseMessage_rejectsAnInvalidPresenceFlag(c *C) {
+	msg := []byte{0x00, 0x04, messageTypePublication, 0x00, 0x02}
+
+	_, _, e := parseMessage(msg)
+
+	c.Assert(e, ErrorMatches, "invalid message of type 0x08: client profile flag at offset 4: must be 0 or 1, but was 2")
+}
+
+func (s *GenericServerSuite) Test_Handle_returnsADecodeErrorForAGarbageMessage(c *C) {
+	gs := testServerForInitiator()
+	msg := []byte{0x00, 0x04, messageTypeEnsembleRetrievalQuery, 0x12, 0x45, 0xab, 0xcd, 0x00, 0x00, 0x00, 0xFF}
+
+	_, e := gs.Handle("someone@example.org", encodeMessage(msg)+".")
+
+	de := decodeErrorFrom(c, e)
+	c.Assert(de.Field, Equals, "identity")
+	c.Assert(de.Offset, Equals, 7)
+	c.Assert(de.Reason, Equals, "length 255 is longer than the 0 bytes left")
+}
+
+func (s *GenericServerSuite) Test_deserialize_stillAllowsTrailingBytes(c *C) {
+	pm, _ := generatePrekeyMessage(testServerForInitiator(), sita.instanceTag)
+	buf := append(pm.serialize(), 0x42)
+
+	rest, ok := (&prekeyMessage{}).deserialize(buf)
+
+	c.Assert(ok, Equals, true)
+	c.Assert(rest, DeepEquals, []byte{0x42})
+}
@@ -0,0 +1,98 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+)
+
+// These are the kinds of errors Handle can return. The errors returned have
+// their own messages, with the details of what went wrong, but errors.Is will
+// tell which of these kinds they are.
+var (
+	// ErrDecode is returned for messages that can't be decoded. A *DecodeError
+	// has more information about where the problem is.
+	ErrDecode = errors.New("message could not be decoded")
+	// ErrFragment is returned for fragments that can't be put together
+	ErrFragment = errors.New("invalid fragment")
+	// ErrFragmentLimit is returned for fragments that go over one of the limits
+	// for fragmented messages. A *FragmentLimitError has more information.
+	ErrFragmentLimit = errors.New("fragment limit exceeded")
+	// ErrInvalidMessage is returned for messages that decode correctly, but have invalid values
+	ErrInvalidMessage = errors.New("invalid message")
+	// ErrInvalidProfile is returned for client or prekey profiles that don't validate
+	ErrInvalidProfile = errors.New("invalid profile")
+	// ErrExpiredProfile is returned for client or prekey profiles that have expired
+	ErrExpiredProfile = errors.New("profile has expired")
+	// ErrOutOfSequence is returned for messages that are not expected at this
+	// point of the DAKE with the sender
+	ErrOutOfSequence = errors.New("message out of sequence")
+	// ErrAuthentication is returned when a signature, MAC or instance tag doesn't match
+	ErrAuthentication = errors.New("authentication failed")
+	// ErrRestricted is returned when the sender isn't allowed to send this kind of message
+	ErrRestricted = errors.New("sender is restricted")
+	// ErrStorage is returned when the storage fails
+	ErrStorage = errors.New("storage failure")
+	// ErrInternal is returned when something fails inside of the server
+	ErrInternal = errors.New("internal server error")
+	// ErrInvalidConfig is returned by NewServerWithConfig for settings that can't be used
+	ErrInvalidConfig = errors.New("invalid server configuration")
+	// ErrTooManySessions is returned for a DAKE1 that needs a new session while
+	// the session table is full of sessions that can't be evicted
+	ErrTooManySessions = errors.New("too many sessions")
+	// ErrServerClosed is returned for messages that arrive after the server
+	// has started shutting down
+	ErrServerClosed = errors.New("server is closed")
+)
+
+// IsClientError returns true if the error was caused by what the client sent,
+// and false if it comes from a problem in the server itself, or from the
+// context given to HandleContext.
+func IsClientError(err error) bool {
+	return err != nil &&
+		!errors.Is(err, ErrStorage) &&
+		!errors.Is(err, ErrInternal) &&
+		!errors.Is(err, ErrServerClosed) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// kindError is an error of one of the kinds above, with its own message
+type kindError struct {
+	kind  error
+	msg   string
+	cause error
+}
+
+func newError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+// wrapError returns an error of the given kind, that was caused by another error
+func wrapError(kind error, msg string, cause error) error {
+	return &kindError{kind: kind, msg: msg, cause: cause}
+}
+
+func (e *kindError) Error() string {
+	if e.cause != nil {
+		return e.msg + ": " + e.cause.Error()
+	}
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.cause
+}
+
+// Is makes every DecodeError match ErrDecode
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// Is makes every PanicError match ErrInternal
+func (e *PanicError) Is(target error) bool {
+	return target == ErrInternal
+}
@@ -0,0 +1,111 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *GenericServerSuite) Test_Handle_returnsADecodeErrorKindForAnEmptyMessage(c *C) {
+	_, e := (&GenericServer{}).Handle("someone@example.org", "")
+
+	c.Assert(errors.Is(e, ErrDecode), Equals, true)
+	c.Assert(IsClientError(e), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_DecodeError_isADecodeError(c *C) {
+	_, _, e := parseMessage([]byte{0x00, 0x04, messageTypeDAKE1, 0x12})
+
+	var de *DecodeError
+	c.Assert(errors.As(e, &de), Equals, true)
+	c.Assert(errors.Is(e, ErrDecode), Equals, true)
+	c.Assert(errors.Is(e, ErrFragment), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_returnsAFragmentError(c *C) {
+	_, _, e := newFragmentations().newFragmentReceived("someone@example.org", "?OTRP|1|2|3|,,,.")
+
+	c.Assert(errors.Is(e, ErrFragment), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_returnsARestrictedError(c *C) {
+	gs := testServerForInitiator()
+	gs.rest = func(string) bool { return true }
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k)
+
+	_, e := gs.messageHandler.handleMessage(context.Background(), "someone@example.org", d1.serialize())
+
+	c.Assert(errors.Is(e, ErrRestricted), Equals, true)
+	c.Assert(IsClientError(e), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_dake1Message_validate_returnsAnExpiredProfileError(c *C) {
+	gs := testServerForInitiator()
+	cp := generateSitaClientProfile(sita.longTerm)
+	cp.expiration = time.Now().Add(-time.Hour)
+	cp.sig = &eddsaSignature{s: cp.generateSignature(sita.longTerm)}
+
+	e := generateDake1(sita.instanceTag, cp, sita.i.pub.k).validate("sita@example.org", gs)
+
+	c.Assert(e, ErrorMatches, "invalid client profile: client profile has expired")
+	c.Assert(errors.Is(e, ErrInvalidProfile), Equals, true)
+	c.Assert(errors.Is(e, ErrExpiredProfile), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_Handle_returnsAnOutOfSequenceErrorForAnUnexpectedDAKE3(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+	d3, _ := in.StorageInformationDAKE3()
+
+	_, e := testServerForInitiator().Handle("sita@example.org", encodeMessage(d3)+".")
+
+	c.Assert(errors.Is(e, ErrOutOfSequence), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_publicationMessage_respond_returnsAStorageError(c *C) {
+	gs := testServerForInitiator()
+	gs.storageImpl = &failingStorage{gs.storageImpl}
+	gs.testSession("sita@example.org").(*realSession).st = sessionAuthenticated
+
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	m := &publicationMessage{prekeyMessages: []*prekeyMessage{pm}}
+	_, e := m.respond(context.Background(), "sita@example.org", gs)
+
+	c.Assert(e, ErrorMatches, "couldn't store publication: disk is full")
+	c.Assert(errors.Is(e, ErrStorage), Equals, true)
+	c.Assert(IsClientError(e), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_Handle_returnsAStorageErrorWithTheFailureForAPublication(c *C) {
+	gs := testServerForInitiator()
+	gs.storageImpl = &failingStorage{gs.storageImpl}
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	res, e := gs.Handle("sita@example.org", encodeMessage(in.DAKE1())+".")
+	c.Assert(e, IsNil)
+	d2, _ := decodeMessage(strings.TrimSuffix(res[0], "."))
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	d3, _ := in.PublicationDAKE3(nil, nil, []PrekeyMessage{pm})
+
+	res, e = gs.Handle("sita@example.org", encodeMessage(d3)+".")
+
+	c.Assert(e, ErrorMatches, "message inside of DAKE3 was rejected: couldn't store publication: disk is full")
+	c.Assert(errors.Is(e, ErrStorage), Equals, true)
+	c.Assert(IsClientError(e), Equals, false)
+	c.Assert(res, HasLen, 1)
+	fm, _ := decodeMessage(strings.TrimSuffix(res[0], "."))
+	c.Assert(in.ReceiveSuccess(fm), Equals, ErrRejected)
+}
+
+func (s *GenericServerSuite) Test_PanicError_isAnInternalError(c *C) {
+	var e error = &PanicError{Stage: stageResponse, Value: "boom"}
+
+	c.Assert(errors.Is(e, ErrInternal), Equals, true)
+	c.Assert(IsClientError(e), Equals, false)
+	c.Assert(IsClientError(nil), Equals, false)
+}
@@ -1,6 +1,7 @@
 package prekeyserver
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -8,7 +9,7 @@ import (
 	"os"
 	"path"
 	"regexp"
-	"strings"
+	"time"
 )
 
 // Design:
@@ -33,12 +34,19 @@ import (
 //   - same thing when we create the directory.
 //   - The cleanup method is in charge of deleting empty directories - we don't care about that in the main path
 
+func init() {
+	RegisterStorageType("dir", createFileStorageFactoryFrom)
+}
+
 type fileStorageFactory struct {
 	path string
 }
 
-func createFileStorageFactoryFrom(desc string) (Storage, error) {
-	path := strings.TrimPrefix(desc, "dir:")
+func createFileStorageFactoryFrom(params string) (Storage, error) {
+	path, _, e := ParseStorageParameters(params)
+	if e != nil {
+		return nil, e
+	}
 
 	if !entryExists(path) {
 		return nil, errors.New("directory doesn't exist")
@@ -46,16 +54,15 @@ func createFileStorageFactoryFrom(desc string) (Storage, error) {
 	return &fileStorageFactory{path: path}, nil
 }
 
-func (fsf *fileStorageFactory) createStorage() storage {
-	return createFileStorageFrom(fsf.path)
+func (fsf *fileStorageFactory) createStorage() (storage, error) {
+	return createFileStorageFrom(fsf.path), nil
 }
 
 type fileStorage struct {
 	path string
-}
-
-func isFileStorageDescriptor(desc string) bool {
-	return strings.HasPrefix(desc, "dir:")
+	// ctx is the context of the message being handled, if any
+	ctx context.Context
+	storageClock
 }
 
 func createFileStorageFrom(path string) *fileStorage {
@@ -64,9 +71,32 @@ func createFileStorageFrom(path string) *fileStorage {
 	}
 }
 
+func (fs *fileStorage) withContext(ctx context.Context) storage {
+	return &fileStorage{
+		path:         fs.path,
+		ctx:          ctx,
+		storageClock: fs.storageClock,
+	}
+}
+
+// lock locks the directory, giving up if the context of the storage is done first
+func (fs *fileStorage) lock(dirName string) (uint64, error) {
+	ctx := fs.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return lockDirContext(ctx, dirName)
+}
+
 func (fs *fileStorage) writeData(user, file string, itag uint32, data []byte) error {
-	userDir := fs.getOrCreateDirFor(user)
-	t1 := lockDir(userDir)
+	userDir, e := fs.getOrCreateDirFor(user)
+	if e != nil {
+		return e
+	}
+	t1, e := fs.lock(userDir)
+	if e != nil {
+		return e
+	}
 	defer unlockDir(userDir, t1)
 
 	itagDir := fs.getOrCreateInstanceTagDir(userDir, itag)
@@ -109,22 +139,28 @@ func (fs *fileStorage) getPmDir(itagDir string) string {
 	return path.Join(itagDir, "pm")
 }
 
-func (fs *fileStorage) getOrCreateDirFor(user string) string {
+func (fs *fileStorage) getOrCreateDirFor(user string) (string, error) {
 	dir, ok := fs.getDirFor(user)
 	if ok {
-		return dir
+		return dir, nil
 	}
 
 	pref, us := fs.composeDirNameFor(user)
 	if !entryExists(pref) {
-		t1 := lockDir(fs.path)
+		t1, e := fs.lock(fs.path)
+		if e != nil {
+			return "", e
+		}
 		os.Mkdir(pref, 0700)
 		unlockDir(fs.path, t1)
 	}
-	t1 := lockDir(pref)
+	t1, e := fs.lock(pref)
+	if e != nil {
+		return "", e
+	}
 	os.Mkdir(us, 0700)
 	unlockDir(pref, t1)
-	return us
+	return us, nil
 }
 
 // getOrCreateInstanceTagDir assumes that the user dir is already locked
@@ -146,8 +182,14 @@ func (fs *fileStorage) getOrCreatePmDir(userDir string) string {
 }
 
 func (fs *fileStorage) storePrekeyMessages(user string, pms []*prekeyMessage) error {
-	userDir := fs.getOrCreateDirFor(user)
-	t1 := lockDir(userDir)
+	userDir, e := fs.getOrCreateDirFor(user)
+	if e != nil {
+		return e
+	}
+	t1, e := fs.lock(userDir)
+	if e != nil {
+		return e
+	}
 	defer unlockDir(userDir, t1)
 
 	for _, pm := range pms {
@@ -165,7 +207,10 @@ func (fs *fileStorage) numberStored(user string, itag uint32) uint32 {
 	if !ok {
 		return 0
 	}
-	t1 := lockDir(userDir)
+	t1, e := fs.lock(userDir)
+	if e != nil {
+		return 0
+	}
 	defer unlockDir(userDir, t1)
 
 	pmDir := fs.getPmDir(fs.getInstanceTagDir(userDir, itag))
@@ -188,17 +233,24 @@ func isUint32Hex(name string) bool {
 	return res
 }
 
-func (fs *fileStorage) retrieveFor(user string) []*prekeyEnsemble {
+func (fs *fileStorage) retrieveFor(user string, accept ensembleFilter) ([]*prekeyEnsemble, error) {
+	now := fs.now()
 	userDir, ok := fs.getDirFor(user)
 	if !ok {
-		return nil
+		return nil, nil
+	}
+	t1, e := fs.lock(userDir)
+	if e != nil {
+		return nil, e
 	}
-	t1 := lockDir(userDir)
 	defer unlockDir(userDir, t1)
 
 	files, err := ioutil.ReadDir(userDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	entries := []*prekeyEnsemble{}
@@ -225,7 +277,15 @@ func (fs *fileStorage) retrieveFor(user string) []*prekeyEnsemble {
 						_, ok1 := pmR.deserialize(pm)
 						_, ok2 := cpR.deserialize(cp)
 						_, ok3 := ppR.deserialize(pp)
-						if ok1 && ok2 && ok3 {
+						if ok2 && cpR.hasExpired(now) {
+							os.Remove(cpFile)
+							continue
+						}
+						if ok3 && ppR.hasExpired(now) {
+							os.Remove(ppFile)
+							continue
+						}
+						if ok1 && ok2 && ok3 && accept.accepts(cpR, ppR) {
 							defer os.Remove(pmFile)
 							entries = append(entries, &prekeyEnsemble{
 								cp: cpR,
@@ -239,10 +299,10 @@ func (fs *fileStorage) retrieveFor(user string) []*prekeyEnsemble {
 		}
 	}
 
-	return entries
+	return entries, nil
 }
 
-func cleanupClientProfile(p string) error {
+func cleanupClientProfile(p string, now time.Time) error {
 	cpFile := path.Join(p, "cp.bin")
 	cp := &clientProfile{}
 	cpd, e := ioutil.ReadFile(cpFile)
@@ -250,13 +310,13 @@ func cleanupClientProfile(p string) error {
 		return e
 	}
 	_, ok := cp.deserialize(cpd)
-	if !ok || cp.hasExpired() {
+	if !ok || cp.hasExpired(now) {
 		os.Remove(cpFile)
 	}
 	return nil
 }
 
-func cleanupPrekeyProfile(p string) error {
+func cleanupPrekeyProfile(p string, now time.Time) error {
 	ppFile := path.Join(p, "pp.bin")
 	pp := &prekeyProfile{}
 	ppd, e := ioutil.ReadFile(ppFile)
@@ -264,7 +324,7 @@ func cleanupPrekeyProfile(p string) error {
 		return e
 	}
 	_, ok := pp.deserialize(ppd)
-	if !ok || pp.hasExpired() {
+	if !ok || pp.hasExpired(now) {
 		os.Remove(ppFile)
 	}
 	return nil
@@ -280,9 +340,9 @@ func cleanupPrekeyMessages(p string) {
 	}
 }
 
-func cleanupInstanceTag(p string) {
-	cleanupClientProfile(p)
-	cleanupPrekeyProfile(p)
+func cleanupInstanceTag(p string, now time.Time) {
+	cleanupClientProfile(p, now)
+	cleanupPrekeyProfile(p, now)
 	cleanupPrekeyMessages(p)
 	if entryExists(p) {
 		ff, _ := ioutil.ReadDir(p)
@@ -309,8 +369,9 @@ func (fs *fileStorage) cleanupUser(p string) {
 	t1 := lockDir(p)
 	defer unlockDir(p, t1)
 
+	now := fs.now()
 	for _, itag := range listInstanceTagsIn(p) {
-		cleanupInstanceTag(itag)
+		cleanupInstanceTag(itag, now)
 	}
 }
 
@@ -342,6 +403,11 @@ func (fs *fileStorage) cleanupPrefix(p string) {
 	}
 }
 
+// close has nothing to do, since every change is written as soon as it's made
+func (fs *fileStorage) close() error {
+	return nil
+}
+
 func (fs *fileStorage) cleanup() {
 	for _, ff := range listDirsIn(fs.path) {
 		fs.cleanupPrefix(ff)
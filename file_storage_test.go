@@ -1,6 +1,7 @@
 package prekeyserver
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
@@ -43,9 +44,9 @@ func (s *GenericServerSuite) Test_fileStorage_numberStored_returnsNumberOfPrekey
 	os.Mkdir(testDir, 0700)
 	defer os.RemoveAll(testDir)
 
-	fsf, e := createFileStorageFactoryFrom("dir:" + testDir)
+	fsf, e := createFileStorageFactoryFrom(testDir)
 	c.Assert(e, IsNil)
-	fs := fsf.createStorage()
+	fs, _ := fsf.createStorage()
 
 	gs := &GenericServer{
 		rand: fixtureRand(),
@@ -70,8 +71,8 @@ func (s *GenericServerSuite) Test_fileStorage_cleanup_willRemoveExpiredClientPro
 	os.Mkdir(testDir, 0700)
 	defer os.RemoveAll(testDir)
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
 	cp := generateSitaTestData().clientProfile
 	cp.expiration = time.Date(2017, 11, 5, 13, 46, 00, 13, time.UTC)
@@ -105,8 +106,8 @@ func (s *GenericServerSuite) Test_fileStorage_cleanup_willRemoveExpiredPrekeyPro
 		rand: fixtureRand(),
 	}
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
 	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2017, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pp2, _ := generatePrekeyProfile(gs, 0x42424242, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
@@ -135,8 +136,8 @@ func (s *GenericServerSuite) Test_fileStorage_cleanup_shouldNotRemoveUserIfThere
 		rand: fixtureRand(),
 	}
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
 	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2017, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pp2, _ := generatePrekeyProfile(gs, 0x42424242, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
@@ -169,8 +170,8 @@ func (s *GenericServerSuite) Test_fileStorage_retrieveFor_willReturnAPrekeyEnsem
 		rand: fixtureRand(),
 	}
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
 	cp := generateSitaTestData().clientProfile
 	cp2 := generateSitaTestData().clientProfile
@@ -206,7 +207,7 @@ func (s *GenericServerSuite) Test_fileStorage_retrieveFor_willReturnAPrekeyEnsem
 	c.Assert(listDir(path.Join(testDir, prefixHexForUser2, hexForUser2, "1245ABCD", "pm")), HasLen, 4)
 	c.Assert(listDir(path.Join(testDir, prefixHexForUser2, hexForUser2, "42424242", "pm")), HasLen, 3)
 
-	pes := fs.retrieveFor("someone@example.org")
+	pes := retrieved(fs.retrieveFor("someone@example.org", nil))
 	c.Assert(pes, HasLen, 2)
 	c.Assert(pes[0].cp.sig, DeepEquals, cp.sig)
 	c.Assert(pes[1].cp.sig, DeepEquals, cp2.sig)
@@ -222,21 +223,21 @@ func (s *GenericServerSuite) Test_fileStorage_retrieveFor_willReturnAPrekeyEnsem
 	c.Assert(listDir(path.Join(testDir, prefixHexForUser2, hexForUser2, "1245ABCD", "pm")), HasLen, 3)
 	c.Assert(listDir(path.Join(testDir, prefixHexForUser2, hexForUser2, "42424242", "pm")), HasLen, 2)
 
-	pes = fs.retrieveFor("someone@example.org")
+	pes = retrieved(fs.retrieveFor("someone@example.org", nil))
 	c.Assert(pes, HasLen, 2)
 	c.Assert(pes[0].pm.identifier, DeepEquals, pm4.identifier)
 	c.Assert(pes[1].pm.identifier, DeepEquals, pm2x2.identifier)
 
-	pes = fs.retrieveFor("someone@example.org")
+	pes = retrieved(fs.retrieveFor("someone@example.org", nil))
 	c.Assert(pes, HasLen, 2)
 	c.Assert(pes[0].pm.identifier, DeepEquals, pm1.identifier)
 	c.Assert(pes[1].pm.identifier, DeepEquals, pm2x3.identifier)
 
-	pes = fs.retrieveFor("someone@example.org")
+	pes = retrieved(fs.retrieveFor("someone@example.org", nil))
 	c.Assert(pes, HasLen, 1)
 	c.Assert(pes[0].pm.identifier, DeepEquals, pm2.identifier)
 
-	pes = fs.retrieveFor("someone@example.org")
+	pes = retrieved(fs.retrieveFor("someone@example.org", nil))
 	c.Assert(pes, HasLen, 0)
 
 	c.Assert(entryExists(path.Join(testDir, prefixHexForUser2, hexForUser2, "1245ABCD", "pm")), Equals, true)
@@ -252,8 +253,8 @@ func (s *GenericServerSuite) Test_fileStorage_storePrekeyMessages_reportsErrorWh
 		rand: fixtureRand(),
 	}
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
 	os.MkdirAll(path.Join(testDir, prefixHexForUser2, hexForUser2, "1245ABCD"), 0700)
 	os.Mkdir(path.Join(testDir, prefixHexForUser2, hexForUser2, "1245ABCD", "pm"), 0500)
@@ -267,8 +268,8 @@ func (s *GenericServerSuite) Test_fileStorage_numberStored_returns0WhenItCantRea
 	os.Mkdir(testDir, 0700)
 	defer os.RemoveAll(testDir)
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
 	os.MkdirAll(path.Join(testDir, prefixHexForUser2, hexForUser2, "1245ABCD"), 0700)
 	res := fs.numberStored("someone@example.org", 0x1245ABCD)
@@ -279,10 +280,10 @@ func (s *GenericServerSuite) Test_fileStorage_retrieveFor_returnsEmptyForNonExis
 	os.Mkdir(testDir, 0700)
 	defer os.RemoveAll(testDir)
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
-	res := fs.retrieveFor("someone@example.org")
+	res := retrieved(fs.retrieveFor("someone@example.org", nil))
 	c.Assert(res, HasLen, 0)
 }
 
@@ -290,12 +291,12 @@ func (s *GenericServerSuite) Test_fileStorage_retrieveFor_returnsEmptyIfItCantRe
 	os.Mkdir(testDir, 0700)
 	defer os.RemoveAll(testDir)
 
-	fsf, _ := createFileStorageFactoryFrom("dir:" + testDir)
-	fs := fsf.createStorage()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	fs, _ := fsf.createStorage()
 
 	os.Mkdir(path.Join(testDir, prefixHexForUser2), 0700)
 	os.Mkdir(path.Join(testDir, prefixHexForUser2, hexForUser2), 0000)
-	res := fs.retrieveFor("someone@example.org")
+	res, _ := fs.retrieveFor("someone@example.org", nil)
 	c.Assert(res, HasLen, 0)
 }
 
@@ -319,7 +320,7 @@ func (s *GenericServerSuite) Test_fileStorage_cleanupClientProfile_returnsErrorI
 
 	ioutil.WriteFile(path.Join(testDir, "cp.bin"), []byte{}, 0200)
 
-	c.Assert(cleanupClientProfile(testDir), ErrorMatches, "open __dir_for_tests/cp.bin: permission denied")
+	c.Assert(cleanupClientProfile(testDir, time.Now()), ErrorMatches, "open __dir_for_tests/cp.bin: permission denied")
 }
 
 func (s *GenericServerSuite) Test_fileStorage_cleanupPrekeyProfile_returnsErrorIfItCantReadTheFile(c *C) {
@@ -328,5 +329,32 @@ func (s *GenericServerSuite) Test_fileStorage_cleanupPrekeyProfile_returnsErrorI
 
 	ioutil.WriteFile(path.Join(testDir, "pp.bin"), []byte{}, 0200)
 
-	c.Assert(cleanupPrekeyProfile(testDir), ErrorMatches, "open __dir_for_tests/pp.bin: permission denied")
+	c.Assert(cleanupPrekeyProfile(testDir, time.Now()), ErrorMatches, "open __dir_for_tests/pp.bin: permission denied")
+}
+
+func (s *GenericServerSuite) Test_fileStorage_withContext_givesUpWaitingForALockedUser(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	gs := &GenericServer{
+		rand: fixtureRand(),
+	}
+
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	userDir := path.Join(testDir, prefixHexForUser2, hexForUser2)
+	os.MkdirAll(userDir, 0700)
+	t1 := lockDir(userDir)
+	defer unlockDir(userDir, t1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st, _ := fsf.createStorage()
+	fs := st.(contextStorage).withContext(ctx)
+
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	c.Assert(fs.storePrekeyMessages("someone@example.org", []*prekeyMessage{pm1}), Equals, context.Canceled)
+	c.Assert(fs.numberStored("someone@example.org", sita.instanceTag), Equals, uint32(0))
+	pes, e := fs.retrieveFor("someone@example.org", nil)
+	c.Assert(e, Equals, context.Canceled)
+	c.Assert(pes, HasLen, 0)
 }
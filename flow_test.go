@@ -1,6 +1,7 @@
 package prekeyserver
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -75,7 +76,7 @@ func (s *GenericServerSuite) Test_flow_CheckStorageNumber(c *C) {
 
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k)
 
-	r, e := mh.handleMessage("sita@example.org", d1.serialize())
+	r, e := mh.handleMessage(context.Background(), "sita@example.org", d1.serialize())
 
 	c.Assert(e, IsNil)
 
@@ -179,7 +180,7 @@ func (s *GenericServerSuite) Test_flow_CheckStorageNumber(c *C) {
 
 	d3 := generateDake3(sita.instanceTag, sigma, msg.serialize())
 
-	r, e = mh.handleMessage("sita@example.org", d3.serialize())
+	r, e = mh.handleMessage(context.Background(), "sita@example.org", d3.serialize())
 
 	c.Assert(e, IsNil)
 
@@ -219,7 +220,7 @@ func (s *GenericServerSuite) Test_flow_retrieveEnsemblesFromUnknownPerson(c *C)
 	}
 	mh := &otrngMessageHandler{s: gs}
 
-	r, e := mh.handleMessage("rama@example.org", retM.serialize())
+	r, e := mh.handleMessage(context.Background(), "rama@example.org", retM.serialize())
 	c.Assert(e, IsNil)
 
 	rm := &noPrekeyEnsemblesMessage{}
@@ -237,6 +238,7 @@ func (s *GenericServerSuite) Test_flow_invalidUserProfileInDAKE1(c *C) {
 		rand:        fixtureRand(),
 		key:         serverKey,
 		fingerprint: serverKey.pub.fingerprint(),
+		sessions:    newSessionManager(),
 		rest:        nullRestrictor,
 	}
 	mh := &otrngMessageHandler{s: gs}
@@ -246,10 +248,10 @@ func (s *GenericServerSuite) Test_flow_invalidUserProfileInDAKE1(c *C) {
 
 	d1 := generateDake1(sita.instanceTag, badcp, sita.i.pub.k)
 
-	_, e := mh.handleMessage("sita@example.org", d1.serialize())
+	_, e := mh.handleMessage(context.Background(), "sita@example.org", d1.serialize())
 
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid client profile"))
+	c.Assert(e, ErrorMatches, "invalid client profile: invalid instance tag in client profile")
 }
 
 func (s *GenericServerSuite) Test_flow_invalidPointI(c *C) {
@@ -259,6 +261,7 @@ func (s *GenericServerSuite) Test_flow_invalidPointI(c *C) {
 		rand:        fixtureRand(),
 		key:         serverKey,
 		fingerprint: serverKey.pub.fingerprint(),
+		sessions:    newSessionManager(),
 		rest:        nullRestrictor,
 	}
 	mh := &otrngMessageHandler{s: gs}
@@ -267,10 +270,10 @@ func (s *GenericServerSuite) Test_flow_invalidPointI(c *C) {
 	badi := ed448.NewPoint([16]uint32{0x00}, [16]uint32{0x01}, [16]uint32{0x01}, [16]uint32{0x00})
 	d1 := generateDake1(sita.instanceTag, badcp, badi)
 
-	_, e := mh.handleMessage("sita@example.org", d1.serialize())
+	_, e := mh.handleMessage(context.Background(), "sita@example.org", d1.serialize())
 
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid point I"))
+	c.Assert(e, ErrorMatches, "invalid point I")
 }
 
 func (s *GenericServerSuite) Test_flow_invalidDAKE3(c *C) {
@@ -287,7 +290,7 @@ func (s *GenericServerSuite) Test_flow_invalidDAKE3(c *C) {
 
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k)
 
-	r, e := mh.handleMessage("sita@example.org", d1.serialize())
+	r, e := mh.handleMessage(context.Background(), "sita@example.org", d1.serialize())
 
 	c.Assert(e, IsNil)
 
@@ -312,7 +315,7 @@ func (s *GenericServerSuite) Test_flow_invalidDAKE3(c *C) {
 	msg := generateStorageInformationRequestMessage(sitaPrekeyMac)
 
 	d3 := generateDake3(0xBADBADBA, sigma, msg.serialize())
-	r, e = mh.handleMessage("sita@example.org", d3.serialize())
+	r, e = mh.handleMessage(context.Background(), "sita@example.org", d3.serialize())
 
 	c.Assert(e, Not(IsNil))
 }
@@ -332,7 +335,7 @@ func (s *GenericServerSuite) Test_flow_invalidMACused(c *C) {
 
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k)
 
-	r, e := mh.handleMessage("sita@example.org", d1.serialize())
+	r, e := mh.handleMessage(context.Background(), "sita@example.org", d1.serialize())
 
 	c.Assert(e, IsNil)
 
@@ -353,15 +356,24 @@ func (s *GenericServerSuite) Test_flow_invalidMACused(c *C) {
 	sigma, _ := generateSignature(gs, sita.longTerm.priv, sita.longTerm.pub, sita.longTerm.pub, gs.key.pub, &publicKey{k: d2.s}, t)
 
 	sk := kdfx(usageSK, skLength, serializePoint(ed448.PointScalarMul(d2.s, sita.i.priv.k)))
+	sitaPrekeyMacK := kdfx(usagePreMACKey, 64, sk)
 	sitaBadPrekeyMacK := kdfx(usagePreMACKey, 64, sk)
 	sitaBadPrekeyMacK[0] = 0xBA
 	sitaBadPrekeyMacK[1] = 0xDB
 	msg := generateStorageInformationRequestMessage(sitaBadPrekeyMacK)
 
 	d3 := generateDake3(sita.instanceTag, sigma, msg.serialize())
-	r, e = mh.handleMessage("sita@example.org", d3.serialize())
+	r, e = mh.handleMessage(context.Background(), "sita@example.org", d3.serialize())
 
-	c.Assert(e, Not(IsNil))
+	c.Assert(e, ErrorMatches, "message inside of DAKE3 was rejected: incorrect MAC")
+	c.Assert(errors.Is(e, ErrAuthentication), Equals, true)
+
+	fm := &failureMessage{}
+	_, ok = fm.deserialize(r)
+	c.Assert(ok, Equals, true)
+	c.Assert(fm.instanceTag, Equals, sita.instanceTag)
+	c.Assert(fm.mac[:], DeepEquals, generateFailureMessage(sitaPrekeyMacK, sita.instanceTag).mac[:])
+	c.Assert(gs.sessions.has("sita@example.org"), Equals, false)
 }
 
 func (s *GenericServerSuite) Test_flow_publication(c *C) {
@@ -381,7 +393,7 @@ func (s *GenericServerSuite) Test_flow_publication(c *C) {
 
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k)
 
-	r, e := mh.handleMessage("sita@example.org", d1.serialize())
+	r, e := mh.handleMessage(context.Background(), "sita@example.org", d1.serialize())
 
 	c.Assert(e, IsNil)
 
@@ -412,7 +424,7 @@ func (s *GenericServerSuite) Test_flow_publication(c *C) {
 
 	d3 := generateDake3(sita.instanceTag, sigma, msg.serialize())
 
-	r, e = mh.handleMessage("sita@example.org", d3.serialize())
+	r, e = mh.handleMessage(context.Background(), "sita@example.org", d3.serialize())
 
 	c.Assert(e, IsNil)
 
@@ -463,10 +475,10 @@ func (s *GenericServerSuite) Test_flow_retrieveEnsemblesFromKnownPerson(c *C) {
 	retM := &ensembleRetrievalQueryMessage{
 		instanceTag: 0x5555DDDD,
 		identity:    "sita@example.org",
-		versions:    []byte{0x04},
+		versions:    []byte{'4'},
 	}
 
-	r, e := mh.handleMessage("rama@example.org", retM.serialize())
+	r, e := mh.handleMessage(context.Background(), "rama@example.org", retM.serialize())
 	c.Assert(e, IsNil)
 
 	rm := &ensembleRetrievalMessage{}
@@ -478,3 +490,111 @@ func (s *GenericServerSuite) Test_flow_retrieveEnsemblesFromKnownPerson(c *C) {
 	c.Assert(stor.perUser["sita@example.org"].prekeyMessages[0x1245ABCD], HasLen, 1)
 	c.Assert(stor.perUser["sita@example.org"].prekeyMessages[0x1245ABCD][0].Equals(pm2), Equals, true)
 }
+
+func (s *GenericServerSuite) Test_flow_retrieveEnsemblesForUnsupportedVersions(c *C) {
+	serverKey := deriveKeypair([symKeyLength]byte{0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25})
+	stor := createInMemoryStorage()
+
+	gs := &GenericServer{
+		identity:    "masterOfKeys.example.org",
+		rand:        fixtureRand(),
+		key:         serverKey,
+		fingerprint: serverKey.pub.fingerprint(),
+		storageImpl: stor,
+	}
+	mh := &otrngMessageHandler{s: gs}
+
+	stor.storeClientProfile("sita@example.org", sita.clientProfile)
+	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	stor.storePrekeyProfile("sita@example.org", pp1)
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	stor.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm1})
+
+	retM := &ensembleRetrievalQueryMessage{
+		instanceTag: 0x5555DDDD,
+		identity:    "sita@example.org",
+		versions:    []byte{'5'},
+	}
+
+	r, e := mh.handleMessage(context.Background(), "rama@example.org", retM.serialize())
+	c.Assert(e, IsNil)
+
+	rm := &noPrekeyEnsemblesMessage{}
+	_, ok := rm.deserialize(r)
+
+	c.Assert(ok, Equals, true)
+	c.Assert(rm.instanceTag, Equals, uint32(0x5555DDDD))
+	c.Assert(stor.perUser["sita@example.org"].prekeyMessages[sita.instanceTag], HasLen, 1)
+}
+
+func (s *GenericServerSuite) Test_flow_DAKE3WithoutDAKE1IsRejected(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+	d3, _ := in.StorageInformationDAKE3()
+
+	other := testServerForInitiator()
+	_, e := other.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, ErrorMatches, "unexpected DAKE3 message, session is awaiting DAKE1")
+	c.Assert(other.hasSession("sita@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_flow_replayedDAKE3IsRejected(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+	d3, _ := in.StorageInformationDAKE3()
+
+	_, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, IsNil)
+	c.Assert(gs.hasSession("sita@example.org"), Equals, false)
+
+	_, e = gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, ErrorMatches, "unexpected DAKE3 message, session is awaiting DAKE1")
+}
+
+func (s *GenericServerSuite) Test_flow_DAKE1CanRestartADAKEInProgress(c *C) {
+	gs := testServerForInitiator()
+	first := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	_, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", first.DAKE1())
+	c.Assert(e, IsNil)
+
+	second := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	d2, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", second.DAKE1())
+	c.Assert(e, IsNil)
+	c.Assert(second.ReceiveDAKE2(d2), IsNil)
+
+	d3, _ := second.StorageInformationDAKE3()
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, IsNil)
+	_, e = second.ReceiveStorageStatus(res)
+	c.Assert(e, IsNil)
+}
+
+func (s *GenericServerSuite) Test_flow_publicationOutsideOfDAKE3IsRejected(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pub := generatePublicationMessage(sita.clientProfile, nil, []*prekeyMessage{pm}, make([]byte, 64))
+
+	_, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", pub.serialize())
+	c.Assert(e, ErrorMatches, "publication message is only allowed inside of a DAKE3")
+
+	_, e = gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(e, IsNil)
+
+	_, e = gs.messageHandler.handleMessage(context.Background(), "sita@example.org", pub.serialize())
+	c.Assert(e, ErrorMatches, "publication message is only allowed inside of a DAKE3")
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(0))
+}
+
+func (s *GenericServerSuite) Test_flow_storageInformationRequestOutsideOfDAKE3IsRejected(c *C) {
+	gs := testServerForInitiator()
+
+	_, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", (&storageInformationRequestMessage{}).serialize())
+	c.Assert(e, ErrorMatches, "storage information request is only allowed inside of a DAKE3")
+	c.Assert(gs.hasSession("sita@example.org"), Equals, false)
+}
@@ -1,12 +1,13 @@
 package prekeyserver
 
 import (
+	"container/list"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,40 +17,222 @@ import (
 // I don't think it's worth the trouble and complexity to implement it
 
 type fragmentationContext struct {
-	pieces      []string
-	have        []bool
+	id          string
+	from        string
 	total       uint16
 	count       uint16
+	size        int
 	lastTouched time.Time
+	el          *list.Element
+	// used is the tick of the last time a fragment of the message was received
+	used int64
+	// pieces has the pieces received so far by their index. It only grows as
+	// they arrive, since the total is chosen by the sender.
+	pieces map[uint16]string
 }
 
+// fragmentations keeps the incomplete messages of a server. They are spread
+// over shards by sender, and each shard has its own lock, so all contexts of one
+// sender are in the same shard. The limit for buffered bytes is kept for all
+// shards together. As long as it isn't reached, a fragment only needs the lock
+// of its own shard. When it is reached, the locks of all shards are taken, so
+// the least recently touched context of any shard can be evicted.
 type fragmentations struct {
+	shards []*fragmentShard
+	// buffered is the number of bytes in all pieces kept
+	buffered int64
+	// ticks orders the fragments received across all shards
+	ticks  int64
+	limits fragmentLimits
+	// evicted is told about every context that is evicted to make room, and why
+	evicted func(limit string)
+	clock   Clock
+}
+
+type fragmentShard struct {
 	contexts map[string]*fragmentationContext
-	// For now we will have one big mutex for all contexts
-	// This should be fine for large amounts of traffic
-	// since each fragmentation process is very very fast
+	// lru has all contexts of the shard, the most recently touched first
+	lru       *list.List
+	perSender map[string]int
 	sync.Mutex
 }
 
+// fragmentLimits keeps incomplete messages from using up too much memory. A
+// limit of zero means there is no limit.
+type fragmentLimits struct {
+	maxFragments int
+	maxPerSender int
+	maxBuffered  int
+	maxLength    int
+}
+
+// The names of the fragment limits, as used in FragmentLimitError and the metrics
+const (
+	limitFragmentsPerMessage = "fragments per message"
+	limitContextsPerSender   = "incomplete messages per sender"
+	limitBufferedBytes       = "buffered bytes"
+	limitReassembledLength   = "reassembled length"
+)
+
+// FragmentLimitError is returned for a fragment that goes over one of the limits
+// for fragmented messages. The incomplete message it belongs to is thrown away.
+// Every FragmentLimitError matches both ErrFragment and ErrFragmentLimit.
+type FragmentLimitError struct {
+	// Limit is the name of the limit, for example "fragments per message"
+	Limit string
+	// Max is the value of the limit
+	Max int
+}
+
+func (e *FragmentLimitError) Error() string {
+	return fmt.Sprintf("fragment goes over the limit of %d %s", e.Max, e.Limit)
+}
+
+// Is makes every FragmentLimitError match ErrFragment and ErrFragmentLimit
+func (e *FragmentLimitError) Is(target error) bool {
+	return target == ErrFragment || target == ErrFragmentLimit
+}
+
 func newFragmentations() *fragmentations {
-	return &fragmentations{
-		contexts: make(map[string]*fragmentationContext),
+	return newShardedFragmentations(registryShards)
+}
+
+func newShardedFragmentations(shards int) *fragmentations {
+	f := &fragmentations{shards: make([]*fragmentShard, shards)}
+	for ix := range f.shards {
+		f.shards[ix] = &fragmentShard{
+			contexts:  make(map[string]*fragmentationContext),
+			lru:       list.New(),
+			perSender: make(map[string]int),
+		}
+	}
+	return f
+}
+
+func (f *fragmentations) shardFor(from string) *fragmentShard {
+	return f.shards[shardIndex(from, len(f.shards))]
+}
+
+// context returns the context with the given id of the sender, or nil
+func (f *fragmentations) context(from, id string) *fragmentationContext {
+	sh := f.shardFor(from)
+	sh.Lock()
+	defer sh.Unlock()
+
+	return sh.contexts[id]
+}
+
+// count returns how many incomplete messages there are
+func (f *fragmentations) count() int {
+	res := 0
+	for _, sh := range f.shards {
+		sh.Lock()
+		res += len(sh.contexts)
+		sh.Unlock()
+	}
+	return res
+}
+
+func (f *fragmentations) bufferedBytes() int {
+	return int(atomic.LoadInt64(&f.buffered))
+}
+
+func (fc *fragmentationContext) hasExpired(timeout time.Duration, now time.Time) bool {
+	return fc.lastTouched.Add(timeout).Before(now)
+}
+
+// cleanup removes the fragments of messages that haven't been completed in
+// time, and returns how many messages there were. The shards are cleaned up
+// one at a time.
+func (f *fragmentations) cleanup(timeout time.Duration) int {
+	now := nowFrom(f.clock)
+	removed := 0
+	for _, sh := range f.shards {
+		removed += f.cleanupShard(sh, timeout, now)
+	}
+	return removed
+}
+
+func (f *fragmentations) cleanupShard(sh *fragmentShard, timeout time.Duration, now time.Time) int {
+	sh.Lock()
+	defer sh.Unlock()
+
+	toRemove := []*fragmentationContext{}
+	for _, fc := range sh.contexts {
+		if fc.hasExpired(timeout, now) {
+			toRemove = append(toRemove, fc)
+		}
 	}
+	for _, fc := range toRemove {
+		f.remove(sh, fc)
+	}
+	return len(toRemove)
 }
 
-func (fc *fragmentationContext) hasExpired(timeout time.Duration) bool {
-	return fc.lastTouched.Add(timeout).Before(time.Now())
+// clear throws away the fragments of all incomplete messages
+func (f *fragmentations) clear() {
+	for _, sh := range f.shards {
+		sh.Lock()
+		for _, fc := range sh.contexts {
+			f.remove(sh, fc)
+		}
+		sh.Unlock()
+	}
 }
 
-func (f *fragmentations) cleanup(timeout time.Duration) {
-	toRemove := []string{}
-	for nm, fc := range f.contexts {
-		if fc.hasExpired(timeout) {
-			toRemove = append(toRemove, nm)
+// remove takes the context out of the shard, and stops counting its bytes.
+// Expects the shard lock to be held.
+func (f *fragmentations) remove(sh *fragmentShard, fc *fragmentationContext) {
+	if _, ok := sh.contexts[fc.id]; !ok {
+		return
+	}
+	delete(sh.contexts, fc.id)
+	sh.lru.Remove(fc.el)
+	atomic.AddInt64(&f.buffered, -int64(fc.size))
+	if sh.perSender[fc.from]--; sh.perSender[fc.from] == 0 {
+		delete(sh.perSender, fc.from)
+	}
+}
+
+// evictOldest removes the least recently touched context of the given shards
+// that matches, except for keep. It returns false if there is no such context.
+// Expects the locks of the shards to be held.
+func (f *fragmentations) evictOldest(shards []*fragmentShard, matches func(*fragmentationContext) bool, keep *fragmentationContext, limit string) bool {
+	var oldest *fragmentationContext
+	var oldestShard *fragmentShard
+	for _, sh := range shards {
+		// The first match from the back is the least recently touched one of the shard
+		for el := sh.lru.Back(); el != nil; el = el.Prev() {
+			fc := el.Value.(*fragmentationContext)
+			if fc == keep || !matches(fc) {
+				continue
+			}
+			if oldest == nil || fc.used < oldest.used {
+				oldest, oldestShard = fc, sh
+			}
+			break
 		}
 	}
-	for _, nm := range toRemove {
-		delete(f.contexts, nm)
+	if oldest == nil {
+		return false
+	}
+
+	f.remove(oldestShard, oldest)
+	if f.evicted != nil {
+		f.evicted(limit)
+	}
+	return true
+}
+
+func (f *fragmentations) lockAll() {
+	for _, sh := range f.shards {
+		sh.Lock()
+	}
+}
+
+func (f *fragmentations) unlockAll() {
+	for ix := len(f.shards) - 1; ix >= 0; ix-- {
+		f.shards[ix].Unlock()
 	}
 }
 
@@ -78,15 +261,61 @@ func parseUint16(s string) (uint16, bool) {
 	return 0, false
 }
 
-func (f *fragmentations) getOrCreate(ctx string, tot uint16) *fragmentationContext {
-	fc, ok := f.contexts[ctx]
+// getOrCreate returns the context for the message, and creates it if it doesn't
+// exist. If the sender already has as many incomplete messages as allowed, the
+// one touched least recently is evicted to make room.
+// Expects the shard lock to be held.
+func (f *fragmentations) getOrCreate(sh *fragmentShard, from, ctx string, tot uint16) *fragmentationContext {
+	fc, ok := sh.contexts[ctx]
 	if !ok {
+		if max := f.limits.maxPerSender; max > 0 && sh.perSender[from] >= max {
+			f.evictOldest([]*fragmentShard{sh}, func(o *fragmentationContext) bool { return o.from == from }, nil, limitContextsPerSender)
+		}
 		fc = newFragmentationContext(tot)
-		f.contexts[ctx] = fc
+		fc.id = ctx
+		fc.from = from
+		fc.el = sh.lru.PushFront(fc)
+		sh.contexts[ctx] = fc
+		sh.perSender[from]++
 	}
 	return fc
 }
 
+// errNeedsAllShards is returned by reserve when the limit for buffered bytes has
+// been reached, but it can't evict, since it only has the lock of one shard
+var errNeedsAllShards = newError(ErrFragment, "needs the locks of all shards")
+
+// reserve counts the bytes of a piece that is about to be added to the context.
+// If evict is true, other incomplete messages are evicted, least recently
+// touched first, to keep under the limit for buffered bytes. Otherwise
+// errNeedsAllShards is returned when the limit is reached. If the piece can't
+// fit, the context is thrown away and a *FragmentLimitError is returned.
+// Expects the shard lock to be held, and the locks of all shards if evict is true.
+func (f *fragmentations) reserve(sh *fragmentShard, fc *fragmentationContext, size int, evict bool) error {
+	if max := f.limits.maxLength; max > 0 && fc.size+size > max {
+		f.remove(sh, fc)
+		return &FragmentLimitError{Limit: limitReassembledLength, Max: max}
+	}
+	max := int64(f.limits.maxBuffered)
+	all := func(*fragmentationContext) bool { return true }
+	for {
+		cur := atomic.LoadInt64(&f.buffered)
+		if max <= 0 || cur+int64(size) <= max {
+			if atomic.CompareAndSwapInt64(&f.buffered, cur, cur+int64(size)) {
+				return nil
+			}
+			continue
+		}
+		if int64(fc.size+size) <= max && !evict {
+			return errNeedsAllShards
+		}
+		if int64(fc.size+size) > max || !f.evictOldest(f.shards, all, fc, limitBufferedBytes) {
+			f.remove(sh, fc)
+			return &FragmentLimitError{Limit: limitBufferedBytes, Max: int(max)}
+		}
+	}
+}
+
 // newFragmentReceived receives a fragment, including the fragment prefix
 // it will add the received information to the fragmentation context
 // if the received fragment completes a message, it will be returned and the previous pieces will be removed
@@ -94,11 +323,11 @@ func (f *fragmentations) newFragmentReceived(from, frag string) (string, bool, e
 	frag = frag[len(fragmentationPrefix) : len(frag)-1]
 	fragOne := strings.SplitN(frag, "|", 3)
 	if len(fragOne) < 3 {
-		return "", false, errors.New("invalid fragmentation parse")
+		return "", false, newError(ErrFragment, "invalid fragmentation parse")
 	}
 	fragTwo := strings.SplitN(fragOne[2], ",", 4)
 	if len(fragTwo) < 4 {
-		return "", false, errors.New("invalid fragmentation parse")
+		return "", false, newError(ErrFragment, "invalid fragmentation parse")
 	}
 
 	id, ok1 := parseUint32(fragOne[0])
@@ -108,24 +337,51 @@ func (f *fragmentations) newFragmentReceived(from, frag string) (string, bool, e
 	tot, ok5 := parseUint16(fragTwo[2])
 
 	if !(ok1 && ok2 && ok3 && ok4 && ok5 && ix > 0 && tot > 0 && ix <= tot) {
-		return "", false, errors.New("invalid fragmentation parse")
+		return "", false, newError(ErrFragment, "invalid fragmentation parse")
+	}
+
+	if max := f.limits.maxFragments; max > 0 && int(tot) > max {
+		return "", false, &FragmentLimitError{Limit: limitFragmentsPerMessage, Max: max}
 	}
 
 	ctxID := fmt.Sprintf("%s/%d", from, id)
-	f.Lock()
-	defer f.Unlock()
-	fc := f.getOrCreate(ctxID, tot)
+	piece := fragTwo[3]
+	sh := f.shardFor(from)
+	sh.Lock()
+	res, done, e := f.receive(sh, from, ctxID, ix, tot, piece, false)
+	sh.Unlock()
+	if e != errNeedsAllShards {
+		return res, done, e
+	}
+
+	f.lockAll()
+	defer f.unlockAll()
+	return f.receive(sh, from, ctxID, ix, tot, piece, true)
+}
+
+// receive adds the piece to the context of the message. If evict is true,
+// other incomplete messages can be evicted to make room for it.
+// Expects the shard lock to be held, and the locks of all shards if evict is true.
+func (f *fragmentations) receive(sh *fragmentShard, from, ctxID string, ix, tot uint16, piece string, evict bool) (string, bool, error) {
+	fc := f.getOrCreate(sh, from, ctxID, tot)
 
 	if fc.total != tot {
-		return "", false, errors.New("inconsistent total")
+		return "", false, newError(ErrFragment, "inconsistent total")
 	}
 
-	fc.lastTouched = time.Now()
+	fc.lastTouched = nowFrom(f.clock)
+	fc.used = atomic.AddInt64(&f.ticks, 1)
+	sh.lru.MoveToFront(fc.el)
 
-	fc.add(ix, fragTwo[3])
+	if !fc.has(ix) {
+		if e := f.reserve(sh, fc, len(piece), evict); e != nil {
+			return "", false, e
+		}
+		fc.add(ix, piece)
+	}
 	if fc.done() {
 		complete := fc.complete()
-		delete(f.contexts, ctxID)
+		f.remove(sh, fc)
 		return complete, true, nil
 	}
 	return "", false, nil
@@ -133,17 +389,21 @@ func (f *fragmentations) newFragmentReceived(from, frag string) (string, bool, e
 
 func newFragmentationContext(total uint16) *fragmentationContext {
 	return &fragmentationContext{
-		pieces: make([]string, total),
-		have:   make([]bool, total),
+		pieces: make(map[uint16]string),
 		total:  total,
 	}
 }
 
+func (fc *fragmentationContext) has(ix uint16) bool {
+	_, ok := fc.pieces[ix]
+	return ok
+}
+
 func (fc *fragmentationContext) add(ix uint16, piece string) {
-	if !fc.have[ix-1] {
-		fc.have[ix-1] = true
-		fc.pieces[ix-1] = piece
+	if !fc.has(ix) {
+		fc.pieces[ix] = piece
 		fc.count++
+		fc.size += len(piece)
 	}
 }
 
@@ -152,7 +412,12 @@ func (fc *fragmentationContext) done() bool {
 }
 
 func (fc *fragmentationContext) complete() string {
-	return strings.Join(fc.pieces, "")
+	var b strings.Builder
+	b.Grow(fc.size)
+	for ix := 1; ix <= int(fc.total); ix++ {
+		b.WriteString(fc.pieces[uint16(ix)])
+	}
+	return b.String()
 }
 
 func generateRandomID(r WithRandom) uint32 {
@@ -2,6 +2,8 @@ package prekeyserver
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -95,26 +97,26 @@ func (s *GenericServerSuite) Test_newFragmentReceived_ErrorsOnInvalidIndices(c *
 	f := newFragmentations()
 	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,0,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,-42,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,3,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 }
 
 func (s *GenericServerSuite) Test_newFragmentReceived_ErrorsOnInvalidTotals(c *C) {
 	f := newFragmentations()
 	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,-2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,0,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 }
 
 func (s *GenericServerSuite) Test_newFragmentReceived_ErrorsOnInconsistentTotals(c *C) {
@@ -123,62 +125,62 @@ func (s *GenericServerSuite) Test_newFragmentReceived_ErrorsOnInconsistentTotals
 	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,2,4,hello,")
 
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("inconsistent total"))
+	c.Assert(e, ErrorMatches, "inconsistent total")
 }
 
 func (s *GenericServerSuite) Test_newFragmentReceived_ErrorsOnImpossibleParsing(c *C) {
 	f := newFragmentations()
 	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2f,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,f1,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEFBEEFBEEF,1,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEFS,1,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEADB|BEEF,1,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAS|BEEF,1,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|-45243|AF1FDEAS|BEEF,1,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|5A43|AF1FDEAS|BEEF,1,2,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|5143|AF1FDEAS|BEEF,1,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|5143|AF1FDEAS|BEEF,hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|5143|AF1FDEAS|hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|5143|hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 
 	_, _, e = f.newFragmentReceived("me@example.org", "?OTRP|hello,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 }
 
 func (s *GenericServerSuite) Test_potentiallyFragment_fragmentsCorrectly(c *C) {
@@ -206,19 +208,146 @@ func (s *GenericServerSuite) Test_fragmentations_cleanup_removesOldContexts(c *C
 	f.newFragmentReceived("another@example.org", "?OTRP|12345|AF1FDEAD|BEEF,1,2,hello,")
 	f.newFragmentReceived("me@example.org", "?OTRP|45244|AF1FDEAD|BEEF,1,2,hello,")
 
-	f.contexts["me@example.org/45243"].lastTouched = time.Now().Add(time.Duration(-11) * time.Minute)
-	f.contexts["another@example.org/12345"].lastTouched = time.Now().Add(time.Duration(-7) * time.Minute)
-	f.contexts["me@example.org/45244"].lastTouched = time.Now().Add(time.Duration(-4) * time.Minute)
+	f.context("me@example.org", "me@example.org/45243").lastTouched = time.Now().Add(time.Duration(-11) * time.Minute)
+	f.context("another@example.org", "another@example.org/12345").lastTouched = time.Now().Add(time.Duration(-7) * time.Minute)
+	f.context("me@example.org", "me@example.org/45244").lastTouched = time.Now().Add(time.Duration(-4) * time.Minute)
 
 	f.cleanup(time.Duration(6) * time.Minute)
 
-	c.Assert(f.contexts, HasLen, 1)
-	c.Assert(f.contexts["me@example.org/45244"], Not(IsNil))
+	c.Assert(f.count(), Equals, 1)
+	c.Assert(f.context("me@example.org", "me@example.org/45244"), Not(IsNil))
 }
 
 func (s *GenericServerSuite) Test_fragmentations_newFragmentReceived_willUpdateLastTouched(c *C) {
 	f := newFragmentations()
 	bef := time.Now()
 	f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,hello,")
-	c.Assert(f.contexts["me@example.org/45243"].lastTouched.After(bef), Equals, true)
+	c.Assert(f.context("me@example.org", "me@example.org/45243").lastTouched.After(bef), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_rejectsMessagesWithTooManyFragments(c *C) {
+	f := newFragmentations()
+	f.limits.maxFragments = 3
+
+	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,65535,hello,")
+
+	c.Assert(e, ErrorMatches, "fragment goes over the limit of 3 fragments per message")
+	var fle *FragmentLimitError
+	c.Assert(errors.As(e, &fle), Equals, true)
+	c.Assert(fle.Limit, Equals, limitFragmentsPerMessage)
+	c.Assert(errors.Is(e, ErrFragment), Equals, true)
+	c.Assert(errors.Is(e, ErrFragmentLimit), Equals, true)
+	c.Assert(f.count(), Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_onlyKeepsThePiecesThatHaveArrived(c *C) {
+	f := newFragmentations()
+
+	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,65535,65535,hello,")
+	c.Assert(e, IsNil)
+
+	sh := f.shardFor("me@example.org")
+	fc := sh.contexts["me@example.org/45243"]
+	c.Assert(fc.pieces, DeepEquals, map[uint16]string{65535: "hello"})
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_putsTogetherAMessageWithTheMostFragmentsPossible(c *C) {
+	f := newFragmentations()
+	for ix := 1; ix < 65535; ix++ {
+		_, done, e := f.newFragmentReceived("me@example.org", fmt.Sprintf("?OTRP|45243|AF1FDEAD|BEEF,%d,65535,a,", ix))
+		c.Assert(e, IsNil)
+		c.Assert(done, Equals, false)
+	}
+
+	res, done, e := f.newFragmentReceived("me@example.org", "?OTRP|45243|AF1FDEAD|BEEF,65535,65535,b,")
+	c.Assert(e, IsNil)
+	c.Assert(done, Equals, true)
+	c.Assert(res, Equals, strings.Repeat("a", 65534)+"b")
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_evictsTheOldestMessageOfASenderWithTooMany(c *C) {
+	f := newFragmentations()
+	f.limits.maxPerSender = 2
+	evicted := []string{}
+	f.evicted = func(limit string) { evicted = append(evicted, limit) }
+	f.newFragmentReceived("me@example.org", "?OTRP|1|AF1FDEAD|BEEF,1,2,one,")
+	f.newFragmentReceived("me@example.org", "?OTRP|2|AF1FDEAD|BEEF,1,2,two,")
+	f.newFragmentReceived("another@example.org", "?OTRP|3|AF1FDEAD|BEEF,1,2,three,")
+	f.newFragmentReceived("me@example.org", "?OTRP|1|AF1FDEAD|BEEF,1,2,one,")
+
+	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|4|AF1FDEAD|BEEF,1,2,four,")
+
+	c.Assert(e, IsNil)
+	c.Assert(evicted, DeepEquals, []string{limitContextsPerSender})
+	c.Assert(f.context("me@example.org", "me@example.org/2"), IsNil)
+	c.Assert(f.context("me@example.org", "me@example.org/1"), Not(IsNil))
+	c.Assert(f.context("another@example.org", "another@example.org/3"), Not(IsNil))
+	c.Assert(f.shardFor("me@example.org").perSender["me@example.org"], Equals, 2)
+	c.Assert(f.bufferedBytes(), Equals, len("one")+len("three")+len("four"))
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_evictsTheOldestMessagesToKeepUnderTheBufferedBytes(c *C) {
+	f := newFragmentations()
+	f.limits.maxBuffered = 10
+	f.newFragmentReceived("one@example.org", "?OTRP|1|AF1FDEAD|BEEF,1,2,1234,")
+	f.newFragmentReceived("two@example.org", "?OTRP|2|AF1FDEAD|BEEF,1,2,1234,")
+
+	_, _, e := f.newFragmentReceived("three@example.org", "?OTRP|3|AF1FDEAD|BEEF,1,2,123456,")
+
+	c.Assert(e, IsNil)
+	c.Assert(f.count(), Equals, 2)
+	c.Assert(f.context("one@example.org", "one@example.org/1"), IsNil)
+	c.Assert(f.bufferedBytes(), Equals, 10)
+
+	_, _, e = f.newFragmentReceived("three@example.org", "?OTRP|3|AF1FDEAD|BEEF,2,2,12345,")
+
+	c.Assert(e, ErrorMatches, "fragment goes over the limit of 10 buffered bytes")
+	c.Assert(errors.Is(e, ErrFragmentLimit), Equals, true)
+	c.Assert(f.count(), Equals, 1)
+	c.Assert(f.context("two@example.org", "two@example.org/2"), Not(IsNil))
+	c.Assert(f.bufferedBytes(), Equals, 4)
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_evictsFromAnotherShardToKeepUnderTheBufferedBytes(c *C) {
+	f := newFragmentations()
+	f.limits.maxBuffered = 10
+	first := sendersInShard(0, 1, "example.org")[0]
+	second := sendersInShard(1, 1, "example.org")[0]
+	f.newFragmentReceived(first, "?OTRP|1|AF1FDEAD|BEEF,1,2,12345678,")
+
+	_, _, e := f.newFragmentReceived(second, "?OTRP|2|AF1FDEAD|BEEF,1,2,12345,")
+
+	c.Assert(e, IsNil)
+	c.Assert(f.count(), Equals, 1)
+	c.Assert(f.context(first, first+"/1"), IsNil)
+	c.Assert(f.context(second, second+"/2"), Not(IsNil))
+	c.Assert(f.bufferedBytes(), Equals, 5)
+}
+
+func (s *GenericServerSuite) Test_newFragmentReceived_throwsAwayMessagesThatGetTooLong(c *C) {
+	f := newFragmentations()
+	f.limits.maxLength = 8
+	f.newFragmentReceived("me@example.org", "?OTRP|1|AF1FDEAD|BEEF,1,3,hello,")
+
+	_, _, e := f.newFragmentReceived("me@example.org", "?OTRP|1|AF1FDEAD|BEEF,2,3, world,")
+
+	c.Assert(e, ErrorMatches, "fragment goes over the limit of 8 reassembled length")
+	c.Assert(f.count(), Equals, 0)
+	c.Assert(f.shardFor("me@example.org").perSender, HasLen, 0)
+	c.Assert(f.bufferedBytes(), Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_fragmentations_keepTrackOfTheBufferedBytes(c *C) {
+	f := newFragmentations()
+	f.newFragmentReceived("me@example.org", "?OTRP|1|AF1FDEAD|BEEF,1,2,hello,")
+	f.newFragmentReceived("me@example.org", "?OTRP|1|AF1FDEAD|BEEF,1,2,hello,")
+	f.newFragmentReceived("me@example.org", "?OTRP|2|AF1FDEAD|BEEF,1,2,hi,")
+	c.Assert(f.bufferedBytes(), Equals, 7)
+
+	f.newFragmentReceived("me@example.org", "?OTRP|1|AF1FDEAD|BEEF,2,2, world,")
+	c.Assert(f.bufferedBytes(), Equals, 2)
+
+	f.clear()
+	c.Assert(f.bufferedBytes(), Equals, 0)
+	c.Assert(f.count(), Equals, 0)
 }
@@ -6,6 +6,23 @@ import (
 	"github.com/otrv4/ed448"
 )
 
+// retrieved returns the ensembles from a call to retrieveFor that isn't expected to fail
+func retrieved(pes []*prekeyEnsemble, e error) []*prekeyEnsemble {
+	if e != nil {
+		panic(e)
+	}
+	return pes
+}
+
+// testSession returns the session of the sender, and starts one if there is none
+func (g *GenericServer) testSession(from string) session {
+	sess, e := g.sessions.start(from)
+	if e != nil {
+		panic(e)
+	}
+	return sess
+}
+
 // bnFromHex is a test utility that doesn't take into account possible errors. Thus, make sure to only call it with valid hexadecimal strings (of even length)
 func bnFromHex(s string) *big.Int {
 	res, _ := new(big.Int).SetString(s, 16)
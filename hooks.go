@@ -0,0 +1,241 @@
+package prekeyserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Hooks lets the user of a server react to what happens on it, for example to
+// nudge a client to publish more prekey messages. The hooks are called from a
+// separate goroutine, one at a time, in the order the events happened. A hook
+// that is slow or panics never holds up the handling of messages - if too many
+// events are waiting, new ones are dropped. The prekey messages left are counted
+// just before a hook is called, so the count can include messages handled after
+// the event.
+type Hooks interface {
+	// Published is called after a publication has been stored
+	Published(PublicationEvent)
+	// Retrieved is called after prekey ensembles for an identity were handed out
+	Retrieved(RetrievalEvent)
+	// LowOnPrekeys is called when a retrieval makes the number of prekey
+	// messages left for an instance tag drop below LowPrekeyThreshold
+	LowOnPrekeys(LowPrekeysEvent)
+	// LowPrekeyThreshold returns the number of prekey messages an instance tag
+	// should at least have left. Zero turns off LowOnPrekeys. It is only
+	// called once, when the server is created.
+	LowPrekeyThreshold() uint32
+}
+
+// PublicationEvent describes a publication that was stored
+type PublicationEvent struct {
+	Identity    string
+	InstanceTag uint32
+	// Published is the number of prekey messages in the publication
+	Published int
+	// Remaining is the number of prekey messages stored for the instance tag
+	Remaining uint32
+}
+
+// RetrievalEvent describes the prekey ensembles handed out for an identity
+type RetrievalEvent struct {
+	Identity string
+	// Remaining maps the instance tag of every handed out ensemble to the
+	// number of prekey messages left for it
+	Remaining map[uint32]uint32
+}
+
+// LowPrekeysEvent describes an instance tag that is running out of prekey messages
+type LowPrekeysEvent struct {
+	Identity    string
+	InstanceTag uint32
+	Remaining   uint32
+}
+
+// hookQueueSize is the number of events that can wait for the hooks
+const hookQueueSize = 256
+
+// maxHookCounts is the number of instance tags the hooks remember the count of
+const maxHookCounts = 1 << 16
+
+// hookDispatcher calls the hooks of a server from its own goroutine. The
+// number of prekey messages left is counted in that goroutine too, so a slow
+// storage doesn't hold up the handling of messages either.
+type hookDispatcher struct {
+	h         Hooks
+	threshold uint32
+	events    chan func(Hooks)
+	failed    func(error)
+	// remaining is the last count seen for the instance tags the hooks have
+	// been told about, while it's at least the threshold. It is only used by
+	// the goroutine.
+	remaining map[prekeyKey]uint32
+	// quit is closed when the events still waiting should be dropped, and
+	// done when the goroutine has finished
+	quit chan struct{}
+	done chan struct{}
+	// stopped is set when stop has stopped waiting for the goroutine. After
+	// that, count doesn't use the storage anymore, since it's about to be
+	// closed. The lock is held while counting.
+	stopped bool
+	sync.Mutex
+}
+
+type prekeyKey struct {
+	identity    string
+	instanceTag uint32
+}
+
+func newHookDispatcher(h Hooks, failed func(error)) *hookDispatcher {
+	if h == nil {
+		return nil
+	}
+	d := &hookDispatcher{
+		h:         h,
+		threshold: h.LowPrekeyThreshold(),
+		events:    make(chan func(Hooks), hookQueueSize),
+		failed:    failed,
+		remaining: make(map[prekeyKey]uint32),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *hookDispatcher) run() {
+	defer close(d.done)
+	for f := range d.events {
+		select {
+		case <-d.quit:
+			continue
+		default:
+		}
+		d.call(f)
+	}
+}
+
+// stop lets the hooks work through the events that are waiting, until the
+// context is done. After that, the events still waiting are dropped, and a hook
+// that is running is left to finish on its own - but a count that is running is
+// waited for, and no more are made, so the storage can be closed once stop has
+// returned. No events can be dispatched after stop has been called.
+func (d *hookDispatcher) stop(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	close(d.events)
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		close(d.quit)
+		d.Lock()
+		d.stopped = true
+		d.Unlock()
+	}
+}
+
+func (d *hookDispatcher) call(f func(Hooks)) {
+	defer func() {
+		if x := recover(); x != nil {
+			d.failed(fmt.Errorf("hook panicked: %v", x))
+		}
+	}()
+	f(d.h)
+}
+
+// dispatch queues a call to the hooks, or drops it if the queue is full
+func (d *hookDispatcher) dispatch(f func(Hooks)) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.events <- f:
+	default:
+		d.failed(fmt.Errorf("hook queue is full, dropping event"))
+	}
+}
+
+// count returns the number of prekey messages left for the instance tag, and
+// whether that just dropped below the threshold, or false for ok if the
+// dispatcher has been stopped. A count that wasn't seen
+// before is taken to have been one higher, since a retrieval uses up one
+// prekey message per instance tag. Counts below the threshold are forgotten,
+// since they can only drop below it again after a publication, which is counted
+// too. When too many are remembered, an arbitrary one is forgotten to make
+// room. Only called from the goroutine.
+func (d *hookDispatcher) count(stor storage, k prekeyKey) (left uint32, crossed, ok bool) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopped {
+		return 0, false, false
+	}
+	left = stor.numberStored(k.identity, k.instanceTag)
+	if d.threshold == 0 {
+		return left, false, true
+	}
+	prev, seen := d.remaining[k]
+	if !seen {
+		prev = left + 1
+	}
+	if left < d.threshold {
+		delete(d.remaining, k)
+	} else {
+		d.remember(k, left)
+	}
+	return left, prev >= d.threshold && left < d.threshold, true
+}
+
+func (d *hookDispatcher) remember(k prekeyKey, left uint32) {
+	if _, ok := d.remaining[k]; !ok && len(d.remaining) >= maxHookCounts {
+		for other := range d.remaining {
+			delete(d.remaining, other)
+			break
+		}
+	}
+	d.remaining[k] = left
+}
+
+func (d *hookDispatcher) published(stor storage, identity string, instanceTag uint32, published int) {
+	d.dispatch(func(h Hooks) {
+		left, _, ok := d.count(stor, prekeyKey{identity, instanceTag})
+		if !ok {
+			return
+		}
+		h.Published(PublicationEvent{
+			Identity:    identity,
+			InstanceTag: instanceTag,
+			Published:   published,
+			Remaining:   left,
+		})
+	})
+}
+
+func (d *hookDispatcher) retrieved(stor storage, identity string, ensembles []*prekeyEnsemble) {
+	if d == nil || len(ensembles) == 0 {
+		return
+	}
+	tags := make([]uint32, 0, len(ensembles))
+	for _, pe := range ensembles {
+		tags = append(tags, pe.cp.instanceTag)
+	}
+
+	d.dispatch(func(h Hooks) {
+		ev := RetrievalEvent{Identity: identity, Remaining: make(map[uint32]uint32, len(tags))}
+		low := []LowPrekeysEvent{}
+		for _, tag := range tags {
+			left, crossed, ok := d.count(stor, prekeyKey{identity, tag})
+			if !ok {
+				return
+			}
+			ev.Remaining[tag] = left
+			if crossed {
+				low = append(low, LowPrekeysEvent{Identity: identity, InstanceTag: tag, Remaining: left})
+			}
+		}
+		d.call(func(h Hooks) { h.Retrieved(ev) })
+		for _, l := range low {
+			d.call(func(h Hooks) { h.LowOnPrekeys(l) })
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package prekeyserver
+
+import (
+	"context"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type recordingHooks struct {
+	limit   uint32
+	block   chan struct{}
+	events  chan interface{}
+	panicky bool
+}
+
+func newRecordingHooks(limit uint32) *recordingHooks {
+	return &recordingHooks{limit: limit, events: make(chan interface{}, 10)}
+}
+
+func (h *recordingHooks) record(ev interface{}) {
+	if h.block != nil {
+		<-h.block
+	}
+	if h.panicky {
+		panic("hook failed")
+	}
+	h.events <- ev
+}
+
+func (h *recordingHooks) Published(ev PublicationEvent)   { h.record(ev) }
+func (h *recordingHooks) Retrieved(ev RetrievalEvent)     { h.record(ev) }
+func (h *recordingHooks) LowOnPrekeys(ev LowPrekeysEvent) { h.record(ev) }
+func (h *recordingHooks) LowPrekeyThreshold() uint32      { return h.limit }
+
+func (h *recordingHooks) next(c *C) interface{} {
+	select {
+	case ev := <-h.events:
+		return ev
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for hook")
+	}
+	return nil
+}
+
+func storeSitaPrekeys(gs *GenericServer, n int) {
+	stor := gs.storage()
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pms := []*prekeyMessage{}
+	for i := 0; i < n; i++ {
+		pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+		pms = append(pms, pm)
+	}
+	stor.storeClientProfile("sita@example.org", sita.clientProfile)
+	stor.storePrekeyProfile("sita@example.org", pp)
+	stor.storePrekeyMessages("sita@example.org", pms)
+}
+
+func (s *GenericServerSuite) Test_Hooks_areToldAboutAPublication(c *C) {
+	gs := testServerForInitiator()
+	defer gs.Close()
+	h := newRecordingHooks(0)
+	gs.hooks = newHookDispatcher(h, func(error) {})
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	d3, _ := in.PublicationDAKE3(nil, nil, []PrekeyMessage{pm1, pm2})
+	_, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, IsNil)
+
+	c.Assert(h.next(c), DeepEquals, PublicationEvent{
+		Identity:    "sita@example.org",
+		InstanceTag: sita.instanceTag,
+		Published:   2,
+		Remaining:   2,
+	})
+}
+
+func (s *GenericServerSuite) Test_Hooks_areToldAboutARetrievalAndWhenPrekeysRunLow(c *C) {
+	gs := testServerForInitiator()
+	defer gs.Close()
+	h := newRecordingHooks(2)
+	gs.hooks = newHookDispatcher(h, func(error) {})
+	storeSitaPrekeys(gs, 3)
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+
+	gs.Handle("someone@example.org", q)
+	c.Assert(h.next(c), DeepEquals, RetrievalEvent{
+		Identity:  "sita@example.org",
+		Remaining: map[uint32]uint32{sita.instanceTag: 2},
+	})
+
+	gs.Handle("someone@example.org", q)
+	c.Assert(h.next(c), DeepEquals, RetrievalEvent{
+		Identity:  "sita@example.org",
+		Remaining: map[uint32]uint32{sita.instanceTag: 1},
+	})
+	c.Assert(h.next(c), DeepEquals, LowPrekeysEvent{
+		Identity:    "sita@example.org",
+		InstanceTag: sita.instanceTag,
+		Remaining:   1,
+	})
+
+	gs.Handle("someone@example.org", q)
+	c.Assert(h.next(c), FitsTypeOf, RetrievalEvent{})
+	c.Assert(h.events, HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_Hooks_cantBlockTheHandlingOfMessages(c *C) {
+	gs := testServerForInitiator()
+	defer gs.Close()
+	h := newRecordingHooks(0)
+	h.block = make(chan struct{})
+	defer close(h.block)
+	dropped := make(chan error, 1)
+	gs.hooks = newHookDispatcher(h, func(e error) {
+		select {
+		case dropped <- e:
+		default:
+		}
+	})
+	storeSitaPrekeys(gs, hookQueueSize+2)
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+
+	for i := 0; i < hookQueueSize+2; i++ {
+		_, e := gs.Handle("someone@example.org", q)
+		c.Assert(e, IsNil)
+	}
+
+	c.Assert(<-dropped, ErrorMatches, "hook queue is full, dropping event")
+}
+
+func (s *GenericServerSuite) Test_Hooks_thatPanicAreContained(c *C) {
+	gs := testServerForInitiator()
+	defer gs.Close()
+	h := newRecordingHooks(0)
+	h.panicky = true
+	failed := make(chan error, 1)
+	gs.hooks = newHookDispatcher(h, func(e error) { failed <- e })
+	storeSitaPrekeys(gs, 1)
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+
+	_, e := gs.Handle("someone@example.org", q)
+
+	c.Assert(e, IsNil)
+	c.Assert(<-failed, ErrorMatches, "hook panicked: hook failed")
+}
+
+func (s *GenericServerSuite) Test_Hooks_areToldOnceWhenRetrievalsPassTheThresholdBeforeTheyAreCounted(c *C) {
+	gs := testServerForInitiator()
+	defer gs.Close()
+	h := newRecordingHooks(4)
+	gs.hooks = newHookDispatcher(h, func(error) {})
+	storeSitaPrekeys(gs, 6)
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+
+	gs.Handle("someone@example.org", q)
+	c.Assert(h.next(c), DeepEquals, RetrievalEvent{
+		Identity:  "sita@example.org",
+		Remaining: map[uint32]uint32{sita.instanceTag: 5},
+	})
+
+	block := make(chan struct{})
+	gs.hooks.dispatch(func(Hooks) { <-block })
+	for i := 0; i < 3; i++ {
+		gs.Handle("someone@example.org", q)
+	}
+	close(block)
+
+	c.Assert(h.next(c), DeepEquals, RetrievalEvent{
+		Identity:  "sita@example.org",
+		Remaining: map[uint32]uint32{sita.instanceTag: 2},
+	})
+	c.Assert(h.next(c), DeepEquals, LowPrekeysEvent{
+		Identity:    "sita@example.org",
+		InstanceTag: sita.instanceTag,
+		Remaining:   2,
+	})
+	c.Assert(h.next(c), FitsTypeOf, RetrievalEvent{})
+	c.Assert(h.next(c), FitsTypeOf, RetrievalEvent{})
+	c.Assert(h.events, HasLen, 0)
+}
+
+type slowCountingStorage struct {
+	storage
+	block chan struct{}
+}
+
+func (s *slowCountingStorage) numberStored(from string, tag uint32) uint32 {
+	<-s.block
+	return s.storage.numberStored(from, tag)
+}
+
+// fixedCountStorage always has the same number of prekey messages stored
+type fixedCountStorage struct {
+	storage
+	left uint32
+}
+
+func (s *fixedCountStorage) numberStored(string, uint32) uint32 {
+	return s.left
+}
+
+func (s *GenericServerSuite) Test_hookDispatcher_count_forgetsCountsBelowTheThreshold(c *C) {
+	d := &hookDispatcher{threshold: 4, remaining: make(map[prekeyKey]uint32)}
+	st := &fixedCountStorage{left: 6}
+	k := prekeyKey{"sita@example.org", sita.instanceTag}
+
+	_, crossed, _ := d.count(st, k)
+	c.Assert(crossed, Equals, false)
+	c.Assert(d.remaining, DeepEquals, map[prekeyKey]uint32{k: 6})
+
+	st.left = 2
+	_, crossed, _ = d.count(st, k)
+	c.Assert(crossed, Equals, true)
+	c.Assert(d.remaining, HasLen, 0)
+
+	st.left = 1
+	_, crossed, _ = d.count(st, k)
+	c.Assert(crossed, Equals, false)
+	c.Assert(d.remaining, HasLen, 0)
+
+	st.left = 0
+	_, crossed, _ = d.count(st, prekeyKey{"rama@example.org", 0x1234})
+	c.Assert(crossed, Equals, false)
+	c.Assert(d.remaining, HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_hookDispatcher_count_remembersALimitedNumberOfCounts(c *C) {
+	d := &hookDispatcher{threshold: 4, remaining: make(map[prekeyKey]uint32)}
+	st := &fixedCountStorage{left: 10}
+	for i := 0; i < maxHookCounts; i++ {
+		d.count(st, prekeyKey{"sita@example.org", uint32(i)})
+	}
+	c.Assert(d.remaining, HasLen, maxHookCounts)
+
+	d.count(st, prekeyKey{"rama@example.org", 1})
+	c.Assert(d.remaining, HasLen, maxHookCounts)
+	c.Assert(d.remaining[prekeyKey{"rama@example.org", 1}], Equals, uint32(10))
+
+	d.count(st, prekeyKey{"rama@example.org", 1})
+	c.Assert(d.remaining, HasLen, maxHookCounts)
+}
+
+func (s *GenericServerSuite) Test_Hooks_countThePrekeyMessagesLeftOutsideOfTheHandling(c *C) {
+	gs := testServerForInitiator()
+	defer gs.Close()
+	h := newRecordingHooks(2)
+	gs.hooks = newHookDispatcher(h, func(error) {})
+	storeSitaPrekeys(gs, 3)
+	slow := &slowCountingStorage{storage: gs.storageImpl, block: make(chan struct{})}
+	gs.storageImpl = slow
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+
+	res, e := gs.Handle("someone@example.org", q)
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 1)
+
+	close(slow.block)
+	c.Assert(h.next(c), DeepEquals, RetrievalEvent{
+		Identity:  "sita@example.org",
+		Remaining: map[uint32]uint32{sita.instanceTag: 2},
+	})
+}
+
+func (s *GenericServerSuite) Test_realFactory_NewServerWithConfig_usesTheGivenHooks(c *C) {
+	f := &realFactory{r: fixtureRand()}
+	h := newRecordingHooks(7)
+	conf := ServerConfig{
+		Identity:        "foobar",
+		Keys:            f.CreateKeypair(),
+		Storage:         &inMemoryStorageFactory{},
+		SessionTimeout:  time.Minute,
+		FragmentTimeout: time.Minute,
+		Hooks:           h,
+	}
+
+	res, e := f.NewServerWithConfig(conf)
+	c.Assert(e, IsNil)
+	gs := res.(*GenericServer)
+	defer gs.Close()
+	c.Assert(gs.hooks.h, Equals, h)
+	c.Assert(gs.hooks.threshold, Equals, uint32(7))
+
+	conf.Hooks = nil
+	res, e = f.NewServerWithConfig(conf)
+	c.Assert(e, IsNil)
+	defer res.Close()
+	c.Assert(res.(*GenericServer).hooks, IsNil)
+}
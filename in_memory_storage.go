@@ -1,17 +1,24 @@
 package prekeyserver
 
 import (
+	"errors"
 	"sync"
+	"time"
 )
 
-func isInMemoryStorageDescriptor(desc string) bool {
-	return desc == "in-memory"
+func init() {
+	RegisterStorageType("in-memory", func(params string) (Storage, error) {
+		if params != "" {
+			return nil, errors.New("the in-memory storage type takes no parameters")
+		}
+		return &inMemoryStorageFactory{}, nil
+	})
 }
 
 type inMemoryStorageFactory struct{}
 
-func (*inMemoryStorageFactory) createStorage() storage {
-	return createInMemoryStorage()
+func (*inMemoryStorageFactory) createStorage() (storage, error) {
+	return createInMemoryStorage(), nil
 }
 
 type inMemoryStorageEntry struct {
@@ -23,18 +30,24 @@ type inMemoryStorageEntry struct {
 
 type inMemoryStorage struct {
 	perUser map[string]*inMemoryStorageEntry
+	storageClock
 	sync.RWMutex
 }
 
-func (s *inMemoryStorageEntry) retrieve() []*prekeyEnsemble {
+func (s *inMemoryStorageEntry) retrieve(accept ensembleFilter, now time.Time) []*prekeyEnsemble {
 	s.Lock()
 	defer s.Unlock()
 
+	// Expired profiles can never be part of an ensemble again, so there is
+	// no reason to wait for the next cleanup to get rid of them
+	s.cleanupClientProfiles(now)
+	s.cleanupPrekeyProfiles(now)
+
 	entries := []*prekeyEnsemble{}
 	for itag, cp := range s.clientProfiles {
 		pp, ok := s.prekeyProfiles[itag]
 		pms, ok2 := s.prekeyMessages[itag]
-		if ok && ok2 && pp != nil && len(pms) > 0 {
+		if ok && ok2 && pp != nil && len(pms) > 0 && accept.accepts(cp, pp) {
 			entries = append(entries, &prekeyEnsemble{
 				cp: cp,
 				pp: pp,
@@ -104,28 +117,30 @@ func (s *inMemoryStorage) storePrekeyMessages(from string, pms []*prekeyMessage)
 
 func (s *inMemoryStorage) numberStored(from string, tag uint32) uint32 {
 	s.RLock()
-	defer s.RUnlock()
 	pu, ok := s.perUser[from]
+	s.RUnlock()
 	if !ok {
 		return 0
 	}
+	pu.Lock()
+	defer pu.Unlock()
 	return uint32(len(pu.prekeyMessages[tag]))
 }
 
-func (s *inMemoryStorage) retrieveFor(from string) []*prekeyEnsemble {
+func (s *inMemoryStorage) retrieveFor(from string, accept ensembleFilter) ([]*prekeyEnsemble, error) {
 	s.RLock()
 	pu, ok := s.perUser[from]
 	s.RUnlock()
 	if !ok {
-		return nil
+		return nil, nil
 	}
-	return pu.retrieve()
+	return pu.retrieve(accept, s.now()), nil
 }
 
-func (s *inMemoryStorageEntry) cleanupClientProfiles() {
+func (s *inMemoryStorageEntry) cleanupClientProfiles(now time.Time) {
 	toRemove := []uint32{}
 	for itag, cp := range s.clientProfiles {
-		if cp.hasExpired() {
+		if cp.hasExpired(now) {
 			toRemove = append(toRemove, itag)
 		}
 	}
@@ -134,10 +149,10 @@ func (s *inMemoryStorageEntry) cleanupClientProfiles() {
 	}
 }
 
-func (s *inMemoryStorageEntry) cleanupPrekeyProfiles() {
+func (s *inMemoryStorageEntry) cleanupPrekeyProfiles(now time.Time) {
 	toRemove := []uint32{}
 	for itag, pp := range s.prekeyProfiles {
-		if pp.hasExpired() {
+		if pp.hasExpired(now) {
 			toRemove = append(toRemove, itag)
 		}
 	}
@@ -152,11 +167,11 @@ func (s *inMemoryStorageEntry) hasAnyEntries() bool {
 		len(s.prekeyMessages) != 0
 }
 
-func (s *inMemoryStorageEntry) cleanup() bool {
+func (s *inMemoryStorageEntry) cleanup(now time.Time) bool {
 	s.Lock()
 	defer s.Unlock()
-	s.cleanupClientProfiles()
-	s.cleanupPrekeyProfiles()
+	s.cleanupClientProfiles(now)
+	s.cleanupPrekeyProfiles(now)
 
 	return s.hasAnyEntries()
 }
@@ -164,9 +179,10 @@ func (s *inMemoryStorageEntry) cleanup() bool {
 func (s *inMemoryStorage) cleanup() {
 	s.Lock()
 	defer s.Unlock()
+	now := s.now()
 	toRemove := []string{}
 	for pu, pus := range s.perUser {
-		if !pus.cleanup() {
+		if !pus.cleanup(now) {
 			toRemove = append(toRemove, pu)
 		}
 	}
@@ -174,3 +190,7 @@ func (s *inMemoryStorage) cleanup() {
 		delete(s.perUser, pu)
 	}
 }
+
+func (s *inMemoryStorage) close() error {
+	return nil
+}
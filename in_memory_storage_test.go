@@ -89,3 +89,25 @@ func (s *GenericServerSuite) Test_inMemoryStorage_cleanup_shouldNotRemoveUserIfT
 	c.Assert(is.perUser["someoneThird@example.org"].prekeyProfiles, HasLen, 0)
 	c.Assert(is.perUser["someoneThird@example.org"].prekeyMessages, HasLen, 1)
 }
+
+func (s *GenericServerSuite) Test_inMemoryStorage_retrieveFor_removesExpiredProfilesWithoutUsingPrekeyMessages(c *C) {
+	gs := &GenericServer{
+		rand: fixtureRand(),
+	}
+	is := createInMemoryStorage()
+
+	cp := generateSitaTestData().clientProfile
+	cp.expiration = time.Date(2017, 11, 5, 13, 46, 00, 13, time.UTC)
+	cp.sig = &eddsaSignature{s: cp.generateSignature(sita.longTerm)}
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+
+	is.storeClientProfile("someone@example.org", cp)
+	is.storePrekeyProfile("someone@example.org", pp)
+	is.storePrekeyMessages("someone@example.org", []*prekeyMessage{pm})
+
+	c.Assert(retrieved(is.retrieveFor("someone@example.org", nil)), HasLen, 0)
+	c.Assert(is.perUser["someone@example.org"].clientProfiles, HasLen, 0)
+	c.Assert(is.perUser["someone@example.org"].prekeyProfiles, HasLen, 1)
+	c.Assert(is.numberStored("someone@example.org", sita.instanceTag), Equals, uint32(1))
+}
@@ -0,0 +1,252 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/otrv4/ed448"
+)
+
+// ErrRejected is returned when the server authenticated the request, but refused to handle it
+var ErrRejected = errors.New("request rejected by the server")
+
+type realInitiator struct {
+	wr             WithRandom
+	from           string
+	serverIdentity string
+	longTerm       *keypair
+	cp             *clientProfile
+
+	i         *keypair
+	serverKey *publicKey
+	s         ed448.Point
+	macK      []byte
+}
+
+func newInitiator(wr WithRandom, from, serverIdentity string, longTerm *keypair, cp *clientProfile) *realInitiator {
+	return &realInitiator{
+		wr:             wr,
+		from:           from,
+		serverIdentity: serverIdentity,
+		longTerm:       longTerm,
+		cp:             cp,
+	}
+}
+
+func (in *realInitiator) DAKE1() []byte {
+	in.i = generateKeypair(in.wr)
+	return generateDake1(in.cp.instanceTag, in.cp, in.i.pub.k).serialize()
+}
+
+func (in *realInitiator) ReceiveDAKE2(msg []byte) error {
+	if in.i == nil {
+		return errors.New("DAKE1 has not been generated")
+	}
+
+	d2 := &dake2Message{}
+	if _, ok := d2.deserialize(msg); !ok {
+		return errors.New("invalid DAKE2 message")
+	}
+
+	if d2.instanceTag != in.cp.instanceTag {
+		return errors.New("incorrect instance tag")
+	}
+
+	if string(d2.serverIdentity) != in.serverIdentity {
+		return errors.New("incorrect server identity")
+	}
+
+	if validatePoint(d2.serverKey) != nil {
+		return errors.New("invalid server key")
+	}
+
+	if validatePoint(d2.s) != nil {
+		return errors.New("invalid point S")
+	}
+
+	serverKey := &publicKey{k: d2.serverKey, keyType: ed448Key}
+	phi := calculatePhi(in.from, in.serverIdentity)
+	t := calculateDAKE2T(in.cp, calculateCompositeIdentity(in.serverIdentity, serverKey), in.i.pub.k, d2.s, phi)
+
+	if !d2.sigma.verify(in.cp.publicKey, serverKey, in.i.pub, t) {
+		return errors.New("incorrect ring signature")
+	}
+
+	in.serverKey = serverKey
+	in.s = d2.s
+	in.macK = calculateMACKey(d2.s, in.i.priv.k)
+
+	return nil
+}
+
+func (in *realInitiator) ServerFingerprint() []byte {
+	if in.serverKey == nil {
+		return nil
+	}
+	fp := in.serverKey.fingerprint()
+	return fp[:]
+}
+
+func (in *realInitiator) dake3(m serializable) ([]byte, error) {
+	if in.macK == nil {
+		return nil, errors.New("DAKE2 has not been received")
+	}
+
+	phi := calculatePhi(in.from, in.serverIdentity)
+	t := calculateDAKE3T(in.cp, calculateCompositeIdentity(in.serverIdentity, in.serverKey), in.i.pub.k, in.s, phi)
+
+	sigma, e := generateSignature(in.wr, in.longTerm.priv, in.longTerm.pub, in.longTerm.pub, in.serverKey, &publicKey{k: in.s}, t)
+	if e != nil {
+		return nil, errors.New("invalid ring signature generation")
+	}
+
+	return generateDake3(in.cp.instanceTag, sigma, m.serialize()).serialize(), nil
+}
+
+func (in *realInitiator) PublicationDAKE3(cp ClientProfile, pp PrekeyProfile, pms []PrekeyMessage) ([]byte, error) {
+	var rcp *clientProfile
+	if cp != nil {
+		rcp = cp.realClientProfile()
+	}
+
+	var rpp *prekeyProfile
+	if pp != nil {
+		rpp = pp.realPrekeyProfile()
+	}
+
+	rpms := make([]*prekeyMessage, len(pms))
+	for ix, pm := range pms {
+		rpms[ix] = pm.realPrekeyMessage()
+	}
+
+	return in.dake3(generatePublicationMessage(rcp, rpp, rpms, in.macK))
+}
+
+func (in *realInitiator) StorageInformationDAKE3() ([]byte, error) {
+	return in.dake3(generateStorageInformationRequestMessage(in.macK))
+}
+
+func (in *realInitiator) ReceiveSuccess(msg []byte) error {
+	if in.macK == nil {
+		return errors.New("DAKE2 has not been received")
+	}
+
+	if isFailureMessage(msg) {
+		return in.receiveFailure(msg)
+	}
+
+	m := &successMessage{}
+	if _, ok := m.deserialize(msg); !ok {
+		return errors.New("invalid success message")
+	}
+
+	if m.instanceTag != in.cp.instanceTag {
+		return errors.New("incorrect instance tag")
+	}
+
+	expected := generateSuccessMessage(in.macK, in.cp.instanceTag)
+	if !bytes.Equal(expected.mac[:], m.mac[:]) {
+		return errors.New("incorrect MAC")
+	}
+
+	return nil
+}
+
+func (in *realInitiator) ReceiveStorageStatus(msg []byte) (uint32, error) {
+	if in.macK == nil {
+		return 0, errors.New("DAKE2 has not been received")
+	}
+
+	if isFailureMessage(msg) {
+		return 0, in.receiveFailure(msg)
+	}
+
+	m := &storageStatusMessage{}
+	if _, ok := m.deserialize(msg); !ok {
+		return 0, errors.New("invalid storage status message")
+	}
+
+	if m.instanceTag != in.cp.instanceTag {
+		return 0, errors.New("incorrect instance tag")
+	}
+
+	mac := kdfx(usageStatusMAC, 64, in.macK, []byte{messageTypeStorageStatusMessage}, serializeWord(m.instanceTag), serializeWord(m.number))
+	if !bytes.Equal(mac, m.mac[:]) {
+		return 0, errors.New("incorrect MAC")
+	}
+
+	return m.number, nil
+}
+
+func isFailureMessage(msg []byte) bool {
+	return len(msg) > indexOfMessageType && msg[indexOfMessageType] == messageTypeFailure
+}
+
+// receiveFailure returns ErrRejected if the failure message is authentic
+func (in *realInitiator) receiveFailure(msg []byte) error {
+	m := &failureMessage{}
+	if _, ok := m.deserialize(msg); !ok {
+		return errors.New("invalid failure message")
+	}
+
+	if m.instanceTag != in.cp.instanceTag {
+		return errors.New("incorrect instance tag")
+	}
+
+	expected := generateFailureMessage(in.macK, in.cp.instanceTag)
+	if !bytes.Equal(expected.mac[:], m.mac[:]) {
+		return errors.New("incorrect MAC")
+	}
+
+	return ErrRejected
+}
+
+// CreateEnsembleRetrievalQuery returns an ensemble retrieval query message, asking for
+// the prekey ensembles of the given identity. The instance tag is the one of the asking client.
+func CreateEnsembleRetrievalQuery(instanceTag uint32, identity string, versions []byte) []byte {
+	m := &ensembleRetrievalQueryMessage{
+		instanceTag: instanceTag,
+		identity:    identity,
+		versions:    versions,
+	}
+	return m.serialize()
+}
+
+// ParseEnsembleRetrievalResponse parses the answer to an ensemble retrieval query.
+// It returns no ensembles and no error if the server has no prekey ensembles for
+// the identity. Ensembles that don't validate are left out of the result.
+func ParseEnsembleRetrievalResponse(instanceTag uint32, msg []byte) ([]PrekeyEnsemble, error) {
+	if len(msg) <= indexOfMessageType {
+		return nil, errors.New("message too short to be a valid message")
+	}
+
+	switch msg[indexOfMessageType] {
+	case messageTypeNoPrekeyEnsembles:
+		m := &noPrekeyEnsemblesMessage{}
+		if _, ok := m.deserialize(msg); !ok {
+			return nil, errors.New("invalid no prekey ensembles message")
+		}
+		if m.instanceTag != instanceTag {
+			return nil, errors.New("incorrect instance tag")
+		}
+		return nil, nil
+	case messageTypeEnsembleRetrieval:
+		m := &ensembleRetrievalMessage{}
+		if _, ok := m.deserialize(msg); !ok {
+			return nil, errors.New("invalid ensemble retrieval message")
+		}
+		if m.instanceTag != instanceTag {
+			return nil, errors.New("incorrect instance tag")
+		}
+		result := []PrekeyEnsemble{}
+		for _, pe := range m.ensembles {
+			if pe.validate(time.Now()) == nil {
+				result = append(result, pe)
+			}
+		}
+		return result, nil
+	}
+
+	return nil, errors.New("unexpected message type")
+}
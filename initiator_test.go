@@ -0,0 +1,205 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func testServerForInitiator() *GenericServer {
+	serverKey := deriveKeypair([symKeyLength]byte{0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25})
+	gs := &GenericServer{
+		identity:       "masterOfKeys.example.org",
+		rand:           fixtureRand(),
+		key:            serverKey,
+		fingerprint:    serverKey.pub.fingerprint(),
+		storageImpl:    createInMemoryStorage(),
+		sessions:       newSessionManager(),
+		rest:           nullRestrictor,
+		fragmentations: newFragmentations(),
+		sessionTimeout: 30 * time.Minute,
+	}
+	gs.messageHandler = &otrngMessageHandler{s: gs}
+	return gs
+}
+
+func (s *GenericServerSuite) Test_realInitiator_runsAPublicationAgainstTheServer(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(e, IsNil)
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+	c.Assert(in.ServerFingerprint(), DeepEquals, gs.fingerprint[:])
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+
+	d3, e := in.PublicationDAKE3(sita.clientProfile, pp, []PrekeyMessage{pm})
+	c.Assert(e, IsNil)
+
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, IsNil)
+	c.Assert(in.ReceiveSuccess(res), IsNil)
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+}
+
+func (s *GenericServerSuite) Test_realInitiator_asksForTheStorageStatus(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	d3, e := in.StorageInformationDAKE3()
+	c.Assert(e, IsNil)
+
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, IsNil)
+
+	n, e := in.ReceiveStorageStatus(res)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, uint32(0))
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveDAKE2_failsBeforeDAKE1(c *C) {
+	in := newInitiator(fixedRandBytes(), "sita@example.org", "masterOfKeys.example.org", sita.longTerm, sita.clientProfile)
+	c.Assert(in.ReceiveDAKE2(nil), ErrorMatches, "DAKE1 has not been generated")
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveDAKE2_failsOnInvalidMessage(c *C) {
+	in := newInitiator(defaultRandom(), "sita@example.org", "masterOfKeys.example.org", sita.longTerm, sita.clientProfile)
+	in.DAKE1()
+	c.Assert(in.ReceiveDAKE2([]byte{0x00, 0x04, 0x36}), ErrorMatches, "invalid DAKE2 message")
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveDAKE2_failsOnAnotherServerIdentity(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", "other.example.org", sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), ErrorMatches, "incorrect server identity")
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveDAKE2_failsOnABadSignature(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "rama@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), ErrorMatches, "incorrect ring signature")
+}
+
+func (s *GenericServerSuite) Test_realInitiator_DAKE3_failsBeforeDAKE2(c *C) {
+	in := newInitiator(defaultRandom(), "sita@example.org", "masterOfKeys.example.org", sita.longTerm, sita.clientProfile)
+	_, e := in.StorageInformationDAKE3()
+	c.Assert(e, ErrorMatches, "DAKE2 has not been received")
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveSuccess_failsOnBadMAC(c *C) {
+	in := newInitiator(defaultRandom(), "sita@example.org", "masterOfKeys.example.org", sita.longTerm, sita.clientProfile)
+	in.macK = make([]byte, 64)
+	m := generateSuccessMessage([]byte{0x01}, sita.instanceTag)
+	c.Assert(in.ReceiveSuccess(m.serialize()), ErrorMatches, "incorrect MAC")
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveSuccess_reportsARejectedPublication(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	pm, _ := generatePrekeyMessage(gs, 0x1234AAAA)
+	d3, _ := in.PublicationDAKE3(nil, nil, []PrekeyMessage{pm})
+
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(errors.Is(e, ErrInvalidMessage), Equals, true)
+	c.Assert(in.ReceiveSuccess(res), Equals, ErrRejected)
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(0))
+}
+
+type failingStorage struct {
+	storage
+}
+
+func (*failingStorage) storePrekeyMessages(string, []*prekeyMessage) error {
+	return errors.New("disk is full")
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveSuccess_reportsAFailureToStore(c *C) {
+	gs := testServerForInitiator()
+	gs.storageImpl = &failingStorage{gs.storageImpl}
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	d3, _ := in.PublicationDAKE3(nil, nil, []PrekeyMessage{pm})
+
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(errors.Is(e, ErrStorage), Equals, true)
+	c.Assert(in.ReceiveSuccess(res), Equals, ErrRejected)
+	c.Assert(gs.sessions.has("sita@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_realInitiator_ReceiveStorageStatus_failsOnBadFailureMAC(c *C) {
+	in := newInitiator(defaultRandom(), "sita@example.org", "masterOfKeys.example.org", sita.longTerm, sita.clientProfile)
+	in.macK = make([]byte, 64)
+	m := generateFailureMessage([]byte{0x01}, sita.instanceTag)
+	_, e := in.ReceiveStorageStatus(m.serialize())
+	c.Assert(e, ErrorMatches, "incorrect MAC")
+}
+
+func (s *GenericServerSuite) Test_dake3Message_respond_sendsAFailureForUnexpectedInnerMessages(c *C) {
+	gs := testServerForInitiator()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	d3, _ := in.dake3(generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k))
+
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(errors.Is(e, ErrInvalidMessage), Equals, true)
+	c.Assert(in.ReceiveSuccess(res), Equals, ErrRejected)
+}
+
+func (s *GenericServerSuite) Test_ParseEnsembleRetrievalResponse_returnsNothingForNoPrekeyEnsembles(c *C) {
+	m := &noPrekeyEnsemblesMessage{instanceTag: 0x12445511, message: noPrekeyMessagesAvailableMessage}
+	res, e := ParseEnsembleRetrievalResponse(0x12445511, m.serialize())
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_ParseEnsembleRetrievalResponse_leavesOutInvalidEnsembles(c *C) {
+	gs := &GenericServer{rand: fixtureRand()}
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	badpm, _ := generatePrekeyMessage(gs, 0x42424242)
+
+	m := &ensembleRetrievalMessage{
+		instanceTag: 0x12445511,
+		ensembles: []*prekeyEnsemble{
+			&prekeyEnsemble{cp: sita.clientProfile, pp: pp, pm: pm},
+			&prekeyEnsemble{cp: sita.clientProfile, pp: pp, pm: badpm},
+		},
+	}
+	res, e := ParseEnsembleRetrievalResponse(0x12445511, m.serialize())
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].PrekeyMessage().Identifier(), Equals, pm.identifier)
+}
+
+func (s *GenericServerSuite) Test_ParseEnsembleRetrievalResponse_failsOnIncorrectInstanceTag(c *C) {
+	m := &noPrekeyEnsemblesMessage{instanceTag: 0x12445511, message: noPrekeyMessagesAvailableMessage}
+	_, e := ParseEnsembleRetrievalResponse(0x11111111, m.serialize())
+	c.Assert(e, ErrorMatches, "incorrect instance tag")
+}
+
+func (s *GenericServerSuite) Test_ParseEnsembleRetrievalResponse_failsOnOtherMessages(c *C) {
+	_, e := ParseEnsembleRetrievalResponse(0x11111111, generateSuccessMessage([]byte{0x01}, 0x11111111).serialize())
+	c.Assert(e, ErrorMatches, "unexpected message type")
+}
@@ -0,0 +1,426 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path"
+	"sync"
+)
+
+// Design:
+// - an embedded, transactional key-value store kept in one single file
+// - the file starts with an eight byte magic header, followed by an append-only log
+//   of committed transactions
+// - each transaction is written as one record: a four byte length, a four byte
+//   CRC-32C checksum of the payload, and the payload itself
+// - the payload is a sequence of operations, either a put (0x01) followed by the key
+//   and the value, or a delete (0x02) followed by the key. Keys and values are
+//   encoded as data, the same way as in the protocol
+// - when the file is opened, all records are replayed to build an in-memory index from each
+//   key to the position of its latest value in the file. Values are read from the file when needed
+// - a record that is cut short or has a bad checksum can only come from a commit that
+//   never finished, so it marks the end of the log and is truncated away. This means that either
+//   all or none of the changes in a transaction will survive a crash
+// - only one writing transaction can run at a time, but any number of reading ones
+// - since the file only grows, compact will write all live values into a new file and
+//   rename it over the old one
+// - the file is locked while open, so two processes can't use it at the same time
+
+var kvMagic = []byte{'O', 'T', 'R', 'P', 'K', 'V', 0x00, 0x01}
+
+const (
+	kvOpPut    = uint8(0x01)
+	kvOpDelete = uint8(0x02)
+
+	kvRecordHeaderLength = 8
+	kvMaxRecordLength    = 1 << 30
+	kvCompactBatchLength = 1 << 20
+	kvMinCompactGarbage  = 1 << 20
+)
+
+var kvCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type kvValueRef struct {
+	offset int64
+	length uint32
+}
+
+type kvDB struct {
+	sync.RWMutex
+	path   string
+	f      *os.File
+	sync   bool
+	index  map[string]kvValueRef
+	size   int64
+	live   int64
+	closed bool
+}
+
+type kvTx struct {
+	db     *kvDB
+	writes map[string][]byte
+}
+
+func openKV(name string, sync bool) (*kvDB, error) {
+	f, e := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if e != nil {
+		return nil, e
+	}
+
+	if e := lockFile(f); e != nil {
+		f.Close()
+		return nil, errors.New("storage file is already in use")
+	}
+
+	db := &kvDB{
+		path:  name,
+		f:     f,
+		sync:  sync,
+		index: make(map[string]kvValueRef),
+	}
+
+	if e := db.load(); e != nil {
+		f.Close()
+		return nil, e
+	}
+
+	return db, nil
+}
+
+func (db *kvDB) load() error {
+	fi, e := db.f.Stat()
+	if e != nil {
+		return e
+	}
+
+	if fi.Size() == 0 {
+		if _, e := db.f.WriteAt(kvMagic, 0); e != nil {
+			return e
+		}
+		db.size = int64(len(kvMagic))
+		return db.f.Sync()
+	}
+
+	header := make([]byte, len(kvMagic))
+	if _, e := db.f.ReadAt(header, 0); e != nil || !bytes.Equal(header, kvMagic) {
+		return errors.New("not a prekey storage file")
+	}
+
+	db.size = int64(len(kvMagic))
+	for {
+		payload, ok := db.readRecordAt(db.size, fi.Size())
+		if !ok {
+			break
+		}
+		if e := db.apply(db.size+kvRecordHeaderLength, payload); e != nil {
+			return e
+		}
+		db.size += kvRecordHeaderLength + int64(len(payload))
+	}
+
+	if db.size != fi.Size() {
+		return db.f.Truncate(db.size)
+	}
+	return nil
+}
+
+func (db *kvDB) readRecordAt(offset, fileSize int64) ([]byte, bool) {
+	header := make([]byte, kvRecordHeaderLength)
+	if _, e := db.f.ReadAt(header, offset); e != nil {
+		return nil, false
+	}
+
+	length := int64(binary.BigEndian.Uint32(header))
+	if length > fileSize-offset-kvRecordHeaderLength {
+		return nil, false
+	}
+
+	payload := make([]byte, length)
+	if _, e := db.f.ReadAt(payload, offset+kvRecordHeaderLength); e != nil {
+		return nil, false
+	}
+
+	if crc32.Checksum(payload, kvCastagnoli) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, false
+	}
+
+	return payload, true
+}
+
+// apply updates the index from a payload that starts at the given offset in the file
+func (db *kvDB) apply(offset int64, payload []byte) error {
+	buf := payload
+	for len(buf) > 0 {
+		var op uint8
+		var key, value []byte
+		var ok bool
+		if buf, op, ok = extractByte(buf); !ok {
+			return errors.New("corrupt record in storage file")
+		}
+		if buf, key, ok = extractData(buf); !ok {
+			return errors.New("corrupt record in storage file")
+		}
+
+		db.remove(string(key))
+
+		switch op {
+		case kvOpPut:
+			if buf, value, ok = extractData(buf); !ok {
+				return errors.New("corrupt record in storage file")
+			}
+			pos := offset + int64(len(payload)-len(buf)-len(value))
+			db.index[string(key)] = kvValueRef{offset: pos, length: uint32(len(value))}
+			db.live += kvEntryLength(key, value)
+		case kvOpDelete:
+		default:
+			return errors.New("corrupt record in storage file")
+		}
+	}
+	return nil
+}
+
+func (db *kvDB) remove(key string) {
+	if ref, ok := db.index[key]; ok {
+		db.live -= int64(1 + 4 + len(key) + 4 + int(ref.length))
+		delete(db.index, key)
+	}
+}
+
+func kvEntryLength(key, value []byte) int64 {
+	return int64(1 + 4 + len(key) + 4 + len(value))
+}
+
+func (db *kvDB) readValue(ref kvValueRef) ([]byte, error) {
+	res := make([]byte, ref.length)
+	if _, e := db.f.ReadAt(res, ref.offset); e != nil {
+		return nil, e
+	}
+	return res, nil
+}
+
+// appendRecord writes a complete record at the end of the log and returns the offset of its payload
+func (db *kvDB) appendRecord(payload []byte) (int64, error) {
+	if len(payload) > kvMaxRecordLength {
+		return 0, errors.New("transaction is too large")
+	}
+
+	rec := appendWord(nil, uint32(len(payload)))
+	rec = appendWord(rec, crc32.Checksum(payload, kvCastagnoli))
+	rec = append(rec, payload...)
+
+	if _, e := db.f.WriteAt(rec, db.size); e != nil {
+		db.f.Truncate(db.size)
+		return 0, e
+	}
+
+	if db.sync {
+		if e := db.f.Sync(); e != nil {
+			db.f.Truncate(db.size)
+			return 0, e
+		}
+	}
+
+	offset := db.size + kvRecordHeaderLength
+	db.size += int64(len(rec))
+	return offset, nil
+}
+
+// view runs f in a read-only transaction
+func (db *kvDB) view(f func(*kvTx) error) error {
+	db.RLock()
+	defer db.RUnlock()
+	if db.closed {
+		return errors.New("storage is closed")
+	}
+	return f(&kvTx{db: db})
+}
+
+// update runs f in a writable transaction. The changes made by f are
+// only committed if it returns no error.
+func (db *kvDB) update(f func(*kvTx) error) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return errors.New("storage is closed")
+	}
+
+	tx := &kvTx{db: db, writes: make(map[string][]byte)}
+	if e := f(tx); e != nil {
+		return e
+	}
+	return tx.commit()
+}
+
+func (tx *kvTx) get(key string) ([]byte, error) {
+	if v, ok := tx.writes[key]; ok {
+		return v, nil
+	}
+	ref, ok := tx.db.index[key]
+	if !ok {
+		return nil, nil
+	}
+	return tx.db.readValue(ref)
+}
+
+func (tx *kvTx) put(key string, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.writes[key] = value
+}
+
+func (tx *kvTx) delete(key string) {
+	tx.writes[key] = nil
+}
+
+func (tx *kvTx) commit() error {
+	var payload []byte
+	for k, v := range tx.writes {
+		if v == nil {
+			if _, ok := tx.db.index[k]; !ok {
+				continue
+			}
+			payload = append(payload, kvOpDelete)
+			payload = appendData(payload, []byte(k))
+		} else {
+			payload = append(payload, kvOpPut)
+			payload = appendData(payload, []byte(k))
+			payload = appendData(payload, v)
+		}
+	}
+
+	if len(payload) == 0 {
+		return nil
+	}
+
+	offset, e := tx.db.appendRecord(payload)
+	if e != nil {
+		return e
+	}
+	return tx.db.apply(offset, payload)
+}
+
+func (db *kvDB) keys() []string {
+	db.RLock()
+	defer db.RUnlock()
+	res := make([]string, 0, len(db.index))
+	for k := range db.index {
+		res = append(res, k)
+	}
+	return res
+}
+
+func (db *kvDB) needsCompaction() bool {
+	db.RLock()
+	defer db.RUnlock()
+	garbage := db.size - int64(len(kvMagic)) - db.live
+	return garbage > kvMinCompactGarbage && garbage > db.live
+}
+
+// compact writes all live values into a new file, which then replaces the current one
+func (db *kvDB) compact() error {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return errors.New("storage is closed")
+	}
+
+	tmpName := db.path + ".compact"
+	nf, e := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if e != nil {
+		return e
+	}
+
+	ndb := &kvDB{
+		path:  db.path,
+		f:     nf,
+		sync:  db.sync,
+		index: make(map[string]kvValueRef),
+	}
+
+	if e := ndb.copyFrom(db); e != nil {
+		nf.Close()
+		os.Remove(tmpName)
+		return e
+	}
+
+	if e := lockFile(nf); e != nil {
+		nf.Close()
+		os.Remove(tmpName)
+		return e
+	}
+
+	if e := os.Rename(tmpName, db.path); e != nil {
+		nf.Close()
+		os.Remove(tmpName)
+		return e
+	}
+	syncDir(path.Dir(db.path))
+
+	db.f.Close()
+	db.f = nf
+	db.index = ndb.index
+	db.size = ndb.size
+	db.live = ndb.live
+	return nil
+}
+
+func (db *kvDB) copyFrom(old *kvDB) error {
+	if _, e := db.f.WriteAt(kvMagic, 0); e != nil {
+		return e
+	}
+	db.size = int64(len(kvMagic))
+
+	var payload []byte
+	flush := func() error {
+		if len(payload) == 0 {
+			return nil
+		}
+		offset, e := db.appendRecord(payload)
+		if e == nil {
+			e = db.apply(offset, payload)
+		}
+		payload = nil
+		return e
+	}
+
+	for k, ref := range old.index {
+		v, e := old.readValue(ref)
+		if e != nil {
+			return e
+		}
+		payload = append(payload, kvOpPut)
+		payload = appendData(payload, []byte(k))
+		payload = appendData(payload, v)
+		if len(payload) >= kvCompactBatchLength {
+			if e := flush(); e != nil {
+				return e
+			}
+		}
+	}
+
+	if e := flush(); e != nil {
+		return e
+	}
+	return db.f.Sync()
+}
+
+func (db *kvDB) close() error {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.f.Close()
+}
+
+func syncDir(name string) {
+	if d, e := os.Open(name); e == nil {
+		d.Sync()
+		d.Close()
+	}
+}
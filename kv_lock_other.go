@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package prekeyserver
+
+import "os"
+
+// lockFile does nothing on systems without flock, so it is up to the
+// administrator to make sure only one server uses a storage file
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,297 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The kv storage keeps all information for one from-string in one value of the
+// embedded key-value store, keyed by the from-string itself. Every operation
+// reads, changes and writes back that value inside of one transaction, so a
+// retrieval will hand out each prekey message exactly once, even with many
+// servers using the same storage.
+
+func init() {
+	RegisterStorageType("kv", createKVStorageFactoryFrom)
+}
+
+// kvStorageFactory closes the file when the last server using it has been
+// closed, and opens it again for the next server created with it
+type kvStorageFactory struct {
+	name  string
+	sync  bool
+	db    *kvDB
+	users *storageUsers
+}
+
+func createKVStorageFactoryFrom(params string) (Storage, error) {
+	name, opts, e := ParseStorageParameters(params, "sync")
+	if e != nil {
+		return nil, e
+	}
+
+	if name == "" {
+		return nil, errors.New("missing file name for kv storage")
+	}
+
+	sync := true
+	if v := opts.Get("sync"); v != "" {
+		if sync, e = strconv.ParseBool(v); e != nil {
+			return nil, fmt.Errorf("invalid value for sync: %s", v)
+		}
+	}
+
+	f := &kvStorageFactory{name: name, sync: sync}
+	if e := f.open(); e != nil {
+		return nil, e
+	}
+	f.users = &storageUsers{open: f.open, release: f.release}
+	return f, nil
+}
+
+func (f *kvStorageFactory) open() error {
+	db, e := openKV(f.name, f.sync)
+	if e != nil {
+		return e
+	}
+	f.db = db
+	return nil
+}
+
+func (f *kvStorageFactory) release() error {
+	return f.db.close()
+}
+
+func (f *kvStorageFactory) createStorage() (storage, error) {
+	if e := f.users.add(); e != nil {
+		return nil, e
+	}
+	return &kvStorage{db: f.db, users: f.users}, nil
+}
+
+type kvStorage struct {
+	db    *kvDB
+	users *storageUsers
+	storageClock
+}
+
+func newStorageEntry() *inMemoryStorageEntry {
+	return &inMemoryStorageEntry{
+		clientProfiles: make(map[uint32]*clientProfile),
+		prekeyProfiles: make(map[uint32]*prekeyProfile),
+		prekeyMessages: make(map[uint32][]*prekeyMessage),
+	}
+}
+
+func serializeStorageEntry(se *inMemoryStorageEntry) []byte {
+	tags := []uint32{}
+	seen := make(map[uint32]bool)
+	add := func(itag uint32) {
+		if !seen[itag] {
+			seen[itag] = true
+			tags = append(tags, itag)
+		}
+	}
+	for itag := range se.clientProfiles {
+		add(itag)
+	}
+	for itag := range se.prekeyProfiles {
+		add(itag)
+	}
+	for itag, pms := range se.prekeyMessages {
+		if len(pms) > 0 {
+			add(itag)
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	out := appendWord(nil, uint32(len(tags)))
+	for _, itag := range tags {
+		out = appendWord(out, itag)
+
+		var cp, pp []byte
+		if v, ok := se.clientProfiles[itag]; ok {
+			cp = v.serialize()
+		}
+		if v, ok := se.prekeyProfiles[itag]; ok {
+			pp = v.serialize()
+		}
+		out = appendData(out, cp)
+		out = appendData(out, pp)
+
+		pms := se.prekeyMessages[itag]
+		out = appendWord(out, uint32(len(pms)))
+		for _, pm := range pms {
+			out = appendData(out, pm.serialize())
+		}
+	}
+	return out
+}
+
+func deserializeStorageEntry(buf []byte) (*inMemoryStorageEntry, bool) {
+	se := newStorageEntry()
+	if len(buf) == 0 {
+		return se, true
+	}
+
+	buf, count, ok := extractWord(buf)
+	if !ok {
+		return nil, false
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var itag, npms uint32
+		var cpb, ppb []byte
+		if buf, itag, ok = extractWord(buf); !ok {
+			return nil, false
+		}
+		if buf, cpb, ok = extractData(buf); !ok {
+			return nil, false
+		}
+		if buf, ppb, ok = extractData(buf); !ok {
+			return nil, false
+		}
+
+		if len(cpb) > 0 {
+			cp := &clientProfile{}
+			if _, ok = cp.deserialize(cpb); !ok {
+				return nil, false
+			}
+			se.clientProfiles[itag] = cp
+		}
+
+		if len(ppb) > 0 {
+			pp := &prekeyProfile{}
+			if _, ok = pp.deserialize(ppb); !ok {
+				return nil, false
+			}
+			se.prekeyProfiles[itag] = pp
+		}
+
+		if buf, npms, ok = extractWord(buf); !ok {
+			return nil, false
+		}
+		for j := uint32(0); j < npms; j++ {
+			var pmb []byte
+			if buf, pmb, ok = extractData(buf); !ok {
+				return nil, false
+			}
+			pm := &prekeyMessage{}
+			if _, ok = pm.deserialize(pmb); !ok {
+				return nil, false
+			}
+			se.prekeyMessages[itag] = append(se.prekeyMessages[itag], pm)
+		}
+	}
+
+	return se, true
+}
+
+func kvGetEntry(tx *kvTx, from string) (*inMemoryStorageEntry, []byte, error) {
+	v, e := tx.get(from)
+	if e != nil {
+		return nil, nil, e
+	}
+	se, ok := deserializeStorageEntry(v)
+	if !ok {
+		return nil, nil, errors.New("corrupt entry in kv storage")
+	}
+	return se, v, nil
+}
+
+// updateEntry changes the entry for from with f, and only writes it back if
+// anything changed
+func (s *kvStorage) updateEntry(from string, f func(*inMemoryStorageEntry)) error {
+	return s.db.update(func(tx *kvTx) error {
+		se, old, e := kvGetEntry(tx, from)
+		if e != nil {
+			return e
+		}
+		f(se)
+
+		v := serializeStorageEntry(se)
+		if bytes.Equal(v, old) {
+			return nil
+		}
+		if v == nil {
+			tx.delete(from)
+		} else {
+			tx.put(from, v)
+		}
+		return nil
+	})
+}
+
+func (s *kvStorage) storeClientProfile(from string, cp *clientProfile) error {
+	return s.updateEntry(from, func(se *inMemoryStorageEntry) {
+		se.clientProfiles[cp.instanceTag] = cp
+	})
+}
+
+func (s *kvStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	if pp == nil {
+		return nil
+	}
+	return s.updateEntry(from, func(se *inMemoryStorageEntry) {
+		se.prekeyProfiles[pp.instanceTag] = pp
+	})
+}
+
+func (s *kvStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	if len(pms) == 0 {
+		return nil
+	}
+	return s.updateEntry(from, func(se *inMemoryStorageEntry) {
+		for _, pm := range pms {
+			se.prekeyMessages[pm.instanceTag] = append(se.prekeyMessages[pm.instanceTag], pm)
+		}
+	})
+}
+
+func (s *kvStorage) numberStored(from string, tag uint32) uint32 {
+	var res uint32
+	s.db.view(func(tx *kvTx) error {
+		se, _, e := kvGetEntry(tx, from)
+		if e != nil {
+			return e
+		}
+		res = uint32(len(se.prekeyMessages[tag]))
+		return nil
+	})
+	return res
+}
+
+func (s *kvStorage) retrieveFor(from string, accept ensembleFilter) ([]*prekeyEnsemble, error) {
+	var res []*prekeyEnsemble
+	e := s.updateEntry(from, func(se *inMemoryStorageEntry) {
+		res = se.retrieve(accept, s.now())
+	})
+	if e != nil {
+		return nil, e
+	}
+	return res, nil
+}
+
+func (s *kvStorage) cleanup() {
+	now := s.now()
+	for _, from := range s.db.keys() {
+		s.updateEntry(from, func(se *inMemoryStorageEntry) {
+			se.cleanup(now)
+		})
+	}
+
+	if s.db.needsCompaction() {
+		s.db.compact()
+	}
+}
+
+func (s *kvStorage) close() error {
+	return s.users.done()
+}
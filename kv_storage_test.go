@@ -0,0 +1,247 @@
+package prekeyserver
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func createTestKVStorage(name string) *kvStorage {
+	f, _ := createKVStorageFactoryFrom(name + "?sync=false")
+	res, _ := f.createStorage()
+	return res.(*kvStorage)
+}
+
+func (s *GenericServerSuite) Test_kvStorage_storesAndRetrievesEnsembles(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	gs := &GenericServer{rand: fixtureRand()}
+	ks := createTestKVStorage(path.Join(testDir, "prekeys.kv"))
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
+
+	c.Assert(ks.storeClientProfile("sita@example.org", sita.clientProfile), IsNil)
+	c.Assert(ks.storePrekeyProfile("sita@example.org", pp), IsNil)
+	c.Assert(ks.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm1, pm2}), IsNil)
+	c.Assert(ks.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(2))
+	c.Assert(ks.numberStored("sita@example.org", 0x42424242), Equals, uint32(0))
+	c.Assert(ks.numberStored("someone@example.org", sita.instanceTag), Equals, uint32(0))
+
+	res := retrieved(ks.retrieveFor("sita@example.org", nil))
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].cp.Equals(sita.clientProfile), Equals, true)
+	c.Assert(res[0].pp.Equals(pp), Equals, true)
+	c.Assert(res[0].pm.Equals(pm1), Equals, true)
+	c.Assert(ks.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+
+	res = retrieved(ks.retrieveFor("sita@example.org", nil))
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].pm.Equals(pm2), Equals, true)
+
+	c.Assert(retrieved(ks.retrieveFor("sita@example.org", nil)), HasLen, 0)
+	c.Assert(retrieved(ks.retrieveFor("someone@example.org", nil)), HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_kvStorage_keepsEverythingWhenReopened(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	gs := &GenericServer{rand: fixtureRand()}
+	name := path.Join(testDir, "prekeys.kv")
+	ks := createTestKVStorage(name)
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	ks.storeClientProfile("sita@example.org", sita.clientProfile)
+	ks.storePrekeyProfile("sita@example.org", pp)
+	ks.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm1})
+	ks.db.close()
+
+	ks = createTestKVStorage(name)
+	defer ks.db.close()
+	res := retrieved(ks.retrieveFor("sita@example.org", nil))
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].pm.Equals(pm1), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_kvStorageFactory_opensTheFileAgainForANewServer(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	gs := &GenericServer{rand: fixtureRand()}
+	f, _ := createKVStorageFactoryFrom(path.Join(testDir, "prekeys.kv") + "?sync=false")
+
+	first, _ := f.createStorage()
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	c.Assert(first.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm}), IsNil)
+	c.Assert(first.close(), IsNil)
+
+	second, _ := f.createStorage()
+	defer second.close()
+	c.Assert(second.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+	c.Assert(second.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm}), IsNil)
+}
+
+func (s *GenericServerSuite) Test_kvStorageFactory_reportsAFileThatCantBeOpenedAgain(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	name := path.Join(testDir, "prekeys.kv")
+	f, _ := createKVStorageFactoryFrom(name + "?sync=false")
+	first, _ := f.createStorage()
+	c.Assert(first.close(), IsNil)
+	os.WriteFile(name, []byte("not a storage file"), 0600)
+
+	st, e := f.createStorage()
+	c.Assert(e, ErrorMatches, "not a prekey storage file")
+	c.Assert(st, IsNil)
+}
+
+func (s *GenericServerSuite) Test_realFactory_NewServerWithConfig_reportsAStorageThatCantBeOpenedAgain(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	rf := &realFactory{r: fixtureRand()}
+	name := path.Join(testDir, "prekeys.kv")
+	st, _ := rf.LoadStorageType("kv:" + name + "?sync=false")
+	conf := validServerConfig(rf)
+	conf.Storage = st
+	first, e := rf.NewServerWithConfig(conf)
+	c.Assert(e, IsNil)
+	c.Assert(first.Close(), IsNil)
+	os.WriteFile(name, []byte("not a storage file"), 0600)
+
+	res, e := rf.NewServerWithConfig(conf)
+	c.Assert(res, IsNil)
+	c.Assert(errors.Is(e, ErrStorage), Equals, true)
+	c.Assert(e, ErrorMatches, "couldn't open the storage: not a prekey storage file")
+}
+
+func (s *GenericServerSuite) Test_realFactory_NewServer_reportsAStorageThatCantBeOpenedAgainForEveryMessage(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	rf := &realFactory{r: fixtureRand()}
+	name := path.Join(testDir, "prekeys.kv")
+	st, _ := rf.LoadStorageType("kv:" + name + "?sync=false")
+	c.Assert(rf.NewServer("prekeys.example.org", rf.CreateKeypair(), 0, st, time.Minute, time.Minute, nil).Close(), IsNil)
+	os.WriteFile(name, []byte("not a storage file"), 0600)
+
+	gs := rf.NewServer("prekeys.example.org", rf.CreateKeypair(), 0, st, time.Minute, time.Minute, nil).(*GenericServer)
+	defer gs.Close()
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	c.Assert(gs.storage().storePrekeyMessages("sita@example.org", []*prekeyMessage{pm}), ErrorMatches, "not a prekey storage file")
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(0))
+}
+
+func (s *GenericServerSuite) Test_kvStorage_storePrekeyMessages_keepsEveryMessageUnderItsOwnInstanceTag(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	gs := &GenericServer{rand: fixtureRand()}
+	ks := createTestKVStorage(path.Join(testDir, "prekeys.kv"))
+	defer ks.close()
+
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pm2, _ := generatePrekeyMessage(gs, 0x42424242)
+	c.Assert(ks.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm1, pm2}), IsNil)
+
+	c.Assert(ks.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+	c.Assert(ks.numberStored("sita@example.org", 0x42424242), Equals, uint32(1))
+}
+
+func (s *GenericServerSuite) Test_kvStorage_retrieveFor_handsOutEachPrekeyMessageOnce(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	gs := &GenericServer{rand: fixtureRand()}
+	ks := createTestKVStorage(path.Join(testDir, "prekeys.kv"))
+	defer ks.db.close()
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pms := []*prekeyMessage{}
+	for i := 0; i < 20; i++ {
+		pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+		pm.identifier = uint32(i)
+		pms = append(pms, pm)
+	}
+	ks.storeClientProfile("sita@example.org", sita.clientProfile)
+	ks.storePrekeyProfile("sita@example.org", pp)
+	ks.storePrekeyMessages("sita@example.org", pms)
+
+	var lock sync.Mutex
+	seen := make(map[uint32]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, pe := range retrieved(ks.retrieveFor("sita@example.org", nil)) {
+				lock.Lock()
+				seen[pe.pm.identifier]++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(seen, HasLen, 20)
+	for _, n := range seen {
+		c.Assert(n, Equals, 1)
+	}
+}
+
+func (s *GenericServerSuite) Test_kvStorage_cleanup_removesExpiredProfilesAndEmptyUsers(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	gs := &GenericServer{rand: fixtureRand()}
+	ks := createTestKVStorage(path.Join(testDir, "prekeys.kv"))
+	defer ks.db.close()
+
+	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2017, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pp2, _ := generatePrekeyProfile(gs, 0x42424242, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+
+	ks.storePrekeyProfile("someone@example.org", pp1)
+	ks.storePrekeyProfile("someone@example.org", pp2)
+	ks.storePrekeyProfile("someoneElse@example.org", pp1)
+	ks.storePrekeyProfile("someoneThird@example.org", pp1)
+	ks.storePrekeyMessages("someoneThird@example.org", []*prekeyMessage{pm1})
+
+	ks.cleanup()
+
+	keys := ks.db.keys()
+	c.Assert(keys, HasLen, 2)
+	c.Assert(ks.numberStored("someoneThird@example.org", sita.instanceTag), Equals, uint32(1))
+
+	ks.db.view(func(tx *kvTx) error {
+		se, _, _ := kvGetEntry(tx, "someone@example.org")
+		c.Assert(se.prekeyProfiles, HasLen, 1)
+		c.Assert(se.prekeyProfiles[0x42424242], Not(IsNil))
+		return nil
+	})
+}
+
+func (s *GenericServerSuite) Test_realFactory_LoadStorageType_returnsKVStorage(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	res, e := (&realFactory{}).LoadStorageType("kv:" + path.Join(testDir, "prekeys.kv") + "?sync=true")
+	c.Assert(e, IsNil)
+	c.Assert(res, FitsTypeOf, &kvStorageFactory{})
+	c.Assert(res.(*kvStorageFactory).db.sync, Equals, true)
+	res.(*kvStorageFactory).db.close()
+}
+
+func (s *GenericServerSuite) Test_createKVStorageFactoryFrom_reportsBadParameters(c *C) {
+	_, e := createKVStorageFactoryFrom("")
+	c.Assert(e, ErrorMatches, "missing file name for kv storage")
+
+	_, e = createKVStorageFactoryFrom("prekeys.kv?sync=maybe")
+	c.Assert(e, ErrorMatches, "invalid value for sync: maybe")
+
+	_, e = createKVStorageFactoryFrom("prekeys.kv?fast=true")
+	c.Assert(e, ErrorMatches, "unknown storage option: fast")
+
+	_, e = createKVStorageFactoryFrom("unknown/dir/please/dont/create/prekeys.kv")
+	c.Assert(e, ErrorMatches, "open unknown/dir/please/dont/create/prekeys.kv: no such file or directory")
+}
@@ -0,0 +1,188 @@
+package prekeyserver
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "gopkg.in/check.v1"
+)
+
+func kvGet(db *kvDB, key string) []byte {
+	var res []byte
+	db.view(func(tx *kvTx) error {
+		res, _ = tx.get(key)
+		return nil
+	})
+	return res
+}
+
+func kvPut(db *kvDB, key string, value []byte) error {
+	return db.update(func(tx *kvTx) error {
+		tx.put(key, value)
+		return nil
+	})
+}
+
+func (s *GenericServerSuite) Test_kvDB_keepsValuesWhenReopened(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	name := path.Join(testDir, "test.kv")
+
+	db, e := openKV(name, true)
+	c.Assert(e, IsNil)
+	c.Assert(kvPut(db, "one", []byte{0x01}), IsNil)
+	c.Assert(kvPut(db, "two", []byte{0x02, 0x02}), IsNil)
+	c.Assert(kvPut(db, "one", []byte{0x11}), IsNil)
+	c.Assert(db.update(func(tx *kvTx) error {
+		tx.delete("two")
+		return nil
+	}), IsNil)
+	c.Assert(db.close(), IsNil)
+
+	db, e = openKV(name, true)
+	c.Assert(e, IsNil)
+	defer db.close()
+	c.Assert(kvGet(db, "one"), DeepEquals, []byte{0x11})
+	c.Assert(kvGet(db, "two"), IsNil)
+	c.Assert(db.keys(), DeepEquals, []string{"one"})
+}
+
+func (s *GenericServerSuite) Test_kvDB_update_doesNotCommitWhenReturningAnError(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	db, _ := openKV(path.Join(testDir, "test.kv"), false)
+	defer db.close()
+
+	e := db.update(func(tx *kvTx) error {
+		tx.put("one", []byte{0x01})
+		return errors.New("something went wrong")
+	})
+
+	c.Assert(e, ErrorMatches, "something went wrong")
+	c.Assert(kvGet(db, "one"), IsNil)
+}
+
+func (s *GenericServerSuite) Test_kvDB_update_seesItsOwnWrites(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	db, _ := openKV(path.Join(testDir, "test.kv"), false)
+	defer db.close()
+
+	var seen []byte
+	db.update(func(tx *kvTx) error {
+		tx.put("one", []byte{0x01})
+		seen, _ = tx.get("one")
+		return nil
+	})
+
+	c.Assert(seen, DeepEquals, []byte{0x01})
+}
+
+func (s *GenericServerSuite) Test_kvDB_dropsAnUnfinishedTransactionWhenOpened(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	name := path.Join(testDir, "test.kv")
+
+	db, _ := openKV(name, true)
+	kvPut(db, "one", []byte{0x01})
+	sizeAfterFirst := db.size
+	kvPut(db, "two", []byte{0x02})
+	db.close()
+
+	content, _ := ioutil.ReadFile(name)
+	ioutil.WriteFile(name, content[:len(content)-3], 0600)
+
+	db, e := openKV(name, true)
+	c.Assert(e, IsNil)
+	defer db.close()
+	c.Assert(kvGet(db, "one"), DeepEquals, []byte{0x01})
+	c.Assert(kvGet(db, "two"), IsNil)
+
+	fi, _ := os.Stat(name)
+	c.Assert(fi.Size(), Equals, sizeAfterFirst)
+}
+
+func (s *GenericServerSuite) Test_kvDB_dropsATransactionWithABadChecksum(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	name := path.Join(testDir, "test.kv")
+
+	db, _ := openKV(name, true)
+	kvPut(db, "one", []byte{0x01})
+	kvPut(db, "two", []byte{0x02})
+	db.close()
+
+	content, _ := ioutil.ReadFile(name)
+	content[len(content)-1] ^= 0xFF
+	ioutil.WriteFile(name, content, 0600)
+
+	db, _ = openKV(name, true)
+	defer db.close()
+	c.Assert(kvGet(db, "one"), DeepEquals, []byte{0x01})
+	c.Assert(kvGet(db, "two"), IsNil)
+}
+
+func (s *GenericServerSuite) Test_openKV_failsForAFileInAnotherFormat(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	name := path.Join(testDir, "test.kv")
+	ioutil.WriteFile(name, []byte("hello world, this is not it"), 0600)
+
+	_, e := openKV(name, true)
+	c.Assert(e, ErrorMatches, "not a prekey storage file")
+}
+
+func (s *GenericServerSuite) Test_openKV_failsWhenTheFileIsAlreadyInUse(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	name := path.Join(testDir, "test.kv")
+
+	db, _ := openKV(name, true)
+	defer db.close()
+
+	_, e := openKV(name, true)
+	c.Assert(e, ErrorMatches, "storage file is already in use")
+}
+
+func (s *GenericServerSuite) Test_kvDB_compact_keepsOnlyTheLiveValues(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+	name := path.Join(testDir, "test.kv")
+
+	db, _ := openKV(name, false)
+	big := make([]byte, 1024)
+	for i := 0; i < 2048; i++ {
+		kvPut(db, "one", big)
+	}
+	kvPut(db, "two", []byte{0x02})
+	c.Assert(db.needsCompaction(), Equals, true)
+
+	c.Assert(db.compact(), IsNil)
+
+	c.Assert(db.needsCompaction(), Equals, false)
+	fi, _ := os.Stat(name)
+	c.Assert(fi.Size() < 2048, Equals, true)
+	c.Assert(kvGet(db, "one"), DeepEquals, big)
+	c.Assert(kvPut(db, "three", []byte{0x03}), IsNil)
+	c.Assert(db.close(), IsNil)
+
+	db, _ = openKV(name, false)
+	defer db.close()
+	c.Assert(kvGet(db, "one"), DeepEquals, big)
+	c.Assert(kvGet(db, "two"), DeepEquals, []byte{0x02})
+	c.Assert(kvGet(db, "three"), DeepEquals, []byte{0x03})
+}
+
+func (s *GenericServerSuite) Test_kvDB_failsAfterClose(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	db, _ := openKV(path.Join(testDir, "test.kv"), false)
+	db.close()
+
+	c.Assert(kvPut(db, "one", []byte{0x01}), ErrorMatches, "storage is closed")
+}
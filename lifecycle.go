@@ -0,0 +1,177 @@
+package prekeyserver
+
+import (
+	"context"
+	"sync"
+)
+
+// serverState is where a server is in its life. A server is started by Start,
+// and stops taking messages as soon as Shutdown or Close is called. It is
+// closed once everything it holds has been let go of.
+type serverState int
+
+const (
+	serverNew serverState = iota
+	serverRunning
+	serverShuttingDown
+	serverClosed
+)
+
+// lifecycle keeps track of the messages being handled, so a server that is
+// shutting down can wait for them before it lets go of its sessions and storage.
+// The zero value is a new server.
+type lifecycle struct {
+	state    serverState
+	inFlight sync.WaitGroup
+	// abandon is done when the server stops waiting for the messages being
+	// handled. Their contexts are canceled at that point.
+	abandon    context.Context
+	abandonAll context.CancelFunc
+
+	releaseOnce sync.Once
+	releaseErr  error
+	sync.Mutex
+}
+
+// expects the lock to be held
+func (l *lifecycle) init() {
+	if l.abandon == nil {
+		l.abandon, l.abandonAll = context.WithCancel(context.Background())
+	}
+}
+
+// Start starts the background maintenance of the server. A server that hasn't
+// been started cleans up after every message it handles instead, and has no
+// goroutines of its own to stop, other than the one for its hooks. Start
+// returns an error of kind ErrServerClosed if the server has been shut down.
+func (g *GenericServer) Start() error {
+	g.life.Lock()
+	defer g.life.Unlock()
+
+	switch g.life.state {
+	case serverNew:
+		g.life.init()
+		g.maintenance.start()
+		g.life.state = serverRunning
+	case serverShuttingDown, serverClosed:
+		return newError(ErrServerClosed, "server has been shut down")
+	}
+	return nil
+}
+
+// started returns whether the maintenance of the server runs in the background
+func (g *GenericServer) started() bool {
+	g.life.Lock()
+	defer g.life.Unlock()
+
+	return g.life.state == serverRunning
+}
+
+// enter registers a message that is about to be handled. It returns the
+// context to handle the message with, which is canceled if the server gives up
+// waiting for it, and a function to call when the message has been handled.
+func (g *GenericServer) enter(ctx context.Context) (context.Context, func(), error) {
+	g.life.Lock()
+	if g.life.state >= serverShuttingDown {
+		g.life.Unlock()
+		return nil, nil, newError(ErrServerClosed, "server has been shut down")
+	}
+	g.life.init()
+	g.life.inFlight.Add(1)
+	abandon := g.life.abandon
+	g.life.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(abandon, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		g.life.inFlight.Done()
+	}, nil
+}
+
+// Shutdown stops the server from taking new messages, and waits for the
+// messages being handled to finish. If the context is done before that, the
+// messages still being handled are abandoned - their contexts are canceled, and
+// the server waits for them to return. After that, the background maintenance
+// and the hooks are stopped, the unfinished DAKEs and fragments are thrown away
+// and the storage is closed. The hooks get to finish the events that are waiting
+// for them until the context is done. Shutdown returns the error of the context if it had to abandon
+// messages, or an error from closing the storage.
+// Calling Shutdown more than once is safe, and every call waits for the server to be closed.
+func (g *GenericServer) Shutdown(ctx context.Context) error {
+	abandoned, e := g.shutdown(ctx)
+	if e != nil {
+		return e
+	}
+	if abandoned {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Close shuts down the server without waiting for the messages being handled,
+// which are abandoned straight away
+func (g *GenericServer) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, e := g.shutdown(ctx)
+	return e
+}
+
+func (g *GenericServer) shutdown(ctx context.Context) (bool, error) {
+	g.life.Lock()
+	g.life.init()
+	if g.life.state < serverShuttingDown {
+		g.life.state = serverShuttingDown
+	}
+	g.life.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		g.life.inFlight.Wait()
+		close(drained)
+	}()
+
+	abandoned := false
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		select {
+		case <-drained:
+		default:
+			abandoned = true
+			g.life.abandonAll()
+			<-drained
+		}
+	}
+
+	g.life.releaseOnce.Do(func() {
+		g.life.releaseErr = g.release(ctx)
+		g.life.Lock()
+		g.life.state = serverClosed
+		g.life.Unlock()
+	})
+	return abandoned, g.life.releaseErr
+}
+
+// release lets go of everything the server holds, once no messages are being
+// handled anymore. The hooks are stopped before the storage is closed, since
+// they count the prekey messages left in it.
+func (g *GenericServer) release(ctx context.Context) error {
+	g.maintenance.stop()
+	g.hooks.stop(ctx)
+	if g.sessions != nil {
+		g.sessions.closeAll()
+	}
+	if g.fragmentations != nil {
+		g.fragmentations.clear()
+	}
+	if g.storageImpl == nil {
+		return nil
+	}
+	if e := g.storageImpl.close(); e != nil {
+		return wrapError(ErrStorage, "couldn't close storage", e)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+const retrievalQueryForSita = "AAQQEkRVEQAAABBzaXRhQGV4YW1wbGUub3JnAAAAAQQ=."
+
+// blockingServer returns a server where every message waits in middleware until
+// release is closed, or until its context is done. Entering the middleware is
+// reported on entered.
+func blockingServer(c *C) (gs *GenericServer, entered chan struct{}, release chan struct{}) {
+	f := &realFactory{r: fixtureRand()}
+	conf := validServerConfig(f)
+	entered = make(chan struct{}, 10)
+	release = make(chan struct{})
+	conf.Middleware = []Middleware{func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) ([]byte, error) {
+			entered <- struct{}{}
+			select {
+			case <-release:
+			case <-r.Context.Done():
+				return nil, r.Context.Err()
+			}
+			return next.HandleMessage(r)
+		})
+	}}
+	res, e := f.NewServerWithConfig(conf)
+	c.Assert(e, IsNil)
+	return res.(*GenericServer), entered, release
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Start_canBeCalledMoreThanOnce(c *C) {
+	gs, _, _ := blockingServer(c)
+	defer gs.Close()
+
+	c.Assert(gs.Start(), IsNil)
+	c.Assert(gs.Start(), IsNil)
+	c.Assert(gs.life.state, Equals, serverRunning)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Handle_doesNotStartTheServer(c *C) {
+	gs := testServerForInitiator()
+
+	gs.Handle("rama@example.org", retrievalQueryForSita)
+
+	c.Assert(gs.life.state, Equals, serverNew)
+	c.Assert(gs.started(), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Handle_leavesNoGoroutinesBehindWhenNotStarted(c *C) {
+	f := &realFactory{r: fixtureRand()}
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		gs, e := f.NewServerWithConfig(validServerConfig(f))
+		c.Assert(e, IsNil)
+		gs.Handle("rama@example.org", retrievalQueryForSita)
+	}
+
+	c.Assert(runtime.NumGoroutine() <= before, Equals, true)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Shutdown_waitsForMessagesBeingHandled(c *C) {
+	gs, entered, release := blockingServer(c)
+	var handleErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, handleErr = gs.Handle("rama@example.org", retrievalQueryForSita)
+	}()
+	<-entered
+
+	shutdown := make(chan error)
+	go func() { shutdown <- gs.Shutdown(context.Background()) }()
+	waitFor(c, func() bool {
+		gs.life.Lock()
+		defer gs.life.Unlock()
+		return gs.life.state == serverShuttingDown
+	})
+	_, e := gs.Handle("sita@example.org", retrievalQueryForSita)
+	c.Assert(e, ErrorMatches, "server has been shut down")
+	c.Assert(errors.Is(e, ErrServerClosed), Equals, true)
+
+	close(release)
+	c.Assert(<-shutdown, IsNil)
+	wg.Wait()
+	c.Assert(handleErr, IsNil)
+	c.Assert(gs.life.state, Equals, serverClosed)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Shutdown_abandonsMessagesWhenTheContextIsDone(c *C) {
+	gs, entered, _ := blockingServer(c)
+	var handleErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, handleErr = gs.Handle("rama@example.org", retrievalQueryForSita)
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	e := gs.Shutdown(ctx)
+
+	c.Assert(e, Equals, context.DeadlineExceeded)
+	wg.Wait()
+	c.Assert(handleErr, Equals, context.Canceled)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Close_throwsAwaySessionsAndFragments(c *C) {
+	gs, _, _ := blockingServer(c)
+	sess := gs.testSession("sita@example.org")
+	gs.fragmentations.newFragmentReceived("rama@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,AAQ1,")
+
+	c.Assert(gs.Close(), IsNil)
+
+	c.Assert(sess.state(), Equals, sessionClosed)
+	c.Assert(gs.hasSession("sita@example.org"), Equals, false)
+	c.Assert(gs.cleanupFragments(), Equals, 0)
+	c.Assert(gs.fragmentations.count(), Equals, 0)
+	c.Assert(gs.Start(), ErrorMatches, "server has been shut down")
+	c.Assert(gs.Close(), IsNil)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Close_closesTheBackendWithTheLastServerUsingIt(c *C) {
+	f := &realFactory{r: fixtureRand()}
+	b := newSerializingBackend()
+	conf := validServerConfig(f)
+	conf.Storage = StorageFromBackend(b)
+	gs1, _ := f.NewServerWithConfig(conf)
+	gs2, _ := f.NewServerWithConfig(conf)
+
+	c.Assert(gs1.Close(), IsNil)
+	c.Assert(gs1.Close(), IsNil)
+	c.Assert(b.closed, Equals, 0)
+
+	c.Assert(gs2.Shutdown(context.Background()), IsNil)
+	c.Assert(b.closed, Equals, 1)
+}
+
+// serverWithBlockedHooks returns a server whose hooks are busy with an event
+// until the returned channel is closed, with three retrievals waiting behind it
+func serverWithBlockedHooks(c *C) (*GenericServer, *recordingHooks, chan struct{}) {
+	f := &realFactory{r: fixtureRand()}
+	conf := validServerConfig(f)
+	h := newRecordingHooks(0)
+	conf.Hooks = h
+	res, e := f.NewServerWithConfig(conf)
+	c.Assert(e, IsNil)
+	gs := res.(*GenericServer)
+	storeSitaPrekeys(gs, 3)
+
+	started := make(chan struct{})
+	block := make(chan struct{})
+	gs.hooks.dispatch(func(Hooks) {
+		close(started)
+		<-block
+	})
+	<-started
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+	for i := 0; i < 3; i++ {
+		_, e := gs.Handle("rama@example.org", q)
+		c.Assert(e, IsNil)
+	}
+	return gs, h, block
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Shutdown_letsTheHooksFinishTheEventsWaiting(c *C) {
+	gs, h, block := serverWithBlockedHooks(c)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- gs.Shutdown(ctx)
+	}()
+	close(block)
+
+	c.Assert(<-done, IsNil)
+	<-gs.hooks.done
+	c.Assert(h.events, HasLen, 3)
+}
+
+// countWatchingStorage blocks counts, and remembers if it was closed during one
+type countWatchingStorage struct {
+	storage
+	entered chan struct{}
+	block   chan struct{}
+
+	sync.Mutex
+	counting            bool
+	counts              int
+	closedWhileCounting bool
+}
+
+func (s *countWatchingStorage) numberStored(from string, tag uint32) uint32 {
+	s.Lock()
+	s.counting = true
+	s.Unlock()
+	close(s.entered)
+	<-s.block
+
+	s.Lock()
+	defer s.Unlock()
+	s.counting = false
+	s.counts++
+	return s.storage.numberStored(from, tag)
+}
+
+func (s *countWatchingStorage) close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closedWhileCounting = s.counting
+	return s.storage.close()
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Close_waitsForACountOfTheHooksBeforeClosingTheStorage(c *C) {
+	gs := testServerForInitiator()
+	gs.hooks = newHookDispatcher(newRecordingHooks(2), func(error) {})
+	storeSitaPrekeys(gs, 3)
+	st := &countWatchingStorage{storage: gs.storageImpl, entered: make(chan struct{}), block: make(chan struct{})}
+	gs.storageImpl = st
+	q := encodeMessage(CreateEnsembleRetrievalQuery(0x1234ABCD, "sita@example.org", []byte{'4'})) + "."
+	res, e := gs.Handle("rama@example.org", q)
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 1)
+	<-st.entered
+
+	closed := make(chan error)
+	go func() { closed <- gs.Close() }()
+	time.Sleep(10 * time.Millisecond)
+	close(st.block)
+
+	c.Assert(<-closed, IsNil)
+	st.Lock()
+	c.Assert(st.counts, Equals, 1)
+	c.Assert(st.closedWhileCounting, Equals, false)
+	st.Unlock()
+	_, _, ok := gs.hooks.count(st, prekeyKey{"sita@example.org", sita.instanceTag})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Close_dropsTheHookEventsWaitingAndStopsTheHooks(c *C) {
+	gs, h, block := serverWithBlockedHooks(c)
+
+	c.Assert(gs.Close(), IsNil)
+	close(block)
+
+	select {
+	case <-gs.hooks.done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the hooks were never stopped")
+	}
+	c.Assert(h.events, HasLen, 0)
+}
@@ -1,6 +1,7 @@
 package prekeyserver
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +27,15 @@ func hasLocks(dir string, without string) bool {
 //  if there is already a lock file there, it will wait
 //  until it's been removed
 func lockDir(dirName string) uint64 {
+	token, _ := lockDirContext(context.Background(), dirName)
+	return token
+}
+
+// lockDirContext works like lockDir, but will stop waiting and return the
+// error of the context when it is done
+func lockDirContext(ctx context.Context, dirName string) (uint64, error) {
+	// Tokens have to be unique between everyone sharing the directory, so they
+	// can't come from the randomness of a server, which might be fixed
 	token := rand.Uint64()
 	lockName := fmt.Sprintf(".lock-%016X", token)
 	b := make([]byte, 8)
@@ -35,12 +45,16 @@ func lockDir(dirName string) uint64 {
 
 	for {
 		for hasLocks(dirName, "") {
-			time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(time.Duration(rand.Intn(100)) * time.Millisecond):
+			}
 		}
 		ioutil.WriteFile(lockFile, b, 0600)
 		if !hasLocks(dirName, lockName) {
 			os.Rename(lockFile, finalLockFile)
-			return token
+			return token, nil
 		}
 		// Reaching this line with a test would be very laborous and fragile
 		// since we would have to fake a race condition from a test
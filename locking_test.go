@@ -1,6 +1,7 @@
 package prekeyserver
 
 import (
+	"context"
 	"encoding/binary"
 	"io/ioutil"
 	"os"
@@ -65,3 +66,21 @@ func (s *GenericServerSuite) Test_fileStorage_unlockDir_doesntRemoveALockForAnot
 
 	c.Assert(entryExists(lfile), Equals, true)
 }
+
+func (s *GenericServerSuite) Test_fileStorage_lockDirContext_stopsWaitingWhenTheContextIsDone(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	lfile := path.Join(testDir, ".lock")
+	ioutil.WriteFile(lfile, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, 0600)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(50)*time.Millisecond)
+	defer cancel()
+
+	_, e := lockDirContext(ctx, testDir)
+
+	c.Assert(e, Equals, context.DeadlineExceeded)
+	b, _ := ioutil.ReadFile(lfile)
+	c.Assert(b, DeepEquals, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+	c.Assert(hasLocks(testDir, ".lock"), Equals, false)
+}
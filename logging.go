@@ -0,0 +1,105 @@
+package prekeyserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// The outcomes of handling a message, as they are logged
+const (
+	outcomeHandled  = "handled"
+	outcomePending  = "pending"
+	outcomeRejected = "rejected"
+	outcomeFailed   = "failed"
+	outcomeCanceled = "canceled"
+)
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// CreateLogger returns a structured logger writing to w. The level can be one
+// of debug, info, warn or error, and the format either text or json.
+func CreateLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if e := l.UnmarshalText([]byte(level)); e != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// senderHash identifies a sender in the logs, without writing down who it is
+func senderHash(from string) string {
+	h := sha256.Sum256([]byte(from))
+	return hex.EncodeToString(h[:8])
+}
+
+// instanceTagOf returns the instance tag of the messages that start with one
+func instanceTagOf(msg []byte) uint32 {
+	switch messageTypeOf(msg) {
+	case messageTypeDAKE1, messageTypeDAKE3, messageTypeEnsembleRetrievalQuery:
+		if _, tag, ok := extractWord(msg[indexOfMessageType+1:]); ok {
+			return tag
+		}
+	}
+	return 0
+}
+
+func outcomeOf(p *handlingProgress, err error) (string, slog.Level) {
+	switch {
+	case err == nil && p.pending:
+		return outcomePending, slog.LevelDebug
+	case err == nil:
+		return outcomeHandled, slog.LevelInfo
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return outcomeCanceled, slog.LevelWarn
+	case IsClientError(err):
+		return outcomeRejected, slog.LevelWarn
+	}
+	return outcomeFailed, slog.LevelError
+}
+
+func (g *GenericServer) log() *slog.Logger {
+	if g.logger == nil {
+		return discardLogger
+	}
+	return g.logger
+}
+
+// logHandled writes one record for each message given to Handle. Only the
+// type, instance tag and outcome are logged - never the message itself, since
+// it can contain key material.
+func (g *GenericServer) logHandled(ctx context.Context, from string, p *handlingProgress, err error) {
+	outcome, level := outcomeOf(p, err)
+	l := g.log()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("sender", senderHash(from)),
+		slog.String("outcome", outcome),
+	}
+	if p.messageType != 0 {
+		attrs = append(attrs, slog.String("message_type", fmt.Sprintf("0x%02X", p.messageType)))
+	}
+	if p.instanceTag != 0 {
+		attrs = append(attrs, slog.String("instance_tag", fmt.Sprintf("0x%08X", p.instanceTag)))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	l.LogAttrs(ctx, level, "message "+outcome, attrs...)
+}
@@ -0,0 +1,87 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func loggingTestServer(c *C, level string) (*GenericServer, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l, e := CreateLogger(&buf, level, "json")
+	c.Assert(e, IsNil)
+	gs := testServerForInitiator()
+	gs.logger = l
+	return gs, &buf
+}
+
+func logRecords(c *C, buf *bytes.Buffer) []map[string]interface{} {
+	res := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		r := map[string]interface{}{}
+		c.Assert(json.Unmarshal([]byte(line), &r), IsNil)
+		res = append(res, r)
+	}
+	return res
+}
+
+func (s *GenericServerSuite) Test_Handle_logsTheOutcomeOfAMessageWithoutKeyMaterial(c *C) {
+	gs, buf := loggingTestServer(c, "debug")
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+	d1 := in.DAKE1()
+
+	res, e := gs.Handle("sita@example.org", encodeMessage(d1)+".")
+	c.Assert(e, IsNil)
+
+	rs := logRecords(c, buf)
+	c.Assert(rs, HasLen, 1)
+	c.Assert(rs[0]["level"], Equals, "INFO")
+	c.Assert(rs[0]["msg"], Equals, "message handled")
+	c.Assert(rs[0]["outcome"], Equals, "handled")
+	c.Assert(rs[0]["sender"], Equals, senderHash("sita@example.org"))
+	c.Assert(rs[0]["message_type"], Equals, "0x35")
+	c.Assert(rs[0]["instance_tag"], Equals, "0x1245ABCD")
+
+	c.Assert(strings.Contains(buf.String(), "sita@example.org"), Equals, false)
+	c.Assert(strings.Contains(buf.String(), encodeMessage(d1)), Equals, false)
+	c.Assert(strings.Contains(buf.String(), res[0]), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_Handle_logsARejectedMessageAsAWarning(c *C) {
+	gs, buf := loggingTestServer(c, "info")
+
+	gs.Handle("someone@example.org", "AAQ1.")
+
+	rs := logRecords(c, buf)
+	c.Assert(rs, HasLen, 1)
+	c.Assert(rs[0]["level"], Equals, "WARN")
+	c.Assert(rs[0]["outcome"], Equals, "rejected")
+	c.Assert(rs[0]["message_type"], Equals, "0x35")
+	c.Assert(rs[0]["error"], Matches, "invalid message of type 0x35: .*")
+}
+
+func (s *GenericServerSuite) Test_Handle_logsAPendingFragmentOnlyForDebugging(c *C) {
+	gs, buf := loggingTestServer(c, "info")
+
+	gs.Handle("someone@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,AAQ1,")
+	c.Assert(buf.Len(), Equals, 0)
+
+	gs, buf = loggingTestServer(c, "debug")
+	gs.Handle("someone@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,AAQ1,")
+	rs := logRecords(c, buf)
+	c.Assert(rs, HasLen, 1)
+	c.Assert(rs[0]["outcome"], Equals, "pending")
+}
+
+func (s *GenericServerSuite) Test_CreateLogger_rejectsUnknownLevelsAndFormats(c *C) {
+	_, e := CreateLogger(&bytes.Buffer{}, "loud", "text")
+	c.Assert(e, ErrorMatches, `unknown log level "loud"`)
+
+	_, e = CreateLogger(&bytes.Buffer{}, "warn", "xml")
+	c.Assert(e, ErrorMatches, `unknown log format "xml"`)
+}
@@ -0,0 +1,162 @@
+package prekeyserver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Maintenance decides how often a server cleans up after itself. The cleanup
+// runs in the background, so it doesn't slow down the handling of messages.
+// An interval of zero gets the default, and a negative interval turns that
+// cleanup off.
+type Maintenance struct {
+	// SessionInterval is how often expired sessions are removed. The default
+	// is half the session timeout.
+	SessionInterval time.Duration
+	// FragmentInterval is how often expired fragments are removed. The
+	// default is half the fragment timeout.
+	FragmentInterval time.Duration
+	// StorageInterval is how often expired profiles are removed from the
+	// storage. The default is one hour.
+	StorageInterval time.Duration
+	// Jitter moves every run up to this fraction of the interval earlier or
+	// later, so servers started together don't all clean up at the same time.
+	// It has to be at least 0 and less than 1.
+	Jitter float64
+}
+
+const defaultStorageCleanupInterval = time.Hour
+
+// minDefaultInterval keeps the default intervals from getting too short for very short timeouts
+const minDefaultInterval = time.Second
+
+// The names of the maintenance tasks, as used in the metrics
+const (
+	taskSessions  = "sessions"
+	taskFragments = "fragments"
+	taskStorage   = "storage"
+)
+
+// maintenanceTask is one kind of cleanup. It returns how many things it
+// removed, or -1 if it can't tell.
+type maintenanceTask struct {
+	name     string
+	interval time.Duration
+	run      func(context.Context) int
+}
+
+// maintenance runs the cleanup tasks of a server, each in its own goroutine
+type maintenance struct {
+	tasks   []maintenanceTask
+	jitter  float64
+	clock   Clock
+	metrics *Metrics
+	failed  func(error)
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func intervalOrDefault(interval, def time.Duration) time.Duration {
+	switch {
+	case interval != 0:
+		return interval
+	case def < minDefaultInterval:
+		return minDefaultInterval
+	}
+	return def
+}
+
+// maintenanceFor returns the maintenance of the server with the given settings
+func (g *GenericServer) maintenanceFor(conf Maintenance) *maintenance {
+	m := &maintenance{jitter: conf.Jitter, clock: g.clock, metrics: g.metrics}
+	m.failed = func(e error) {
+		g.log().Error("maintenance failed", "error", e.Error())
+	}
+	m.add(taskSessions, intervalOrDefault(conf.SessionInterval, g.sessionTimeout/2), func(context.Context) int {
+		return g.cleanupSessions()
+	})
+	m.add(taskFragments, intervalOrDefault(conf.FragmentInterval, g.fragmentationTimeout/2), func(context.Context) int {
+		return g.cleanupFragments()
+	})
+	m.add(taskStorage, intervalOrDefault(conf.StorageInterval, defaultStorageCleanupInterval), func(ctx context.Context) int {
+		g.storageFor(ctx).cleanup()
+		return -1
+	})
+	return m
+}
+
+func (m *maintenance) add(name string, interval time.Duration, run func(context.Context) int) {
+	if interval > 0 {
+		m.tasks = append(m.tasks, maintenanceTask{name: name, interval: interval, run: run})
+	}
+}
+
+func (m *maintenance) start() {
+	if m == nil {
+		return
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for _, t := range m.tasks {
+		m.done.Add(1)
+		go m.loop(t)
+	}
+}
+
+// stop makes all tasks finish, and waits for the ones that are running
+func (m *maintenance) stop() {
+	if m == nil || m.cancel == nil {
+		return
+	}
+	m.stopOnce.Do(func() {
+		m.cancel()
+		m.done.Wait()
+	})
+}
+
+func (m *maintenance) loop(t maintenanceTask) {
+	defer m.done.Done()
+	for {
+		fired, stop := newTimerFrom(m.clock, m.next(t.interval))
+		select {
+		case <-m.ctx.Done():
+			stop()
+			return
+		case <-fired:
+			m.runTask(t)
+		}
+	}
+}
+
+// next returns how long to wait for the next run, with jitter
+func (m *maintenance) next(interval time.Duration) time.Duration {
+	if m.jitter <= 0 {
+		return interval
+	}
+	spread := float64(interval) * m.jitter
+	return interval + time.Duration(spread*(2*rand.Float64()-1))
+}
+
+func (m *maintenance) runTask(t maintenanceTask) {
+	start := nowFrom(m.clock)
+	defer func() {
+		if x := recover(); x != nil {
+			m.failed(fmt.Errorf("%s cleanup panicked: %v", t.name, x))
+		}
+	}()
+	removed := t.run(m.ctx)
+	m.metrics.maintenanceRan(t.name, removed, nowFrom(m.clock).Sub(start))
+}
+
+func (g *GenericServer) cleanupSessions() int {
+	return g.sessions.cleanup(g.sessionTimeout)
+}
+
+func (g *GenericServer) cleanupFragments() int {
+	return g.fragmentations.cleanup(g.fragmentationTimeout)
+}
@@ -0,0 +1,223 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// lockedClock is a fixedClock that can be moved forward while a server is
+// running. Its timers fire when it's moved past them.
+type lockedClock struct {
+	sync.Mutex
+	t      time.Time
+	timers []*lockedClockTimer
+}
+
+type lockedClockTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *lockedClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *lockedClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.Lock()
+	defer c.Unlock()
+	t := &lockedClockTimer{at: c.t.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t.c, func() bool { return c.stop(t) }
+}
+
+func (c *lockedClock) stop(t *lockedClockTimer) bool {
+	c.Lock()
+	defer c.Unlock()
+	for ix, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:ix], c.timers[ix+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// waiting returns how many timers haven't fired yet
+func (c *lockedClock) waiting() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+func (c *lockedClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+	left := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.t) {
+			left = append(left, t)
+		} else {
+			t.c <- c.t
+		}
+	}
+	c.timers = left
+}
+
+func waitFor(c *C, cond func() bool) {
+	for end := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(end) {
+			c.Fatal("timed out waiting for maintenance")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *GenericServerSuite) Test_maintenance_removesExpiredThingsInTheBackground(c *C) {
+	clock := &lockedClock{t: time.Date(2028, 11, 5, 4, 0, 0, 0, time.UTC)}
+	f := &realFactory{r: fixtureRand()}
+	conf := validServerConfig(f)
+	conf.Clock = clock
+	conf.Maintenance = Maintenance{
+		SessionInterval:  time.Minute,
+		FragmentInterval: time.Minute,
+		StorageInterval:  time.Hour,
+		Jitter:           0.5,
+	}
+	res, e := f.NewServerWithConfig(conf)
+	c.Assert(e, IsNil)
+	gs := res.(*GenericServer)
+	c.Assert(gs.Start(), IsNil)
+	defer gs.Close()
+	storeSitaPrekeys(gs, 1)
+	gs.testSession("sita@example.org")
+	gs.fragmentations.newFragmentReceived("rama@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,AAQ1,")
+
+	waitFor(c, func() bool { return clock.waiting() == 3 })
+	clock.advance(2 * time.Hour)
+
+	st := gs.storage().(*inMemoryStorage)
+	hasPrekeyProfile := func() bool {
+		st.RLock()
+		pu := st.perUser["sita@example.org"]
+		st.RUnlock()
+		pu.Lock()
+		defer pu.Unlock()
+		return pu.prekeyProfiles[sita.instanceTag] != nil
+	}
+	waitFor(c, func() bool {
+		return !gs.sessions.has("sita@example.org") && gs.cleanupFragments() == 0 && !hasPrekeyProfile()
+	})
+	out := metricsOutput(c, gs.Metrics())
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_maintenance_removed_total\{task="sessions"\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_maintenance_runs_total\{task="storage"\} [1-9].*`)
+}
+
+func (s *GenericServerSuite) Test_maintenance_waitsForTheIntervalsOnTheClockOfTheServer(c *C) {
+	clock := &lockedClock{t: time.Date(2028, 11, 5, 4, 0, 0, 0, time.UTC)}
+	f := &realFactory{r: fixtureRand()}
+	conf := validServerConfig(f)
+	conf.Clock = clock
+	conf.SessionTimeout = 10 * time.Minute
+	conf.Maintenance = Maintenance{SessionInterval: 5 * time.Minute, FragmentInterval: -1, StorageInterval: -1}
+	res, _ := f.NewServerWithConfig(conf)
+	gs := res.(*GenericServer)
+	c.Assert(gs.Start(), IsNil)
+	defer gs.Close()
+	waitFor(c, func() bool { return clock.waiting() == 1 })
+
+	clock.advance(5*time.Minute - time.Second)
+	c.Assert(clock.waiting(), Equals, 1)
+	c.Assert(gs.metrics.maintenanceRuns.with(taskSessions).value(), Equals, uint64(0))
+
+	clock.advance(time.Second)
+	waitFor(c, func() bool { return gs.metrics.maintenanceRuns.with(taskSessions).value() == 1 })
+	waitFor(c, func() bool { return clock.waiting() == 1 })
+	clock.advance(5 * time.Minute)
+	waitFor(c, func() bool { return gs.metrics.maintenanceRuns.with(taskSessions).value() == 2 })
+
+	c.Assert(gs.Close(), IsNil)
+	c.Assert(clock.waiting(), Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Close_stopsTheMaintenance(c *C) {
+	f := &realFactory{r: fixtureRand()}
+	conf := validServerConfig(f)
+	conf.Maintenance.SessionInterval = time.Millisecond
+	res, _ := f.NewServerWithConfig(conf)
+	gs := res.(*GenericServer)
+	c.Assert(gs.Start(), IsNil)
+	waitFor(c, func() bool { return gs.metrics.maintenanceRuns.with(taskSessions).value() > 0 })
+
+	c.Assert(gs.Close(), IsNil)
+	runs := gs.metrics.maintenanceRuns.with(taskSessions).value()
+	time.Sleep(10 * time.Millisecond)
+
+	c.Assert(gs.metrics.maintenanceRuns.with(taskSessions).value(), Equals, runs)
+	c.Assert(gs.Close(), IsNil)
+}
+
+func (s *GenericServerSuite) Test_maintenanceFor_usesDefaultIntervalsAndSkipsTurnedOffTasks(c *C) {
+	gs := &GenericServer{sessionTimeout: 10 * time.Minute, fragmentationTimeout: time.Second}
+
+	m := gs.maintenanceFor(Maintenance{})
+	c.Assert(m.tasks, HasLen, 3)
+	c.Assert(m.tasks[0].interval, Equals, 5*time.Minute)
+	c.Assert(m.tasks[1].interval, Equals, minDefaultInterval)
+	c.Assert(m.tasks[2].interval, Equals, defaultStorageCleanupInterval)
+
+	m = gs.maintenanceFor(Maintenance{SessionInterval: time.Minute, StorageInterval: -1})
+	c.Assert(m.tasks, HasLen, 2)
+	c.Assert(m.tasks[0].interval, Equals, time.Minute)
+	c.Assert(m.tasks[1].name, Equals, taskFragments)
+}
+
+func (s *GenericServerSuite) Test_maintenance_next_staysWithinTheJitter(c *C) {
+	m := &maintenance{jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		d := m.next(time.Minute)
+		c.Assert(d >= 45*time.Second && d <= 75*time.Second, Equals, true)
+	}
+	c.Assert((&maintenance{}).next(time.Minute), Equals, time.Minute)
+}
+
+func (s *GenericServerSuite) Test_maintenance_reportsAPanickingTask(c *C) {
+	var failure error
+	m := &maintenance{ctx: context.Background(), failed: func(e error) { failure = e }}
+
+	m.runTask(maintenanceTask{name: "storage", run: func(context.Context) int { panic(errors.New("disk on fire")) }})
+
+	c.Assert(failure, ErrorMatches, "storage cleanup panicked: disk on fire")
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Handle_cleansUpAfterEveryMessageWhenNotStarted(c *C) {
+	clock := &fixedClock{time.Date(2028, 11, 5, 4, 0, 0, 0, time.UTC)}
+	gs := deterministicServer(c, clock)
+	gs.testSession("sita@example.org")
+	gs.fragmentations.newFragmentReceived("rama@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,AAQ1,")
+
+	clock.advance(2 * time.Hour)
+	gs.Handle("rama@example.org", retrievalQueryForSita)
+
+	c.Assert(gs.hasSession("sita@example.org"), Equals, false)
+	c.Assert(gs.fragmentations.count(), Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_Handle_leavesTheCleanupToTheMaintenanceWhenStarted(c *C) {
+	clock := &fixedClock{time.Date(2028, 11, 5, 4, 0, 0, 0, time.UTC)}
+	gs := deterministicServer(c, clock)
+	c.Assert(gs.Start(), IsNil)
+	defer gs.Close()
+	gs.testSession("sita@example.org")
+
+	clock.advance(2 * time.Hour)
+	gs.Handle("rama@example.org", retrievalQueryForSita)
+
+	c.Assert(gs.hasSession("sita@example.org"), Equals, true)
+}
@@ -1,47 +1,113 @@
 package prekeyserver
 
-import "errors"
+import "context"
 
 type messageHandler interface {
-	handleMessage(from string, message []byte) ([]byte, error)
-	handleInnerMessage(from string, message []byte) (serializable, error)
+	handleMessage(ctx context.Context, from string, message []byte) ([]byte, error)
+	handleInnerMessage(ctx context.Context, from string, message []byte) (serializable, error)
 }
 
 type otrngMessageHandler struct {
 	s *GenericServer
 }
 
-func (mh *otrngMessageHandler) handleMessage(from string, message []byte) ([]byte, error) {
-	r, e := mh.handleInnerMessage(from, message)
+func (mh *otrngMessageHandler) handleMessage(ctx context.Context, from string, message []byte) ([]byte, error) {
+	r, e := mh.handleInnerMessage(ctx, from, message)
 	if e != nil {
+		if r != nil {
+			return r.serialize(), e
+		}
+		return nil, e
+	}
+	// The storage might have stopped early because of the context, so the
+	// response can't be trusted anymore
+	if e := ctx.Err(); e != nil {
 		return nil, e
 	}
 	return r.serialize(), nil
 }
 
+func (mh *otrngMessageHandler) dakeFailedIf(mt uint8) {
+	if mt == messageTypeDAKE1 || mt == messageTypeDAKE3 {
+		mh.s.metrics.dakeFailed()
+	}
+}
+
 func (mh *otrngMessageHandler) shouldRestrict(from string, mt uint8) bool {
 	return (mt == messageTypeDAKE1 || mt == messageTypeDAKE3) && mh.s.rest(from)
 
 }
 
-func (mh *otrngMessageHandler) handleInnerMessage(from string, message []byte) (serializable, error) {
-	result, mt, e := parseMessage(message)
+// handleInnerMessage will turn a panic into a PanicError, and let it continue up
+// to Handle. That way a panic in a message nested inside a DAKE3 is reported for
+// the inner message, instead of becoming a failure message.
+// The message goes through the middleware of the server before it's handled.
+// A response can be returned together with an error, when the error should be
+// answered with a failure message.
+func (mh *otrngMessageHandler) handleInnerMessage(ctx context.Context, from string, message []byte) (serializable, error) {
+	p := &handlingProgress{messageType: messageTypeOf(message), stage: stageMiddleware}
+	defer func() {
+		if x := recover(); x != nil {
+			panic(p.asPanicError(x))
+		}
+	}()
+
+	h := mh.s.chain(HandlerFunc(func(r *Request) ([]byte, error) {
+		res, e := mh.handleRequest(r, p)
+		p.at(stageMiddleware)
+		if e != nil && res == nil {
+			return nil, e
+		}
+		return res.serialize(), e
+	}))
+
+	r, e := h.HandleMessage(&Request{
+		Context:     ctx,
+		From:        from,
+		MessageType: p.messageType,
+		Message:     message,
+	})
+	if e != nil && r == nil {
+		return nil, e
+	}
+	return &serializedMessage{b: r}, e
+}
+
+// handleRequest parses, validates and responds to a request that has made it
+// through the middleware. The context is checked before every step, so a
+// message whose context is done will not be handled any further.
+func (mh *otrngMessageHandler) handleRequest(r *Request, p *handlingProgress) (serializable, error) {
+	ctx, from := r.Context, r.From
+	p.at(stageParsing)
+	result, mt, e := parseMessage(r.Message)
 	if e != nil {
 		return nil, e
 	}
+	mh.s.metrics.messageParsed(mt)
 
 	if mh.shouldRestrict(from, mt) {
-		return nil, errors.New("this from-string is restricted for these kinds of messages")
+		mh.s.metrics.senderRestricted()
+		return nil, newError(ErrRestricted, "this from-string is restricted for these kinds of messages")
 	}
 
+	p.at(stageValidation)
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
 	if e := result.validate(from, mh.s); e != nil {
+		mh.dakeFailedIf(mt)
 		return nil, e
 	}
 
-	r, e := result.respond(from, mh.s)
-	if e != nil {
+	p.at(stageResponse)
+	if e := ctx.Err(); e != nil {
 		return nil, e
 	}
+	res, e := result.respond(ctx, from, mh.s)
+	if e != nil {
+		mh.dakeFailedIf(mt)
+		return res, e
+	}
 
-	return r, nil
+	return res, nil
 }
@@ -1,12 +1,14 @@
 package prekeyserver
 
 import (
+	"context"
+
 	"github.com/otrv4/ed448"
 	. "gopkg.in/check.v1"
 )
 
 func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_errorsOnMessageParsing(c *C) {
-	_, e := (&otrngMessageHandler{}).handleMessage("", []byte{0x01, 0x02, 0x03, 0x04})
+	_, e := (&otrngMessageHandler{}).handleMessage(context.Background(), "", []byte{0x01, 0x02, 0x03, 0x04})
 	c.Assert(e, ErrorMatches, "invalid protocol version")
 }
 
@@ -23,7 +25,7 @@ func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_errorsOnErro
 		rest:        nullRestrictor,
 	}
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, gs.key.pub.k)
-	_, e := (&otrngMessageHandler{s: gs}).handleMessage("someone@somewhere.org", d1.serialize())
+	_, e := (&otrngMessageHandler{s: gs}).handleMessage(context.Background(), "someone@somewhere.org", d1.serialize())
 	c.Assert(e, ErrorMatches, "invalid ring signature generation")
 }
 
@@ -44,7 +46,7 @@ func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_errorsOnRest
 
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k)
 
-	_, e := (&otrngMessageHandler{s: gs}).handleMessage("someone@somewhere.org", d1.serialize())
+	_, e := (&otrngMessageHandler{s: gs}).handleMessage(context.Background(), "someone@somewhere.org", d1.serialize())
 	c.Assert(e, ErrorMatches, "this from-string is restricted for these kinds of messages")
 }
 
@@ -64,7 +66,7 @@ func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_errorsOnRest
 	gs.messageHandler = mh
 
 	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.pub.k)
-	r, _ := mh.handleMessage("sita@example.org", d1.serialize())
+	r, _ := mh.handleMessage(context.Background(), "sita@example.org", d1.serialize())
 	gs.rest = func(string) bool { return true }
 	d2 := dake2Message{}
 	d2.deserialize(r)
@@ -85,6 +87,6 @@ func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_errorsOnRest
 
 	d3 := generateDake3(sita.instanceTag, sigma, msg.serialize())
 
-	_, e := (&otrngMessageHandler{s: gs}).handleMessage("someone@somewhere.org", d3.serialize())
+	_, e := (&otrngMessageHandler{s: gs}).handleMessage(context.Background(), "someone@somewhere.org", d3.serialize())
 	c.Assert(e, ErrorMatches, "this from-string is restricted for these kinds of messages")
 }
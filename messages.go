@@ -2,9 +2,9 @@ package prekeyserver
 
 import (
 	"bytes"
-	"encoding/base64"
-	"errors"
+	"context"
 	"fmt"
+	"time"
 )
 
 type publicationMessage struct {
@@ -53,7 +53,7 @@ type noPrekeyEnsemblesMessage struct {
 type message interface {
 	serializable
 	validate(string, *GenericServer) error
-	respond(string, *GenericServer) (serializable, error)
+	respond(context.Context, string, *GenericServer) (serializable, error)
 }
 
 func parseVersion(message []byte) uint16 {
@@ -63,11 +63,11 @@ func parseVersion(message []byte) uint16 {
 
 func parseMessage(msg []byte) (message, uint8, error) {
 	if len(msg) <= indexOfMessageType {
-		return nil, 0, errors.New("message too short to be a valid message")
+		return nil, 0, newError(ErrDecode, "message too short to be a valid message")
 	}
 
 	if v := parseVersion(msg); v != uint16(4) {
-		return nil, 0, errors.New("invalid protocol version")
+		return nil, 0, newError(ErrDecode, "invalid protocol version")
 	}
 
 	messageType := msg[indexOfMessageType]
@@ -85,10 +85,14 @@ func parseMessage(msg []byte) (message, uint8, error) {
 	case messageTypeEnsembleRetrievalQuery:
 		r = &ensembleRetrievalQueryMessage{}
 	default:
-		return nil, 0, fmt.Errorf("unknown message type: 0x%x", messageType)
+		return nil, 0, newError(ErrDecode, fmt.Sprintf("unknown message type: 0x%x", messageType))
 	}
 
-	r.deserialize(msg)
+	d := newDecoder(msg, messageType)
+	r.decode(d)
+	if e := d.finish(); e != nil {
+		return nil, messageType, e
+	}
 
 	return r, messageType, nil
 }
@@ -100,9 +104,12 @@ func generateStorageInformationRequestMessage(macKey []byte) *storageInformation
 	return res
 }
 
-func (m *storageInformationRequestMessage) respond(from string, s *GenericServer) (serializable, error) {
-	ses := s.session(from)
-	num := s.storage().numberStored(from, ses.instanceTag())
+func (m *storageInformationRequestMessage) respond(ctx context.Context, from string, s *GenericServer) (serializable, error) {
+	ses, e := s.session(from)
+	if e != nil {
+		return nil, e
+	}
+	num := s.storageFor(ctx).numberStored(from, ses.instanceTag())
 	itag := ses.instanceTag()
 	prekeyMacK := ses.macKey()
 	statusMac := kdfx(usageStatusMAC, 64, prekeyMacK, []byte{messageTypeStorageStatusMessage}, serializeWord(itag), serializeWord(num))
@@ -117,10 +124,18 @@ func (m *storageInformationRequestMessage) respond(from string, s *GenericServer
 }
 
 func (m *storageInformationRequestMessage) validate(from string, s *GenericServer) error {
-	prekeyMacK := s.session(from).macKey()
+	if s.sessionState(from) != sessionAuthenticated {
+		return newError(ErrOutOfSequence, "storage information request is only allowed inside of a DAKE3")
+	}
+
+	ses, e := s.session(from)
+	if e != nil {
+		return e
+	}
+	prekeyMacK := ses.macKey()
 	tag := kdfx(usageStorageInfoMAC, 64, prekeyMacK, []byte{messageTypeStorageInformationRequest})
 	if !bytes.Equal(tag, m.mac[:]) {
-		return errors.New("incorrect MAC")
+		return newError(ErrAuthentication, "incorrect MAC")
 	}
 
 	return nil
@@ -130,9 +145,17 @@ func (m *ensembleRetrievalQueryMessage) validate(from string, s *GenericServer)
 	return nil
 }
 
-func (m *ensembleRetrievalQueryMessage) respond(from string, s *GenericServer) (serializable, error) {
-	stor := s.storage()
-	bundles := stor.retrieveFor(m.identity)
+func (m *ensembleRetrievalQueryMessage) respond(ctx context.Context, from string, s *GenericServer) (serializable, error) {
+	stor := s.storageFor(ctx)
+	bundles, e := stor.retrieveFor(m.identity, m.acceptsAt(s.now()))
+	if ce := ctx.Err(); ce != nil {
+		return nil, ce
+	}
+	if e != nil {
+		return nil, wrapError(ErrStorage, "couldn't retrieve prekey ensembles", e)
+	}
+	s.metrics.retrieved(len(bundles))
+	s.hooks.retrieved(s.storage(), m.identity, bundles)
 	if len(bundles) == 0 {
 		return &noPrekeyEnsemblesMessage{
 			instanceTag: m.instanceTag,
@@ -145,9 +168,26 @@ func (m *ensembleRetrievalQueryMessage) respond(from string, s *GenericServer) (
 	}, nil
 }
 
+// acceptsAt returns a filter for profiles that can form an ensemble that is
+// valid for this query at the given time
+func (m *ensembleRetrievalQueryMessage) acceptsAt(now time.Time) ensembleFilter {
+	return func(cp *clientProfile, pp *prekeyProfile) bool {
+		return !cp.hasExpired(now) && !pp.hasExpired(now) && m.acceptsVersions(cp, pp)
+	}
+}
+
+// acceptsVersions returns true if the client profile supports at least one of the asked for versions
+func (m *ensembleRetrievalQueryMessage) acceptsVersions(cp *clientProfile, _ *prekeyProfile) bool {
+	for _, v := range m.versions {
+		if bytes.IndexByte(cp.versions, v) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
 func generateMACForPublicationMessage(cp *clientProfile, pp *prekeyProfile, pms []*prekeyMessage, macKey []byte) []byte {
 	kpms := kdfx(usagePrekeyMessage, 64, serializePrekeyMessages(pms))
-	kpps := kdfx(usagePrekeyProfile, 64, pp.serialize())
 	k := []byte{byte(0)}
 	kcp := []byte{}
 	if cp != nil {
@@ -156,16 +196,12 @@ func generateMACForPublicationMessage(cp *clientProfile, pp *prekeyProfile, pms
 	}
 
 	ppLen := 0
+	kpps := []byte{}
 	if pp != nil {
 		ppLen = 1
+		kpps = kdfx(usagePrekeyProfile, 64, pp.serialize())
 	}
 
-	fmt.Printf("\n\n\nGenerating SIG for publication message\n")
-	fmt.Printf("prekeyMsgKDF = %s\n", base64.StdEncoding.EncodeToString(kpms))
-	fmt.Printf("prekeyProfileKDF = %s\n", base64.StdEncoding.EncodeToString(kpps))
-	fmt.Printf("clientProfileKDF = %s\n", base64.StdEncoding.EncodeToString(kcp))
-	fmt.Printf("fullKDFBody = %s\n", base64.StdEncoding.EncodeToString(concat(macKey, []byte{messageTypePublication, byte(len(pms))}, kpms, k, kcp, []byte{byte(ppLen)}, kpps)))
-
 	return kdfx(usagePreMAC, 64, concat(macKey, []byte{messageTypePublication, byte(len(pms))}, kpms, k, kcp, []byte{byte(ppLen)}, kpps))
 }
 
@@ -181,27 +217,42 @@ func generatePublicationMessage(cp *clientProfile, pp *prekeyProfile, pms []*pre
 }
 
 func (m *publicationMessage) validate(from string, s *GenericServer) error {
-	macKey := s.session(from).macKey()
-	clientProfile := s.session(from).clientProfile()
+	if s.sessionState(from) != sessionAuthenticated {
+		return newError(ErrOutOfSequence, "publication message is only allowed inside of a DAKE3")
+	}
+
+	if max := s.limits.MaxPrekeyMessagesPerPublication; max > 0 && len(m.prekeyMessages) > max {
+		return newError(ErrInvalidMessage, fmt.Sprintf("too many prekey messages in publication message: %d", len(m.prekeyMessages)))
+	}
+
+	ses, e := s.session(from)
+	if e != nil {
+		return e
+	}
+	macKey := ses.macKey()
+	clientProfile := ses.clientProfile()
 	mac := generateMACForPublicationMessage(m.clientProfile, m.prekeyProfile, m.prekeyMessages, macKey)
 
-	fmt.Printf("mac = %s\n", base64.StdEncoding.EncodeToString(mac))
 	if !bytes.Equal(mac[:], m.mac[:]) {
-		return errors.New("invalid mac for publication message")
+		return newError(ErrAuthentication, "invalid mac for publication message")
 	}
 
-	tag := s.session(from).instanceTag()
-	if m.clientProfile != nil && m.clientProfile.validate(tag) != nil {
-		return errors.New("invalid client profile in publication message")
+	tag := ses.instanceTag()
+	if m.clientProfile != nil {
+		if e := m.clientProfile.validate(tag, s.now()); e != nil {
+			return wrapError(ErrInvalidProfile, "invalid client profile in publication message", e)
+		}
 	}
 
-	if m.prekeyProfile != nil && m.prekeyProfile.validate(tag, clientProfile.publicKey) != nil {
-		return errors.New("invalid prekey profile in publication message")
+	if m.prekeyProfile != nil {
+		if e := m.prekeyProfile.validate(tag, clientProfile.publicKey, s.now()); e != nil {
+			return wrapError(ErrInvalidProfile, "invalid prekey profile in publication message", e)
+		}
 	}
 
 	for _, pm := range m.prekeyMessages {
-		if pm.validate(tag) != nil {
-			return errors.New("invalid prekey message in publication message")
+		if e := pm.validate(tag); e != nil {
+			return wrapError(ErrInvalidMessage, "invalid prekey message in publication message", e)
 		}
 	}
 
@@ -219,14 +270,45 @@ func generateSuccessMessage(macKey []byte, tag uint32) *successMessage {
 	return m
 }
 
-func (m *publicationMessage) respond(from string, s *GenericServer) (serializable, error) {
-	stor := s.storage()
-	stor.storeClientProfile(from, m.clientProfile)
-	stor.storePrekeyProfile(from, m.prekeyProfile)
-	stor.storePrekeyMessages(from, m.prekeyMessages)
+func generateFailureMessage(macKey []byte, tag uint32) *failureMessage {
+	m := &failureMessage{
+		instanceTag: tag,
+	}
+
+	mac := kdfx(usageFailureMAC, 64, appendWord(append(macKey, messageTypeFailure), tag))
+	copy(m.mac[:], mac)
+
+	return m
+}
+
+func (m *publicationMessage) store(from string, stor storage) error {
+	if m.clientProfile != nil {
+		if e := stor.storeClientProfile(from, m.clientProfile); e != nil {
+			return e
+		}
+	}
+	if m.prekeyProfile != nil {
+		if e := stor.storePrekeyProfile(from, m.prekeyProfile); e != nil {
+			return e
+		}
+	}
+	return stor.storePrekeyMessages(from, m.prekeyMessages)
+}
+
+func (m *publicationMessage) respond(ctx context.Context, from string, s *GenericServer) (serializable, error) {
+	ses, e := s.session(from)
+	if e != nil {
+		return nil, e
+	}
+	stor := s.storageFor(ctx)
+	if e := m.store(from, stor); e != nil {
+		return nil, wrapError(ErrStorage, "couldn't store publication", e)
+	}
+	s.metrics.published(len(m.prekeyMessages))
 
-	macKey := s.session(from).macKey()
-	instanceTag := s.session(from).instanceTag()
+	macKey := ses.macKey()
+	instanceTag := ses.instanceTag()
+	s.hooks.published(s.storage(), from, instanceTag, len(m.prekeyMessages))
 
 	s.sessionComplete(from)
 
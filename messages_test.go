@@ -1,7 +1,7 @@
 package prekeyserver
 
 import (
-	"errors"
+	"context"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -10,43 +10,43 @@ import (
 func (s *GenericServerSuite) Test_parseMessage_returnsAnErrorForTooShortMessages(c *C) {
 	_, _, e := parseMessage([]byte{})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("message too short to be a valid message"))
+	c.Assert(e, ErrorMatches, "message too short to be a valid message")
 
 	_, _, e = parseMessage([]byte{0x01, 0x02})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("message too short to be a valid message"))
+	c.Assert(e, ErrorMatches, "message too short to be a valid message")
 }
 
 func (s *GenericServerSuite) Test_parseMessage_returnsAnErrorForUnknownMessageType(c *C) {
 	_, _, e := parseMessage([]byte{0x00, 0x04, 0x42})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("unknown message type: 0x42"))
+	c.Assert(e, ErrorMatches, "unknown message type: 0x42")
 }
 
 func (s *GenericServerSuite) Test_parseMessage_returnsAnErrorForInvalidVersion(c *C) {
 	_, _, e := parseMessage([]byte{0x00, 0x00, 0x01})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid protocol version"))
+	c.Assert(e, ErrorMatches, "invalid protocol version")
 
 	_, _, e = parseMessage([]byte{0x00, 0x01, 0x01})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid protocol version"))
+	c.Assert(e, ErrorMatches, "invalid protocol version")
 
 	_, _, e = parseMessage([]byte{0x00, 0x02, 0x01})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid protocol version"))
+	c.Assert(e, ErrorMatches, "invalid protocol version")
 
 	_, _, e = parseMessage([]byte{0x00, 0x03, 0x01})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid protocol version"))
+	c.Assert(e, ErrorMatches, "invalid protocol version")
 
 	_, _, e = parseMessage([]byte{0x00, 0x05, 0x01})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid protocol version"))
+	c.Assert(e, ErrorMatches, "invalid protocol version")
 
 	_, _, e = parseMessage([]byte{0x24, 0x05, 0x01})
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid protocol version"))
+	c.Assert(e, ErrorMatches, "invalid protocol version")
 }
 
 func (s *GenericServerSuite) Test_publicationMessage_validate_willValidateAValidMessage(c *C) {
@@ -64,9 +64,10 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_willValidateAValid
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).tag = sita.instanceTag
-	gs.session("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("somewhere@example.org").(*realSession).st = sessionAuthenticated
+	gs.testSession("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 
 	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
@@ -90,8 +91,9 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidMac(
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).tag = sita.instanceTag
-	gs.session("somewhere@example.org").(*realSession).storedMac = []byte{
+	gs.testSession("somewhere@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("somewhere@example.org").(*realSession).st = sessionAuthenticated
+	gs.testSession("somewhere@example.org").(*realSession).storedMac = []byte{
 		0x1a, 0x67, 0xb6, 0x76, 0x27, 0xf9, 0x2d, 0xff,
 		0x1b, 0x3f, 0x0, 0xb9, 0x16, 0x8, 0x93, 0x66,
 		0xb3, 0x7d, 0x5f, 0x28, 0xb, 0x1d, 0xe4, 0xdd,
@@ -101,7 +103,7 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidMac(
 		0x42, 0x5c, 0x2d, 0xbb, 0xe5, 0x4b, 0x90, 0xce,
 		0x3f, 0x75, 0x9, 0xed, 0xf4, 0xfc, 0x90, 0x94,
 	}
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
 	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
@@ -124,9 +126,10 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidClie
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).tag = 0xDDDDAAAA
-	gs.session("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).tag = 0xDDDDAAAA
+	gs.testSession("somewhere@example.org").(*realSession).st = sessionAuthenticated
+	gs.testSession("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 
 	cp := generateSitaTestData().clientProfile
 	cp.expiration = time.Date(2017, 11, 5, 13, 46, 00, 13, time.UTC)
@@ -135,7 +138,7 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidClie
 	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
 	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
 	msg := generatePublicationMessage(cp, pp1, []*prekeyMessage{pm1, pm2}, sitaPrekeyMacK)
-	c.Assert(msg.validate("somewhere@example.org", gs), ErrorMatches, "invalid client profile in publication message")
+	c.Assert(msg.validate("somewhere@example.org", gs), ErrorMatches, "invalid client profile in publication message: invalid instance tag in client profile")
 }
 
 func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidPrekeyProfile(c *C) {
@@ -153,9 +156,10 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidPrek
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).tag = sita.instanceTag
-	gs.session("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("somewhere@example.org").(*realSession).st = sessionAuthenticated
+	gs.testSession("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 
 	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pp1.instanceTag = 0xAADDAADD
@@ -163,7 +167,7 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidPrek
 	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
 	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
 	msg := generatePublicationMessage(sita.clientProfile, pp1, []*prekeyMessage{pm1, pm2}, sitaPrekeyMacK)
-	c.Assert(msg.validate("somewhere@example.org", gs), ErrorMatches, "invalid prekey profile in publication message")
+	c.Assert(msg.validate("somewhere@example.org", gs), ErrorMatches, "invalid prekey profile in publication message: invalid instance tag in prekey profile")
 }
 
 func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidPrekeyMessage(c *C) {
@@ -181,16 +185,17 @@ func (s *GenericServerSuite) Test_publicationMessage_validate_failsOnInvalidPrek
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).tag = sita.instanceTag
-	gs.session("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("somewhere@example.org").(*realSession).st = sessionAuthenticated
+	gs.testSession("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 
 	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
 	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
 	pm2.y = identityPoint
 	msg := generatePublicationMessage(sita.clientProfile, pp1, []*prekeyMessage{pm1, pm2}, sitaPrekeyMacK)
-	c.Assert(msg.validate("somewhere@example.org", gs), ErrorMatches, "invalid prekey message in publication message")
+	c.Assert(msg.validate("somewhere@example.org", gs), ErrorMatches, "invalid prekey message in publication message: prekey profile Y point is not a valid point")
 }
 
 func (s *GenericServerSuite) Test_ensembleRetrievalQueryMessage_validate_willValidateAValidMessage(c *C) {
@@ -203,6 +208,26 @@ func (s *GenericServerSuite) Test_ensembleRetrievalQueryMessage_validate_willVal
 	c.Assert(retM.validate("bla@example.org", nil), IsNil)
 }
 
+func (s *GenericServerSuite) Test_ensembleRetrievalQueryMessage_acceptsVersions_needsOneOfTheVersions(c *C) {
+	cp := &clientProfile{versions: []byte{'3', '4'}}
+
+	c.Assert((&ensembleRetrievalQueryMessage{versions: []byte{'4'}}).acceptsVersions(cp, nil), Equals, true)
+	c.Assert((&ensembleRetrievalQueryMessage{versions: []byte{'5', '3'}}).acceptsVersions(cp, nil), Equals, true)
+	c.Assert((&ensembleRetrievalQueryMessage{versions: []byte{'5'}}).acceptsVersions(cp, nil), Equals, false)
+	c.Assert((&ensembleRetrievalQueryMessage{versions: []byte{}}).acceptsVersions(cp, nil), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_ensembleRetrievalQueryMessage_accepts_rejectsExpiredProfiles(c *C) {
+	m := &ensembleRetrievalQueryMessage{versions: []byte{'4'}}
+	valid := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Hour)
+
+	c.Assert(m.acceptsAt(time.Now())(&clientProfile{versions: []byte{'4'}, expiration: valid}, &prekeyProfile{expiration: valid}), Equals, true)
+	c.Assert(m.acceptsAt(time.Now())(&clientProfile{versions: []byte{'4'}, expiration: expired}, &prekeyProfile{expiration: valid}), Equals, false)
+	c.Assert(m.acceptsAt(time.Now())(&clientProfile{versions: []byte{'4'}, expiration: valid}, &prekeyProfile{expiration: expired}), Equals, false)
+	c.Assert(m.acceptsAt(time.Now())(&clientProfile{versions: []byte{'3'}, expiration: valid}, &prekeyProfile{expiration: valid}), Equals, false)
+}
+
 func (s *GenericServerSuite) Test_publicationMessage_respond_willRemoveTheSession(c *C) {
 	stor := createInMemoryStorage()
 	sitaPrekeyMacK := []byte{
@@ -220,14 +245,15 @@ func (s *GenericServerSuite) Test_publicationMessage_respond_willRemoveTheSessio
 		storageImpl: stor,
 		sessions:    newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).tag = sita.instanceTag
-	gs.session("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
+	gs.testSession("somewhere@example.org").(*realSession).tag = sita.instanceTag
+	gs.testSession("somewhere@example.org").(*realSession).st = sessionAuthenticated
+	gs.testSession("somewhere@example.org").(*realSession).storedMac = sitaPrekeyMacK
 
 	m := &publicationMessage{
 		clientProfile:  sita.clientProfile,
 		prekeyProfile:  nil,
 		prekeyMessages: []*prekeyMessage{},
 	}
-	m.respond("somewhere@example.org", gs)
+	m.respond(context.Background(), "somewhere@example.org", gs)
 	c.Assert(gs.hasSession("somewhere@example.org"), Equals, false)
 }
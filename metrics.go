@@ -0,0 +1,387 @@
+package prekeyserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics keeps count of what a server has been doing. It can be written out
+// in the Prometheus text format, and can be used directly as an http.Handler
+// for a metrics endpoint. All methods are safe to call on a nil *Metrics, which
+// doesn't count anything.
+type Metrics struct {
+	messagesParsed       counterVec
+	dakeCompletions      counter
+	dakeFailures         counter
+	publications         counter
+	prekeyMessagesStored counter
+	retrievals           counter
+	noPrekeyEnsembles    counter
+	fragmentsReceived    counter
+	fragmentsReassembled counter
+	fragmentsEvicted     counterVec
+	fragmentsRejected    counterVec
+	restrictedSenders    counter
+	sessionsEvicted      counterVec
+	sessionsRejected     counter
+	handleDuration       *histogram
+	storageDuration      histogramVec
+	maintenanceRuns      counterVec
+	maintenanceRemoved   counterVec
+	maintenanceDuration  histogramVec
+}
+
+const metricsPrefix = "otrng_prekey_"
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var messageTypeNames = map[uint8]string{
+	messageTypeDAKE1:                     "dake1",
+	messageTypeDAKE3:                     "dake3",
+	messageTypePublication:               "publication",
+	messageTypeStorageInformationRequest: "storage_information_request",
+	messageTypeEnsembleRetrievalQuery:    "ensemble_retrieval_query",
+}
+
+// NewMetrics returns an empty set of metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		handleDuration:      newHistogram(latencyBuckets),
+		storageDuration:     histogramVec{buckets: latencyBuckets},
+		maintenanceDuration: histogramVec{buckets: latencyBuckets},
+	}
+}
+
+func (m *Metrics) messageParsed(mt uint8) {
+	if m != nil {
+		m.messagesParsed.with(messageTypeNames[mt]).inc()
+	}
+}
+
+func (m *Metrics) dakeCompleted() {
+	if m != nil {
+		m.dakeCompletions.inc()
+	}
+}
+
+func (m *Metrics) dakeFailed() {
+	if m != nil {
+		m.dakeFailures.inc()
+	}
+}
+
+func (m *Metrics) published(prekeyMessages int) {
+	if m != nil {
+		m.publications.inc()
+		m.prekeyMessagesStored.add(uint64(prekeyMessages))
+	}
+}
+
+func (m *Metrics) retrieved(ensembles int) {
+	if m == nil {
+		return
+	}
+	if ensembles == 0 {
+		m.noPrekeyEnsembles.inc()
+	} else {
+		m.retrievals.inc()
+	}
+}
+
+func (m *Metrics) fragmentReceived(complete bool) {
+	if m == nil {
+		return
+	}
+	m.fragmentsReceived.inc()
+	if complete {
+		m.fragmentsReassembled.inc()
+	}
+}
+
+// fragmentEvicted records an incomplete message that was thrown away to keep under a limit
+func (m *Metrics) fragmentEvicted(limit string) {
+	if m != nil {
+		m.fragmentsEvicted.with(limit).inc()
+	}
+}
+
+func (m *Metrics) fragmentRejected(limit string) {
+	if m != nil {
+		m.fragmentsRejected.with(limit).inc()
+	}
+}
+
+func (m *Metrics) senderRestricted() {
+	if m != nil {
+		m.restrictedSenders.inc()
+	}
+}
+
+// sessionEvicted records a session that was evicted to make room for a new one
+func (m *Metrics) sessionEvicted(reason string) {
+	if m != nil {
+		m.sessionsEvicted.with(reason).inc()
+	}
+}
+
+func (m *Metrics) sessionRejected() {
+	if m != nil {
+		m.sessionsRejected.inc()
+	}
+}
+
+// handled records the time it took to handle a message that started at start
+func (m *Metrics) handled(start time.Time) {
+	if m != nil {
+		m.handleDuration.observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) storageOperation(op string, d time.Duration) {
+	if m != nil {
+		m.storageDuration.with(op).observe(d.Seconds())
+	}
+}
+
+// maintenanceRan records a run of a maintenance task. Removed is -1 if the
+// task can't tell how much it removed.
+func (m *Metrics) maintenanceRan(task string, removed int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.maintenanceRuns.with(task).inc()
+	if removed > 0 {
+		m.maintenanceRemoved.with(task).add(uint64(removed))
+	}
+	m.maintenanceDuration.with(task).observe(d.Seconds())
+}
+
+// WritePrometheus writes all metrics to w in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	bw := bufio.NewWriter(w)
+	m.messagesParsed.write(bw, "messages_parsed_total", "Messages parsed, by message type.", "type")
+	writeCounter(bw, "dake_completions_total", "DAKEs that were completed.", &m.dakeCompletions)
+	writeCounter(bw, "dake_failures_total", "DAKE messages that were rejected or answered with a failure.", &m.dakeFailures)
+	writeCounter(bw, "publications_total", "Publication messages that were stored.", &m.publications)
+	writeCounter(bw, "prekey_messages_stored_total", "Prekey messages stored from publications.", &m.prekeyMessagesStored)
+	writeCounter(bw, "retrievals_total", "Ensemble retrieval queries answered with prekey ensembles.", &m.retrievals)
+	writeCounter(bw, "no_prekey_ensembles_total", "Ensemble retrieval queries answered with no prekey ensembles.", &m.noPrekeyEnsembles)
+	writeCounter(bw, "fragments_received_total", "Fragments received.", &m.fragmentsReceived)
+	writeCounter(bw, "fragments_reassembled_total", "Messages reassembled from fragments.", &m.fragmentsReassembled)
+	m.fragmentsEvicted.write(bw, "fragments_evicted_total", "Incomplete messages thrown away to make room for new fragments, by the limit that was reached.", "limit")
+	m.fragmentsRejected.write(bw, "fragments_rejected_total", "Fragments rejected for going over a limit, by the limit.", "limit")
+	writeCounter(bw, "restricted_senders_total", "Messages rejected because the sender is restricted.", &m.restrictedSenders)
+	m.sessionsEvicted.write(bw, "sessions_evicted_total", "Unauthenticated sessions evicted to make room for new ones, by the limit that was reached.", "limit")
+	writeCounter(bw, "sessions_rejected_total", "DAKE1 messages rejected because there was no room for a new session.", &m.sessionsRejected)
+	m.handleDuration.write(bw, "handle_duration_seconds", "Time spent handling a message.", "")
+	m.storageDuration.write(bw, "storage_operation_duration_seconds", "Time spent in storage operations, by operation.", "operation")
+	m.maintenanceRuns.write(bw, "maintenance_runs_total", "Runs of background maintenance, by task.", "task")
+	m.maintenanceRemoved.write(bw, "maintenance_removed_total", "Expired sessions and fragments removed by background maintenance, by task.", "task")
+	m.maintenanceDuration.write(bw, "maintenance_duration_seconds", "Time spent in background maintenance, by task.", "task")
+	return bw.Flush()
+}
+
+// ServeHTTP makes it possible to use the metrics as the handler of a metrics endpoint
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+type counter struct {
+	v uint64
+}
+
+func (c *counter) inc() {
+	c.add(1)
+}
+
+func (c *counter) add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *counter) value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+func writeCounter(w io.Writer, name, help string, c *counter) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s%s %d\n", metricsPrefix, name, c.value())
+}
+
+// counterVec is a set of counters, one for each value of a label
+type counterVec struct {
+	sync.Mutex
+	cs map[string]*counter
+}
+
+func (cv *counterVec) with(label string) *counter {
+	cv.Lock()
+	defer cv.Unlock()
+	if cv.cs == nil {
+		cv.cs = make(map[string]*counter)
+	}
+	c, ok := cv.cs[label]
+	if !ok {
+		c = &counter{}
+		cv.cs[label] = c
+	}
+	return c
+}
+
+func (cv *counterVec) labels() []string {
+	cv.Lock()
+	defer cv.Unlock()
+	res := make([]string, 0, len(cv.cs))
+	for l := range cv.cs {
+		res = append(res, l)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (cv *counterVec) write(w io.Writer, name, help, labelName string) {
+	writeHeader(w, name, help, "counter")
+	for _, l := range cv.labels() {
+		fmt.Fprintf(w, "%s%s{%s=%q} %d\n", metricsPrefix, name, labelName, l, cv.with(l).value())
+	}
+}
+
+type histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for ix, b := range h.buckets {
+		if v <= b {
+			h.counts[ix]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram, with the given label if it's part of a vector
+func (h *histogram) write(w io.Writer, name, help, label string) {
+	if help != "" {
+		writeHeader(w, name, help, "histogram")
+	}
+	h.Lock()
+	defer h.Unlock()
+	sep := ""
+	if label != "" {
+		sep = ","
+	}
+	for ix, b := range h.buckets {
+		fmt.Fprintf(w, "%s%s_bucket{%s%sle=%q} %d\n", metricsPrefix, name, label, sep, strconv.FormatFloat(b, 'g', -1, 64), h.counts[ix])
+	}
+	fmt.Fprintf(w, "%s%s_bucket{%s%sle=\"+Inf\"} %d\n", metricsPrefix, name, label, sep, h.count)
+	if label != "" {
+		label = "{" + label + "}"
+	}
+	fmt.Fprintf(w, "%s%s_sum%s %s\n", metricsPrefix, name, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s%s_count%s %d\n", metricsPrefix, name, label, h.count)
+}
+
+// histogramVec is a set of histograms, one for each value of a label
+type histogramVec struct {
+	sync.Mutex
+	buckets []float64
+	hs      map[string]*histogram
+}
+
+func (hv *histogramVec) with(label string) *histogram {
+	hv.Lock()
+	defer hv.Unlock()
+	if hv.hs == nil {
+		hv.hs = make(map[string]*histogram)
+	}
+	h, ok := hv.hs[label]
+	if !ok {
+		h = newHistogram(hv.buckets)
+		hv.hs[label] = h
+	}
+	return h
+}
+
+func (hv *histogramVec) write(w io.Writer, name, help, labelName string) {
+	writeHeader(w, name, help, "histogram")
+	hv.Lock()
+	labels := make([]string, 0, len(hv.hs))
+	for l := range hv.hs {
+		labels = append(labels, l)
+	}
+	hv.Unlock()
+	sort.Strings(labels)
+	for _, l := range labels {
+		hv.with(l).write(w, name, "", fmt.Sprintf("%s=%q", labelName, l))
+	}
+}
+
+// measuredStorage records how long every operation on the storage takes
+type measuredStorage struct {
+	s storage
+	m *Metrics
+}
+
+func (s *measuredStorage) measure(op string, start time.Time) {
+	s.m.storageOperation(op, time.Since(start))
+}
+
+func (s *measuredStorage) storeClientProfile(from string, cp *clientProfile) error {
+	defer s.measure("store_client_profile", time.Now())
+	return s.s.storeClientProfile(from, cp)
+}
+
+func (s *measuredStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	defer s.measure("store_prekey_profile", time.Now())
+	return s.s.storePrekeyProfile(from, pp)
+}
+
+func (s *measuredStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	defer s.measure("store_prekey_messages", time.Now())
+	return s.s.storePrekeyMessages(from, pms)
+}
+
+func (s *measuredStorage) numberStored(from string, tag uint32) uint32 {
+	defer s.measure("number_stored", time.Now())
+	return s.s.numberStored(from, tag)
+}
+
+func (s *measuredStorage) retrieveFor(from string, accept ensembleFilter) ([]*prekeyEnsemble, error) {
+	defer s.measure("retrieve", time.Now())
+	return s.s.retrieveFor(from, accept)
+}
+
+func (s *measuredStorage) cleanup() {
+	defer s.measure("cleanup", time.Now())
+	s.s.cleanup()
+}
+
+func (s *measuredStorage) close() error {
+	return s.s.close()
+}
@@ -0,0 +1,157 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func metricsTestServer() *GenericServer {
+	gs := testServerForInitiator()
+	gs.metrics = NewMetrics()
+	return gs
+}
+
+func metricsOutput(c *C, m *Metrics) string {
+	var buf bytes.Buffer
+	c.Assert(m.WritePrometheus(&buf), IsNil)
+	return buf.String()
+}
+
+func (s *GenericServerSuite) Test_Metrics_countsAPublication(c *C) {
+	gs := metricsTestServer()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.Handle("sita@example.org", encodeMessage(in.DAKE1())+".")
+	d2d, _ := decodeMessage(d2[0][:len(d2[0])-1])
+	c.Assert(in.ReceiveDAKE2(d2d), IsNil)
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	d3, _ := in.PublicationDAKE3(sita.clientProfile, pp, []PrekeyMessage{pm1, pm2})
+	_, e := gs.Handle("sita@example.org", encodeMessage(d3)+".")
+	c.Assert(e, IsNil)
+
+	out := metricsOutput(c, gs.Metrics())
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_messages_parsed_total\{type="dake1"\} 1\n`+
+		`otrng_prekey_messages_parsed_total\{type="dake3"\} 1\n`+
+		`otrng_prekey_messages_parsed_total\{type="publication"\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_dake_completions_total 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_dake_failures_total 0\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_publications_total 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_prekey_messages_stored_total 2\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_handle_duration_seconds_count 2\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_storage_operation_duration_seconds_count\{operation="store_prekey_messages"\} 1\n.*`)
+}
+
+func (s *GenericServerSuite) Test_Metrics_countsRetrievals(c *C) {
+	gs := metricsTestServer()
+	stor := gs.storage()
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	stor.storeClientProfile("sita@example.org", sita.clientProfile)
+	stor.storePrekeyProfile("sita@example.org", pp)
+	stor.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm})
+
+	q := encodeMessage(CreateEnsembleRetrievalQuery(sita.instanceTag, "sita@example.org", []byte{'4'})) + "."
+	gs.Handle("someone@example.org", q)
+	gs.Handle("someone@example.org", q)
+
+	out := metricsOutput(c, gs.Metrics())
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_retrievals_total 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_no_prekey_ensembles_total 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_storage_operation_duration_seconds_count\{operation="retrieve"\} 2\n.*`)
+}
+
+func (s *GenericServerSuite) Test_Metrics_countsFailedDAKEsAndRestrictedSenders(c *C) {
+	gs := metricsTestServer()
+	other := testServerForInitiator()
+	in := newInitiator(other, "sita@example.org", other.identity, sita.longTerm, sita.clientProfile)
+	d2, _ := other.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+	d3, _ := in.StorageInformationDAKE3()
+	gs.Handle("sita@example.org", encodeMessage(d3)+".")
+
+	gs.rest = func(string) bool { return true }
+	gs.Handle("sita@example.org", encodeMessage(in.DAKE1())+".")
+
+	out := metricsOutput(c, gs.Metrics())
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_dake_failures_total 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_restricted_senders_total 1\n.*`)
+}
+
+func (s *GenericServerSuite) Test_Metrics_countsFragments(c *C) {
+	gs := metricsTestServer()
+
+	gs.Handle("someone@example.org", "?OTRP|45243|AF1FDEAD|BEEF,1,2,AAQ,")
+	gs.Handle("someone@example.org", "?OTRP|45243|AF1FDEAD|BEEF,2,2,1.,")
+
+	out := metricsOutput(c, gs.Metrics())
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_fragments_received_total 2\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_fragments_reassembled_total 1\n.*`)
+}
+
+func (s *GenericServerSuite) Test_Metrics_writesHistogramsInThePrometheusFormat(c *C) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(0.0625)
+	h.observe(0.5)
+	h.observe(3)
+
+	var buf bytes.Buffer
+	h.write(&buf, "test_seconds", "A test.", "")
+
+	c.Assert(buf.String(), Equals, "# HELP otrng_prekey_test_seconds A test.\n"+
+		"# TYPE otrng_prekey_test_seconds histogram\n"+
+		"otrng_prekey_test_seconds_bucket{le=\"0.1\"} 1\n"+
+		"otrng_prekey_test_seconds_bucket{le=\"1\"} 2\n"+
+		"otrng_prekey_test_seconds_bucket{le=\"+Inf\"} 3\n"+
+		"otrng_prekey_test_seconds_sum 3.5625\n"+
+		"otrng_prekey_test_seconds_count 3\n")
+}
+
+func (s *GenericServerSuite) Test_Metrics_doesNothingWhenNil(c *C) {
+	var m *Metrics
+	m.messageParsed(messageTypeDAKE1)
+	m.handled(time.Now())
+	c.Assert(metricsOutput(c, m), Equals, "")
+}
+
+func (s *GenericServerSuite) Test_Metrics_countsEvictedAndRejectedSessions(c *C) {
+	gs := metricsTestServer()
+	gs.sessions = newSessionManager()
+	gs.sessions.limits.max = 1
+	gs.sessions.evicted = gs.metrics.sessionEvicted
+	dake1 := func(from string) error {
+		in := newInitiator(gs, from, gs.identity, sita.longTerm, sita.clientProfile)
+		_, e := gs.Handle(from, encodeMessage(in.DAKE1())+".")
+		return e
+	}
+
+	c.Assert(dake1("sita@example.org"), IsNil)
+	c.Assert(dake1("fake1@example.org"), IsNil)
+	gs.testSession("fake1@example.org").authenticate()
+	c.Assert(dake1("fake2@example.org"), ErrorMatches, "too many sessions")
+
+	out := metricsOutput(c, gs.Metrics())
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_sessions_evicted_total\{limit="total"\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_sessions_rejected_total 1\n.*`)
+}
+
+func (s *GenericServerSuite) Test_Metrics_countsEvictedAndRejectedFragments(c *C) {
+	gs := metricsTestServer()
+	gs.fragmentations.limits = fragmentLimits{maxFragments: 2, maxPerSender: 1}
+	gs.fragmentations.evicted = gs.metrics.fragmentEvicted
+
+	gs.Handle("rama@example.org", "?OTRP|1|AF1FDEAD|BEEF,1,2,AAQ1,")
+	gs.Handle("rama@example.org", "?OTRP|2|AF1FDEAD|BEEF,1,2,AAQ1,")
+	_, e := gs.Handle("rama@example.org", "?OTRP|3|AF1FDEAD|BEEF,1,3,AAQ1,")
+	c.Assert(errors.Is(e, ErrFragmentLimit), Equals, true)
+
+	out := metricsOutput(c, gs.Metrics())
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_fragments_evicted_total\{limit="incomplete messages per sender"\} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*\notrng_prekey_fragments_rejected_total\{limit="fragments per message"\} 1\n.*`)
+}
@@ -0,0 +1,79 @@
+package prekeyserver
+
+import "context"
+
+// The types of the messages a server can receive, as given in Request.MessageType
+const (
+	MessageTypeDAKE1                     = messageTypeDAKE1
+	MessageTypeDAKE3                     = messageTypeDAKE3
+	MessageTypePublication               = messageTypePublication
+	MessageTypeStorageInformationRequest = messageTypeStorageInformationRequest
+	MessageTypeEnsembleRetrievalQuery    = messageTypeEnsembleRetrievalQuery
+)
+
+// Request is one decoded message on its way to be handled. The message nested
+// inside a DAKE3 is handled as a request of its own.
+type Request struct {
+	Context context.Context
+	// From is the sender of the message
+	From string
+	// MessageType is the type given in the header of the message. It's not
+	// checked before the message reaches the end of the chain, so middleware can
+	// handle message types the server doesn't know about.
+	MessageType uint8
+	// Message is the decoded message, without base64 encoding and fragmentation
+	Message []byte
+}
+
+// Handler handles one request and returns the serialized response to it
+type Handler interface {
+	HandleMessage(*Request) ([]byte, error)
+}
+
+// HandlerFunc makes it possible to use an ordinary function as a Handler
+type HandlerFunc func(*Request) ([]byte, error)
+
+// HandleMessage calls f(r)
+func (f HandlerFunc) HandleMessage(r *Request) ([]byte, error) {
+	return f(r)
+}
+
+// Middleware wraps a Handler. It can look at the request and the result of the
+// next handler, change either of them, or answer the request on its own
+// without calling next at all.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware to the server. The middleware given first is the
+// outermost one, and sees every request before the others.
+// Use should be called before the server starts handling messages.
+func (g *GenericServer) Use(mw ...Middleware) {
+	g.middleware = append(g.middleware, mw...)
+}
+
+// chain wraps the handler in all middleware of the server
+func (g *GenericServer) chain(h Handler) Handler {
+	if g == nil {
+		return h
+	}
+	for ix := len(g.middleware) - 1; ix >= 0; ix-- {
+		h = g.middleware[ix](h)
+	}
+	return h
+}
+
+// serializedMessage is a response that has already been serialized by a Handler
+type serializedMessage struct {
+	b []byte
+}
+
+func (m *serializedMessage) deserialize(buf []byte) ([]byte, bool) {
+	return deserializeWith(buf, m.decode)
+}
+
+func (m *serializedMessage) decode(d *decoder) {
+	m.b = d.fixed("message", len(d.buf))
+}
+
+func (m *serializedMessage) serialize() []byte {
+	return m.b
+}
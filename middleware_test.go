@@ -0,0 +1,123 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+type observedRequest struct {
+	from        string
+	messageType uint8
+	result      []byte
+	err         error
+}
+
+func observingMiddleware(seen *[]observedRequest) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) ([]byte, error) {
+			res, e := next.HandleMessage(r)
+			*seen = append(*seen, observedRequest{r.From, r.MessageType, res, e})
+			return res, e
+		})
+	}
+}
+
+func (s *GenericServerSuite) Test_Middleware_seesTheSenderTypeAndResultOfEveryRequest(c *C) {
+	gs := testServerForInitiator()
+	seen := []observedRequest{}
+	gs.Use(observingMiddleware(&seen))
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(e, IsNil)
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+	d3, _ := in.StorageInformationDAKE3()
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, IsNil)
+
+	c.Assert(seen, HasLen, 3)
+	c.Assert(seen[0], DeepEquals, observedRequest{"sita@example.org", MessageTypeDAKE1, d2, nil})
+	c.Assert(seen[1].messageType, Equals, uint8(MessageTypeStorageInformationRequest))
+	c.Assert(seen[2], DeepEquals, observedRequest{"sita@example.org", MessageTypeDAKE3, res, nil})
+}
+
+func (s *GenericServerSuite) Test_Middleware_canShortCircuitARequest(c *C) {
+	gs := testServerForInitiator()
+	called := false
+	gs.Use(func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) ([]byte, error) {
+			if r.From != "sita@example.org" {
+				return nil, errors.New("not authenticated")
+			}
+			return next.HandleMessage(r)
+		})
+	}, func(next Handler) Handler {
+		called = true
+		return next
+	})
+	in := newInitiator(gs, "rama@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	res, e := gs.Handle("rama@example.org", encodeMessage(in.DAKE1())+".")
+
+	c.Assert(res, IsNil)
+	c.Assert(e, ErrorMatches, "not authenticated")
+	c.Assert(called, Equals, true)
+	c.Assert(gs.sessions.has("rama@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_Middleware_canHandleUnknownMessageTypes(c *C) {
+	gs := testServerForInitiator()
+	gs.Use(func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) ([]byte, error) {
+			if r.MessageType == 0x77 {
+				return []byte("pong"), nil
+			}
+			return next.HandleMessage(r)
+		})
+	})
+
+	res, e := gs.Handle("someone@example.org", encodeMessage([]byte{0x00, 0x04, 0x77})+".")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []string{encodeMessage([]byte("pong")) + "."})
+
+	_, e = gs.Handle("someone@example.org", encodeMessage([]byte{0x00, 0x04, 0x78})+".")
+	c.Assert(e, ErrorMatches, "unknown message type: 0x78")
+}
+
+func (s *GenericServerSuite) Test_Middleware_isCalledWithTheFirstOneOutermost(c *C) {
+	gs := testServerForInitiator()
+	order := []string{}
+	named := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(r *Request) ([]byte, error) {
+				order = append(order, name)
+				return next.HandleMessage(r)
+			})
+		}
+	}
+	gs.Use(named("first"), named("second"))
+	gs.Use(named("third"))
+
+	gs.Handle("someone@example.org", encodeMessage([]byte{0x00, 0x04, 0x77})+".")
+
+	c.Assert(order, DeepEquals, []string{"first", "second", "third"})
+}
+
+func (s *GenericServerSuite) Test_Middleware_thatPanicsIsReportedAsAPanicError(c *C) {
+	gs := testServerForInitiator()
+	gs.Use(func(next Handler) Handler {
+		return HandlerFunc(func(r *Request) ([]byte, error) {
+			panic(fmt.Sprintf("can't handle 0x%02X", r.MessageType))
+		})
+	})
+
+	_, e := gs.Handle("someone@example.org", encodeMessage([]byte{0x00, 0x04, 0x77})+".")
+
+	var pe *PanicError
+	c.Assert(errors.As(e, &pe), Equals, true)
+	c.Assert(pe.Stage, Equals, stageMiddleware)
+	c.Assert(pe.Value, Equals, "can't handle 0x77")
+}
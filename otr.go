@@ -3,7 +3,6 @@ package prekeyserver
 import (
 	"bytes"
 	"crypto/dsa"
-	"errors"
 	"time"
 
 	"github.com/otrv4/ed448"
@@ -39,27 +38,27 @@ type prekeyEnsemble struct {
 	pm *prekeyMessage
 }
 
-func (m *clientProfile) validate(tag uint32) error {
+func (m *clientProfile) validate(tag uint32, now time.Time) error {
 	if m.instanceTag != tag {
-		return errors.New("invalid instance tag in client profile")
+		return newError(ErrInvalidProfile, "invalid instance tag in client profile")
 	}
 
 	if !ed448.DSAVerify(m.sig.s, m.publicKey.k, m.serializeForSignature()) {
-		return errors.New("invalid signature in client profile")
+		return newError(ErrInvalidProfile, "invalid signature in client profile")
 	}
 
-	if m.expiration.Before(time.Now()) {
-		return errors.New("client profile has expired")
+	if m.expiration.Before(now) {
+		return newError(ErrExpiredProfile, "client profile has expired")
 	}
 
 	if !bytes.Contains(m.versions, []byte{'4'}) {
-		return errors.New("client profile doesn't support version 4")
+		return newError(ErrInvalidProfile, "client profile doesn't support version 4")
 	}
 
 	// This branch will be untested for now, since I have NO idea how to generate
 	// a valid private key AND eddsa signature that matches an invalid point...
 	if validatePoint(m.publicKey.k) != nil {
-		return errors.New("client profile public key is not a valid point")
+		return newError(ErrInvalidProfile, "client profile public key is not a valid point")
 	}
 
 	// The spec says to verify the DSA transitional signature here
@@ -69,6 +68,19 @@ func (m *clientProfile) validate(tag uint32) error {
 	return nil
 }
 
+func generateClientProfile(tag uint32, expiration time.Time, longTerm *keypair) *clientProfile {
+	cp := &clientProfile{
+		instanceTag: tag,
+		publicKey:   longTerm.pub,
+		versions:    []byte{'4'},
+		expiration:  expiration,
+	}
+
+	cp.sig = &eddsaSignature{s: cp.generateSignature(longTerm)}
+
+	return cp
+}
+
 func generatePrekeyProfile(wr WithRandom, tag uint32, expiration time.Time, longTerm *keypair) (*prekeyProfile, *keypair) {
 	sharedKey := generateKeypair(wr)
 	sharedKey.pub.keyType = sharedPrekeyKey
@@ -118,21 +130,21 @@ func (m *clientProfile) generateSignature(kp *keypair) [114]byte {
 	return ed448.DSASign(kp.sym, kp.pub.k, msg)
 }
 
-func (pp *prekeyProfile) validate(tag uint32, pub *publicKey) error {
+func (pp *prekeyProfile) validate(tag uint32, pub *publicKey, now time.Time) error {
 	if pp.instanceTag != tag {
-		return errors.New("invalid instance tag in prekey profile")
+		return newError(ErrInvalidProfile, "invalid instance tag in prekey profile")
 	}
 
 	if !ed448.DSAVerify(pp.sig.s, pub.k, pp.serializeForSignature()) {
-		return errors.New("invalid signature in prekey profile")
+		return newError(ErrInvalidProfile, "invalid signature in prekey profile")
 	}
 
-	if pp.expiration.Before(time.Now()) {
-		return errors.New("prekey profile has expired")
+	if pp.expiration.Before(now) {
+		return newError(ErrExpiredProfile, "prekey profile has expired")
 	}
 
 	if validatePoint(pp.sharedPrekey.k) != nil {
-		return errors.New("prekey profile shared prekey is not a valid point")
+		return newError(ErrInvalidProfile, "prekey profile shared prekey is not a valid point")
 	}
 
 	return nil
@@ -140,24 +152,105 @@ func (pp *prekeyProfile) validate(tag uint32, pub *publicKey) error {
 
 func (pm *prekeyMessage) validate(tag uint32) error {
 	if pm.instanceTag != tag {
-		return errors.New("invalid instance tag in prekey message")
+		return newError(ErrInvalidMessage, "invalid instance tag in prekey message")
 	}
 
 	if validatePoint(pm.y) != nil {
-		return errors.New("prekey profile Y point is not a valid point")
+		return newError(ErrInvalidMessage, "prekey profile Y point is not a valid point")
 	}
 
 	if validateDHValue(pm.b) != nil {
-		return errors.New("prekey profile B value is not a valid DH group member")
+		return newError(ErrInvalidMessage, "prekey profile B value is not a valid DH group member")
 	}
 
 	return nil
 }
 
-func (m *clientProfile) hasExpired() bool {
-	return m.expiration.Before(time.Now())
+func (m *clientProfile) hasExpired(now time.Time) bool {
+	return m.expiration.Before(now)
+}
+
+func (pp *prekeyProfile) hasExpired(now time.Time) bool {
+	return pp.expiration.Before(now)
+}
+
+func (m *clientProfile) InstanceTag() uint32 {
+	return m.instanceTag
+}
+
+func (m *clientProfile) Expiration() time.Time {
+	return m.expiration
+}
+
+func (m *clientProfile) Versions() []byte {
+	return append([]byte{}, m.versions...)
+}
+
+func (m *clientProfile) Serialize() []byte {
+	return m.serialize()
+}
+
+func (m *clientProfile) realClientProfile() *clientProfile {
+	return m
+}
+
+func (pp *prekeyProfile) InstanceTag() uint32 {
+	return pp.instanceTag
+}
+
+func (pp *prekeyProfile) Expiration() time.Time {
+	return pp.expiration
+}
+
+func (pp *prekeyProfile) Serialize() []byte {
+	return pp.serialize()
+}
+
+func (pp *prekeyProfile) realPrekeyProfile() *prekeyProfile {
+	return pp
+}
+
+func (pm *prekeyMessage) Identifier() uint32 {
+	return pm.identifier
+}
+
+func (pm *prekeyMessage) InstanceTag() uint32 {
+	return pm.instanceTag
+}
+
+func (pm *prekeyMessage) Serialize() []byte {
+	return pm.serialize()
 }
 
-func (pp *prekeyProfile) hasExpired() bool {
-	return pp.expiration.Before(time.Now())
+func (pm *prekeyMessage) realPrekeyMessage() *prekeyMessage {
+	return pm
+}
+
+func (pe *prekeyEnsemble) ClientProfile() ClientProfile {
+	return pe.cp
+}
+
+func (pe *prekeyEnsemble) PrekeyProfile() PrekeyProfile {
+	return pe.pp
+}
+
+func (pe *prekeyEnsemble) PrekeyMessage() PrekeyMessage {
+	return pe.pm
+}
+
+func (pe *prekeyEnsemble) Serialize() []byte {
+	return pe.serialize()
+}
+
+func (pe *prekeyEnsemble) validate(now time.Time) error {
+	tag := pe.cp.instanceTag
+	if e := pe.cp.validate(tag, now); e != nil {
+		return e
+	}
+
+	if e := pe.pp.validate(tag, pe.cp.publicKey, now); e != nil {
+		return e
+	}
+
+	return pe.pm.validate(tag)
 }
@@ -10,32 +10,32 @@ func (s *GenericServerSuite) Test_clientProfile_validate_checksForCorrectInstanc
 	cp := &clientProfile{
 		instanceTag: 0x12345678,
 	}
-	c.Assert(cp.validate(0x88898888), ErrorMatches, "invalid instance tag in client profile")
+	c.Assert(cp.validate(0x88898888, time.Now()), ErrorMatches, "invalid instance tag in client profile")
 }
 
 func (s *GenericServerSuite) Test_clientProfile_validate_validatesACorrectClientProfile(c *C) {
 	cp := generateSitaTestData().clientProfile
-	c.Assert(cp.validate(sita.instanceTag), IsNil)
+	c.Assert(cp.validate(sita.instanceTag, time.Now()), IsNil)
 }
 
 func (s *GenericServerSuite) Test_clientProfile_validate_checksForCorrectSignature(c *C) {
 	cp := generateSitaTestData().clientProfile
 	cp.instanceTag = 0xBADBADBA
-	c.Assert(cp.validate(0xBADBADBA), ErrorMatches, "invalid signature in client profile")
+	c.Assert(cp.validate(0xBADBADBA, time.Now()), ErrorMatches, "invalid signature in client profile")
 }
 
 func (s *GenericServerSuite) Test_clientProfile_validate_checksForExpiry(c *C) {
 	cp := generateSitaTestData().clientProfile
 	cp.expiration = time.Date(2017, 11, 5, 13, 46, 00, 13, time.UTC)
 	cp.sig = &eddsaSignature{s: cp.generateSignature(sita.longTerm)}
-	c.Assert(cp.validate(sita.instanceTag), ErrorMatches, "client profile has expired")
+	c.Assert(cp.validate(sita.instanceTag, time.Now()), ErrorMatches, "client profile has expired")
 }
 
 func (s *GenericServerSuite) Test_clientProfile_validate_versionsInclude4(c *C) {
 	cp := generateSitaTestData().clientProfile
 	cp.versions = []byte{0x03}
 	cp.sig = &eddsaSignature{s: cp.generateSignature(sita.longTerm)}
-	c.Assert(cp.validate(sita.instanceTag), ErrorMatches, "client profile doesn't support version 4")
+	c.Assert(cp.validate(sita.instanceTag, time.Now()), ErrorMatches, "client profile doesn't support version 4")
 }
 
 func (s *GenericServerSuite) Test_prekeyProfile_validate_validatesACorrectPrekeyProfile(c *C) {
@@ -43,9 +43,9 @@ func (s *GenericServerSuite) Test_prekeyProfile_validate_validatesACorrectPrekey
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
-	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub), IsNil)
+	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub, time.Now()), IsNil)
 }
 
 func (s *GenericServerSuite) Test_prekeyProfile_validate_checksForCorrectInstanceTag(c *C) {
@@ -53,11 +53,11 @@ func (s *GenericServerSuite) Test_prekeyProfile_validate_checksForCorrectInstanc
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pp.instanceTag = 0xBADBADBA
 	pp.sig = &eddsaSignature{s: pp.generateSignature(sita.longTerm)}
-	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub), ErrorMatches, "invalid instance tag in prekey profile")
+	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub, time.Now()), ErrorMatches, "invalid instance tag in prekey profile")
 }
 
 func (s *GenericServerSuite) Test_prekeyProfile_validate_checksValidSignature(c *C) {
@@ -65,10 +65,10 @@ func (s *GenericServerSuite) Test_prekeyProfile_validate_checksValidSignature(c
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pp.sig.s[0] = 0x42
-	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub), ErrorMatches, "invalid signature in prekey profile")
+	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub, time.Now()), ErrorMatches, "invalid signature in prekey profile")
 }
 
 func (s *GenericServerSuite) Test_prekeyProfile_validate_checksForExpiry(c *C) {
@@ -76,11 +76,11 @@ func (s *GenericServerSuite) Test_prekeyProfile_validate_checksForExpiry(c *C) {
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pp.expiration = time.Date(2017, 11, 5, 13, 46, 00, 13, time.UTC)
 	pp.sig = &eddsaSignature{s: pp.generateSignature(sita.longTerm)}
-	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub), ErrorMatches, "prekey profile has expired")
+	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub, time.Now()), ErrorMatches, "prekey profile has expired")
 }
 
 func (s *GenericServerSuite) Test_prekeyProfile_validate_checksValidSharedPrekeyPoint(c *C) {
@@ -88,11 +88,11 @@ func (s *GenericServerSuite) Test_prekeyProfile_validate_checksValidSharedPrekey
 		rand:     fixtureRand(),
 		sessions: newSessionManager(),
 	}
-	gs.session("somewhere@example.org").(*realSession).cp = sita.clientProfile
+	gs.testSession("somewhere@example.org").(*realSession).cp = sita.clientProfile
 	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
 	pp.sharedPrekey = &publicKey{k: identityPoint}
 	pp.sig = &eddsaSignature{s: pp.generateSignature(sita.longTerm)}
-	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub), ErrorMatches, "prekey profile shared prekey is not a valid point")
+	c.Assert(pp.validate(sita.instanceTag, sita.longTerm.pub, time.Now()), ErrorMatches, "prekey profile shared prekey is not a valid point")
 }
 
 func (s *GenericServerSuite) Test_prekeyMessage_validate_validatesACorrectPrekeyMessage(c *C) {
@@ -128,3 +128,10 @@ func (s *GenericServerSuite) Test_prekeyMessage_validate_checksInvalidBValue(c *
 	pm.b = []byte{0x00}
 	c.Assert(pm.validate(sita.instanceTag), ErrorMatches, "prekey profile B value is not a valid DH group member")
 }
+
+func (s *GenericServerSuite) Test_generateClientProfile_createsAValidProfile(c *C) {
+	cp := generateClientProfile(0x1245ABCD, time.Date(2028, 11, 5, 13, 46, 00, 13, time.UTC), sita.longTerm)
+	c.Assert(cp.validate(0x1245ABCD, time.Now()), IsNil)
+	c.Assert(cp.InstanceTag(), Equals, uint32(0x1245ABCD))
+	c.Assert(cp.Versions(), DeepEquals, []byte{'4'})
+}
@@ -0,0 +1,74 @@
+package prekeyserver
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// The stages of handling a message, used to report where a panic happened
+const (
+	stageFragmentation = "fragment reassembly"
+	stageDecoding      = "decoding"
+	stageMiddleware    = "middleware"
+	stageParsing       = "parsing"
+	stageValidation    = "validation"
+	stageResponse      = "response"
+	stageEncoding      = "encoding"
+	stageCleanup       = "cleanup"
+)
+
+// PanicError is returned by Handle when handling a message panicked. The
+// panic is contained to that one message, and the server can keep on
+// handling other messages.
+type PanicError struct {
+	// MessageType is the type of the message that failed, or zero if
+	// the message was never decoded far enough to know it
+	MessageType uint8
+	// Stage is the part of the handling that failed, for example "validation"
+	Stage string
+	// Value is the value the code panicked with
+	Value interface{}
+	// Stack is the stack trace of the goroutine at the moment of the panic
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	if e.MessageType == 0 {
+		return fmt.Sprintf("internal error during %s: %v", e.Stage, e.Value)
+	}
+	return fmt.Sprintf("internal error during %s of message type 0x%02X: %v", e.Stage, e.MessageType, e.Value)
+}
+
+// handlingProgress keeps track of how far the handling of one message has come
+type handlingProgress struct {
+	messageType uint8
+	instanceTag uint32
+	stage       string
+	// pending is set when a fragment was received, but the message isn't complete yet
+	pending bool
+}
+
+func (p *handlingProgress) at(stage string) {
+	p.stage = stage
+}
+
+// asPanicError turns a recovered value into a PanicError. If the value already
+// is one, it comes from a nested message, and describes the failure best.
+func (p *handlingProgress) asPanicError(x interface{}) *PanicError {
+	if pe, ok := x.(*PanicError); ok {
+		return pe
+	}
+	return &PanicError{
+		MessageType: p.messageType,
+		Stage:       p.stage,
+		Value:       x,
+		Stack:       debug.Stack(),
+	}
+}
+
+func messageTypeOf(msg []byte) uint8 {
+	if len(msg) <= indexOfMessageType {
+		return 0
+	}
+	return msg[indexOfMessageType]
+}
@@ -0,0 +1,174 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type panickingStorage struct {
+	storage
+}
+
+func (*panickingStorage) storePrekeyMessages(string, []*prekeyMessage) error {
+	panic("storage exploded")
+}
+
+func (*panickingStorage) retrieveFor(string, ensembleFilter) ([]*prekeyEnsemble, error) {
+	panic("storage exploded")
+}
+
+// panicCorpus returns the messages of every entry in the corpus of messages
+// that used to make the validation of a DAKE1 panic, by the name of the entry
+func panicCorpus() (map[string][]string, error) {
+	files, e := ioutil.ReadDir("testdata/panics")
+	if e != nil {
+		return nil, e
+	}
+
+	res := map[string][]string{}
+	for _, f := range files {
+		data, e := ioutil.ReadFile(path.Join("testdata/panics", f.Name()))
+		if e != nil {
+			return nil, e
+		}
+		res[f.Name()] = strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	return res, nil
+}
+
+func (s *GenericServerSuite) Test_Handle_survivesThePanicCorpus(c *C) {
+	corpus, e := panicCorpus()
+	c.Assert(e, IsNil)
+	c.Assert(corpus, Not(HasLen), 0)
+
+	for name, msgs := range corpus {
+		gs := testServerForInitiator()
+		var last error
+		for _, msg := range msgs {
+			_, last = gs.Handle("sita@example.org", msg)
+		}
+		var pe *PanicError
+		c.Assert(last, Not(IsNil), Commentf("corpus entry %s", name))
+		c.Assert(errors.As(last, &pe), Equals, false, Commentf("corpus entry %s: %v", name, last))
+
+		in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+		res, e := gs.Handle("sita@example.org", encodeMessage(in.DAKE1())+".")
+		c.Assert(e, IsNil, Commentf("corpus entry %s", name))
+		c.Assert(res, HasLen, 1)
+	}
+}
+
+// The corpus is rejected while the message is parsed, so the handler doesn't
+// panic on it even without the recovery in Handle
+func (s *GenericServerSuite) Test_handleMessage_rejectsThePanicCorpusWithoutPanicking(c *C) {
+	corpus, e := panicCorpus()
+	c.Assert(e, IsNil)
+
+	for name, msgs := range corpus {
+		gs := testServerForInitiator()
+		message := msgs[0]
+		for _, msg := range msgs {
+			if m, complete, _ := gs.fragmentations.newFragmentReceived("sita@example.org", msg); complete {
+				message = m
+			}
+		}
+		decoded, ok := decodeMessage(message[:len(message)-1])
+		c.Assert(ok, Equals, true, Commentf("corpus entry %s", name))
+
+		var res []byte
+		panicked := func() (x interface{}) {
+			defer func() { x = recover() }()
+			res, e = gs.messageHandler.handleMessage(context.Background(), "sita@example.org", decoded)
+			return nil
+		}()
+		c.Assert(panicked, IsNil, Commentf("corpus entry %s", name))
+		c.Assert(res, IsNil, Commentf("corpus entry %s", name))
+		var de *DecodeError
+		c.Assert(errors.As(e, &de), Equals, true, Commentf("corpus entry %s: %v", name, e))
+	}
+}
+
+// FuzzHandle checks that no message makes the handling panic, even when the
+// panic would be contained, or leaves the server unable to handle the next DAKE.
+// It is seeded from the panic corpus.
+func FuzzHandle(f *testing.F) {
+	corpus, e := panicCorpus()
+	if e != nil {
+		f.Fatal(e)
+	}
+	for _, msgs := range corpus {
+		for _, msg := range msgs {
+			f.Add(msg)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, msg string) {
+		gs := testServerForInitiator()
+		defer gs.Close()
+		var pe *PanicError
+		if _, e := gs.Handle("sita@example.org", msg); errors.As(e, &pe) {
+			t.Fatalf("handling %q panicked: %v\n%s", msg, pe, pe.Stack)
+		}
+
+		in := newInitiator(gs, "rama@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+		if _, e := gs.Handle("rama@example.org", encodeMessage(in.DAKE1())+"."); e != nil {
+			t.Fatalf("server can't handle a DAKE1 after %q: %v", msg, e)
+		}
+	})
+}
+
+func (s *GenericServerSuite) Test_Handle_returnsAPanicErrorWithTheFailingMessageAndStage(c *C) {
+	gs := testServerForInitiator()
+	gs.storageImpl = &panickingStorage{gs.storageImpl}
+
+	q := CreateEnsembleRetrievalQuery(sita.instanceTag, "sita@example.org", []byte{'4'})
+	res, e := gs.Handle("someone@example.org", encodeMessage(q)+".")
+
+	c.Assert(res, IsNil)
+	pe, ok := e.(*PanicError)
+	c.Assert(ok, Equals, true)
+	c.Assert(pe.MessageType, Equals, messageTypeEnsembleRetrievalQuery)
+	c.Assert(pe.Stage, Equals, "response")
+	c.Assert(pe.Value, Equals, "storage exploded")
+	c.Assert(string(pe.Stack), Matches, "(?s).*retrieveFor.*")
+	c.Assert(e, ErrorMatches, "internal error during response of message type 0x10: storage exploded")
+}
+
+func (s *GenericServerSuite) Test_Handle_reportsAPanicInsideOfADAKE3ForTheInnerMessage(c *C) {
+	gs := testServerForInitiator()
+	gs.storageImpl = &panickingStorage{gs.storageImpl}
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	d3, _ := in.PublicationDAKE3(nil, nil, []PrekeyMessage{pm})
+
+	_, e := gs.Handle("sita@example.org", encodeMessage(d3)+".")
+
+	pe, ok := e.(*PanicError)
+	c.Assert(ok, Equals, true)
+	c.Assert(pe.MessageType, Equals, messageTypePublication)
+	c.Assert(pe.Stage, Equals, "response")
+	c.Assert(gs.hasSession("sita@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_Handle_returnsAPanicErrorWithoutAMessageHandler(c *C) {
+	gs := &GenericServer{}
+
+	_, e := gs.Handle("someone@example.org", "AAQ1.")
+
+	c.Assert(e, ErrorMatches, "internal error during parsing of message type 0x35: programmer error, missing message handler")
+}
+
+func (s *GenericServerSuite) Test_PanicError_leavesOutAnUnknownMessageType(c *C) {
+	e := &PanicError{Stage: "decoding", Value: "boom"}
+	c.Assert(e, ErrorMatches, "internal error during decoding: boom")
+}
@@ -2,6 +2,7 @@ package prekeyserver
 
 import (
 	"crypto/dsa"
+	"fmt"
 	"time"
 
 	"github.com/otrv4/ed448"
@@ -9,38 +10,22 @@ import (
 
 type serializable interface {
 	deserialize([]byte) ([]byte, bool)
+	decode(*decoder)
 	serialize() []byte
 }
 
 func (m *dake1Message) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return buf, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeDAKE1 {
-		return buf, false
-	}
-	buf = buf[1:]
-
-	buf, m.instanceTag, ok = extractWord(buf)
-	if !ok {
-		return buf, false
-	}
-
-	m.clientProfile = &clientProfile{}
-	buf, ok = m.clientProfile.deserialize(buf)
-	if !ok {
-		return buf, false
-	}
-
-	buf, m.i, ok = deserializePoint(buf)
-	if !ok {
-		return buf, false
-	}
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *dake1Message) decode(d *decoder) {
+	d.header(messageTypeDAKE1)
+	m.instanceTag = d.word("instance tag")
+	d.nested("client profile", func() {
+		m.clientProfile = &clientProfile{}
+		m.clientProfile.decode(d)
+	})
+	m.i = d.point("point I")
 }
 
 func (m *dake1Message) serialize() []byte {
@@ -65,41 +50,23 @@ func (m *dake2Message) serialize() []byte {
 }
 
 func (m *dake2Message) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return buf, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeDAKE2 {
-		return buf, false
-	}
-	buf = buf[1:]
-
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	if buf, m.serverIdentity, ok = extractData(buf); !ok {
-		return nil, false
-	}
-
-	sk := &publicKey{keyType: ed448Key}
-	if buf, ok = sk.deserialize(buf); !ok {
-		return nil, false
-	}
-	m.serverKey = sk.k
-
-	if buf, m.s, ok = deserializePoint(buf); !ok {
-		return nil, false
-	}
-
-	m.sigma = &ringSignature{}
-	if buf, ok = m.sigma.deserialize(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *dake2Message) decode(d *decoder) {
+	d.header(messageTypeDAKE2)
+	m.instanceTag = d.word("instance tag")
+	m.serverIdentity = d.data("server identity")
+	d.nested("server key", func() {
+		sk := &publicKey{keyType: ed448Key}
+		sk.decode(d)
+		m.serverKey = sk.k
+	})
+	m.s = d.point("point S")
+	d.nested("ring signature", func() {
+		m.sigma = &ringSignature{}
+		m.sigma.decode(d)
+	})
 }
 
 func (m *dake3Message) serialize() []byte {
@@ -112,31 +79,17 @@ func (m *dake3Message) serialize() []byte {
 }
 
 func (m *dake3Message) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return buf, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeDAKE3 {
-		return buf, false
-	}
-	buf = buf[1:]
-
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	m.sigma = &ringSignature{}
-	if buf, ok = m.sigma.deserialize(buf); !ok {
-		return nil, false
-	}
-
-	if buf, m.message, ok = extractData(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *dake3Message) decode(d *decoder) {
+	d.header(messageTypeDAKE3)
+	m.instanceTag = d.word("instance tag")
+	d.nested("ring signature", func() {
+		m.sigma = &ringSignature{}
+		m.sigma.decode(d)
+	})
+	m.message = d.data("inner message")
 }
 
 func serializePrekeyMessages(pms []*prekeyMessage) []byte {
@@ -172,59 +125,44 @@ func (m *publicationMessage) serialize() []byte {
 }
 
 func (m *publicationMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return nil, false
-	}
+	return deserializeWith(buf, m.decode)
+}
 
-	if len(buf) < 1 || buf[0] != messageTypePublication {
-		return nil, false
-	}
-	buf = buf[1:]
+func (m *publicationMessage) decode(d *decoder) {
+	d.header(messageTypePublication)
 
-	var tmp uint8
-	if buf, tmp, ok = extractByte(buf); !ok {
-		return nil, false
-	}
-
-	m.prekeyMessages = make([]*prekeyMessage, tmp)
+	m.prekeyMessages = make([]*prekeyMessage, d.byte("number of prekey messages"))
 	for ix := range m.prekeyMessages {
-		m.prekeyMessages[ix] = &prekeyMessage{}
-		if buf, ok = m.prekeyMessages[ix].deserialize(buf); !ok {
-			return nil, false
-		}
-	}
-
-	if buf, tmp, ok = extractByte(buf); !ok || tmp > 1 {
-		return nil, false
+		d.nested(fmt.Sprintf("prekey message %d", ix+1), func() {
+			m.prekeyMessages[ix] = &prekeyMessage{}
+			m.prekeyMessages[ix].decode(d)
+		})
 	}
 
-	if tmp == 1 {
-		m.clientProfile = &clientProfile{}
-		if buf, ok = m.clientProfile.deserialize(buf); !ok {
-			return nil, false
-		}
+	if decodePresence(d, "client profile flag") {
+		d.nested("client profile", func() {
+			m.clientProfile = &clientProfile{}
+			m.clientProfile.decode(d)
+		})
 	}
 
-	if buf, tmp, ok = extractByte(buf); !ok {
-		return nil, false
+	if decodePresence(d, "prekey profile flag") {
+		d.nested("prekey profile", func() {
+			m.prekeyProfile = &prekeyProfile{}
+			m.prekeyProfile.decode(d)
+		})
 	}
 
-	if tmp == 1 {
-		m.prekeyProfile = &prekeyProfile{}
-		if buf, ok = m.prekeyProfile.deserialize(buf); !ok {
-			return nil, false
-		}
-	}
+	copy(m.mac[:], d.fixed("MAC", 64))
+}
 
-	var tmpb []byte
-	if buf, tmpb, ok = extractFixedData(buf, 64); !ok {
-		return nil, false
+// decodePresence reads the byte that says if an optional part is included
+func decodePresence(d *decoder, field string) bool {
+	v := d.byte(field)
+	if !d.failed() && v > 1 {
+		d.failAt(d.offset-1, field, fmt.Sprintf("must be 0 or 1, but was %d", v))
 	}
-	copy(m.mac[:], tmpb)
-
-	return buf, true
+	return !d.failed() && v == 1
 }
 
 func (m *storageInformationRequestMessage) serialize() []byte {
@@ -235,24 +173,12 @@ func (m *storageInformationRequestMessage) serialize() []byte {
 }
 
 func (m *storageInformationRequestMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return buf, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeStorageInformationRequest {
-		return buf, false
-	}
-	buf = buf[1:]
-
-	var tmp []byte
-	if buf, tmp, ok = extractFixedData(buf, 64); !ok {
-		return nil, false
-	}
-	copy(m.mac[:], tmp)
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *storageInformationRequestMessage) decode(d *decoder) {
+	d.header(messageTypeStorageInformationRequest)
+	copy(m.mac[:], d.fixed("MAC", 64))
 }
 
 func (m *storageStatusMessage) serialize() []byte {
@@ -265,32 +191,14 @@ func (m *storageStatusMessage) serialize() []byte {
 }
 
 func (m *storageStatusMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return buf, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeStorageStatusMessage {
-		return buf, false
-	}
-	buf = buf[1:]
-
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	if buf, m.number, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	var tmp []byte
-	if buf, tmp, ok = extractFixedData(buf, 64); !ok {
-		return nil, false
-	}
-	copy(m.mac[:], tmp)
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *storageStatusMessage) decode(d *decoder) {
+	d.header(messageTypeStorageStatusMessage)
+	m.instanceTag = d.word("instance tag")
+	m.number = d.word("number of prekey messages")
+	copy(m.mac[:], d.fixed("MAC", 64))
 }
 
 func (m *successMessage) serialize() []byte {
@@ -302,28 +210,13 @@ func (m *successMessage) serialize() []byte {
 }
 
 func (m *successMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return buf, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeSuccess {
-		return buf, false
-	}
-	buf = buf[1:]
-
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	var tmp []byte
-	if buf, tmp, ok = extractFixedData(buf, 64); !ok {
-		return nil, false
-	}
-	copy(m.mac[:], tmp)
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *successMessage) decode(d *decoder) {
+	d.header(messageTypeSuccess)
+	m.instanceTag = d.word("instance tag")
+	copy(m.mac[:], d.fixed("MAC", 64))
 }
 
 func (m *failureMessage) serialize() []byte {
@@ -335,28 +228,13 @@ func (m *failureMessage) serialize() []byte {
 }
 
 func (m *failureMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return buf, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeFailure {
-		return buf, false
-	}
-	buf = buf[1:]
-
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	var tmp []byte
-	if buf, tmp, ok = extractFixedData(buf, 64); !ok {
-		return nil, false
-	}
-	copy(m.mac[:], tmp)
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *failureMessage) decode(d *decoder) {
+	d.header(messageTypeFailure)
+	m.instanceTag = d.word("instance tag")
+	copy(m.mac[:], d.fixed("MAC", 64))
 }
 
 func (m *ensembleRetrievalQueryMessage) serialize() []byte {
@@ -369,32 +247,14 @@ func (m *ensembleRetrievalQueryMessage) serialize() []byte {
 }
 
 func (m *ensembleRetrievalQueryMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return nil, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeEnsembleRetrievalQuery {
-		return nil, false
-	}
-	buf = buf[1:]
-
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	var tmp []byte
-	if buf, tmp, ok = extractData(buf); !ok {
-		return nil, false
-	}
-	m.identity = string(tmp)
-
-	if buf, m.versions, ok = extractData(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *ensembleRetrievalQueryMessage) decode(d *decoder) {
+	d.header(messageTypeEnsembleRetrievalQuery)
+	m.instanceTag = d.word("instance tag")
+	m.identity = string(d.data("identity"))
+	m.versions = d.data("versions")
 }
 
 func (m *ensembleRetrievalMessage) serialize() []byte {
@@ -410,35 +270,25 @@ func (m *ensembleRetrievalMessage) serialize() []byte {
 }
 
 func (m *ensembleRetrievalMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return nil, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeEnsembleRetrieval {
-		return nil, false
-	}
-	buf = buf[1:]
+	return deserializeWith(buf, m.decode)
+}
 
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
+func (m *ensembleRetrievalMessage) decode(d *decoder) {
+	d.header(messageTypeEnsembleRetrieval)
+	m.instanceTag = d.word("instance tag")
 
-	var tmp uint8
-	if buf, tmp, ok = extractByte(buf); !ok || tmp == 0 {
-		return nil, false
+	count := d.byte("number of ensembles")
+	if !d.failed() && count == 0 {
+		d.failAt(d.offset-1, "number of ensembles", "must be at least 1")
 	}
 
-	m.ensembles = make([]*prekeyEnsemble, tmp)
+	m.ensembles = make([]*prekeyEnsemble, count)
 	for ix := range m.ensembles {
-		m.ensembles[ix] = &prekeyEnsemble{}
-		if buf, ok = m.ensembles[ix].deserialize(buf); !ok {
-			return nil, false
-		}
+		d.nested(fmt.Sprintf("ensemble %d", ix+1), func() {
+			m.ensembles[ix] = &prekeyEnsemble{}
+			m.ensembles[ix].decode(d)
+		})
 	}
-
-	return buf, true
 }
 
 func (m *noPrekeyEnsemblesMessage) serialize() []byte {
@@ -450,28 +300,13 @@ func (m *noPrekeyEnsemblesMessage) serialize() []byte {
 }
 
 func (m *noPrekeyEnsemblesMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	buf, v, ok := extractShort(buf)
-	if !ok || v != version {
-		return nil, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypeNoPrekeyEnsembles {
-		return nil, false
-	}
-	buf = buf[1:]
-
-	if buf, m.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	var tmp []byte
-	if buf, tmp, ok = extractData(buf); !ok {
-		return nil, false
-	}
-	m.message = string(tmp)
+	return deserializeWith(buf, m.decode)
+}
 
-	return buf, true
+func (m *noPrekeyEnsemblesMessage) decode(d *decoder) {
+	d.header(messageTypeNoPrekeyEnsembles)
+	m.instanceTag = d.word("instance tag")
+	m.message = string(d.data("message"))
 }
 
 func serializeVersions(v []byte) []byte {
@@ -493,30 +328,27 @@ func serializeDSAKey(k *dsa.PublicKey) []byte {
 }
 
 func deserializeDSAKey(buf []byte) ([]byte, *dsa.PublicKey, bool) {
-	res := &dsa.PublicKey{}
-	var ok bool
-	var keyType uint16
-	if buf, keyType, ok = extractShort(buf); !ok || keyType != uint16(0x0000) { // key type
-		return nil, nil, false
-	}
-
-	if buf, res.P, ok = extractMPI(buf); !ok {
-		return nil, nil, false
-	}
-
-	if buf, res.Q, ok = extractMPI(buf); !ok {
-		return nil, nil, false
-	}
-
-	if buf, res.G, ok = extractMPI(buf); !ok {
+	var res *dsa.PublicKey
+	buf, ok := deserializeWith(buf, func(d *decoder) {
+		res = decodeDSAKey(d)
+	})
+	if !ok {
 		return nil, nil, false
 	}
+	return buf, res, true
+}
 
-	if buf, res.Y, ok = extractMPI(buf); !ok {
-		return nil, nil, false
+func decodeDSAKey(d *decoder) *dsa.PublicKey {
+	if kt := d.short("key type"); !d.failed() && kt != uint16(0x0000) {
+		d.failAt(d.offset-2, "key type", fmt.Sprintf("unknown DSA key type 0x%04X", kt))
 	}
 
-	return buf, res, true
+	res := &dsa.PublicKey{}
+	res.P = d.mpi("P")
+	res.Q = d.mpi("Q")
+	res.G = d.mpi("G")
+	res.Y = d.mpi("Y")
+	return res
 }
 
 func (cp *clientProfile) serializeForSignature() []byte {
@@ -562,65 +394,78 @@ func (cp *clientProfile) serialize() []byte {
 	return append(cp.serializeForSignature(), cp.sig.serialize()...)
 }
 
-func (cp *clientProfile) deserializeField(buf []byte) ([]byte, bool) {
-	var tp uint16
-	var ok bool
-
-	if buf, tp, ok = extractShort(buf); !ok {
-		return nil, false
-	}
-
+func (cp *clientProfile) decodeField(d *decoder, tp uint16) {
 	switch tp {
 	case clientProfileTagInstanceTag:
-		if buf, cp.instanceTag, ok = extractWord(buf); !ok {
-			return nil, false
-		}
+		cp.instanceTag = d.word("instance tag")
 	case clientProfileTagPublicKey:
-		cp.publicKey = &publicKey{keyType: ed448Key}
-		if buf, ok = cp.publicKey.deserialize(buf); !ok {
-			return nil, false
-		}
+		d.nested("public key", func() {
+			cp.publicKey = &publicKey{keyType: ed448Key}
+			cp.publicKey.decode(d)
+		})
 	case clientProfileTagVersions:
-		if buf, cp.versions, ok = extractData(buf); !ok {
-			return nil, false
-		}
+		cp.versions = d.data("versions")
 	case clientProfileTagExpiry:
-		if buf, cp.expiration, ok = extractTime(buf); !ok {
-			return nil, false
-		}
+		cp.expiration = d.time("expiry")
 	case clientProfileTagDSAKey:
-		if buf, cp.dsaKey, ok = deserializeDSAKey(buf); !ok {
-			return nil, false
-		}
+		d.nested("DSA key", func() {
+			cp.dsaKey = decodeDSAKey(d)
+		})
 	case clientProfileTagTransitionalSignature:
-		if buf, cp.transitionalSignature, ok = extractFixedData(buf, 40); !ok {
-			return nil, false
-		}
-	default:
-		return nil, false
+		cp.transitionalSignature = d.fixed("transitional signature", 40)
 	}
-	return buf, true
 }
 
 func (cp *clientProfile) deserialize(buf []byte) ([]byte, bool) {
-	var fields uint32
-	var ok bool
-	if buf, fields, ok = extractWord(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, cp.decode)
+}
 
-	for i := uint32(0); i < fields; i++ {
-		if buf, ok = cp.deserializeField(buf); !ok {
-			return nil, false
+var clientProfileFieldNames = map[uint16]string{
+	clientProfileTagInstanceTag:           "instance tag",
+	clientProfileTagPublicKey:             "public key",
+	clientProfileTagVersions:              "versions",
+	clientProfileTagExpiry:                "expiry",
+	clientProfileTagDSAKey:                "DSA key",
+	clientProfileTagTransitionalSignature: "transitional signature",
+}
+
+var requiredClientProfileFields = []uint16{
+	clientProfileTagInstanceTag,
+	clientProfileTagPublicKey,
+	clientProfileTagVersions,
+	clientProfileTagExpiry,
+}
+
+func (cp *clientProfile) decode(d *decoder) {
+	start := d.offset
+	fields := d.word("number of fields")
+
+	seen := make(map[uint16]bool)
+	for i := uint32(0); i < fields && !d.failed(); i++ {
+		tp := d.short("field type")
+		if d.failed() {
+			break
+		}
+		if _, known := clientProfileFieldNames[tp]; !known {
+			d.failAt(d.offset-2, "field type", fmt.Sprintf("unknown field type 0x%04X", tp))
+			break
+		}
+		if seen[tp] {
+			d.failAt(d.offset-2, "field type", fmt.Sprintf("duplicate %s field", clientProfileFieldNames[tp]))
+			break
 		}
+		seen[tp] = true
+		cp.decodeField(d, tp)
 	}
 
-	cp.sig = &eddsaSignature{}
-	if buf, ok = cp.sig.deserialize(buf); !ok {
-		return nil, false
+	for _, tp := range requiredClientProfileFields {
+		if !d.failed() && !seen[tp] {
+			d.failAt(start, "", fmt.Sprintf("missing %s field", clientProfileFieldNames[tp]))
+		}
 	}
 
-	return buf, true
+	cp.sig = &eddsaSignature{}
+	cp.sig.decode(d)
 }
 
 func (pp *prekeyProfile) serializeForSignature() []byte {
@@ -636,27 +481,18 @@ func (pp *prekeyProfile) serialize() []byte {
 }
 
 func (pp *prekeyProfile) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-
-	if buf, pp.instanceTag, ok = extractWord(buf); !ok {
-		return nil, false
-	}
-
-	if buf, pp.expiration, ok = extractTime(buf); !ok {
-		return nil, false
-	}
-
-	pp.sharedPrekey = &publicKey{keyType: sharedPrekeyKey}
-	if buf, ok = pp.sharedPrekey.deserialize(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, pp.decode)
+}
 
+func (pp *prekeyProfile) decode(d *decoder) {
+	pp.instanceTag = d.word("instance tag")
+	pp.expiration = d.time("expiry")
+	d.nested("shared prekey", func() {
+		pp.sharedPrekey = &publicKey{keyType: sharedPrekeyKey}
+		pp.sharedPrekey.decode(d)
+	})
 	pp.sig = &eddsaSignature{}
-	if buf, ok = pp.sig.deserialize(buf); !ok {
-		return nil, false
-	}
-
-	return buf, true
+	pp.sig.decode(d)
 }
 
 func (pm *prekeyMessage) serialize() []byte {
@@ -670,35 +506,15 @@ func (pm *prekeyMessage) serialize() []byte {
 }
 
 func (pm *prekeyMessage) deserialize(buf []byte) ([]byte, bool) {
-	var ok1 bool
-	var v uint16
-
-	if buf, v, ok1 = extractShort(buf); !ok1 || v != version { // version
-		return nil, false
-	}
-
-	if len(buf) < 1 || buf[0] != messageTypePrekeyMessage {
-		return nil, false
-	}
-	buf = buf[1:] // message type
-
-	if buf, pm.identifier, ok1 = extractWord(buf); !ok1 {
-		return nil, false
-	}
-
-	if buf, pm.instanceTag, ok1 = extractWord(buf); !ok1 {
-		return nil, false
-	}
-
-	if buf, pm.y, ok1 = deserializePoint(buf); !ok1 {
-		return nil, false
-	}
-
-	if buf, pm.b, ok1 = extractData(buf); !ok1 {
-		return nil, false
-	}
+	return deserializeWith(buf, pm.decode)
+}
 
-	return buf, true
+func (pm *prekeyMessage) decode(d *decoder) {
+	d.header(messageTypePrekeyMessage)
+	pm.identifier = d.word("identifier")
+	pm.instanceTag = d.word("instance tag")
+	pm.y = d.point("point Y")
+	pm.b = d.data("B value")
 }
 
 func (pe *prekeyEnsemble) serialize() []byte {
@@ -710,24 +526,22 @@ func (pe *prekeyEnsemble) serialize() []byte {
 }
 
 func (pe *prekeyEnsemble) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-
-	pe.cp = &clientProfile{}
-	if buf, ok = pe.cp.deserialize(buf); !ok {
-		return nil, false
-	}
-
-	pe.pp = &prekeyProfile{}
-	if buf, ok = pe.pp.deserialize(buf); !ok {
-		return nil, false
-	}
-
-	pe.pm = &prekeyMessage{}
-	if buf, ok = pe.pm.deserialize(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, pe.decode)
+}
 
-	return buf, true
+func (pe *prekeyEnsemble) decode(d *decoder) {
+	d.nested("client profile", func() {
+		pe.cp = &clientProfile{}
+		pe.cp.decode(d)
+	})
+	d.nested("prekey profile", func() {
+		pe.pp = &prekeyProfile{}
+		pe.pp.decode(d)
+	})
+	d.nested("prekey message", func() {
+		pe.pm = &prekeyMessage{}
+		pe.pm.decode(d)
+	})
 }
 
 func (p *publicKey) serialize() []byte {
@@ -762,18 +576,17 @@ func deserializePoint(buf []byte) ([]byte, ed448.Point, bool) {
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 	})
-	tp.DSADecode(buf[0:57])
+	if !tp.DSADecode(buf[0:57]) {
+		return buf, nil, false
+	}
 	return buf[57:], tp, true
 }
 
 func (p *publicKey) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	pubKeyType := uint16(0)
-
-	if buf, pubKeyType, ok = extractShort(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, p.decode)
+}
 
+func (p *publicKey) decode(d *decoder) {
 	keyType := uint16(0xBAD0)
 	switch p.keyType {
 	case ed448Key:
@@ -782,22 +595,18 @@ func (p *publicKey) deserialize(buf []byte) ([]byte, bool) {
 		keyType = sharedPrekeyKeyTypeInt
 	}
 
-	if pubKeyType != keyType {
-		return nil, false
+	if kt := d.short("key type"); !d.failed() && kt != keyType {
+		d.failAt(d.offset-2, "key type", fmt.Sprintf("expected 0x%04X but got 0x%04X", keyType, kt))
 	}
-
-	buf, p.k, ok = deserializePoint(buf)
-	return buf, ok
+	p.k = d.point("point")
 }
 
 func (s *eddsaSignature) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	var res []byte
-	if buf, res, ok = extractFixedData(buf, 114); !ok {
-		return nil, false
-	}
-	copy(s.s[:], res)
-	return buf, true
+	return deserializeWith(buf, s.decode)
+}
+
+func (s *eddsaSignature) decode(d *decoder) {
+	copy(s.s[:], d.fixed("signature", 114))
 }
 
 func serializeScalar(s ed448.Scalar) []byte {
@@ -815,32 +624,16 @@ func deserializeScalar(buf []byte) ([]byte, ed448.Scalar, bool) {
 }
 
 func (r *ringSignature) deserialize(buf []byte) ([]byte, bool) {
-	var ok bool
-	if buf, r.c1, ok = deserializeScalar(buf); !ok {
-		return nil, false
-	}
-
-	if buf, r.r1, ok = deserializeScalar(buf); !ok {
-		return nil, false
-	}
-
-	if buf, r.c2, ok = deserializeScalar(buf); !ok {
-		return nil, false
-	}
-
-	if buf, r.r2, ok = deserializeScalar(buf); !ok {
-		return nil, false
-	}
-
-	if buf, r.c3, ok = deserializeScalar(buf); !ok {
-		return nil, false
-	}
-
-	if buf, r.r3, ok = deserializeScalar(buf); !ok {
-		return nil, false
-	}
+	return deserializeWith(buf, r.decode)
+}
 
-	return buf, true
+func (r *ringSignature) decode(d *decoder) {
+	r.c1 = d.scalar("c1")
+	r.r1 = d.scalar("r1")
+	r.c2 = d.scalar("c2")
+	r.r2 = d.scalar("r2")
+	r.c3 = d.scalar("c3")
+	r.r3 = d.scalar("r3")
 }
 
 func (r *ringSignature) serialize() []byte {
@@ -1,8 +1,10 @@
 package prekeyserver
 
 import (
+	"context"
 	"errors"
 	"io"
+	"log/slog"
 	"time"
 )
 
@@ -29,15 +31,43 @@ type GenericServer struct {
 	sessionTimeout       time.Duration
 	fragmentationTimeout time.Duration
 	rest                 Restrictor
+
+	logger  *slog.Logger
+	metrics *Metrics
+	hooks   *hookDispatcher
+
+	middleware []Middleware
+	limits     Limits
+	clock      Clock
+
+	maintenance *maintenance
+	life        lifecycle
 }
 
 func (g *GenericServer) storage() storage {
 	return g.storageImpl
 }
 
-func (g *GenericServer) handleMessage(from string, message []byte) ([]byte, error) {
+// storageFor returns the storage to use while handling a message with the given context
+func (g *GenericServer) storageFor(ctx context.Context) storage {
+	st := g.storageImpl
+	if cs, ok := st.(contextStorage); ok {
+		st = cs.withContext(ctx)
+	}
+	if g.metrics != nil {
+		st = &measuredStorage{s: st, m: g.metrics}
+	}
+	return st
+}
+
+// Metrics returns the metrics of the server
+func (g *GenericServer) Metrics() *Metrics {
+	return g.metrics
+}
+
+func (g *GenericServer) handleMessage(ctx context.Context, from string, message []byte) ([]byte, error) {
 	if g.messageHandler != nil {
-		return g.messageHandler.handleMessage(from, message)
+		return g.messageHandler.handleMessage(ctx, from, message)
 	}
 
 	panic("programmer error, missing message handler")
@@ -49,58 +79,120 @@ func (g *GenericServer) handleMessage(from string, message []byte) ([]byte, erro
 // It will return an error if something went wrong, and a list of messages that should be returned
 // Each message to return should be sent in a separate network package, back to the original sender
 // The Handle function should be called from its own goroutine to ensure asynchronous behavior of the server
-func (g *GenericServer) Handle(from, message string) (returns []string, err error) {
+// A request inside of an authenticated DAKE that is rejected is answered with a
+// failure message, which is returned together with the error that caused it.
+// A panic while handling the message will be returned as a *PanicError.
+// Once the server has started shutting down, an error of kind ErrServerClosed is returned.
+func (g *GenericServer) Handle(from, message string) ([]string, error) {
+	return g.HandleContext(context.Background(), from, message)
+}
+
+// HandleContext works like Handle, but stops handling the message as soon as the
+// context is canceled or its deadline has passed, and then returns the error of the context.
+// The context is also given to the storage, so it can stop waiting for locks or slow backends.
+func (g *GenericServer) HandleContext(ctx context.Context, from, message string) (returns []string, err error) {
+	p := &handlingProgress{stage: stageFragmentation}
+	defer g.metrics.handled(time.Now())
+	defer func() {
+		if x := recover(); x != nil {
+			returns, err = nil, p.asPanicError(x)
+		}
+		g.logHandled(ctx, from, p, err)
+	}()
+
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+
+	ctx, done, e := g.enter(ctx)
+	if e != nil {
+		return nil, e
+	}
+	defer done()
+
 	if message == "" {
-		return nil, errors.New("empty message")
+		return nil, newError(ErrDecode, "empty message")
 	}
 
 	if isFragment(message) {
 		m, c, e := g.fragmentations.newFragmentReceived(from, message)
 		if e != nil {
+			var fle *FragmentLimitError
+			if errors.As(e, &fle) {
+				g.metrics.fragmentRejected(fle.Limit)
+			}
 			return nil, e
 		}
+		g.metrics.fragmentReceived(c)
 		if !c {
+			p.pending = true
 			return nil, nil
 		}
 		message = m
 	}
 
 	if message[len(message)-1] != '.' {
-		return nil, errors.New("invalid message format - missing ending punctuation")
+		return nil, newError(ErrDecode, "invalid message format - missing ending punctuation")
 	}
 
+	p.at(stageDecoding)
 	decoded, ok := decodeMessage(message[:len(message)-1])
 	if !ok {
-		return nil, errors.New("invalid message format - corrupted base64 encoding")
+		return nil, newError(ErrDecode, "invalid message format - corrupted base64 encoding")
 	}
 
-	msg, e := g.handleMessage(from, decoded)
-	if e != nil {
+	p.messageType = messageTypeOf(decoded)
+	p.instanceTag = instanceTagOf(decoded)
+	p.at(stageParsing)
+	msg, e := g.handleMessage(ctx, from, decoded)
+	if msg == nil {
 		return nil, e
 	}
 
+	p.at(stageEncoding)
 	encoded := encodeMessage(msg) + "."
-
 	msgs := potentiallyFragment(encoded, g.fragLen, g)
 
-	g.cleanupAfter()
+	if !g.started() {
+		p.at(stageCleanup)
+		g.cleanupAfter()
+	}
 
-	return msgs, nil
+	return msgs, e
 }
 
+// cleanupAfter removes the expired sessions and fragments after a message, for
+// a server that doesn't run its maintenance in the background
 func (g *GenericServer) cleanupAfter() {
-	g.sessions.cleanup(g.sessionTimeout)
-	g.fragmentations.cleanup(g.fragmentationTimeout)
-	// Keep returned prekeys on storage so we can test without re-publishing them
-	//g.storageImpl.cleanup()
+	g.cleanupSessions()
+	g.cleanupFragments()
 }
 
 func (g *GenericServer) compositeIdentity() []byte {
-	return append(appendData(nil, []byte(g.identity)), g.key.pub.serialize()...)
+	return calculateCompositeIdentity(g.identity, g.key.pub)
+}
+
+// session returns the session of the sender. If there is none, for example
+// because it expired or was evicted, an error of kind ErrOutOfSequence is returned.
+func (g *GenericServer) session(from string) (session, error) {
+	sess, ok := g.sessions.get(from)
+	if !ok {
+		return nil, newError(ErrOutOfSequence, "no session for sender")
+	}
+	return sess, nil
+}
+
+// startSession returns the session to use for a new DAKE with the sender
+func (g *GenericServer) startSession(from string) (session, error) {
+	sess, e := g.sessions.start(from)
+	if e != nil {
+		g.metrics.sessionRejected()
+	}
+	return sess, e
 }
 
-func (g *GenericServer) session(from string) session {
-	return g.sessions.get(from)
+func (g *GenericServer) sessionState(from string) sessionState {
+	return g.sessions.state(from)
 }
 
 func (g *GenericServer) sessionComplete(from string) {
@@ -1,6 +1,9 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"log/slog"
+)
 
 // These flags represent all the available command line flags
 var (
@@ -14,4 +17,8 @@ var (
 	fileCert       = flag.String("cert-file", "", "File where certificate is stored for tls")
 	bindPath       = flag.String("path", "/prekeys", "Path of the url where server should listen")
 	passwordFile   = flag.String("pwd-file", "passwords.asc", "File containing the usernames and passwords, one line for each entry, user:pwd")
+	logLevel       = flag.String("log-level", "info", "The lowest level of log messages to write to stderr: debug, info, warn or error")
+	logFormat      = flag.String("log-format", "text", "The format of log messages: text or json")
 )
+
+var logger *slog.Logger
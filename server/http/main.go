@@ -9,8 +9,10 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 
+	pks "github.com/otrv4/otrng-prekey-server"
 	"golang.org/x/crypto/scrypt"
 )
 
@@ -45,6 +47,13 @@ func main() {
 		return
 	}
 
+	var e error
+	logger, e = pks.CreateLogger(os.Stderr, *logLevel, *logFormat)
+	if e != nil {
+		fmt.Println(e)
+		return
+	}
+
 	loadUsers()
 
 	handler := http.NewServeMux()
@@ -111,7 +120,7 @@ func getPrekeyResponseFromRealServer(u string, data []byte) []byte {
 	res, _ := ioutil.ReadAll(con)
 	res2, ss, _ := extractShort(res)
 	if uint16(len(res2)) != ss {
-		fmt.Printf("Unexpected length of data received\n")
+		logger.Warn("unexpected length of data received from the raw server", "expected", ss, "received", len(res2))
 		return nil
 	}
 	return res2
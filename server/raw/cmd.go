@@ -1,18 +1,32 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"strings"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
 
 // These flags represent all the available command line flags
 var (
 	keyFile              = flag.String("key-file", "raw-server.keys", "Location of file where server long term keys should be stored and loaded")
 	listenPort           = flag.Uint("port", 3242, "Port to listen to")
 	listenIP             = flag.String("address", "localhost", "Address to listen to")
-	storageEngine        = flag.String("storage", "in-memory", "What storage engine to use: 'in-memory' or 'dir:/PATH/HERE' are the choices available")
+	storageEngine        = flag.String("storage", "in-memory", "What storage engine to use, in the form TYPE or TYPE:PARAMETERS, for example 'dir:/PATH/HERE'. Available types: "+strings.Join(pks.StorageTypes(), ", "))
 	serverIdentity       = flag.String("identity", "keys.example.org", "The identity of the server")
 	fragLen              = flag.Uint("fragmentation-length", 0, "Fragmentation length - 0 means no fragmenting")
 	sessionTimeout       = flag.Uint("session-timeout", 5, "Session timeout, in minutes")
 	fragmentationTimeout = flag.Uint("fragmentation-timeout", 5, "Fragment timeout, in minutes")
+	maxSessions          = flag.Uint("max-sessions", 100000, "The largest number of unfinished DAKEs kept at the same time - 0 means no limit")
+	maxSessionsPerDomain = flag.Uint("max-sessions-per-domain", 0, "The largest number of unfinished DAKEs kept at the same time for the senders of one domain - 0 means no limit")
+	maxFragments         = flag.Uint("max-fragments", 4096, "The largest number of fragments a message can be split into - 0 means no limit")
+	maxIncompletePerFrom = flag.Uint("max-incomplete-messages", 16, "The largest number of fragmented messages one sender can have waiting for more fragments - 0 means no limit")
+	maxFragmentBytes     = flag.Uint("max-fragment-bytes", 64*1024*1024, "The largest number of bytes kept in fragments of incomplete messages - 0 means no limit")
+	maxReassembledLength = flag.Uint("max-reassembled-length", 16*1024*1024, "The longest message that can be put together from fragments - 0 means no limit")
 	allowOnlyPrefix      = flag.String("only-prefix", "", "The prefixes of 'from' that should be allowed, separated by comma. Empty means no restrictions")
 	allowOnlySuffix      = flag.String("only-suffix", "", "The suffixes of 'from' that should be allowed, separated by comma. Empty means no restrictions")
 	allowOnly            = flag.String("only", "", "The only 'from' addresses that are allowed, separated by comma. Empty means no restrictions")
+	logLevel             = flag.String("log-level", "info", "The lowest level of log messages to write to stderr: debug, info, warn or error")
+	logFormat            = flag.String("log-format", "text", "The format of log messages: text or json")
+	metricsAddress       = flag.String("metrics-address", "", "Address to serve Prometheus metrics on, for example 'localhost:9242'. Empty means no metrics listener")
 )
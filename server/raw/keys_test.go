@@ -25,6 +25,7 @@ func (s *RawServerSuite) Test_formatFingerprint_willFormatTheFingerprint(c *C) {
 }
 
 type mockFactory struct {
+	pks.Factory
 	loadKeypairFromArgFileName string
 	loadKeypairFromReturn      pks.Keypair
 	loadKeypairFromReturnError error
@@ -53,6 +54,10 @@ func (f *mockFactory) NewServer(string, pks.Keypair, int, pks.Storage, time.Dura
 	return nil
 }
 
+func (f *mockFactory) NewServerWithConfig(pks.ServerConfig) (pks.Server, error) {
+	return nil, nil
+}
+
 func (s *RawServerSuite) Test_loadOrCreateKeypair_willTryToLoadFromAnExistingFile(c *C) {
 	f, _ := ioutil.TempFile("", "otrng-raw-createkeypair-file")
 	defer os.Remove(f.Name())
@@ -15,10 +15,20 @@ var signalHandler = make(chan os.Signal, 1)
 
 func main() {
 	flag.Parse()
-	rs := &rawServer{}
 	ending := make(chan bool)
 
-	if e := rs.load(pks.CreateFactory(rand.Reader)); e != nil {
+	logger, e := pks.CreateLogger(os.Stderr, *logLevel, *logFormat)
+	if e != nil {
+		fmt.Println(e)
+		return
+	}
+	rs := &rawServer{logger: logger}
+
+	if e := rs.load(pks.CreateFactoryWithLogger(rand.Reader, logger)); e != nil {
+		fmt.Println(e)
+		return
+	}
+	if e := rs.s.Start(); e != nil {
 		fmt.Println(e)
 		return
 	}
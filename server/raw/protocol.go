@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 
 	pks "github.com/otrv4/otrng-prekey-server"
@@ -25,15 +26,16 @@ func protocolEncodePacket(inp []byte) []byte {
 	return append(appendShort(nil, uint16(len(inp))), inp...)
 }
 
-func protocolHandleData(data []byte, s pks.Server) ([]byte, error) {
+func protocolHandleData(ctx context.Context, data []byte, s pks.Server) ([]byte, error) {
 	res, e := protocolParseData(data)
 	if e != nil {
 		return nil, e
 	}
 	result := []byte{}
 	for _, pe := range res {
-		outp, e := s.Handle(pe.from, pe.data)
-		if e != nil {
+		// A rejected request can still have a failure message to send back
+		outp, e := s.HandleContext(ctx, pe.from, pe.data)
+		if e != nil && len(outp) == 0 {
 			return nil, e
 		}
 		for _, o := range outp {
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"testing"
 
+	pks "github.com/otrv4/otrng-prekey-server"
 	. "gopkg.in/check.v1"
 )
 
@@ -66,6 +68,10 @@ type mockServer struct {
 }
 
 func (ms *mockServer) Handle(from, message string) ([]string, error) {
+	return ms.HandleContext(context.Background(), from, message)
+}
+
+func (ms *mockServer) HandleContext(ctx context.Context, from, message string) ([]string, error) {
 	currentIx := ms.ix
 	ms.ix++
 	ms.receivedFrom = append(ms.receivedFrom, from)
@@ -73,6 +79,22 @@ func (ms *mockServer) Handle(from, message string) ([]string, error) {
 	return ms.returnData[currentIx], ms.returnError[currentIx]
 }
 
+func (ms *mockServer) Metrics() *pks.Metrics {
+	return nil
+}
+
+func (ms *mockServer) Start() error {
+	return nil
+}
+
+func (ms *mockServer) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (ms *mockServer) Close() error {
+	return nil
+}
+
 func (s *RawServerSuite) Test_protocolHandleData_handsOverDataCorrectlyToTheServer(c *C) {
 	data := append([]byte{}, 0x00, 0x03)
 	data = append(data, []byte("ola")...)
@@ -89,7 +111,7 @@ func (s *RawServerSuite) Test_protocolHandleData_handsOverDataCorrectlyToTheServ
 		[]string{"three"},
 	}
 	ms.returnError = []error{nil, nil}
-	ret, e := protocolHandleData(data, ms)
+	ret, e := protocolHandleData(context.Background(), data, ms)
 	c.Assert(e, IsNil)
 	c.Assert(ret, DeepEquals, []byte{
 		0x00, 0x03, 0x6f, 0x6e, 0x65,
@@ -99,7 +121,7 @@ func (s *RawServerSuite) Test_protocolHandleData_handsOverDataCorrectlyToTheServ
 }
 
 func (s *RawServerSuite) Test_protocolHandleData_willReturnParsingErrors(c *C) {
-	_, e := protocolHandleData([]byte{0x00, 0x03}, nil)
+	_, e := protocolHandleData(context.Background(), []byte{0x00, 0x03}, nil)
 	c.Assert(e, ErrorMatches, "can't parse from element")
 }
 
@@ -114,6 +136,25 @@ func (s *RawServerSuite) Test_protocolHandleData_willReturnServerErrors(c *C) {
 		nil,
 	}
 	ms.returnError = []error{errors.New("something frobbed")}
-	_, e := protocolHandleData(data, ms)
+	_, e := protocolHandleData(context.Background(), data, ms)
 	c.Assert(e, ErrorMatches, "something frobbed")
 }
+
+func (s *RawServerSuite) Test_protocolHandleData_sendsTheFailureMessageOfARejectedRequest(c *C) {
+	data := append([]byte{}, 0x00, 0x03)
+	data = append(data, []byte("ola")...)
+	data = append(data, 0x00, 0x05)
+	data = append(data, []byte("abcde")...)
+
+	ms := &mockServer{}
+	ms.returnData = [][]string{
+		[]string{"one"},
+	}
+	ms.returnError = []error{errors.New("something frobbed")}
+	ret, e := protocolHandleData(context.Background(), data, ms)
+	c.Assert(e, IsNil)
+	c.Assert(ret, DeepEquals, []byte{0x00, 0x03, 0x6f, 0x6e, 0x65})
+}
+
+func (ms *mockServer) Use(...pks.Middleware) {
+}
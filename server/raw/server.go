@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
@@ -24,6 +27,17 @@ type rawServer struct {
 	kp              pks.Keypair
 	finishRequested bool
 	activeConns     sync.WaitGroup
+	metricsListener net.Listener
+	metricsServer   *http.Server
+	// logger is where errors that can't be returned to anyone are reported
+	logger *slog.Logger
+}
+
+func (rs *rawServer) log() *slog.Logger {
+	if rs.logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return rs.logger
 }
 
 func (rs *rawServer) load(f pks.Factory) error {
@@ -36,13 +50,27 @@ func (rs *rawServer) load(f pks.Factory) error {
 	if e != nil {
 		return fmt.Errorf("encountered error when creating storage engine: %v", e)
 	}
-	server := f.NewServer(*serverIdentity,
-		rs.kp,
-		int(*fragLen),
-		storage,
-		time.Duration(*sessionTimeout)*time.Minute,
-		time.Duration(*fragmentationTimeout)*time.Minute,
-		commandLineRestrictor)
+	server, e := f.NewServerWithConfig(pks.ServerConfig{
+		Identity:        *serverIdentity,
+		Keys:            rs.kp,
+		Storage:         storage,
+		FragmentLength:  int(*fragLen),
+		SessionTimeout:  time.Duration(*sessionTimeout) * time.Minute,
+		FragmentTimeout: time.Duration(*fragmentationTimeout) * time.Minute,
+		Restrictor:      commandLineRestrictor,
+		Limits: pks.Limits{
+			MaxSessions:          int(*maxSessions),
+			MaxSessionsPerPrefix: int(*maxSessionsPerDomain),
+
+			MaxFragmentsPerMessage:         int(*maxFragments),
+			MaxIncompleteMessagesPerSender: int(*maxIncompletePerFrom),
+			MaxBufferedFragmentBytes:       int(*maxFragmentBytes),
+			MaxReassembledLength:           int(*maxReassembledLength),
+		},
+	})
+	if e != nil {
+		return fmt.Errorf("encountered error when creating server: %v", e)
+	}
 
 	rs.s = server
 
@@ -53,12 +81,34 @@ func (rs *rawServer) run() error {
 	fmt.Printf("Starting server on %s...\n", net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)))
 	fmt.Printf("  [%s]\n", formatFingerprint(rs.kp.Fingerprint()))
 
+	if *metricsAddress != "" {
+		if e := rs.serveMetrics(*metricsAddress); e != nil {
+			return fmt.Errorf("encountered error when running metrics listener: %v", e)
+		}
+	}
+
 	if e := rs.listenWith(); e != nil {
 		return fmt.Errorf("encountered error when running listener: %v", e)
 	}
 	return nil
 }
 
+// serveMetrics exposes the metrics of the server in the Prometheus text format,
+// on the /metrics path of an HTTP listener on the given address
+func (rs *rawServer) serveMetrics(address string) error {
+	l, e := net.Listen("tcp", address)
+	if e != nil {
+		return e
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", rs.s.Metrics())
+	rs.metricsListener = l
+	rs.metricsServer = &http.Server{Handler: mux}
+	rs.log().Info("serving metrics", "address", "http://"+l.Addr().String()+"/metrics")
+	go rs.metricsServer.Serve(l)
+	return nil
+}
+
 func (rs *rawServer) listenWith() error {
 	addr, e := net.ResolveTCPAddr("tcp", net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)))
 	if e != nil {
@@ -74,8 +124,14 @@ func (rs *rawServer) listenWith() error {
 		l.SetDeadline(time.Now().Add(time.Duration(100) * time.Millisecond))
 		conn, err := rs.l.Accept()
 		if err == nil {
-			conn.SetDeadline(time.Now().Add(time.Duration(2) * time.Minute))
-			go rs.handleRequest(conn)
+			deadline := time.Now().Add(connectionTimeout)
+			conn.SetDeadline(deadline)
+			// Handling the request is stopped at the same time as the connection
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			go func() {
+				defer cancel()
+				rs.handleRequest(ctx, conn)
+			}()
 		} else {
 			if te, ok := err.(net.Error); !ok || !te.Timeout() {
 				return err
@@ -87,29 +143,45 @@ func (rs *rawServer) listenWith() error {
 
 const readLimit = 268435456 // 2 ** 28 ~ 268 Mb
 
-func (rs *rawServer) handleRequest(c io.ReadWriteCloser) {
+const connectionTimeout = time.Duration(2) * time.Minute
+
+func (rs *rawServer) handleRequest(ctx context.Context, c io.ReadWriteCloser) {
 	rs.activeConns.Add(1)
 	defer rs.activeConns.Done()
 	defer c.Close()
 	data, e := ioutil.ReadAll(io.LimitReader(c, readLimit))
 	if e != nil {
-		fmt.Printf("Encountered error when reading data: %v\n", e)
+		rs.log().Error("encountered error when reading data", "error", e)
 		return
 	}
-	res, e := protocolHandleData(data, rs.s)
+	res, e := protocolHandleData(ctx, data, rs.s)
 	if e != nil {
-		fmt.Printf("Encountered error when handling data: %v\n", e)
+		rs.log().Error("encountered error when handling data", "error", e)
 		return
 	}
 	_, e = c.Write(res)
 	if e != nil {
-		fmt.Printf("Encountered error when writing data: %v\n", e)
+		rs.log().Error("encountered error when writing data", "error", e)
 		return
 	}
 }
 
+// shutdownTimeout is how long a shutdown waits for the messages being handled,
+// before they are abandoned
+const shutdownTimeout = time.Duration(10) * time.Second
+
 func (rs *rawServer) shutdown() {
 	fmt.Println("Shutting down server carefully...")
 	rs.finishRequested = true
+	if rs.s != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if e := rs.s.Shutdown(ctx); e != nil {
+			rs.log().Error("encountered error when shutting down", "error", e)
+		}
+	}
 	rs.activeConns.Wait()
+	if rs.metricsServer != nil {
+		rs.metricsServer.Close()
+	}
 }
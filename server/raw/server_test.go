@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"time"
 
 	pks "github.com/otrv4/otrng-prekey-server"
 	. "gopkg.in/check.v1"
@@ -65,41 +70,41 @@ func (m *mockRWC) Close() error {
 	return m.retCloseE
 }
 
-func (s *RawServerSuite) Test_handleRequest_willPrintErrorEncounteredWhenReading(c *C) {
-	capture := startStdoutCapture()
-	defer capture.restore()
+func (s *RawServerSuite) Test_handleRequest_willLogErrorEncounteredWhenReading(c *C) {
+	var out bytes.Buffer
+	logger, _ := pks.CreateLogger(&out, "info", "json")
 
 	m := &mockRWC{retReadN: 0, retReadE: errors.New("something _absolutely_ horrific")}
-	(&rawServer{}).handleRequest(m)
+	(&rawServer{logger: logger}).handleRequest(context.Background(), m)
 	c.Assert(m.readCalled, Equals, true)
 	c.Assert(m.writeCalled, Equals, false)
 	c.Assert(m.closeCalled, Equals, true)
-	c.Assert(capture.finish(), Equals, "Encountered error when reading data: something _absolutely_ horrific\n")
+	c.Assert(out.String(), Matches, `\{"time":".*","level":"ERROR","msg":"encountered error when reading data","error":"something _absolutely_ horrific"\}\n`)
 }
 
-func (s *RawServerSuite) Test_handleRequest_willPrintErrorEncounteredWhenProtocol(c *C) {
-	capture := startStdoutCapture()
-	defer capture.restore()
+func (s *RawServerSuite) Test_handleRequest_willLogErrorEncounteredWhenProtocol(c *C) {
+	var out bytes.Buffer
+	logger, _ := pks.CreateLogger(&out, "info", "json")
 
 	m := &mockRWC{retReadN: 3, retReadE: io.EOF}
 	m.retReadBuf = []byte{0x00, 0x05, 0x01}
-	(&rawServer{}).handleRequest(m)
+	(&rawServer{logger: logger}).handleRequest(context.Background(), m)
 	c.Assert(m.readCalled, Equals, true)
 	c.Assert(m.writeCalled, Equals, false)
 	c.Assert(m.closeCalled, Equals, true)
-	c.Assert(capture.finish(), Equals, "Encountered error when handling data: can't parse from element\n")
+	c.Assert(out.String(), Matches, `\{"time":".*","level":"ERROR","msg":"encountered error when handling data","error":"can't parse from element"\}\n`)
 }
 
-func (s *RawServerSuite) Test_handleRequest_willPrintErrorEncounteredWhenWriting(c *C) {
-	capture := startStdoutCapture()
-	defer capture.restore()
+func (s *RawServerSuite) Test_handleRequest_willLogErrorEncounteredWhenWriting(c *C) {
+	var out bytes.Buffer
+	logger, _ := pks.CreateLogger(&out, "info", "json")
 
 	m := &mockRWC{retReadN: 0, retReadE: io.EOF, retWriteN: 0, retWriteE: errors.New("something even worse")}
-	(&rawServer{}).handleRequest(m)
+	(&rawServer{logger: logger}).handleRequest(context.Background(), m)
 	c.Assert(m.readCalled, Equals, true)
 	c.Assert(m.writeCalled, Equals, true)
 	c.Assert(m.closeCalled, Equals, true)
-	c.Assert(capture.finish(), Equals, "Encountered error when writing data: something even worse\n")
+	c.Assert(out.String(), Matches, `\{"time":".*","level":"ERROR","msg":"encountered error when writing data","error":"something even worse"\}\n`)
 }
 
 func (s *RawServerSuite) Test_load_willReturnErrorEncounteredWithKeypair(c *C) {
@@ -115,7 +120,17 @@ func (s *RawServerSuite) Test_load_willReturnErrorEncounteredWithStorageEngine(c
 	*storageEngine = "--a-storage-engine-that-should-never-exist"
 	defer os.Remove(*keyFile)
 	e := (&rawServer{}).load(pks.CreateFactory(rand.Reader))
-	c.Assert(e, ErrorMatches, "encountered error when creating storage engine: unknown storage type")
+	c.Assert(e, ErrorMatches, `encountered error when creating storage engine: unknown storage type "--a-storage-engine-that-should-never-exist" - available types are: dir, in-memory, kv, sql`)
+}
+
+func (s *RawServerSuite) Test_load_willReturnErrorForAnInvalidConfiguration(c *C) {
+	*keyFile = "__test_thing_that_should_be_removed"
+	*storageEngine = "in-memory"
+	*fragLen = 12
+	defer func() { *fragLen = 0 }()
+	defer os.Remove(*keyFile)
+	e := (&rawServer{}).load(pks.CreateFactory(rand.Reader))
+	c.Assert(e, ErrorMatches, "encountered error when creating server: fragment length has to be 0 or at least 48")
 }
 
 func (s *RawServerSuite) Test_run_willReturnNilOnControlledShutdown(c *C) {
@@ -130,3 +145,29 @@ func (s *RawServerSuite) Test_run_willReturnNilOnControlledShutdown(c *C) {
 	c.Assert(e, IsNil)
 
 }
+
+func (s *RawServerSuite) Test_serveMetrics_exposesTheMetricsOfTheServer(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	var out bytes.Buffer
+	logger, _ := pks.CreateLogger(&out, "info", "json")
+	f := pks.CreateFactory(rand.Reader)
+	st, _ := f.LoadStorageType("in-memory")
+	rs := &rawServer{s: f.NewServer("keys.example.org", f.CreateKeypair(), 0, st, time.Minute, time.Minute, nil), logger: logger}
+	rs.s.Handle("rama@example.org", "AAQQEkRVEQAAABBzaXRhQGV4YW1wbGUub3JnAAAAAQQ=.")
+
+	c.Assert(rs.serveMetrics("localhost:0"), IsNil)
+	defer rs.shutdown()
+	c.Assert(out.String(), Matches, `\{"time":".*","level":"INFO","msg":"serving metrics","address":"http://`+rs.metricsListener.Addr().String()+`/metrics"\}\n`)
+
+	res, e := http.Get("http://" + rs.metricsListener.Addr().String() + "/metrics")
+	c.Assert(e, IsNil)
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	c.Assert(res.Header.Get("Content-Type"), Matches, "text/plain; version=0.0.4.*")
+	c.Assert(string(body), Matches, `(?s).*\notrng_prekey_messages_parsed_total\{type="ensemble_retrieval_query"\} 1\n.*`)
+	c.Assert(string(body), Matches, `(?s).*\notrng_prekey_no_prekey_ensembles_total 1\n.*`)
+	c.Assert(string(body), Matches, `(?s).*\notrng_prekey_handle_duration_seconds_count 1\n.*`)
+}
@@ -1,7 +1,10 @@
 package prekeyserver
 
 import (
+	"context"
 	"errors"
+	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -18,7 +21,7 @@ func (s *GenericServerSuite) Test_Handle_ReturnsErrorIfGivenEmptyMessage(c *C) {
 	gs := &GenericServer{}
 	msgs, e := gs.Handle("myname", "")
 	c.Assert(msgs, IsNil)
-	c.Assert(e, DeepEquals, errors.New("empty message"))
+	c.Assert(e, ErrorMatches, "empty message")
 }
 
 type mockMessageHandler struct {
@@ -28,13 +31,13 @@ type mockMessageHandler struct {
 	toReturnError   error
 }
 
-func (m *mockMessageHandler) handleMessage(from string, message []byte) ([]byte, error) {
+func (m *mockMessageHandler) handleMessage(ctx context.Context, from string, message []byte) ([]byte, error) {
 	m.receivedFrom = from
 	m.receivedMessage = message
 	return m.toReturnMessage, m.toReturnError
 }
 
-func (m *mockMessageHandler) handleInnerMessage(from string, message []byte) (serializable, error) {
+func (m *mockMessageHandler) handleInnerMessage(ctx context.Context, from string, message []byte) (serializable, error) {
 	return nil, nil
 }
 
@@ -67,7 +70,7 @@ func (s *GenericServerSuite) Test_Handle_AMessageWithoutProperFormatSHhouldGener
 	m := &mockMessageHandler{}
 	gs.messageHandler = m
 	_, e := gs.Handle("myname", "aGksIHRoaXMgaXMgbm90IGEgdmFsaWQgb3RyNCBtZXNzYWdlLCBidXQgc3RpbGwuLi4=")
-	c.Assert(e, DeepEquals, errors.New("invalid message format - missing ending punctuation"))
+	c.Assert(e, ErrorMatches, "invalid message format - missing ending punctuation")
 }
 
 func (s *GenericServerSuite) Test_Handle_ACorruptedBase64MessageGeneratesAnError(c *C) {
@@ -75,7 +78,7 @@ func (s *GenericServerSuite) Test_Handle_ACorruptedBase64MessageGeneratesAnError
 	m := &mockMessageHandler{}
 	gs.messageHandler = m
 	_, e := gs.Handle("myname", "aGksIHRoaXMgaXMgbm90IGEgdmFsaWQgb3RyNCBtZXNzYWdlLCBidXQgc3RpbGwuLi4.")
-	c.Assert(e, DeepEquals, errors.New("invalid message format - corrupted base64 encoding"))
+	c.Assert(e, ErrorMatches, "invalid message format - corrupted base64 encoding")
 }
 
 func (s *GenericServerSuite) Test_Handle_WillBase64EncodeAndFormatReturnValues(c *C) {
@@ -129,7 +132,7 @@ func (s *GenericServerSuite) Test_Handle_PassesOnAFragmentationError(c *C) {
 	gs.messageHandler = m
 	_, e := gs.Handle("myname", "?OTRP|1234|BEEF|CADE,3,2,aGksIHRoaXMgaXMgbm90IGEg,")
 	c.Assert(e, Not(IsNil))
-	c.Assert(e, DeepEquals, errors.New("invalid fragmentation parse"))
+	c.Assert(e, ErrorMatches, "invalid fragmentation parse")
 }
 
 func (s *GenericServerSuite) Test_Handle_WillPotentiallyFragmentReturnValues(c *C) {
@@ -155,7 +158,7 @@ func (s *GenericServerSuite) Test_Handle_WillPotentiallyFragmentReturnValues(c *
 
 func (s *GenericServerSuite) Test_handleMessage_panicsWhenNoMessageHandlerIsConfigured(c *C) {
 	gs := &GenericServer{fragLen: 7, rand: fixtureRand()}
-	c.Assert(func() { gs.handleMessage("foo@example.org", nil) }, PanicMatches, "programmer error, missing message handler")
+	c.Assert(func() { gs.handleMessage(context.Background(), "foo@example.org", nil) }, PanicMatches, "programmer error, missing message handler")
 }
 
 func (s *GenericServerSuite) Test_sessionComplete_returnsWhenNoSession(c *C) {
@@ -172,7 +175,7 @@ func (s *GenericServerSuite) Test_hasSession_returnsFalseWhenNoSessionsExist(c *
 	c.Assert(gs.hasSession("someone@example.org"), Equals, false)
 }
 
-func (s *GenericServerSuite) Test_cleanupAfter_removesOldSessions(c *C) {
+func (s *GenericServerSuite) Test_cleanupSessions_removesOldSessions(c *C) {
 	gs := &GenericServer{
 		sessionTimeout: time.Duration(30) * time.Minute,
 		fragmentations: newFragmentations(),
@@ -180,16 +183,16 @@ func (s *GenericServerSuite) Test_cleanupAfter_removesOldSessions(c *C) {
 		sessions:       newSessionManager(),
 	}
 
-	gs.session("someone@example.org").(*realSession).lastTouched = time.Now().Add(time.Duration(-56) * time.Minute)
-	gs.session("another@example.org").(*realSession).lastTouched = time.Now().Add(time.Duration(-26) * time.Minute)
+	gs.testSession("someone@example.org").(*realSession).lastTouched = time.Now().Add(time.Duration(-56) * time.Minute)
+	gs.testSession("another@example.org").(*realSession).lastTouched = time.Now().Add(time.Duration(-26) * time.Minute)
 
-	gs.cleanupAfter()
+	c.Assert(gs.cleanupSessions(), Equals, 1)
 
 	c.Assert(gs.hasSession("someone@example.org"), Equals, false)
 	c.Assert(gs.hasSession("another@example.org"), Equals, true)
 }
 
-func (s *GenericServerSuite) Test_cleanupAfter_doesntDoAnythingWithEmptySessions(c *C) {
+func (s *GenericServerSuite) Test_cleanupSessions_doesntDoAnythingWithEmptySessions(c *C) {
 	gs := &GenericServer{
 		sessionTimeout: time.Duration(30) * time.Minute,
 		fragmentations: newFragmentations(),
@@ -197,10 +200,10 @@ func (s *GenericServerSuite) Test_cleanupAfter_doesntDoAnythingWithEmptySessions
 		sessions:       newSessionManager(),
 	}
 
-	gs.cleanupAfter()
+	c.Assert(gs.cleanupSessions(), Equals, 0)
 }
 
-func (s *GenericServerSuite) Test_cleanupAfter_cleansUpOldFragments(c *C) {
+func (s *GenericServerSuite) Test_cleanupFragments_cleansUpOldFragments(c *C) {
 	gs := &GenericServer{
 		fragmentationTimeout: time.Duration(6) * time.Minute,
 		fragmentations:       newFragmentations(),
@@ -212,11 +215,55 @@ func (s *GenericServerSuite) Test_cleanupAfter_cleansUpOldFragments(c *C) {
 	gs.fragmentations.newFragmentReceived("another@example.org", "?OTRP|12345|AF1FDEAD|BEEF,1,2,hello,")
 	gs.fragmentations.newFragmentReceived("me@example.org", "?OTRP|45244|AF1FDEAD|BEEF,1,2,hello,")
 
-	gs.fragmentations.contexts["me@example.org/45243"].lastTouched = time.Now().Add(time.Duration(-11) * time.Minute)
-	gs.fragmentations.contexts["another@example.org/12345"].lastTouched = time.Now().Add(time.Duration(-7) * time.Minute)
-	gs.fragmentations.contexts["me@example.org/45244"].lastTouched = time.Now().Add(time.Duration(-4) * time.Minute)
+	gs.fragmentations.context("me@example.org", "me@example.org/45243").lastTouched = time.Now().Add(time.Duration(-11) * time.Minute)
+	gs.fragmentations.context("another@example.org", "another@example.org/12345").lastTouched = time.Now().Add(time.Duration(-7) * time.Minute)
+	gs.fragmentations.context("me@example.org", "me@example.org/45244").lastTouched = time.Now().Add(time.Duration(-4) * time.Minute)
 
-	gs.cleanupAfter()
+	c.Assert(gs.cleanupFragments(), Equals, 2)
 
-	c.Assert(gs.fragmentations.contexts, HasLen, 1)
+	c.Assert(gs.fragmentations.count(), Equals, 1)
+}
+
+func (s *GenericServerSuite) Test_HandleContext_returnsTheErrorOfACanceledContext(c *C) {
+	gs := &GenericServer{
+		fragmentations: newFragmentations(),
+		storageImpl:    createInMemoryStorage(),
+		sessions:       newSessionManager(),
+	}
+	m := &mockMessageHandler{}
+	gs.messageHandler = m
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msgs, e := gs.HandleContext(ctx, "myname", "aGksIHRoaXMgaXMgbm90IGEgdmFsaWQgb3RyNCBtZXNzYWdlLCBidXQgc3RpbGwuLi4=.")
+
+	c.Assert(msgs, IsNil)
+	c.Assert(e, Equals, context.Canceled)
+	c.Assert(IsClientError(e), Equals, false)
+	c.Assert(m.receivedFrom, Equals, "")
+}
+
+func (s *GenericServerSuite) Test_HandleContext_stopsWaitingForALockedStorageAtTheDeadline(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	gs := testServerForInitiator()
+	fsf, _ := createFileStorageFactoryFrom(testDir)
+	gs.storageImpl, _ = fsf.createStorage()
+
+	userDir := path.Join(testDir, prefixHexForUser2, hexForUser2)
+	os.MkdirAll(userDir, 0700)
+	t1 := lockDir(userDir)
+	defer unlockDir(userDir, t1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(50)*time.Millisecond)
+	defer cancel()
+	q := CreateEnsembleRetrievalQuery(sita.instanceTag, "someone@example.org", []byte{'4'})
+
+	before := time.Now()
+	msgs, e := gs.HandleContext(ctx, "sita@example.org", encodeMessage(q)+".")
+
+	c.Assert(msgs, IsNil)
+	c.Assert(e, Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(before) < time.Second, Equals, true)
 }
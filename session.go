@@ -1,19 +1,141 @@
 package prekeyserver
 
 import (
+	"container/list"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/otrv4/ed448"
 )
 
+// sessionManager keeps the sessions of a server. The sessions are spread over
+// shards by the name of the sender, and each shard has its own lock. The limits
+// are kept for the whole table. As long as they aren't reached, a new session
+// only needs the lock of its own shard. When one is reached, the locks of all
+// shards are taken, so the least recently used session of the whole table can
+// be evicted.
 type sessionManager struct {
-	s map[string]*realSession
+	shards []*sessionShard
+	// total is the number of sessions in all shards
+	total int64
+	// ticks orders the uses of sessions across all shards
+	ticks    int64
+	prefixes prefixCounts
+	limits   sessionLimits
+	// evicted is told about every session that is evicted to make room, and why
+	evicted func(reason string)
+	// clock is given to every new session
+	clock Clock
+}
+
+type sessionShard struct {
+	s map[string]*sessionEntry
+	// lru has the names of the sessions in the shard, the most recently used first
+	lru *list.List
 	sync.RWMutex
 }
 
+// prefixCounts keeps track of how many sessions there are for each prefix
+type prefixCounts struct {
+	n map[string]int
+	sync.Mutex
+}
+
+// reserve counts one more session for the prefix, unless there are already max
+// of them. A max of zero means there is no limit.
+func (pc *prefixCounts) reserve(prefix string, max int) bool {
+	pc.Lock()
+	defer pc.Unlock()
+
+	if max > 0 && pc.n[prefix] >= max {
+		return false
+	}
+	pc.n[prefix]++
+	return true
+}
+
+func (pc *prefixCounts) release(prefix string) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	if pc.n[prefix]--; pc.n[prefix] <= 0 {
+		delete(pc.n, prefix)
+	}
+}
+
+func (pc *prefixCounts) count(prefix string) int {
+	pc.Lock()
+	defer pc.Unlock()
+
+	return pc.n[prefix]
+}
+
+type sessionEntry struct {
+	s      *realSession
+	prefix string
+	el     *list.Element
+	// used is the tick of the last time the session was looked up or started
+	used int64
+}
+
+// sessionLimits keeps the session table from growing without bounds. A limit of
+// zero means there is no limit.
+type sessionLimits struct {
+	max          int
+	maxPerPrefix int
+	prefix       func(from string) string
+}
+
+// The reasons for evicting a session, as used in the metrics
+const (
+	evictedForTotal  = "total"
+	evictedForPrefix = "prefix"
+)
+
+// DomainPrefix is the default SenderPrefix. It groups senders by what comes
+// after the last @, so all senders of one domain share their limits. A sender
+// without an @ is a group of its own.
+func DomainPrefix(from string) string {
+	if ix := strings.LastIndex(from, "@"); ix != -1 {
+		return from[ix+1:]
+	}
+	return from
+}
+
+// sessionState keeps track of how far the DAKE with a sender has come. A session
+// starts out waiting for DAKE1, then waits for DAKE3 and is authenticated once the
+// DAKE3 has been verified. It is closed when the message inside the DAKE3 has been
+// handled, and can't be used anymore after that.
+type sessionState int
+
+const (
+	sessionAwaitingDAKE1 sessionState = iota
+	sessionAwaitingDAKE3
+	sessionAuthenticated
+	sessionClosed
+)
+
+func (st sessionState) String() string {
+	switch st {
+	case sessionAwaitingDAKE1:
+		return "awaiting DAKE1"
+	case sessionAwaitingDAKE3:
+		return "awaiting DAKE3"
+	case sessionAuthenticated:
+		return "authenticated"
+	case sessionClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 type session interface {
 	save(*keypair, ed448.Point, uint32, *clientProfile)
+	state() sessionState
+	authenticate() error
+	close()
 	instanceTag() uint32
 	macKey() []byte
 	clientProfile() *clientProfile
@@ -28,13 +150,15 @@ type realSession struct {
 	i           ed448.Point
 	cp          *clientProfile
 	storedMac   []byte
+	st          sessionState
 	lastTouched time.Time
+	clock       Clock
 	sync.Mutex
 }
 
 // expects the lock to be held
 func (s *realSession) touch() {
-	s.lastTouched = time.Now()
+	s.lastTouched = nowFrom(s.clock)
 }
 
 func (s *realSession) save(kp *keypair, i ed448.Point, tag uint32, cp *clientProfile) {
@@ -46,6 +170,36 @@ func (s *realSession) save(kp *keypair, i ed448.Point, tag uint32, cp *clientPro
 	s.i = i
 	s.tag = tag
 	s.cp = cp
+	s.st = sessionAwaitingDAKE3
+}
+
+func (s *realSession) state() sessionState {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.st
+}
+
+// authenticate moves the session on after its DAKE3 has been verified. It fails if
+// the session was not waiting for a DAKE3, for example because another DAKE3 for it
+// was handled in the meantime
+func (s *realSession) authenticate() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.st != sessionAwaitingDAKE3 {
+		return newError(ErrOutOfSequence, "session is not awaiting DAKE3")
+	}
+	s.touch()
+	s.st = sessionAuthenticated
+	return nil
+}
+
+func (s *realSession) close() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.st = sessionClosed
 }
 
 func (s *realSession) instanceTag() uint32 {
@@ -88,61 +242,272 @@ func (s *realSession) macKey() []byte {
 	if s.storedMac != nil {
 		return s.storedMac
 	}
-	return kdfx(usagePreMACKey, 64, kdfx(usageSK, skLength, serializePoint(ed448.PointScalarMul(s.i, s.s.priv.k))))
+	return calculateMACKey(s.i, s.s.priv.k)
 }
 
 func (s *realSession) hasExpired(timeout time.Duration) bool {
 	s.Lock()
 	defer s.Unlock()
 
-	return s.lastTouched.Add(timeout).Before(time.Now())
+	return s.lastTouched.Add(timeout).Before(nowFrom(s.clock))
 }
 
 func newSessionManager() *sessionManager {
-	return &sessionManager{
-		s: make(map[string]*realSession),
+	return newShardedSessionManager(registryShards)
+}
+
+func newShardedSessionManager(shards int) *sessionManager {
+	sm := &sessionManager{
+		shards:   make([]*sessionShard, shards),
+		prefixes: prefixCounts{n: make(map[string]int)},
+	}
+	for ix := range sm.shards {
+		sm.shards[ix] = &sessionShard{
+			s:   make(map[string]*sessionEntry),
+			lru: list.New(),
+		}
+	}
+	return sm
+}
+
+func (sm *sessionManager) shardFor(name string) *sessionShard {
+	return sm.shards[shardIndex(name, len(sm.shards))]
+}
+
+func (sm *sessionManager) prefixOf(name string) string {
+	if sm.limits.prefix == nil {
+		return DomainPrefix(name)
 	}
+	return sm.limits.prefix(name)
 }
 
-func (sm *sessionManager) get(name string) session {
-	sm.RLock()
-	s, ok := sm.s[name]
-	sm.RUnlock()
+// get returns the session for name, if there is one. Sessions are only ever
+// created by start, when a DAKE begins.
+func (sm *sessionManager) get(name string) (session, bool) {
+	sh := sm.shardFor(name)
+	sh.Lock()
+	defer sh.Unlock()
+
+	se, ok := sh.s[name]
 	if !ok {
-		s = &realSession{}
-		sm.Lock()
-		sm.s[name] = s
-		sm.Unlock()
+		return nil, false
+	}
+	sm.use(sh, se)
+	return se.s, true
+}
+
+// start returns the session for name, to use for a new DAKE. If a new session
+// has to be created while the table is full, the least recently used session
+// of the table that hasn't been authenticated yet is evicted to make room. An
+// error of kind ErrTooManySessions is returned if there is nothing to evict.
+func (sm *sessionManager) start(name string) (session, error) {
+	sh := sm.shardFor(name)
+	sh.Lock()
+	if se, ok := sh.s[name]; ok {
+		sm.use(sh, se)
+		sh.Unlock()
+		return se.s, nil
+	}
+
+	prefix := sm.prefixOf(name)
+	if sm.prefixes.reserve(prefix, sm.limits.maxPerPrefix) {
+		if sm.reserveTotal() {
+			s := sm.add(sh, name, prefix)
+			sh.Unlock()
+			return s, nil
+		}
+		sm.prefixes.release(prefix)
+	}
+	sh.Unlock()
+
+	return sm.startEvicting(name)
+}
+
+// startEvicting does what start does, for when a limit has been reached. It
+// holds the locks of all shards, so it can evict from any of them.
+func (sm *sessionManager) startEvicting(name string) (session, error) {
+	sm.lockAll()
+	defer sm.unlockAll()
+
+	sh := sm.shardFor(name)
+	if se, ok := sh.s[name]; ok {
+		sm.use(sh, se)
+		return se.s, nil
+	}
+
+	prefix := sm.prefixOf(name)
+	for !sm.prefixes.reserve(prefix, sm.limits.maxPerPrefix) {
+		if !sm.evictOldest(func(se *sessionEntry) bool { return se.prefix == prefix }, evictedForPrefix) {
+			return nil, newError(ErrTooManySessions, "too many sessions for "+prefix)
+		}
 	}
+	for !sm.reserveTotal() {
+		if !sm.evictOldest(func(*sessionEntry) bool { return true }, evictedForTotal) {
+			sm.prefixes.release(prefix)
+			return nil, newError(ErrTooManySessions, "too many sessions")
+		}
+	}
+	return sm.add(sh, name, prefix), nil
+}
+
+func (sm *sessionManager) lockAll() {
+	for _, sh := range sm.shards {
+		sh.Lock()
+	}
+}
+
+func (sm *sessionManager) unlockAll() {
+	for ix := len(sm.shards) - 1; ix >= 0; ix-- {
+		sm.shards[ix].Unlock()
+	}
+}
+
+// reserveTotal counts one more session, unless the table is full
+func (sm *sessionManager) reserveTotal() bool {
+	max := int64(sm.limits.max)
+	for {
+		cur := atomic.LoadInt64(&sm.total)
+		if max > 0 && cur >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&sm.total, cur, cur+1) {
+			return true
+		}
+	}
+}
+
+// use marks the session as the most recently used one.
+// Expects the shard lock to be held.
+func (sm *sessionManager) use(sh *sessionShard, se *sessionEntry) {
+	sh.lru.MoveToFront(se.el)
+	se.used = atomic.AddInt64(&sm.ticks, 1)
+}
+
+// add puts a new session in the shard. The session has to be counted already.
+// Expects the shard lock to be held.
+func (sm *sessionManager) add(sh *sessionShard, name, prefix string) *realSession {
+	s := &realSession{clock: sm.clock}
+	sh.s[name] = &sessionEntry{s: s, prefix: prefix, el: sh.lru.PushFront(name), used: atomic.AddInt64(&sm.ticks, 1)}
 	return s
 }
 
+// remove takes the session out of the shard, and stops counting it.
+// Expects the shard lock to be held.
+func (sm *sessionManager) remove(sh *sessionShard, name string) {
+	se, ok := sh.s[name]
+	if !ok {
+		return
+	}
+	sh.lru.Remove(se.el)
+	delete(sh.s, name)
+	sm.prefixes.release(se.prefix)
+	atomic.AddInt64(&sm.total, -1)
+}
+
+// evictOldest closes and removes the least recently used session of the whole
+// table that matches and hasn't been authenticated. It returns false if there
+// is no such session. Expects the locks of all shards to be held.
+func (sm *sessionManager) evictOldest(matches func(*sessionEntry) bool, reason string) bool {
+	var oldest *sessionEntry
+	var oldestName string
+	var oldestShard *sessionShard
+	for _, sh := range sm.shards {
+		// The first match from the back is the least recently used one of the shard
+		for el := sh.lru.Back(); el != nil; el = el.Prev() {
+			name := el.Value.(string)
+			se := sh.s[name]
+			if !matches(se) || se.s.state() >= sessionAuthenticated {
+				continue
+			}
+			if oldest == nil || se.used < oldest.used {
+				oldest, oldestName, oldestShard = se, name, sh
+			}
+			break
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+
+	oldest.s.close()
+	sm.remove(oldestShard, oldestName)
+	if sm.evicted != nil {
+		sm.evicted(reason)
+	}
+	return true
+}
+
 func (sm *sessionManager) complete(name string) {
-	sm.Lock()
-	defer sm.Unlock()
+	sh := sm.shardFor(name)
+	sh.Lock()
+	defer sh.Unlock()
 
-	delete(sm.s, name)
+	if se, ok := sh.s[name]; ok {
+		se.s.close()
+		sm.remove(sh, name)
+	}
+}
+
+// state returns the state of the session for name, without creating one
+func (sm *sessionManager) state(name string) sessionState {
+	sh := sm.shardFor(name)
+	sh.RLock()
+	se, ok := sh.s[name]
+	sh.RUnlock()
+	if !ok {
+		return sessionAwaitingDAKE1
+	}
+	return se.s.state()
 }
 
 func (sm *sessionManager) has(name string) bool {
-	sm.RLock()
-	defer sm.RUnlock()
+	sh := sm.shardFor(name)
+	sh.RLock()
+	defer sh.RUnlock()
 
-	_, ok := sm.s[name]
+	_, ok := sh.s[name]
 	return ok
 }
 
-func (sm *sessionManager) cleanup(timeout time.Duration) {
-	sm.Lock()
-	defer sm.Unlock()
+// count returns how many sessions there are
+func (sm *sessionManager) count() int {
+	return int(atomic.LoadInt64(&sm.total))
+}
+
+// cleanup removes the sessions that have expired, and returns how many there
+// were. The shards are cleaned up one at a time.
+func (sm *sessionManager) cleanup(timeout time.Duration) int {
+	removed := 0
+	for _, sh := range sm.shards {
+		removed += sm.cleanupShard(sh, timeout)
+	}
+	return removed
+}
+
+func (sm *sessionManager) cleanupShard(sh *sessionShard, timeout time.Duration) int {
+	sh.Lock()
+	defer sh.Unlock()
 
 	toRemove := []string{}
-	for nm, s := range sm.s {
-		if s.hasExpired(timeout) {
+	for nm, se := range sh.s {
+		if se.s.hasExpired(timeout) {
 			toRemove = append(toRemove, nm)
 		}
 	}
 	for _, nm := range toRemove {
-		delete(sm.s, nm)
+		sm.remove(sh, nm)
+	}
+	return len(toRemove)
+}
+
+// closeAll closes and removes every session, for a server that is shutting down
+func (sm *sessionManager) closeAll() {
+	for _, sh := range sm.shards {
+		sh.Lock()
+		for nm, se := range sh.s {
+			se.s.close()
+			sm.remove(sh, nm)
+		}
+		sh.Unlock()
 	}
 }
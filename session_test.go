@@ -1,6 +1,7 @@
 package prekeyserver
 
 import (
+	"errors"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -66,3 +67,187 @@ func (s *GenericServerSuite) Test_realSession_macKey_willUpdateTouch(c *C) {
 	se.macKey()
 	c.Assert(se.lastTouched.After(now), Equals, true)
 }
+
+func (s *GenericServerSuite) Test_realSession_followsTheDAKEStates(c *C) {
+	se := &realSession{}
+	c.Assert(se.state(), Equals, sessionAwaitingDAKE1)
+	c.Assert(se.authenticate(), ErrorMatches, "session is not awaiting DAKE3")
+
+	se.save(nil, nil, 0x11223344, nil)
+	c.Assert(se.state(), Equals, sessionAwaitingDAKE3)
+
+	c.Assert(se.authenticate(), IsNil)
+	c.Assert(se.state(), Equals, sessionAuthenticated)
+	c.Assert(se.authenticate(), ErrorMatches, "session is not awaiting DAKE3")
+
+	se.close()
+	c.Assert(se.state(), Equals, sessionClosed)
+	c.Assert(se.authenticate(), ErrorMatches, "session is not awaiting DAKE3")
+}
+
+func (s *GenericServerSuite) Test_sessionManager_state_doesNotCreateASession(c *C) {
+	sm := newSessionManager()
+	c.Assert(sm.state("someone@example.org"), Equals, sessionAwaitingDAKE1)
+	c.Assert(sm.has("someone@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_get_doesNotCreateASession(c *C) {
+	sm := newSessionManager()
+	se, ok := sm.get("someone@example.org")
+	c.Assert(ok, Equals, false)
+	c.Assert(se, IsNil)
+	c.Assert(sm.has("someone@example.org"), Equals, false)
+	c.Assert(sm.count(), Equals, 0)
+
+	started, _ := sm.start("someone@example.org")
+	se, ok = sm.get("someone@example.org")
+	c.Assert(ok, Equals, true)
+	c.Assert(se, Equals, started)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_session_reportsASenderWithoutASession(c *C) {
+	gs := &GenericServer{sessions: newSessionManager()}
+	_, e := gs.session("someone@example.org")
+	c.Assert(e, ErrorMatches, "no session for sender")
+	c.Assert(errors.Is(e, ErrOutOfSequence), Equals, true)
+	c.Assert(gs.hasSession("someone@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_complete_closesTheSession(c *C) {
+	sm := newSessionManager()
+	se, _ := sm.start("someone@example.org")
+	sm.complete("someone@example.org")
+	c.Assert(se.state(), Equals, sessionClosed)
+	c.Assert(sm.has("someone@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_start_evictsTheLeastRecentlyUsedUnauthenticatedSession(c *C) {
+	sm := newSessionManager()
+	sm.limits.max = 3
+	evicted := []string{}
+	sm.evicted = func(reason string) { evicted = append(evicted, reason) }
+
+	authenticated, _ := sm.start("one@example.org")
+	authenticated.save(nil, nil, 0x11223344, nil)
+	authenticated.authenticate()
+	oldest, _ := sm.start("two@example.org")
+	sm.start("three@example.org")
+	sm.get("two@example.org")
+
+	_, e := sm.start("four@example.org")
+
+	c.Assert(e, IsNil)
+	c.Assert(evicted, DeepEquals, []string{evictedForTotal})
+	c.Assert(sm.has("one@example.org"), Equals, true)
+	c.Assert(sm.has("two@example.org"), Equals, true)
+	c.Assert(sm.has("three@example.org"), Equals, false)
+	c.Assert(sm.has("four@example.org"), Equals, true)
+	c.Assert(oldest.state(), Equals, sessionAwaitingDAKE1)
+	c.Assert(sm.count(), Equals, 3)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_start_limitsTheSessionsPerPrefix(c *C) {
+	sm := newSessionManager()
+	sm.limits.maxPerPrefix = 2
+	evicted := []string{}
+	sm.evicted = func(reason string) { evicted = append(evicted, reason) }
+
+	first, _ := sm.start("one@fake.example")
+	sm.start("two@fake.example")
+	sm.start("sita@example.org")
+	_, e := sm.start("three@fake.example")
+
+	c.Assert(e, IsNil)
+	c.Assert(evicted, DeepEquals, []string{evictedForPrefix})
+	c.Assert(first.state(), Equals, sessionClosed)
+	c.Assert(sm.has("one@fake.example"), Equals, false)
+	c.Assert(sm.has("sita@example.org"), Equals, true)
+	c.Assert(sm.prefixes.count("fake.example"), Equals, 2)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_start_evictsFromAnotherShardWhenTheTableIsFull(c *C) {
+	sm := newSessionManager()
+	sm.limits.max = 4
+	senders := sendersInShard(0, 4, "example.org")
+	for _, from := range senders {
+		sm.start(from)
+	}
+	other := sendersInShard(1, 1, "example.org")[0]
+
+	_, e := sm.start(other)
+
+	c.Assert(e, IsNil)
+	c.Assert(sm.has(senders[0]), Equals, false)
+	c.Assert(sm.has(senders[1]), Equals, true)
+	c.Assert(sm.has(other), Equals, true)
+	c.Assert(sm.count(), Equals, 4)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_start_evictsFromAnotherShardWhenThePrefixIsFull(c *C) {
+	sm := newSessionManager()
+	sm.limits.maxPerPrefix = 2
+	senders := sendersInShard(0, 2, "fake.example")
+	sm.start(senders[0])
+	sm.start(senders[1])
+	other := sendersInShard(1, 1, "fake.example")[0]
+
+	_, e := sm.start(other)
+
+	c.Assert(e, IsNil)
+	c.Assert(sm.has(senders[0]), Equals, false)
+	c.Assert(sm.has(senders[1]), Equals, true)
+	c.Assert(sm.has(other), Equals, true)
+	c.Assert(sm.prefixes.count("fake.example"), Equals, 2)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_start_reusesAnExistingSession(c *C) {
+	sm := newSessionManager()
+	sm.limits.max = 1
+	se, _ := sm.start("one@example.org")
+
+	again, e := sm.start("one@example.org")
+
+	c.Assert(e, IsNil)
+	c.Assert(again, Equals, se)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_start_failsWhenNothingCanBeEvicted(c *C) {
+	sm := newSessionManager()
+	sm.limits.max = 1
+	sm.limits.prefix = func(from string) string { return from[:3] }
+	se, _ := sm.start("one@example.org")
+	se.save(nil, nil, 0x11223344, nil)
+	se.authenticate()
+
+	_, e := sm.start("two@example.org")
+
+	c.Assert(e, ErrorMatches, "too many sessions")
+	c.Assert(errors.Is(e, ErrTooManySessions), Equals, true)
+
+	sm.limits.max = 0
+	sm.limits.maxPerPrefix = 1
+	_, e = sm.start("one-more@example.org")
+	c.Assert(e, ErrorMatches, "too many sessions for one")
+}
+
+func (s *GenericServerSuite) Test_sessionManager_removingSessionsFreesTheirPrefix(c *C) {
+	sm := newSessionManager()
+	sm.start("one@example.org")
+	sm.start("two@example.org")
+
+	sm.complete("one@example.org")
+	c.Assert(sm.prefixes.count("example.org"), Equals, 1)
+	sm.closeAll()
+
+	c.Assert(sm.prefixes.n, HasLen, 0)
+	c.Assert(sm.count(), Equals, 0)
+	for _, sh := range sm.shards {
+		c.Assert(sh.lru.Len(), Equals, 0)
+	}
+}
+
+func (s *GenericServerSuite) Test_DomainPrefix_returnsWhatComesAfterTheLastAt(c *C) {
+	c.Assert(DomainPrefix("sita@example.org"), Equals, "example.org")
+	c.Assert(DomainPrefix("odd@name@example.org"), Equals, "example.org")
+	c.Assert(DomainPrefix("localhost"), Equals, "localhost")
+}
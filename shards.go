@@ -0,0 +1,16 @@
+package prekeyserver
+
+// registryShards is how many parts the session and fragment registries are
+// split into. Every part has its own lock, so messages from senders in
+// different parts never wait for each other.
+const registryShards = 32
+
+// shardIndex returns which of n shards the key belongs to, using FNV-1a
+func shardIndex(key string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
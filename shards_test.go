@@ -0,0 +1,186 @@
+package prekeyserver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// stressSenders is how many senders talk to the registries at the same time in
+// the stress tests. They are meant to be run with the race detector.
+const stressSenders = 4000
+
+// sendersInShard returns count senders of the domain that all go to the given
+// shard of a default registry
+func sendersInShard(shard, count int, domain string) []string {
+	res := []string{}
+	for ix := 0; len(res) < count; ix++ {
+		if from := fmt.Sprintf("sender%d@%s", ix, domain); shardIndex(from, registryShards) == shard {
+			res = append(res, from)
+		}
+	}
+	return res
+}
+
+func (s *GenericServerSuite) Test_shardIndex_returnsTheSameShardForTheSameKey(c *C) {
+	c.Assert(shardIndex("someone@example.org", registryShards), Equals, shardIndex("someone@example.org", registryShards))
+	c.Assert(shardIndex("someone@example.org", 1), Equals, 0)
+	c.Assert(shardIndex("", registryShards), Equals, shardIndex("", registryShards))
+}
+
+func (s *GenericServerSuite) Test_shardIndex_spreadsKeysOverAllShards(c *C) {
+	used := map[int]bool{}
+	for ix := 0; ix < 1000; ix++ {
+		i := shardIndex(fmt.Sprintf("sender%d@example.org", ix), registryShards)
+		c.Assert(i >= 0 && i < registryShards, Equals, true)
+		used[i] = true
+	}
+	c.Assert(used, HasLen, registryShards)
+}
+
+func (s *GenericServerSuite) Test_sessionManager_Stress_keepsItsCountsAndLimitsUnderConcurrentSenders(c *C) {
+	sm := newSessionManager()
+	sm.limits.max = 500
+	sm.limits.maxPerPrefix = 200
+	var evicted int64
+	sm.evicted = func(string) { atomic.AddInt64(&evicted, 1) }
+
+	stop := make(chan struct{})
+	var bg sync.WaitGroup
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				sm.cleanup(time.Hour)
+				c.Check(sm.count() <= sm.limits.max, Equals, true)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for ix := 0; ix < stressSenders; ix++ {
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			from := fmt.Sprintf("sender%d@domain%d.example.org", ix, ix%8)
+			se, e := sm.start(from)
+			if e != nil {
+				c.Check(e, ErrorMatches, ".*too many sessions.*")
+				return
+			}
+			se.save(nil, nil, uint32(ix), nil)
+			sm.state(from)
+			sm.has(from)
+			if ix%3 == 0 {
+				sm.complete(from)
+			}
+		}(ix)
+	}
+	wg.Wait()
+	close(stop)
+	bg.Wait()
+
+	c.Assert(atomic.LoadInt64(&evicted) > 0, Equals, true)
+	c.Assert(sm.count() <= sm.limits.max, Equals, true)
+
+	inShards := 0
+	perPrefix := map[string]int{}
+	for _, sh := range sm.shards {
+		c.Assert(sh.s, HasLen, sh.lru.Len())
+		inShards += len(sh.s)
+		for _, se := range sh.s {
+			perPrefix[se.prefix]++
+		}
+	}
+	c.Assert(sm.count(), Equals, inShards)
+	for prefix, n := range perPrefix {
+		c.Assert(n <= sm.limits.maxPerPrefix, Equals, true)
+		c.Assert(sm.prefixes.count(prefix), Equals, n)
+	}
+
+	sm.closeAll()
+	c.Assert(sm.count(), Equals, 0)
+	c.Assert(sm.prefixes.n, HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_fragmentations_Stress_keepsItsCountsAndLimitsUnderConcurrentSenders(c *C) {
+	f := newFragmentations()
+	f.limits = fragmentLimits{maxFragments: 8, maxPerSender: 2, maxBuffered: 20000, maxLength: 1000}
+	var evicted int64
+	f.evicted = func(string) { atomic.AddInt64(&evicted, 1) }
+
+	stop := make(chan struct{})
+	var bg sync.WaitGroup
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				f.cleanup(time.Hour)
+				c.Check(f.bufferedBytes() <= f.limits.maxBuffered, Equals, true)
+			}
+		}
+	}()
+
+	var completed int64
+	var wg sync.WaitGroup
+	for ix := 0; ix < stressSenders; ix++ {
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			from := fmt.Sprintf("sender%d@example.org", ix%1000)
+			// every sender sends a message it finishes, and one it never does
+			for _, frag := range []string{
+				fmt.Sprintf("?OTRP|%d|AF1FDEAD|BEEF,1,2,hello,", ix),
+				fmt.Sprintf("?OTRP|%d|AF1FDEAD|BEEF,1,3,never,", ix+stressSenders),
+				fmt.Sprintf("?OTRP|%d|AF1FDEAD|BEEF,2,2, world,", ix),
+			} {
+				r, complete, e := f.newFragmentReceived(from, frag)
+				c.Check(e, IsNil)
+				if complete {
+					c.Check(r, Equals, "hello world")
+					atomic.AddInt64(&completed, 1)
+				}
+			}
+		}(ix)
+	}
+	wg.Wait()
+	close(stop)
+	bg.Wait()
+
+	c.Assert(atomic.LoadInt64(&completed) > 0, Equals, true)
+	c.Assert(atomic.LoadInt64(&evicted) > 0, Equals, true)
+
+	buffered := 0
+	contexts := 0
+	for _, sh := range f.shards {
+		c.Assert(sh.contexts, HasLen, sh.lru.Len())
+		contexts += len(sh.contexts)
+		perSender := map[string]int{}
+		for _, fc := range sh.contexts {
+			buffered += fc.size
+			perSender[fc.from]++
+		}
+		c.Assert(sh.perSender, DeepEquals, perSender)
+		for _, n := range perSender {
+			c.Assert(n <= f.limits.maxPerSender, Equals, true)
+		}
+	}
+	c.Assert(f.count(), Equals, contexts)
+	c.Assert(f.bufferedBytes(), Equals, buffered)
+	c.Assert(buffered <= f.limits.maxBuffered, Equals, true)
+
+	f.clear()
+	c.Assert(f.count(), Equals, 0)
+	c.Assert(f.bufferedBytes(), Equals, 0)
+}
@@ -0,0 +1,390 @@
+package prekeyserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The sql storage keeps prekey data in a relational database, using database/sql.
+// The driver has to be registered by the program using it, in the usual way of
+// importing it for its side effects. The descriptor for it looks like
+// "sql:DRIVER:DATA SOURCE NAME", for example "sql:sqlite3:/var/data/prekeys.db"
+//
+// The schema is versioned, and will be created or upgraded when the storage is
+// opened. Only SQL that works the same in SQLite, PostgreSQL and MySQL is used,
+// except for the placeholders and binary column type, which depend on the driver.
+
+func init() {
+	RegisterStorageType("sql", createSQLStorageFactoryFrom)
+}
+
+type sqlDialect struct {
+	blob             string
+	numberedBindings bool
+}
+
+var defaultSQLDialect = sqlDialect{blob: "BLOB"}
+
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {blob: "BYTEA", numberedBindings: true},
+	"pgx":      {blob: "BYTEA", numberedBindings: true},
+}
+
+var sqlSchemaMigrations = []string{
+	`CREATE TABLE client_profiles (
+		identity TEXT NOT NULL,
+		instance_tag BIGINT NOT NULL,
+		expiration BIGINT NOT NULL,
+		data {{BLOB}} NOT NULL,
+		PRIMARY KEY (identity, instance_tag))`,
+	`CREATE TABLE prekey_profiles (
+		identity TEXT NOT NULL,
+		instance_tag BIGINT NOT NULL,
+		expiration BIGINT NOT NULL,
+		data {{BLOB}} NOT NULL,
+		PRIMARY KEY (identity, instance_tag))`,
+	`CREATE TABLE prekey_messages (
+		identity TEXT NOT NULL,
+		instance_tag BIGINT NOT NULL,
+		seq BIGINT NOT NULL,
+		data {{BLOB}} NOT NULL,
+		PRIMARY KEY (identity, instance_tag, seq))`,
+	// The numbers for prekey messages come from one counter shared by everyone,
+	// so that publications that happen at the same time never pick the same one
+	`CREATE TABLE prekey_message_sequence (next_seq BIGINT NOT NULL)`,
+	`INSERT INTO prekey_message_sequence (next_seq) SELECT COALESCE(MAX(seq), 0) FROM prekey_messages`,
+}
+
+type sqlStorageFactory struct {
+	st *sqlStorage
+}
+
+func createSQLStorageFactoryFrom(params string) (Storage, error) {
+	ix := strings.Index(params, ":")
+	if ix < 1 {
+		return nil, errors.New("sql storage needs a descriptor of the form sql:DRIVER:DATA SOURCE NAME")
+	}
+
+	driverName, dsn := params[:ix], params[ix+1:]
+	db, e := sql.Open(driverName, dsn)
+	if e != nil {
+		return nil, e
+	}
+
+	res, e := CreateSQLStorage(driverName, db)
+	if e != nil {
+		db.Close()
+		return nil, e
+	}
+	// The database was opened here, so it is closed with the last server using it
+	res.(*sqlStorageFactory).st.users.release = db.Close
+	return res, nil
+}
+
+// CreateSQLStorage returns a Storage that keeps its data in the given database.
+// The driver name is used to find out the small differences between SQL dialects.
+// The schema will be created or upgraded if necessary. The database is left
+// open when the servers using the storage are closed.
+func CreateSQLStorage(driverName string, db *sql.DB) (Storage, error) {
+	d, ok := sqlDialects[driverName]
+	if !ok {
+		d = defaultSQLDialect
+	}
+
+	st := &sqlStorage{db: db, dialect: d, users: &storageUsers{}}
+	if e := st.migrate(); e != nil {
+		return nil, e
+	}
+	return &sqlStorageFactory{st: st}, nil
+}
+
+func (f *sqlStorageFactory) createStorage() (storage, error) {
+	if e := f.st.users.add(); e != nil {
+		return nil, e
+	}
+	// Every server gets its own copy, since it sets its own clock on it
+	res := *f.st
+	return &res, nil
+}
+
+type sqlStorage struct {
+	db      *sql.DB
+	dialect sqlDialect
+	users   *storageUsers
+	// ctx is the context of the message being handled, if any
+	ctx context.Context
+	storageClock
+}
+
+func (s *sqlStorage) withContext(ctx context.Context) storage {
+	res := *s
+	res.ctx = ctx
+	return &res
+}
+
+func (s *sqlStorage) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// q adapts a query written with question mark placeholders to the dialect
+func (s *sqlStorage) q(query string) string {
+	query = strings.Replace(query, "{{BLOB}}", s.dialect.blob, -1)
+	if !s.dialect.numberedBindings {
+		return query
+	}
+
+	var res strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			res.WriteString("$" + strconv.Itoa(n))
+		} else {
+			res.WriteRune(r)
+		}
+	}
+	return res.String()
+}
+
+func (s *sqlStorage) schemaVersion(tx *sql.Tx) (int, error) {
+	if _, e := tx.ExecContext(s.context(), s.q(`CREATE TABLE IF NOT EXISTS prekey_schema_version (version INTEGER NOT NULL)`)); e != nil {
+		return 0, e
+	}
+
+	var version int
+	e := tx.QueryRowContext(s.context(), s.q(`SELECT version FROM prekey_schema_version`)).Scan(&version)
+	if e == sql.ErrNoRows {
+		if _, e := tx.ExecContext(s.context(), s.q(`INSERT INTO prekey_schema_version (version) VALUES (0)`)); e != nil {
+			return 0, e
+		}
+		return 0, nil
+	}
+	return version, e
+}
+
+func (s *sqlStorage) migrate() error {
+	return s.inTransaction(func(tx *sql.Tx) error {
+		version, e := s.schemaVersion(tx)
+		if e != nil {
+			return e
+		}
+
+		if version > len(sqlSchemaMigrations) {
+			return fmt.Errorf("storage schema version %d is newer than the supported version %d", version, len(sqlSchemaMigrations))
+		}
+
+		for _, m := range sqlSchemaMigrations[version:] {
+			if _, e := tx.ExecContext(s.context(), s.q(m)); e != nil {
+				return e
+			}
+		}
+
+		_, e = tx.ExecContext(s.context(), s.q(`UPDATE prekey_schema_version SET version = ?`), len(sqlSchemaMigrations))
+		return e
+	})
+}
+
+func (s *sqlStorage) inTransaction(f func(*sql.Tx) error) error {
+	tx, e := s.db.BeginTx(s.context(), nil)
+	if e != nil {
+		return e
+	}
+
+	if e := f(tx); e != nil {
+		tx.Rollback()
+		return e
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStorage) storeClientProfile(from string, cp *clientProfile) error {
+	return s.inTransaction(func(tx *sql.Tx) error {
+		if _, e := tx.ExecContext(s.context(), s.q(`DELETE FROM client_profiles WHERE identity = ? AND instance_tag = ?`), from, int64(cp.instanceTag)); e != nil {
+			return e
+		}
+		_, e := tx.ExecContext(s.context(), s.q(`INSERT INTO client_profiles (identity, instance_tag, expiration, data) VALUES (?, ?, ?, ?)`),
+			from, int64(cp.instanceTag), cp.expiration.Unix(), cp.serialize())
+		return e
+	})
+}
+
+func (s *sqlStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	if pp == nil {
+		return nil
+	}
+	return s.inTransaction(func(tx *sql.Tx) error {
+		if _, e := tx.ExecContext(s.context(), s.q(`DELETE FROM prekey_profiles WHERE identity = ? AND instance_tag = ?`), from, int64(pp.instanceTag)); e != nil {
+			return e
+		}
+		_, e := tx.ExecContext(s.context(), s.q(`INSERT INTO prekey_profiles (identity, instance_tag, expiration, data) VALUES (?, ?, ?, ?)`),
+			from, int64(pp.instanceTag), pp.expiration.Unix(), pp.serialize())
+		return e
+	})
+}
+
+func (s *sqlStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	if len(pms) == 0 {
+		return nil
+	}
+	return s.inTransaction(func(tx *sql.Tx) error {
+		first, e := s.reserveSequence(tx, len(pms))
+		if e != nil {
+			return e
+		}
+		for ix, pm := range pms {
+			if _, e := tx.ExecContext(s.context(), s.q(`INSERT INTO prekey_messages (identity, instance_tag, seq, data) VALUES (?, ?, ?, ?)`),
+				from, int64(pm.instanceTag), first+int64(ix), pm.serialize()); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+// reserveSequence takes n numbers for prekey messages from the shared counter
+// and returns the first of them. Updating the counter locks it until the
+// transaction is done, so no other transaction can get the same numbers.
+func (s *sqlStorage) reserveSequence(tx *sql.Tx, n int) (int64, error) {
+	if _, e := tx.ExecContext(s.context(), s.q(`UPDATE prekey_message_sequence SET next_seq = next_seq + ?`), n); e != nil {
+		return 0, e
+	}
+	var last int64
+	if e := tx.QueryRowContext(s.context(), s.q(`SELECT next_seq FROM prekey_message_sequence`)).Scan(&last); e != nil {
+		return 0, e
+	}
+	return last - int64(n) + 1, nil
+}
+
+func (s *sqlStorage) numberStored(from string, tag uint32) uint32 {
+	var res uint32
+	s.db.QueryRowContext(s.context(), s.q(`SELECT COUNT(*) FROM prekey_messages WHERE identity = ? AND instance_tag = ?`), from, int64(tag)).Scan(&res)
+	return res
+}
+
+type sqlProfiles struct {
+	itag int64
+	cp   []byte
+	pp   []byte
+}
+
+func (s *sqlStorage) profilesFor(tx *sql.Tx, from string) ([]sqlProfiles, error) {
+	rows, e := tx.QueryContext(s.context(), s.q(`SELECT cp.instance_tag, cp.data, pp.data FROM client_profiles cp
+		JOIN prekey_profiles pp ON pp.identity = cp.identity AND pp.instance_tag = cp.instance_tag
+		WHERE cp.identity = ?`), from)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+
+	res := []sqlProfiles{}
+	for rows.Next() {
+		p := sqlProfiles{}
+		if e := rows.Scan(&p.itag, &p.cp, &p.pp); e != nil {
+			return nil, e
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+// takePrekeyMessage removes the oldest prekey message for the instance tag and returns it.
+// If another transaction took it first, the next oldest one is tried, until there are
+// none left, in which case nil is returned. Only messages after the ones already tried
+// are looked at, since a snapshot of the table might still show them.
+func (s *sqlStorage) takePrekeyMessage(tx *sql.Tx, from string, itag int64) ([]byte, error) {
+	seq := int64(-1)
+	for {
+		var data []byte
+		e := tx.QueryRowContext(s.context(), s.q(`SELECT seq, data FROM prekey_messages WHERE identity = ? AND instance_tag = ? AND seq > ? ORDER BY seq LIMIT 1`), from, itag, seq).Scan(&seq, &data)
+		if e == sql.ErrNoRows {
+			return nil, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+
+		r, e := tx.ExecContext(s.context(), s.q(`DELETE FROM prekey_messages WHERE identity = ? AND instance_tag = ? AND seq = ?`), from, itag, seq)
+		if e != nil {
+			return nil, e
+		}
+		n, e := r.RowsAffected()
+		if e != nil {
+			return nil, e
+		}
+		if n == 1 {
+			return data, nil
+		}
+	}
+}
+
+// removeExpiredProfilesFor purges the profiles for the identity that can't be handed out anymore
+func (s *sqlStorage) removeExpiredProfilesFor(tx *sql.Tx, from string) error {
+	now := s.now().Unix()
+	if _, e := tx.ExecContext(s.context(), s.q(`DELETE FROM client_profiles WHERE identity = ? AND expiration < ?`), from, now); e != nil {
+		return e
+	}
+	_, e := tx.ExecContext(s.context(), s.q(`DELETE FROM prekey_profiles WHERE identity = ? AND expiration < ?`), from, now)
+	return e
+}
+
+func (s *sqlStorage) retrieveFor(from string, accept ensembleFilter) ([]*prekeyEnsemble, error) {
+	var res []*prekeyEnsemble
+	e := s.inTransaction(func(tx *sql.Tx) error {
+		res = nil
+		if e := s.removeExpiredProfilesFor(tx, from); e != nil {
+			return e
+		}
+		profiles, e := s.profilesFor(tx, from)
+		if e != nil {
+			return e
+		}
+
+		for _, p := range profiles {
+			pe := &prekeyEnsemble{cp: &clientProfile{}, pp: &prekeyProfile{}, pm: &prekeyMessage{}}
+			_, ok1 := pe.cp.deserialize(p.cp)
+			_, ok2 := pe.pp.deserialize(p.pp)
+			if !ok1 || !ok2 {
+				return errors.New("corrupt entry in sql storage")
+			}
+			now := s.now()
+			if pe.cp.hasExpired(now) || pe.pp.hasExpired(now) || !accept.accepts(pe.cp, pe.pp) {
+				continue
+			}
+
+			pmd, e := s.takePrekeyMessage(tx, from, p.itag)
+			if e != nil {
+				return e
+			}
+			if pmd == nil {
+				continue
+			}
+			if _, ok := pe.pm.deserialize(pmd); !ok {
+				return errors.New("corrupt entry in sql storage")
+			}
+			res = append(res, pe)
+		}
+		return nil
+	})
+
+	if e != nil {
+		return nil, e
+	}
+	return res, nil
+}
+
+func (s *sqlStorage) cleanup() {
+	now := s.now().Unix()
+	s.db.ExecContext(s.context(), s.q(`DELETE FROM client_profiles WHERE expiration < ?`), now)
+	s.db.ExecContext(s.context(), s.q(`DELETE FROM prekey_profiles WHERE expiration < ?`), now)
+}
+
+func (s *sqlStorage) close() error {
+	return s.users.done()
+}
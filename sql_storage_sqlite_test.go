@@ -0,0 +1,193 @@
+// These tests run the sql storage against the vendored SQLite driver, which is
+// written in pure Go, so they run together with all other tests.
+
+package prekeyserver
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	. "gopkg.in/check.v1"
+)
+
+func createTestSQLStorage(c *C) *sqlStorage {
+	os.Mkdir(testDir, 0700)
+	st, e := createSQLStorageFactoryFrom("sqlite3:file:" + path.Join(testDir, "prekeys.db") + "?_pragma=busy_timeout(5000)&_txlock=immediate")
+	c.Assert(e, IsNil)
+	res, e := st.createStorage()
+	c.Assert(e, IsNil)
+	return res.(*sqlStorage)
+}
+
+func (s *GenericServerSuite) Test_sqlStorage_storesAndRetrievesEnsembles(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+	gs := &GenericServer{rand: fixtureRand()}
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
+
+	c.Assert(st.storeClientProfile("sita@example.org", sita.clientProfile), IsNil)
+	c.Assert(st.storeClientProfile("sita@example.org", sita.clientProfile), IsNil)
+	c.Assert(st.storePrekeyProfile("sita@example.org", pp), IsNil)
+	c.Assert(st.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm1}), IsNil)
+	c.Assert(st.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm2}), IsNil)
+	c.Assert(st.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(2))
+	c.Assert(st.numberStored("someone@example.org", sita.instanceTag), Equals, uint32(0))
+
+	res := retrieved(st.retrieveFor("sita@example.org", nil))
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].cp.Equals(sita.clientProfile), Equals, true)
+	c.Assert(res[0].pp.Equals(pp), Equals, true)
+	c.Assert(res[0].pm.Equals(pm1), Equals, true)
+
+	res = retrieved(st.retrieveFor("sita@example.org", nil))
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].pm.Equals(pm2), Equals, true)
+
+	c.Assert(retrieved(st.retrieveFor("sita@example.org", nil)), HasLen, 0)
+	c.Assert(st.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(0))
+}
+
+func (s *GenericServerSuite) Test_sqlStorage_retrieveFor_handsOutEachPrekeyMessageOnce(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+	gs := &GenericServer{rand: fixtureRand()}
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pms := []*prekeyMessage{}
+	for i := 0; i < 20; i++ {
+		pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+		pm.identifier = uint32(i)
+		pms = append(pms, pm)
+	}
+	st.storeClientProfile("sita@example.org", sita.clientProfile)
+	st.storePrekeyProfile("sita@example.org", pp)
+	st.storePrekeyMessages("sita@example.org", pms)
+
+	var lock sync.Mutex
+	seen := make(map[uint32]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, pe := range retrieved(st.retrieveFor("sita@example.org", nil)) {
+				lock.Lock()
+				seen[pe.pm.identifier]++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, n := range seen {
+		c.Assert(n, Equals, 1)
+	}
+	c.Assert(uint32(len(seen))+st.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(20))
+}
+
+func (s *GenericServerSuite) Test_sqlStorage_storePrekeyMessages_keepsEveryMessagePublishedAtTheSameTime(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+	gs := &GenericServer{rand: fixtureRand()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+		pm2, _ := generatePrekeyMessage(gs, sita.instanceTag)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(st.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm1, pm2}), IsNil)
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(st.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(40))
+}
+
+func (s *GenericServerSuite) Test_sqlStorage_storePrekeyMessages_keepsEveryMessageUnderItsOwnInstanceTag(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+	gs := &GenericServer{rand: fixtureRand()}
+
+	pm1, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	pm2, _ := generatePrekeyMessage(gs, 0x42424242)
+	c.Assert(st.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm1, pm2}), IsNil)
+
+	c.Assert(st.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+	c.Assert(st.numberStored("sita@example.org", 0x42424242), Equals, uint32(1))
+}
+
+func (s *GenericServerSuite) Test_CreateSQLStorage_continuesTheNumbersOfAnOlderSchema(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+	gs := &GenericServer{rand: fixtureRand()}
+
+	st.db.Exec(`DROP TABLE prekey_message_sequence`)
+	st.db.Exec(`UPDATE prekey_schema_version SET version = 3`)
+	st.db.Exec(`INSERT INTO prekey_messages (identity, instance_tag, seq, data) VALUES ('sita@example.org', 1, 7, x'00')`)
+
+	res, e := CreateSQLStorage("sqlite3", st.db)
+	c.Assert(e, IsNil)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	stor, e := res.createStorage()
+	c.Assert(e, IsNil)
+	c.Assert(stor.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm}), IsNil)
+
+	var seq int64
+	st.db.QueryRow(`SELECT seq FROM prekey_messages WHERE instance_tag = ?`, int64(sita.instanceTag)).Scan(&seq)
+	c.Assert(seq, Equals, int64(8))
+}
+
+func (s *GenericServerSuite) Test_sqlStorage_cleanup_removesExpiredProfiles(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+	gs := &GenericServer{rand: fixtureRand()}
+
+	pp1, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2017, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pp2, _ := generatePrekeyProfile(gs, 0x42424242, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	st.storePrekeyProfile("someone@example.org", pp1)
+	st.storePrekeyProfile("someone@example.org", pp2)
+
+	st.cleanup()
+
+	var n int
+	st.db.QueryRow(`SELECT COUNT(*) FROM prekey_profiles`).Scan(&n)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *GenericServerSuite) Test_CreateSQLStorage_refusesANewerSchema(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+
+	st.db.Exec(`UPDATE prekey_schema_version SET version = 42`)
+
+	_, e := CreateSQLStorage("sqlite3", st.db)
+	c.Assert(e, ErrorMatches, "storage schema version 42 is newer than the supported version 5")
+}
+
+func (s *GenericServerSuite) Test_CreateSQLStorage_canBeOpenedAgain(c *C) {
+	st := createTestSQLStorage(c)
+	defer os.RemoveAll(testDir)
+	defer st.db.Close()
+
+	db, _ := sql.Open("sqlite3", path.Join(testDir, "prekeys.db"))
+	defer db.Close()
+	_, e := CreateSQLStorage("sqlite3", db)
+	c.Assert(e, IsNil)
+}
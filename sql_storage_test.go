@@ -0,0 +1,45 @@
+package prekeyserver
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *GenericServerSuite) Test_createSQLStorageFactoryFrom_needsADriverName(c *C) {
+	_, e := createSQLStorageFactoryFrom("/var/data/prekeys.db")
+	c.Assert(e, ErrorMatches, "sql storage needs a descriptor of the form sql:DRIVER:DATA SOURCE NAME")
+
+	_, e = createSQLStorageFactoryFrom(":/var/data/prekeys.db")
+	c.Assert(e, ErrorMatches, "sql storage needs a descriptor of the form sql:DRIVER:DATA SOURCE NAME")
+}
+
+func (s *GenericServerSuite) Test_createSQLStorageFactoryFrom_failsForAnUnknownDriver(c *C) {
+	_, e := (&realFactory{}).LoadStorageType("sql:a-driver-that-does-not-exist:/var/data/prekeys.db")
+	c.Assert(e, ErrorMatches, `sql: unknown driver "a-driver-that-does-not-exist" \(forgotten import\?\)`)
+}
+
+func (s *GenericServerSuite) Test_sqlStorage_q_leavesPlaceholdersForMostDialects(c *C) {
+	st := &sqlStorage{dialect: defaultSQLDialect}
+	c.Assert(st.q("SELECT data {{BLOB}} FROM t WHERE a = ? AND b = ?"), Equals, "SELECT data BLOB FROM t WHERE a = ? AND b = ?")
+}
+
+func (s *GenericServerSuite) Test_sqlStorage_q_numbersPlaceholdersForPostgres(c *C) {
+	st := &sqlStorage{dialect: sqlDialects["postgres"]}
+	c.Assert(st.q("SELECT data {{BLOB}} FROM t WHERE a = ? AND b = ?"), Equals, "SELECT data BYTEA FROM t WHERE a = $1 AND b = $2")
+}
+
+func (s *GenericServerSuite) Test_sqlStorageFactory_createStorage_givesEveryServerItsOwnClock(c *C) {
+	f := &sqlStorageFactory{st: &sqlStorage{users: &storageUsers{}}}
+	res1, _ := f.createStorage()
+	res2, _ := f.createStorage()
+	st1, st2 := res1.(*sqlStorage), res2.(*sqlStorage)
+
+	st1.useClock(&fixedClock{time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)})
+
+	c.Assert(st1.now(), Equals, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(st2.clock, IsNil)
+	c.Assert(f.st.clock, IsNil)
+	c.Assert(st1.users, Equals, st2.users)
+	c.Assert(f.st.users.n, Equals, 2)
+}
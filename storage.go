@@ -1,10 +1,95 @@
 package prekeyserver
 
+import (
+	"context"
+	"sync"
+)
+
 type storage interface {
 	storeClientProfile(string, *clientProfile) error
 	storePrekeyProfile(string, *prekeyProfile) error
 	storePrekeyMessages(string, []*prekeyMessage) error
 	numberStored(string, uint32) uint32
-	retrieveFor(string) []*prekeyEnsemble
+	retrieveFor(string, ensembleFilter) ([]*prekeyEnsemble, error)
 	cleanup()
+	// close is called once the server using the storage has shut down
+	close() error
+}
+
+// storageUsers counts the storages created from one Storage, so that what they
+// share is only let go of when the last of them has been closed. If open is
+// set, it's called to get it back when a storage is created after that. A nil
+// *storageUsers doesn't count anything.
+type storageUsers struct {
+	n        int
+	open     func() error
+	release  func() error
+	released bool
+	sync.Mutex
+}
+
+func (u *storageUsers) add() error {
+	if u == nil {
+		return nil
+	}
+	u.Lock()
+	defer u.Unlock()
+
+	if u.released && u.open != nil {
+		if e := u.open(); e != nil {
+			return e
+		}
+		u.released = false
+	}
+	u.n++
+	return nil
+}
+
+func (u *storageUsers) done() error {
+	if u == nil {
+		return nil
+	}
+	u.Lock()
+	defer u.Unlock()
+
+	u.n--
+	if u.n == 0 {
+		u.released = true
+		if u.release != nil {
+			return u.release()
+		}
+	}
+	return nil
+}
+
+// failedStorage stands in for a storage that couldn't be created, and returns
+// the reason for everything
+type failedStorage struct {
+	err error
+}
+
+func (s failedStorage) storeClientProfile(string, *clientProfile) error    { return s.err }
+func (s failedStorage) storePrekeyProfile(string, *prekeyProfile) error    { return s.err }
+func (s failedStorage) storePrekeyMessages(string, []*prekeyMessage) error { return s.err }
+func (s failedStorage) numberStored(string, uint32) uint32                 { return 0 }
+func (s failedStorage) cleanup()                                           {}
+func (s failedStorage) close() error                                       { return nil }
+
+func (s failedStorage) retrieveFor(string, ensembleFilter) ([]*prekeyEnsemble, error) {
+	return nil, s.err
+}
+
+// contextStorage is implemented by storages that can observe the context of the
+// message being handled, for example to stop waiting for a lock once it's done.
+// withContext returns a storage that uses the context for all its calls.
+type contextStorage interface {
+	withContext(context.Context) storage
+}
+
+// ensembleFilter decides if the profiles for an instance tag can be handed out.
+// Storage implementations have to ask before they use up a prekey message.
+type ensembleFilter func(*clientProfile, *prekeyProfile) bool
+
+func (f ensembleFilter) accepts(cp *clientProfile, pp *prekeyProfile) bool {
+	return f == nil || f(cp, pp)
 }
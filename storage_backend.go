@@ -0,0 +1,278 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+)
+
+// StorageBackend is the interface a storage engine has to implement to be used
+// by the prekey server. It will be called from several goroutines at the same time.
+// RetrieveFor should hand out each prekey message only once, and only return
+// ensembles where all three parts are available. Expired profiles should never be
+// returned, and can be removed as soon as they are found.
+type StorageBackend interface {
+	StoreClientProfile(from string, cp ClientProfile) error
+	StorePrekeyProfile(from string, pp PrekeyProfile) error
+	StorePrekeyMessages(from string, pms []PrekeyMessage) error
+	NumberStored(from string, instanceTag uint32) uint32
+	RetrieveFor(from string) []PrekeyEnsemble
+	Cleanup()
+}
+
+// ContextStorageBackend can be implemented by a StorageBackend that wants to
+// observe the context given to HandleContext. WithContext is called for every
+// message that needs the storage, and the backend it returns should stop
+// waiting for locks or slow calls once the context is done.
+type ContextStorageBackend interface {
+	StorageBackend
+	WithContext(ctx context.Context) StorageBackend
+}
+
+// FilteringStorageBackend can be implemented by a StorageBackend that can ask
+// about the profiles of an instance tag before it uses up one of its prekey
+// messages. RetrieveMatching works like RetrieveFor, but only uses up prekey
+// messages for the profiles accept returns true for. The ensembles of a backend
+// that doesn't implement it are filtered after RetrieveFor has returned them,
+// and the prekey messages of the ensembles left out are stored again.
+type FilteringStorageBackend interface {
+	StorageBackend
+	RetrieveMatching(from string, accept func(ClientProfile, PrekeyProfile) bool) []PrekeyEnsemble
+}
+
+// ClosingStorageBackend can be implemented by a StorageBackend that holds on to
+// files or connections. Close is called once, when the last server using the
+// backend has shut down, and should write out anything pending and let go of them.
+type ClosingStorageBackend interface {
+	StorageBackend
+	Close() error
+}
+
+// StorageFromBackend returns a Storage that can be given to NewServer, and that
+// will use the given backend for all servers created with it
+func StorageFromBackend(b StorageBackend) Storage {
+	users := &storageUsers{}
+	if cb, ok := b.(ClosingStorageBackend); ok {
+		users.release = cb.Close
+	}
+	return &backendStorageFactory{b: b, users: users}
+}
+
+// StorageBackendFor gives direct access to the storage engine behind a Storage,
+// for example to run the storagetest suite against the engines of this package
+func StorageBackendFor(st Storage) (StorageBackend, error) {
+	if bsf, ok := st.(*backendStorageFactory); ok {
+		return bsf.b, nil
+	}
+	s, e := st.createStorage()
+	if e != nil {
+		return nil, e
+	}
+	return &storageBackendAdapter{s}, nil
+}
+
+// NewPrekeyEnsemble puts together an ensemble from its parts. It is meant for
+// storage backends that need to return ensembles from RetrieveFor.
+func NewPrekeyEnsemble(cp ClientProfile, pp PrekeyProfile, pm PrekeyMessage) PrekeyEnsemble {
+	return &prekeyEnsemble{
+		cp: cp.realClientProfile(),
+		pp: pp.realPrekeyProfile(),
+		pm: pm.realPrekeyMessage(),
+	}
+}
+
+// ParseClientProfile reads back a client profile from the result of Serialize
+func ParseClientProfile(data []byte) (ClientProfile, error) {
+	cp := &clientProfile{}
+	if _, ok := cp.deserialize(data); !ok {
+		return nil, errors.New("invalid client profile")
+	}
+	return cp, nil
+}
+
+// ParsePrekeyProfile reads back a prekey profile from the result of Serialize
+func ParsePrekeyProfile(data []byte) (PrekeyProfile, error) {
+	pp := &prekeyProfile{}
+	if _, ok := pp.deserialize(data); !ok {
+		return nil, errors.New("invalid prekey profile")
+	}
+	return pp, nil
+}
+
+// ParsePrekeyMessage reads back a prekey message from the result of Serialize
+func ParsePrekeyMessage(data []byte) (PrekeyMessage, error) {
+	pm := &prekeyMessage{}
+	if _, ok := pm.deserialize(data); !ok {
+		return nil, errors.New("invalid prekey message")
+	}
+	return pm, nil
+}
+
+type backendStorageFactory struct {
+	b     StorageBackend
+	users *storageUsers
+}
+
+func (f *backendStorageFactory) createStorage() (storage, error) {
+	if e := f.users.add(); e != nil {
+		return nil, e
+	}
+	return &backendStorage{b: f.b, users: f.users}, nil
+}
+
+type backendStorage struct {
+	b     StorageBackend
+	users *storageUsers
+}
+
+func (s *backendStorage) withContext(ctx context.Context) storage {
+	if cb, ok := s.b.(ContextStorageBackend); ok {
+		return &backendStorage{b: cb.WithContext(ctx), users: s.users}
+	}
+	return s
+}
+
+func (s *backendStorage) storeClientProfile(from string, cp *clientProfile) error {
+	return s.b.StoreClientProfile(from, cp)
+}
+
+func (s *backendStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	return s.b.StorePrekeyProfile(from, pp)
+}
+
+func (s *backendStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	res := make([]PrekeyMessage, len(pms))
+	for ix, pm := range pms {
+		res[ix] = pm
+	}
+	return s.b.StorePrekeyMessages(from, res)
+}
+
+func (s *backendStorage) numberStored(from string, tag uint32) uint32 {
+	return s.b.NumberStored(from, tag)
+}
+
+func (s *backendStorage) retrieveFor(from string, accept ensembleFilter) ([]*prekeyEnsemble, error) {
+	var pes []PrekeyEnsemble
+	if fb, ok := s.b.(FilteringStorageBackend); ok && accept != nil {
+		pes = fb.RetrieveMatching(from, func(cp ClientProfile, pp PrekeyProfile) bool {
+			return accept(cp.realClientProfile(), pp.realPrekeyProfile())
+		})
+	} else {
+		pes = s.b.RetrieveFor(from)
+	}
+
+	ensembles := make([]*prekeyEnsemble, len(pes))
+	for ix, pe := range pes {
+		if ensembles[ix] = realEnsemble(pe); ensembles[ix] == nil {
+			return nil, errors.New("storage backend returned an incomplete prekey ensemble")
+		}
+	}
+
+	res := make([]*prekeyEnsemble, 0, len(ensembles))
+	var rejected []PrekeyMessage
+	for _, rpe := range ensembles {
+		if accept.accepts(rpe.cp, rpe.pp) {
+			res = append(res, rpe)
+		} else {
+			rejected = append(rejected, rpe.pm)
+		}
+	}
+	// The backend has already used up the prekey messages of the ensembles
+	// that weren't accepted, so they are put back to be handed out later
+	if len(rejected) > 0 {
+		if e := s.b.StorePrekeyMessages(from, rejected); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+// realEnsemble returns the ensemble from a backend as one the server can use,
+// or nil if any of its parts is missing
+func realEnsemble(pe PrekeyEnsemble) *prekeyEnsemble {
+	if rpe, ok := pe.(*prekeyEnsemble); pe == nil || ok && rpe == nil {
+		return nil
+	}
+	cp, pp, pm := pe.ClientProfile(), pe.PrekeyProfile(), pe.PrekeyMessage()
+	if cp == nil || pp == nil || pm == nil {
+		return nil
+	}
+	res := &prekeyEnsemble{
+		cp: cp.realClientProfile(),
+		pp: pp.realPrekeyProfile(),
+		pm: pm.realPrekeyMessage(),
+	}
+	if res.cp == nil || res.pp == nil || res.pm == nil {
+		return nil
+	}
+	return res
+}
+
+func (s *backendStorage) cleanup() {
+	s.b.Cleanup()
+}
+
+func (s *backendStorage) close() error {
+	return s.users.done()
+}
+
+type storageBackendAdapter struct {
+	s storage
+}
+
+// WithContext implements ContextStorageBackend
+func (a *storageBackendAdapter) WithContext(ctx context.Context) StorageBackend {
+	if cs, ok := a.s.(contextStorage); ok {
+		return &storageBackendAdapter{cs.withContext(ctx)}
+	}
+	return a
+}
+
+func (a *storageBackendAdapter) StoreClientProfile(from string, cp ClientProfile) error {
+	return a.s.storeClientProfile(from, cp.realClientProfile())
+}
+
+func (a *storageBackendAdapter) StorePrekeyProfile(from string, pp PrekeyProfile) error {
+	return a.s.storePrekeyProfile(from, pp.realPrekeyProfile())
+}
+
+func (a *storageBackendAdapter) StorePrekeyMessages(from string, pms []PrekeyMessage) error {
+	res := make([]*prekeyMessage, len(pms))
+	for ix, pm := range pms {
+		res[ix] = pm.realPrekeyMessage()
+	}
+	return a.s.storePrekeyMessages(from, res)
+}
+
+func (a *storageBackendAdapter) NumberStored(from string, tag uint32) uint32 {
+	return a.s.numberStored(from, tag)
+}
+
+func (a *storageBackendAdapter) RetrieveFor(from string) []PrekeyEnsemble {
+	return a.RetrieveMatching(from, nil)
+}
+
+// RetrieveMatching implements FilteringStorageBackend
+func (a *storageBackendAdapter) RetrieveMatching(from string, accept func(ClientProfile, PrekeyProfile) bool) []PrekeyEnsemble {
+	var f ensembleFilter
+	if accept != nil {
+		f = func(cp *clientProfile, pp *prekeyProfile) bool {
+			return accept(cp, pp)
+		}
+	}
+	pes, _ := a.s.retrieveFor(from, f)
+	res := make([]PrekeyEnsemble, len(pes))
+	for ix, pe := range pes {
+		res[ix] = pe
+	}
+	return res
+}
+
+func (a *storageBackendAdapter) Cleanup() {
+	a.s.cleanup()
+}
+
+// Close implements ClosingStorageBackend
+func (a *storageBackendAdapter) Close() error {
+	return a.s.close()
+}
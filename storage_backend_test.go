@@ -0,0 +1,239 @@
+package prekeyserver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// serializingBackend keeps everything in serialized form, the way an external engine would
+type serializingBackend struct {
+	cps map[string][]byte
+	pps map[string][]byte
+	pms map[string][][]byte
+	// closed counts the calls to Close
+	closed int
+	sync.Mutex
+}
+
+func newSerializingBackend() *serializingBackend {
+	return &serializingBackend{
+		cps: make(map[string][]byte),
+		pps: make(map[string][]byte),
+		pms: make(map[string][][]byte),
+	}
+}
+
+func (b *serializingBackend) StoreClientProfile(from string, cp ClientProfile) error {
+	b.Lock()
+	defer b.Unlock()
+	b.cps[from] = cp.Serialize()
+	return nil
+}
+
+func (b *serializingBackend) StorePrekeyProfile(from string, pp PrekeyProfile) error {
+	b.Lock()
+	defer b.Unlock()
+	b.pps[from] = pp.Serialize()
+	return nil
+}
+
+func (b *serializingBackend) StorePrekeyMessages(from string, pms []PrekeyMessage) error {
+	b.Lock()
+	defer b.Unlock()
+	for _, pm := range pms {
+		b.pms[from] = append(b.pms[from], pm.Serialize())
+	}
+	return nil
+}
+
+func (b *serializingBackend) NumberStored(from string, tag uint32) uint32 {
+	b.Lock()
+	defer b.Unlock()
+	return uint32(len(b.pms[from]))
+}
+
+func (b *serializingBackend) RetrieveFor(from string) []PrekeyEnsemble {
+	return b.RetrieveMatching(from, nil)
+}
+
+func (b *serializingBackend) RetrieveMatching(from string, accept func(ClientProfile, PrekeyProfile) bool) []PrekeyEnsemble {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.pms[from]) == 0 || b.cps[from] == nil || b.pps[from] == nil {
+		return nil
+	}
+	cp, _ := ParseClientProfile(b.cps[from])
+	pp, _ := ParsePrekeyProfile(b.pps[from])
+	if accept != nil && !accept(cp, pp) {
+		return nil
+	}
+	pm, _ := ParsePrekeyMessage(b.pms[from][0])
+	b.pms[from] = b.pms[from][1:]
+	return []PrekeyEnsemble{NewPrekeyEnsemble(cp, pp, pm)}
+}
+
+func (b *serializingBackend) Cleanup() {}
+
+func (b *serializingBackend) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	b.closed++
+	return nil
+}
+
+func (s *GenericServerSuite) Test_StorageFromBackend_isUsedForPublicationAndRetrieval(c *C) {
+	gs := testServerForInitiator()
+	gs.storageImpl, _ = StorageFromBackend(newSerializingBackend()).createStorage()
+	in := newInitiator(gs, "sita@example.org", gs.identity, sita.longTerm, sita.clientProfile)
+
+	d2, _ := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", in.DAKE1())
+	c.Assert(in.ReceiveDAKE2(d2), IsNil)
+
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	d3, _ := in.PublicationDAKE3(sita.clientProfile, pp, []PrekeyMessage{pm})
+
+	res, e := gs.messageHandler.handleMessage(context.Background(), "sita@example.org", d3)
+	c.Assert(e, IsNil)
+	c.Assert(in.ReceiveSuccess(res), IsNil)
+	c.Assert(gs.storage().numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+
+	pes := retrieved(gs.storage().retrieveFor("sita@example.org", nil))
+	c.Assert(pes, HasLen, 1)
+	c.Assert(pes[0].cp.Equals(sita.clientProfile), Equals, true)
+	c.Assert(pes[0].pp.Equals(pp), Equals, true)
+	c.Assert(pes[0].pm.Equals(pm), Equals, true)
+	c.Assert(retrieved(gs.storage().retrieveFor("sita@example.org", nil)), HasLen, 0)
+}
+
+// plainBackend only has the methods every StorageBackend must have
+type plainBackend struct {
+	StorageBackend
+}
+
+func (s *GenericServerSuite) Test_StorageFromBackend_filtersTheEnsemblesOfABackendThatCantFilter(c *C) {
+	gs := testServerForInitiator()
+	b := newSerializingBackend()
+	st, _ := StorageFromBackend(plainBackend{b}).createStorage()
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	st.storeClientProfile("sita@example.org", sita.clientProfile)
+	st.storePrekeyProfile("sita@example.org", pp)
+	st.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm, pm})
+
+	c.Assert(retrieved(st.retrieveFor("sita@example.org", func(*clientProfile, *prekeyProfile) bool { return false })), HasLen, 0)
+	c.Assert(st.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(2))
+	pes := retrieved(st.retrieveFor("sita@example.org", nil))
+	c.Assert(pes, HasLen, 1)
+	c.Assert(pes[0].pm.Equals(pm), Equals, true)
+	c.Assert(st.numberStored("sita@example.org", sita.instanceTag), Equals, uint32(1))
+	c.Assert(st.close(), IsNil)
+}
+
+// failingStoreBackend can't store prekey messages
+type failingStoreBackend struct {
+	*serializingBackend
+}
+
+func (b *failingStoreBackend) StorePrekeyMessages(string, []PrekeyMessage) error {
+	return errors.New("disk is full")
+}
+
+func (s *GenericServerSuite) Test_StorageFromBackend_reportsPrekeyMessagesThatCantBePutBack(c *C) {
+	gs := testServerForInitiator()
+	b := newSerializingBackend()
+	pp, _ := generatePrekeyProfile(gs, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 13, time.UTC), sita.longTerm)
+	pm, _ := generatePrekeyMessage(gs, sita.instanceTag)
+	b.StoreClientProfile("sita@example.org", sita.clientProfile)
+	b.StorePrekeyProfile("sita@example.org", pp)
+	b.StorePrekeyMessages("sita@example.org", []PrekeyMessage{pm})
+	st, _ := StorageFromBackend(plainBackend{&failingStoreBackend{b}}).createStorage()
+
+	_, e := st.retrieveFor("sita@example.org", func(*clientProfile, *prekeyProfile) bool { return false })
+	c.Assert(e, ErrorMatches, "disk is full")
+}
+
+// incompleteBackend returns ensembles without prekey messages
+type incompleteBackend struct {
+	*serializingBackend
+}
+
+func (b *incompleteBackend) RetrieveFor(from string) []PrekeyEnsemble {
+	return []PrekeyEnsemble{&prekeyEnsemble{cp: sita.clientProfile}, nil}
+}
+
+func (s *GenericServerSuite) Test_StorageFromBackend_returnsAStorageErrorForIncompleteEnsembles(c *C) {
+	gs := testServerForInitiator()
+	gs.storageImpl, _ = StorageFromBackend(plainBackend{&incompleteBackend{newSerializingBackend()}}).createStorage()
+
+	q := CreateEnsembleRetrievalQuery(sita.instanceTag, "sita@example.org", []byte{'4'})
+	res, e := gs.Handle("someone@example.org", encodeMessage(q)+".")
+
+	c.Assert(res, IsNil)
+	c.Assert(e, ErrorMatches, "couldn't retrieve prekey ensembles: storage backend returned an incomplete prekey ensemble")
+	c.Assert(errors.Is(e, ErrStorage), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_realEnsemble_returnsNilForMissingParts(c *C) {
+	c.Assert(realEnsemble(nil), IsNil)
+	c.Assert(realEnsemble((*prekeyEnsemble)(nil)), IsNil)
+	c.Assert(realEnsemble(&prekeyEnsemble{cp: sita.clientProfile}), IsNil)
+}
+
+type contextKey string
+
+// contextRecordingBackend remembers the contexts it was used with
+type contextRecordingBackend struct {
+	*serializingBackend
+	ctxs []context.Context
+}
+
+func (b *contextRecordingBackend) WithContext(ctx context.Context) StorageBackend {
+	b.ctxs = append(b.ctxs, ctx)
+	return b
+}
+
+func (s *GenericServerSuite) Test_StorageFromBackend_givesTheContextToTheBackend(c *C) {
+	gs := testServerForInitiator()
+	b := &contextRecordingBackend{serializingBackend: newSerializingBackend()}
+	gs.storageImpl, _ = StorageFromBackend(b).createStorage()
+
+	ctx := context.WithValue(context.Background(), contextKey("request"), "one")
+	q := CreateEnsembleRetrievalQuery(sita.instanceTag, "sita@example.org", []byte{'4'})
+	_, e := gs.HandleContext(ctx, "someone@example.org", encodeMessage(q)+".")
+
+	c.Assert(e, IsNil)
+	c.Assert(b.ctxs, HasLen, 1)
+	c.Assert(b.ctxs[0].Value(contextKey("request")), Equals, "one")
+}
+
+func (s *GenericServerSuite) Test_StorageBackendFor_passesOnTheContextToTheEngine(c *C) {
+	sb, e := StorageBackendFor(&sqlStorageFactory{st: &sqlStorage{}})
+	c.Assert(e, IsNil)
+	b, ok := sb.(ContextStorageBackend)
+	c.Assert(ok, Equals, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inner := b.WithContext(ctx).(*storageBackendAdapter).s.(*sqlStorage)
+	c.Assert(inner.context(), Equals, ctx)
+}
+
+func (s *GenericServerSuite) Test_ParseClientProfile_failsOnInvalidData(c *C) {
+	_, e := ParseClientProfile([]byte{0x01, 0x02})
+	c.Assert(e, ErrorMatches, "invalid client profile")
+}
+
+func (s *GenericServerSuite) Test_ParsePrekeyProfile_failsOnInvalidData(c *C) {
+	_, e := ParsePrekeyProfile([]byte{0x01, 0x02})
+	c.Assert(e, ErrorMatches, "invalid prekey profile")
+}
+
+func (s *GenericServerSuite) Test_ParsePrekeyMessage_failsOnInvalidData(c *C) {
+	_, e := ParsePrekeyMessage([]byte{0x01, 0x02})
+	c.Assert(e, ErrorMatches, "invalid prekey message")
+}
@@ -0,0 +1,104 @@
+package prekeyserver
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StorageConstructor creates a storage from the parameters of a storage descriptor.
+// The parameters are everything after the first colon - for "bolt:/path?sync=true"
+// the constructor registered for "bolt" will be called with "/path?sync=true"
+type StorageConstructor func(params string) (Storage, error)
+
+var storageTypes = struct {
+	sync.RWMutex
+	constructors map[string]StorageConstructor
+}{
+	constructors: make(map[string]StorageConstructor),
+}
+
+// RegisterStorageType makes a storage engine available to LoadStorageType under
+// the given scheme. It is meant to be called from init functions, and will panic
+// if the scheme is already taken.
+func RegisterStorageType(scheme string, c StorageConstructor) {
+	storageTypes.Lock()
+	defer storageTypes.Unlock()
+
+	if c == nil {
+		panic("prekeyserver: RegisterStorageType constructor is nil")
+	}
+	if _, dup := storageTypes.constructors[scheme]; dup {
+		panic("prekeyserver: RegisterStorageType called twice for " + scheme)
+	}
+	storageTypes.constructors[scheme] = c
+}
+
+// StorageTypes returns the sorted schemes of all registered storage engines
+func StorageTypes() []string {
+	storageTypes.RLock()
+	defer storageTypes.RUnlock()
+
+	res := make([]string, 0, len(storageTypes.constructors))
+	for scheme := range storageTypes.constructors {
+		res = append(res, scheme)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func splitStorageDescriptor(desc string) (string, string) {
+	ix := strings.Index(desc, ":")
+	if ix == -1 {
+		return desc, ""
+	}
+	return desc[:ix], desc[ix+1:]
+}
+
+func loadStorageType(desc string) (Storage, error) {
+	scheme, params := splitStorageDescriptor(desc)
+
+	storageTypes.RLock()
+	c, ok := storageTypes.constructors[scheme]
+	storageTypes.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q - available types are: %s", scheme, strings.Join(StorageTypes(), ", "))
+	}
+	return c(params)
+}
+
+// ParseStorageParameters splits the parameters given to a StorageConstructor
+// into a location and options, so "/path?sync=true" gives "/path" and sync=true.
+// Options not in the list of known options are reported as an error.
+func ParseStorageParameters(params string, known ...string) (string, url.Values, error) {
+	location := params
+	query := ""
+	if ix := strings.Index(params, "?"); ix != -1 {
+		location, query = params[:ix], params[ix+1:]
+	}
+
+	opts, e := url.ParseQuery(query)
+	if e != nil {
+		return "", nil, fmt.Errorf("invalid storage options: %v", e)
+	}
+
+	for k := range opts {
+		if !containsString(known, k) {
+			return "", nil, fmt.Errorf("unknown storage option: %s", k)
+		}
+	}
+
+	return location, opts, nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
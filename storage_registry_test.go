@@ -0,0 +1,74 @@
+package prekeyserver
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+func unregisterStorageType(scheme string) {
+	storageTypes.Lock()
+	defer storageTypes.Unlock()
+	delete(storageTypes.constructors, scheme)
+}
+
+func (s *GenericServerSuite) Test_RegisterStorageType_makesTheStorageAvailableToLoadStorageType(c *C) {
+	defer unregisterStorageType("test-registered")
+	var given string
+	RegisterStorageType("test-registered", func(params string) (Storage, error) {
+		given = params
+		return &inMemoryStorageFactory{}, nil
+	})
+
+	res, e := (&realFactory{}).LoadStorageType("test-registered:/some/path?sync=true")
+	c.Assert(e, IsNil)
+	c.Assert(res, FitsTypeOf, &inMemoryStorageFactory{})
+	c.Assert(given, Equals, "/some/path?sync=true")
+	c.Assert(StorageTypes(), DeepEquals, []string{"dir", "in-memory", "kv", "sql", "test-registered"})
+}
+
+func (s *GenericServerSuite) Test_RegisterStorageType_panicsForTheSameSchemeTwice(c *C) {
+	c.Assert(func() {
+		RegisterStorageType("in-memory", func(string) (Storage, error) { return nil, nil })
+	}, PanicMatches, "prekeyserver: RegisterStorageType called twice for in-memory")
+}
+
+func (s *GenericServerSuite) Test_loadStorageType_returnsTheErrorFromTheConstructor(c *C) {
+	defer unregisterStorageType("test-failing")
+	RegisterStorageType("test-failing", func(string) (Storage, error) {
+		return nil, errors.New("bad parameters")
+	})
+
+	_, e := loadStorageType("test-failing:something")
+	c.Assert(e, ErrorMatches, "bad parameters")
+}
+
+func (s *GenericServerSuite) Test_loadStorageType_inMemoryDoesNotTakeParameters(c *C) {
+	_, e := loadStorageType("in-memory:foo")
+	c.Assert(e, ErrorMatches, "the in-memory storage type takes no parameters")
+}
+
+func (s *GenericServerSuite) Test_ParseStorageParameters_splitsLocationAndOptions(c *C) {
+	loc, opts, e := ParseStorageParameters("/var/data/prekeys.db?sync=true&timeout=5s", "sync", "timeout")
+	c.Assert(e, IsNil)
+	c.Assert(loc, Equals, "/var/data/prekeys.db")
+	c.Assert(opts.Get("sync"), Equals, "true")
+	c.Assert(opts.Get("timeout"), Equals, "5s")
+}
+
+func (s *GenericServerSuite) Test_ParseStorageParameters_worksWithoutOptions(c *C) {
+	loc, opts, e := ParseStorageParameters("/var/data/prekeys.db")
+	c.Assert(e, IsNil)
+	c.Assert(loc, Equals, "/var/data/prekeys.db")
+	c.Assert(opts, HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_ParseStorageParameters_failsOnUnknownOptions(c *C) {
+	_, _, e := ParseStorageParameters("/var/data/prekeys.db?snyc=true", "sync")
+	c.Assert(e, ErrorMatches, "unknown storage option: snyc")
+}
+
+func (s *GenericServerSuite) Test_ParseStorageParameters_failsOnInvalidOptions(c *C) {
+	_, _, e := ParseStorageParameters("/var/data/prekeys.db?sync=%zz", "sync")
+	c.Assert(e, ErrorMatches, "invalid storage options: .*")
+}
@@ -0,0 +1,16 @@
+package storagetest
+
+import (
+	"path"
+	"testing"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+func TestSQLStorage(t *testing.T) {
+	Run(t, func(t *testing.T) pks.StorageBackend {
+		return loadBackend(t, "sql:sqlite3:file:"+path.Join(t.TempDir(), "prekeys.db")+"?_pragma=busy_timeout(5000)&_txlock=immediate")
+	})
+}
@@ -0,0 +1,424 @@
+// Package storagetest contains a conformance suite for prekey server storage
+// engines. Any StorageBackend should pass it, so the server behaves the same
+// no matter where the prekey material is kept.
+package storagetest
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// Run checks the given storage engine against the expected semantics. The
+// constructor is called once for every check, and should return an empty backend.
+// The checks for FilteringStorageBackend and ClosingStorageBackend are skipped
+// for backends that don't implement them.
+func Run(t *testing.T, newBackend func(t *testing.T) pks.StorageBackend) {
+	checks := []struct {
+		name  string
+		check func(*testing.T, pks.StorageBackend)
+	}{
+		{"NumberStoredForUnknownIdentity", testNumberStoredForUnknownIdentity},
+		{"StoreAndCount", testStoreAndCount},
+		{"RetrieveNeedsAllParts", testRetrieveNeedsAllParts},
+		{"RetrieveConsumesOnce", testRetrieveConsumesOnce},
+		{"RetrieveOnlyConsumesAccepted", testRetrieveOnlyConsumesAccepted},
+		{"StoringProfilesReplacesThem", testStoringProfilesReplacesThem},
+		{"InstanceTagIsolation", testInstanceTagIsolation},
+		{"IdentityIsolation", testIdentityIsolation},
+		{"LongIdentities", testLongIdentities},
+		{"CleanupRemovesExpiredProfiles", testCleanupRemovesExpiredProfiles},
+		{"RetrieveSkipsExpiredProfiles", testRetrieveSkipsExpiredProfiles},
+		{"RetrieveOnlyAsksAboutValidProfiles", testRetrieveOnlyAsksAboutValidProfiles},
+		{"ConcurrentPublishAndRetrieve", testConcurrentPublishAndRetrieve},
+		{"Close", testClose},
+	}
+
+	for _, c := range checks {
+		check := c.check
+		t.Run(c.name, func(t *testing.T) {
+			check(t, newBackend(t))
+		})
+	}
+}
+
+var f = pks.CreateFactory(nil)
+
+const (
+	alice = "alice@example.org"
+	bob   = "bob@example.org"
+)
+
+type client struct {
+	keys pks.Keypair
+	tag  uint32
+}
+
+func newClient(tag uint32) *client {
+	return &client{keys: f.CreateKeypair(), tag: tag}
+}
+
+func (cl *client) clientProfile(expiration time.Time) pks.ClientProfile {
+	return f.CreateClientProfile(cl.keys, cl.tag, expiration)
+}
+
+func (cl *client) prekeyProfile(expiration time.Time) pks.PrekeyProfile {
+	pp, _ := f.CreatePrekeyProfile(cl.keys, cl.tag, expiration)
+	return pp
+}
+
+func (cl *client) prekeyMessages(n int) []pks.PrekeyMessage {
+	res := make([]pks.PrekeyMessage, n)
+	for i := range res {
+		res[i], _ = f.CreatePrekeyMessage(cl.tag)
+	}
+	return res
+}
+
+func inAWeek() time.Time {
+	return time.Now().Add(7 * 24 * time.Hour)
+}
+
+func aWeekAgo() time.Time {
+	return time.Now().Add(-7 * 24 * time.Hour)
+}
+
+// publish stores a complete set of prekey material for the client, and returns the prekey messages stored
+func publish(t *testing.T, b pks.StorageBackend, from string, cl *client, n int) []pks.PrekeyMessage {
+	pms := cl.prekeyMessages(n)
+	if e := b.StoreClientProfile(from, cl.clientProfile(inAWeek())); e != nil {
+		t.Fatalf("storing client profile: %v", e)
+	}
+	if e := b.StorePrekeyProfile(from, cl.prekeyProfile(inAWeek())); e != nil {
+		t.Fatalf("storing prekey profile: %v", e)
+	}
+	if e := b.StorePrekeyMessages(from, pms); e != nil {
+		t.Fatalf("storing prekey messages: %v", e)
+	}
+	return pms
+}
+
+func assertNumberStored(t *testing.T, b pks.StorageBackend, from string, tag uint32, expected uint32) {
+	t.Helper()
+	if n := b.NumberStored(from, tag); n != expected {
+		t.Fatalf("expected %d prekey messages stored for %s/%08X, got %d", expected, from, tag, n)
+	}
+}
+
+func assertRetrieved(t *testing.T, pes []pks.PrekeyEnsemble, expected int) {
+	t.Helper()
+	if len(pes) != expected {
+		t.Fatalf("expected %d prekey ensembles, got %d", expected, len(pes))
+	}
+}
+
+// filtering returns the backend as a FilteringStorageBackend, and skips the
+// check if it isn't one
+func filtering(t *testing.T, b pks.StorageBackend) pks.FilteringStorageBackend {
+	t.Helper()
+	fb, ok := b.(pks.FilteringStorageBackend)
+	if !ok {
+		t.Skip("backend doesn't implement FilteringStorageBackend")
+	}
+	return fb
+}
+
+func containsPrekeyMessage(pms []pks.PrekeyMessage, pm pks.PrekeyMessage) bool {
+	for _, p := range pms {
+		if bytes.Equal(p.Serialize(), pm.Serialize()) {
+			return true
+		}
+	}
+	return false
+}
+
+func testNumberStoredForUnknownIdentity(t *testing.T, b pks.StorageBackend) {
+	assertNumberStored(t, b, alice, 0x11223344, 0)
+	assertRetrieved(t, b.RetrieveFor(alice), 0)
+}
+
+func testStoreAndCount(t *testing.T, b pks.StorageBackend) {
+	cl := newClient(0x11223344)
+	publish(t, b, alice, cl, 3)
+	assertNumberStored(t, b, alice, cl.tag, 3)
+
+	if e := b.StorePrekeyMessages(alice, cl.prekeyMessages(2)); e != nil {
+		t.Fatalf("storing prekey messages: %v", e)
+	}
+	assertNumberStored(t, b, alice, cl.tag, 5)
+}
+
+func testRetrieveNeedsAllParts(t *testing.T, b pks.StorageBackend) {
+	cl := newClient(0x11223344)
+
+	b.StorePrekeyMessages(alice, cl.prekeyMessages(1))
+	assertRetrieved(t, b.RetrieveFor(alice), 0)
+
+	b.StoreClientProfile(alice, cl.clientProfile(inAWeek()))
+	assertRetrieved(t, b.RetrieveFor(alice), 0)
+
+	b.StorePrekeyProfile(alice, cl.prekeyProfile(inAWeek()))
+	assertRetrieved(t, b.RetrieveFor(alice), 1)
+}
+
+func testRetrieveConsumesOnce(t *testing.T, b pks.StorageBackend) {
+	cl := newClient(0x11223344)
+	pms := publish(t, b, alice, cl, 2)
+
+	first := b.RetrieveFor(alice)
+	assertRetrieved(t, first, 1)
+	assertNumberStored(t, b, alice, cl.tag, 1)
+
+	second := b.RetrieveFor(alice)
+	assertRetrieved(t, second, 1)
+	assertNumberStored(t, b, alice, cl.tag, 0)
+
+	if !containsPrekeyMessage(pms, first[0].PrekeyMessage()) || !containsPrekeyMessage(pms, second[0].PrekeyMessage()) {
+		t.Fatalf("retrieved a prekey message that was never stored")
+	}
+	if bytes.Equal(first[0].PrekeyMessage().Serialize(), second[0].PrekeyMessage().Serialize()) {
+		t.Fatalf("the same prekey message was handed out twice")
+	}
+
+	assertRetrieved(t, b.RetrieveFor(alice), 0)
+}
+
+func testRetrieveOnlyConsumesAccepted(t *testing.T, b pks.StorageBackend) {
+	cl1 := newClient(0x11223344)
+	cl2 := newClient(0x55667788)
+	publish(t, b, alice, cl1, 1)
+	publish(t, b, alice, cl2, 1)
+
+	asked := 0
+	pes := filtering(t, b).RetrieveMatching(alice, func(cp pks.ClientProfile, pp pks.PrekeyProfile) bool {
+		asked++
+		return cp.InstanceTag() == cl2.tag
+	})
+
+	assertRetrieved(t, pes, 1)
+	if pes[0].ClientProfile().InstanceTag() != cl2.tag {
+		t.Fatalf("expected only the accepted ensemble to be returned")
+	}
+	if asked != 2 {
+		t.Fatalf("expected to be asked about 2 ensembles, was asked about %d", asked)
+	}
+	assertNumberStored(t, b, alice, cl1.tag, 1)
+	assertNumberStored(t, b, alice, cl2.tag, 0)
+}
+
+func testStoringProfilesReplacesThem(t *testing.T, b pks.StorageBackend) {
+	cl := newClient(0x11223344)
+	publish(t, b, alice, cl, 1)
+
+	cp := cl.clientProfile(inAWeek().Add(time.Hour))
+	pp := cl.prekeyProfile(inAWeek().Add(time.Hour))
+	b.StoreClientProfile(alice, cp)
+	b.StorePrekeyProfile(alice, pp)
+
+	pes := b.RetrieveFor(alice)
+	assertRetrieved(t, pes, 1)
+	if !bytes.Equal(pes[0].ClientProfile().Serialize(), cp.Serialize()) {
+		t.Fatalf("expected the latest client profile to be returned")
+	}
+	if !bytes.Equal(pes[0].PrekeyProfile().Serialize(), pp.Serialize()) {
+		t.Fatalf("expected the latest prekey profile to be returned")
+	}
+}
+
+func testInstanceTagIsolation(t *testing.T, b pks.StorageBackend) {
+	cl1 := newClient(0x11223344)
+	cl2 := newClient(0x55667788)
+	publish(t, b, alice, cl1, 1)
+	publish(t, b, alice, cl2, 2)
+
+	assertNumberStored(t, b, alice, cl1.tag, 1)
+	assertNumberStored(t, b, alice, cl2.tag, 2)
+
+	pes := b.RetrieveFor(alice)
+	assertRetrieved(t, pes, 2)
+	for _, pe := range pes {
+		tag := pe.ClientProfile().InstanceTag()
+		if pe.PrekeyProfile().InstanceTag() != tag || pe.PrekeyMessage().InstanceTag() != tag {
+			t.Fatalf("ensemble mixes parts from different instance tags")
+		}
+	}
+
+	assertRetrieved(t, b.RetrieveFor(alice), 1)
+	assertNumberStored(t, b, alice, cl1.tag, 0)
+	assertNumberStored(t, b, alice, cl2.tag, 0)
+}
+
+func testIdentityIsolation(t *testing.T, b pks.StorageBackend) {
+	cl := newClient(0x11223344)
+	publish(t, b, alice, cl, 1)
+
+	assertNumberStored(t, b, bob, cl.tag, 0)
+	assertRetrieved(t, b.RetrieveFor(bob), 0)
+	assertNumberStored(t, b, alice, cl.tag, 1)
+}
+
+// testLongIdentities makes sure identities aren't cut short, by storing prekeys
+// for two long identities that only differ at the end
+func testLongIdentities(t *testing.T, b pks.StorageBackend) {
+	long := strings.Repeat("a", 1000) + "@example.org"
+	longer := strings.Repeat("a", 1000) + "b@example.org"
+	cl := newClient(0x11223344)
+	publish(t, b, long, cl, 2)
+
+	assertNumberStored(t, b, long, cl.tag, 2)
+	assertNumberStored(t, b, longer, cl.tag, 0)
+	assertRetrieved(t, b.RetrieveFor(longer), 0)
+	assertRetrieved(t, b.RetrieveFor(long), 1)
+	assertNumberStored(t, b, long, cl.tag, 1)
+}
+
+func testCleanupRemovesExpiredProfiles(t *testing.T, b pks.StorageBackend) {
+	expiredClient := newClient(0x11223344)
+	b.StoreClientProfile(alice, expiredClient.clientProfile(aWeekAgo()))
+	b.StorePrekeyProfile(alice, expiredClient.prekeyProfile(inAWeek()))
+	b.StorePrekeyMessages(alice, expiredClient.prekeyMessages(1))
+
+	expiredPrekeys := newClient(0x55667788)
+	b.StoreClientProfile(alice, expiredPrekeys.clientProfile(inAWeek()))
+	b.StorePrekeyProfile(alice, expiredPrekeys.prekeyProfile(aWeekAgo()))
+	b.StorePrekeyMessages(alice, expiredPrekeys.prekeyMessages(1))
+
+	valid := newClient(0x99AABBCC)
+	publish(t, b, alice, valid, 1)
+
+	b.Cleanup()
+
+	pes := b.RetrieveFor(alice)
+	assertRetrieved(t, pes, 1)
+	if pes[0].ClientProfile().InstanceTag() != valid.tag {
+		t.Fatalf("expected only the ensemble with valid profiles to be left")
+	}
+}
+
+func testClose(t *testing.T, b pks.StorageBackend) {
+	cb, ok := b.(pks.ClosingStorageBackend)
+	if !ok {
+		t.Skip("backend doesn't implement ClosingStorageBackend")
+	}
+	publish(t, b, alice, newClient(0x11223344), 2)
+	b.RetrieveFor(alice)
+
+	if e := cb.Close(); e != nil {
+		t.Fatalf("closing the backend: %v", e)
+	}
+}
+
+func testRetrieveSkipsExpiredProfiles(t *testing.T, b pks.StorageBackend) {
+	expiredClient := newClient(0x11223344)
+	b.StoreClientProfile(alice, expiredClient.clientProfile(aWeekAgo()))
+	b.StorePrekeyProfile(alice, expiredClient.prekeyProfile(inAWeek()))
+	b.StorePrekeyMessages(alice, expiredClient.prekeyMessages(1))
+
+	expiredPrekeys := newClient(0x55667788)
+	b.StoreClientProfile(alice, expiredPrekeys.clientProfile(inAWeek()))
+	b.StorePrekeyProfile(alice, expiredPrekeys.prekeyProfile(aWeekAgo()))
+	b.StorePrekeyMessages(alice, expiredPrekeys.prekeyMessages(1))
+
+	valid := newClient(0x99AABBCC)
+	publish(t, b, alice, valid, 1)
+
+	pes := b.RetrieveFor(alice)
+	assertRetrieved(t, pes, 1)
+	if pes[0].ClientProfile().InstanceTag() != valid.tag {
+		t.Fatalf("expected only the ensemble with valid profiles to be returned")
+	}
+
+	assertNumberStored(t, b, alice, expiredClient.tag, 1)
+	assertNumberStored(t, b, alice, expiredPrekeys.tag, 1)
+	assertRetrieved(t, b.RetrieveFor(alice), 0)
+}
+
+func testRetrieveOnlyAsksAboutValidProfiles(t *testing.T, b pks.StorageBackend) {
+	fb := filtering(t, b)
+	expiredClient := newClient(0x11223344)
+	b.StoreClientProfile(alice, expiredClient.clientProfile(aWeekAgo()))
+	b.StorePrekeyProfile(alice, expiredClient.prekeyProfile(inAWeek()))
+	b.StorePrekeyMessages(alice, expiredClient.prekeyMessages(1))
+
+	valid := newClient(0x99AABBCC)
+	publish(t, b, alice, valid, 1)
+
+	asked := 0
+	pes := fb.RetrieveMatching(alice, func(cp pks.ClientProfile, pp pks.PrekeyProfile) bool {
+		asked++
+		return true
+	})
+	assertRetrieved(t, pes, 1)
+	if asked != 1 {
+		t.Fatalf("expected to only be asked about the valid ensemble, was asked about %d", asked)
+	}
+}
+
+func testConcurrentPublishAndRetrieve(t *testing.T, b pks.StorageBackend) {
+	const publishers = 4
+	const perPublisher = 5
+	const retrievers = 8
+
+	clients := make([]*client, publishers)
+	for i := range clients {
+		clients[i] = newClient(0x10000000 + uint32(i))
+		publish(t, b, alice, clients[i], 0)
+	}
+
+	var lock sync.Mutex
+	stored := []pks.PrekeyMessage{}
+	retrieved := []pks.PrekeyMessage{}
+
+	var wg sync.WaitGroup
+	for _, cl := range clients {
+		wg.Add(1)
+		go func(cl *client) {
+			defer wg.Done()
+			for i := 0; i < perPublisher; i++ {
+				pms := cl.prekeyMessages(1)
+				if e := b.StorePrekeyMessages(alice, pms); e != nil {
+					t.Errorf("storing prekey messages: %v", e)
+					return
+				}
+				lock.Lock()
+				stored = append(stored, pms...)
+				lock.Unlock()
+			}
+		}(cl)
+	}
+	for i := 0; i < retrievers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perPublisher; j++ {
+				for _, pe := range b.RetrieveFor(alice) {
+					lock.Lock()
+					retrieved = append(retrieved, pe.PrekeyMessage())
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for ix, pm := range retrieved {
+		if !containsPrekeyMessage(stored, pm) {
+			t.Fatalf("retrieved a prekey message that was never stored")
+		}
+		if containsPrekeyMessage(retrieved[ix+1:], pm) {
+			t.Fatalf("the same prekey message was handed out twice")
+		}
+	}
+
+	left := uint32(0)
+	for _, cl := range clients {
+		left += b.NumberStored(alice, cl.tag)
+	}
+	if int(left)+len(retrieved) != publishers*perPublisher {
+		t.Fatalf("expected %d prekey messages to be retrieved or left, got %d", publishers*perPublisher, int(left)+len(retrieved))
+	}
+}
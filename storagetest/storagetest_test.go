@@ -0,0 +1,38 @@
+package storagetest
+
+import (
+	"path"
+	"testing"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+func loadBackend(t *testing.T, desc string) pks.StorageBackend {
+	st, e := f.LoadStorageType(desc)
+	if e != nil {
+		t.Fatalf("loading storage %s: %v", desc, e)
+	}
+	b, e := pks.StorageBackendFor(st)
+	if e != nil {
+		t.Fatalf("opening storage %s: %v", desc, e)
+	}
+	return b
+}
+
+func TestInMemoryStorage(t *testing.T) {
+	Run(t, func(t *testing.T) pks.StorageBackend {
+		return loadBackend(t, "in-memory")
+	})
+}
+
+func TestFileStorage(t *testing.T) {
+	Run(t, func(t *testing.T) pks.StorageBackend {
+		return loadBackend(t, "dir:"+t.TempDir())
+	})
+}
+
+func TestKVStorage(t *testing.T) {
+	Run(t, func(t *testing.T) pks.StorageBackend {
+		return loadBackend(t, "kv:"+path.Join(t.TempDir(), "prekeys.kv")+"?sync=false")
+	})
+}